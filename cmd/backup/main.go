@@ -0,0 +1,109 @@
+// backup exports, restores and verifies backup archives of pebble databases.
+//
+// Usage:
+//
+//	backup export [--plaintext] <db path> <archive>
+//	backup restore <archive> <db path>
+//	backup verify <archive>
+//
+// export opens the database directly, so the server must not be running. Use
+// PebbleDbConn.Backup or PebbleDbConn.Checkpoint to back up a running database.
+// An encrypted database is decrypted with the keyring in the environment
+// variable RAPIERDB_ENCRYPTION_KEYS. Archives are not encrypted, so exporting
+// an encrypted database requires --plaintext.
+// An archive of "-" means stdout or stdin.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "  %s export [--plaintext] <db path> <archive>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s restore <archive> <db path>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s verify <archive>\n", os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	args := os.Args[2:]
+
+	var docs int
+	var err error
+	switch os.Args[1] {
+	case "export":
+		plaintext := len(args) > 0 && args[0] == "--plaintext"
+		if plaintext {
+			args = args[1:]
+		}
+		if len(args) != 2 {
+			usage()
+		}
+		docs, err = export(args[0], args[1], plaintext)
+	case "restore":
+		if len(args) != 2 {
+			usage()
+		}
+		docs, err = withArchive(args[0], func(r io.Reader) (int, error) {
+			return db_conn.RestoreBackup(r, args[1])
+		})
+	case "verify":
+		if len(args) != 1 {
+			usage()
+		}
+		docs, err = withArchive(args[0], db_conn.VerifyBackup)
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d docs\n", os.Args[1], docs)
+}
+
+func export(dbPath, archive string, plaintext bool) (int, error) {
+	var keyring *db_conn.Keyring
+	if _, ok := os.LookupEnv(db_conn.DefaultEncryptionKeyEnv); ok {
+		var err error
+		if keyring, err = db_conn.LoadKeyringEnv(db_conn.DefaultEncryptionKeyEnv); err != nil {
+			return 0, err
+		}
+	}
+	if archive == "-" {
+		return db_conn.ExportPebbleDb(dbPath, os.Stdout, keyring, plaintext)
+	}
+	f, err := os.OpenFile(archive, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	docs, err := db_conn.ExportPebbleDb(dbPath, f, keyring, plaintext)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(archive)
+		return 0, err
+	}
+	return docs, nil
+}
+
+func withArchive(archive string, fn func(r io.Reader) (int, error)) (int, error) {
+	if archive == "-" {
+		return fn(os.Stdin)
+	}
+	f, err := os.Open(archive)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return fn(f)
+}
@@ -0,0 +1,42 @@
+// migratekeys rewrites the document keys of pebble databases created with an
+// older key layout to the current one. Databases are migrated offline, the
+// server must not be running.
+//
+// Usage:
+//
+//	migratekeys <db path>...
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s <db path>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, path := range flag.Args() {
+		migrated, err := db_conn.MigratePebbleDbKeyLayout(path)
+		if err != nil {
+			fmt.Printf("ERROR %s: %v\n", path, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: migrated %d docs\n", path, migrated)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,65 @@
+// permtest runs permission rule fixtures and reports which cases pass.
+//
+// Usage:
+//
+//	permtest [-v] <fixture.json>...
+//
+// See permission_harness.Fixture for the fixture format. Problems found by
+// statically analyzing the permission definition are printed before the
+// cases. The exit code is 1 if any case fails.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_harness"
+)
+
+func main() {
+	verbose := flag.Bool("v", false, "print passed cases as well")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-v] <fixture.json>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	passed, failed := 0, 0
+	for _, path := range flag.Args() {
+		fixture, err := permission_harness.LoadFixture(path)
+		if err != nil {
+			fmt.Printf("ERROR %s: %v\n", path, err)
+			failed++
+			continue
+		}
+		harness, err := permission_harness.New(fixture)
+		if err != nil {
+			fmt.Printf("ERROR %s: %v\n", path, err)
+			failed++
+			continue
+		}
+		for _, d := range harness.Diagnostics() {
+			fmt.Printf("%s: %s\n", path, d)
+		}
+		for _, result := range harness.RunAll(fixture) {
+			if result.Passed {
+				passed++
+			} else {
+				failed++
+			}
+			if !result.Passed || *verbose {
+				fmt.Printf("%s: %s\n", path, result)
+			}
+		}
+	}
+
+	fmt.Printf("%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,560 @@
+package db_conn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/log"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	pe "github.com/pkg/errors"
+)
+
+// Backup archives
+//
+// A backup archive is a portable stream that does not depend on the key layout
+// or the pebble version. It starts with BACKUP_MAGIC and BACKUP_VERSION followed
+// by records, each framed as
+//
+//	<uvarint length><record><uint32 crc32c of record>
+//
+// The first record is the database meta, then one record per doc, one per
+// version in the doc histories and one per tombstone and purged doc, the last
+// record holds the number of docs so a truncated archive is detected.
+
+const (
+	BACKUP_MAGIC   = "RAPIERDB-BACKUP\n"
+	BACKUP_VERSION = 1
+)
+
+const (
+	backupRecordMeta      uint8 = 'm'
+	backupRecordDoc       uint8 = 'd'
+	backupRecordHistory   uint8 = 'h'
+	backupRecordTombstone uint8 = 't'
+	backupRecordPurged    uint8 = 'p'
+	backupRecordEnd       uint8 = 'e'
+)
+
+var (
+	// ErrBackupCorrupted is returned when a backup archive fails to verify
+	ErrBackupCorrupted = errors.New("backup archive corrupted")
+	// ErrPlaintextBackup is returned when an encrypted database is exported
+	// without allowing a plaintext archive
+	ErrPlaintextBackup = errors.New("backup archive of an encrypted database is not encrypted")
+)
+
+var backupCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checkpoint writes a consistent point-in-time copy of the database to dir
+// while the connection is running. dir must not exist, the copy is a pebble
+// database that can be opened with PebbleDbConn.
+func (conn *PebbleDbConn) Checkpoint(dir string) error {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return pe.Errorf("cannot checkpoint: current status = %d", status)
+	}
+	if err := conn.pebbleDb.Checkpoint(dir, pebble.WithFlushedWAL()); err != nil {
+		return pe.Wrap(err, "failed to checkpoint pebble db")
+	}
+	return nil
+}
+
+// Backup writes a backup archive of the running database to w. The archive is
+// exported from a checkpoint, so commits during the backup are not included.
+// plaintext must be true to back up an encrypted database, see ExportPebbleDb.
+// Returns the number of backed up docs.
+func (conn *PebbleDbConn) Backup(w io.Writer, plaintext bool) (int, error) {
+	tmpDir, err := os.MkdirTemp("", "rapierdb-checkpoint-")
+	if err != nil {
+		return 0, pe.WithStack(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	checkpointDir := filepath.Join(tmpDir, "db")
+	if err := conn.Checkpoint(checkpointDir); err != nil {
+		return 0, err
+	}
+	return ExportPebbleDb(checkpointDir, w, conn.keyring, plaintext)
+}
+
+// ExportPebbleDb writes a backup archive of the pebble database at path to w.
+// The database must not be opened by anyone else, use PebbleDbConn.Backup to
+// back up a running database. Returns the number of exported docs.
+//
+// keyring decrypts an encrypted database, nil if it is not encrypted. The
+// archive is not encrypted, so exporting an encrypted database fails with
+// ErrPlaintextBackup unless plaintext is true. A database restored from the
+// archive is encrypted again once it is opened with a keyring.
+func ExportPebbleDb(path string, w io.Writer, keyring *Keyring, plaintext bool) (int, error) {
+	if keyring != nil && !plaintext {
+		return 0, ErrPlaintextBackup
+	}
+	pebbleOpts := pebble.Options{}
+	pebbleOpts.EnsureDefaults()
+	pebbleOpts.ErrorIfNotExists = true
+	pebbleOpts.ReadOnly = true
+	pebbleDb, err := pebble.Open(path, &pebbleOpts)
+	if err != nil {
+		return 0, pe.Wrap(err, "failed to open pebble db")
+	}
+	defer pebbleDb.Close()
+
+	meta, err := loadDatabaseMeta(pebbleDb, keyring)
+	if err != nil {
+		return 0, pe.Wrap(err, "failed to load database meta")
+	}
+	if meta.keyLayout != key_utils.CURRENT_KEY_LAYOUT {
+		return 0, pe.Wrapf(ErrKeyLayoutOutdated, "database uses key layout %d", meta.keyLayout)
+	}
+	metaBytes, err := meta.ToBytes()
+	if err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := writeBackupHeader(bw); err != nil {
+		return 0, err
+	}
+	var record bytes.Buffer
+	util.WriteUint8(&record, backupRecordMeta)
+	util.WriteVarByteArray(&record, metaBytes)
+	if err := writeBackupRecord(bw, record.Bytes()); err != nil {
+		return 0, err
+	}
+
+	iter, err := pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(key_utils.DOC_KEY_PREFIX),
+		UpperBound: []byte{key_utils.DOC_KEY_PREFIX[0] + 1},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	exported := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		collection, docId, err := key_utils.ParseDocKey(iter.Key())
+		if err != nil {
+			return 0, err
+		}
+		stored, err := iter.ValueAndErr()
+		if err != nil {
+			return 0, err
+		}
+		snapshot, err := keyring.openValue(iter.Key(), stored)
+		if err != nil {
+			return 0, pe.Wrapf(err, "failed to decrypt doc %s/%s", collection, docId)
+		}
+		record.Reset()
+		util.WriteUint8(&record, backupRecordDoc)
+		util.WriteVarString(&record, collection)
+		util.WriteVarString(&record, docId)
+		util.WriteVarByteArray(&record, snapshot)
+		if err := writeBackupRecord(bw, record.Bytes()); err != nil {
+			return 0, err
+		}
+		exported++
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	historyIter, err := pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(key_utils.HISTORY_KEY_PREFIX),
+		UpperBound: []byte{key_utils.HISTORY_KEY_PREFIX[0] + 1},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer historyIter.Close()
+	for historyIter.First(); historyIter.Valid(); historyIter.Next() {
+		collection, docId, seq, err := key_utils.ParseDocHistoryKey(historyIter.Key())
+		if err != nil {
+			return 0, err
+		}
+		stored, err := historyIter.ValueAndErr()
+		if err != nil {
+			return 0, err
+		}
+		version, err := keyring.openValue(historyIter.Key(), stored)
+		if err != nil {
+			return 0, pe.Wrapf(err, "failed to decrypt version %d of doc %s/%s", seq, collection, docId)
+		}
+		record.Reset()
+		util.WriteUint8(&record, backupRecordHistory)
+		util.WriteVarString(&record, collection)
+		util.WriteVarString(&record, docId)
+		util.WriteUint64(&record, seq)
+		util.WriteVarByteArray(&record, version)
+		if err := writeBackupRecord(bw, record.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+	if err := historyIter.Error(); err != nil {
+		return 0, err
+	}
+
+	if err := exportDocTimes(pebbleDb, bw, key_utils.TOMBSTONE_KEY_PREFIX, backupRecordTombstone, key_utils.ParseTombstoneKey); err != nil {
+		return 0, err
+	}
+	if err := exportDocTimes(pebbleDb, bw, key_utils.PURGED_KEY_PREFIX, backupRecordPurged, key_utils.ParsePurgedKey); err != nil {
+		return 0, err
+	}
+
+	record.Reset()
+	util.WriteUint8(&record, backupRecordEnd)
+	util.WriteVarUint(&record, uint64(exported))
+	if err := writeBackupRecord(bw, record.Bytes()); err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, pe.WithStack(err)
+	}
+	return exported, nil
+}
+
+// exportDocTimes writes a record of type recordType for every key under prefix,
+// the keys are parsed by parse and hold a time in unix milliseconds
+func exportDocTimes(pebbleDb *pebble.DB, w io.Writer, prefix string, recordType uint8, parse func(key []byte) (string, string, error)) error {
+	iter, err := pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(prefix),
+		UpperBound: []byte{prefix[0] + 1},
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	var record bytes.Buffer
+	for iter.First(); iter.Valid(); iter.Next() {
+		collection, docId, err := parse(iter.Key())
+		if err != nil {
+			return err
+		}
+		millis, err := decodeMillis(iter.Value())
+		if err != nil {
+			return pe.Wrapf(err, "invalid value of key %q", iter.Key())
+		}
+		record.Reset()
+		util.WriteUint8(&record, recordType)
+		util.WriteVarString(&record, collection)
+		util.WriteVarString(&record, docId)
+		util.WriteVarInt(&record, millis)
+		if err := writeBackupRecord(w, record.Bytes()); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// VerifyBackup reads the backup archive from r and checks its integrity: the
+// checksum of every record, and that every doc snapshot has a valid checksum and
+// can be imported by loro. Returns the number of docs in the archive.
+func VerifyBackup(r io.Reader) (int, error) {
+	return readBackup(r, backupHandlers{})
+}
+
+// RestoreBackup creates a new pebble database at path from the backup archive
+// read from r, path must not exist. The archive is verified like
+// VerifyBackup while restoring, the partially restored database is removed if
+// verification fails. Returns the number of restored docs.
+func RestoreBackup(r io.Reader, path string) (restored int, err error) {
+	if _, err := os.Stat(path); err == nil {
+		return 0, pe.Errorf("cannot restore to %s: path exists", path)
+	} else if !os.IsNotExist(err) {
+		return 0, pe.WithStack(err)
+	}
+	pebbleOpts := pebble.Options{}
+	pebbleOpts.EnsureDefaults()
+	pebbleOpts.ErrorIfExists = true
+	pebbleDb, err := pebble.Open(path, &pebbleOpts)
+	if err != nil {
+		return 0, pe.Wrap(err, "failed to create pebble db")
+	}
+	defer func() {
+		closeErr := pebbleDb.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.RemoveAll(path)
+		}
+	}()
+
+	const batchSize = 1000
+	batch := pebbleDb.NewBatch()
+	defer func() { batch.Close() }()
+	flush := func() error {
+		if err := batch.Commit(pebble.Sync); err != nil {
+			return err
+		}
+		batch.Close()
+		batch = pebbleDb.NewBatch()
+		return nil
+	}
+
+	set := func(key, value []byte) error {
+		if err := batch.Set(key, value, nil); err != nil {
+			return err
+		}
+		if batch.Count() >= batchSize {
+			return flush()
+		}
+		return nil
+	}
+	// the TTL index is not archived, it is rebuilt from the docs
+	var ttlIndex *ttlIndexUpdate
+	restored, err = readBackup(r, backupHandlers{
+		onMeta: func(meta *DatabaseMeta) error {
+			ttlIndex = newTtlIndexUpdate(meta.databaseSchema)
+			// keys are recalculated, so the restored database always uses the current layout
+			meta.keyLayout = key_utils.CURRENT_KEY_LAYOUT
+			metaBytes, err := meta.ToBytes()
+			if err != nil {
+				return err
+			}
+			return set([]byte(key_utils.STORAGE_META_KEY), metaBytes)
+		},
+		onDoc: func(collection, docId string, snapshot []byte, doc *loro.LoroDoc) error {
+			key, err := key_utils.CalcDocKey(collection, docId)
+			if err != nil {
+				return err
+			}
+			// doc records only come after the meta
+			ttlIndex.changes = ttlIndex.changes[:0]
+			if err := ttlIndex.change(collection, docId, nil, doc); err != nil {
+				return err
+			}
+			for _, c := range ttlIndex.changes {
+				if err := set(c.key, nil); err != nil {
+					return err
+				}
+			}
+			return set(key, snapshot)
+		},
+		onHistory: func(collection, docId string, version *DocVersion) error {
+			key, err := key_utils.CalcDocHistoryKey(collection, docId, version.Seq)
+			if err != nil {
+				return err
+			}
+			return set(key, version.ToBytes())
+		},
+		onDocTime: func(recordType uint8, collection, docId string, at time.Time) error {
+			calcKey := key_utils.CalcTombstoneKey
+			if recordType == backupRecordPurged {
+				calcKey = key_utils.CalcPurgedKey
+			}
+			key, err := calcKey(collection, docId)
+			if err != nil {
+				return err
+			}
+			return set(key, encodeMillis(at))
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	log.Infof("RestoreBackup: restored %d docs to %s", restored, path)
+	return restored, nil
+}
+
+// backupHandlers are called by readBackup for the records of an archive, nil
+// handlers are skipped
+type backupHandlers struct {
+	onMeta func(meta *DatabaseMeta) error
+	// onDoc is called with the snapshot and the doc imported from it
+	onDoc     func(collection, docId string, snapshot []byte, doc *loro.LoroDoc) error
+	onHistory func(collection, docId string, version *DocVersion) error
+	// onDocTime is called for tombstone and purged records
+	onDocTime func(recordType uint8, collection, docId string, at time.Time) error
+}
+
+// readBackup reads and verifies the archive from r, calling the handlers for
+// every record
+func readBackup(r io.Reader, handlers backupHandlers) (int, error) {
+	br := bufio.NewReader(r)
+	if err := readBackupHeader(br); err != nil {
+		return 0, err
+	}
+
+	docs := 0
+	gotMeta := false
+	for {
+		record, err := readBackupRecord(br)
+		if err != nil {
+			return 0, err
+		}
+		buf := bytes.NewBuffer(record)
+		recordType, err := util.ReadUint8(buf)
+		if err != nil {
+			return 0, pe.Wrap(ErrBackupCorrupted, err.Error())
+		}
+
+		switch {
+		case recordType == backupRecordMeta && !gotMeta:
+			metaBytes, err := util.ReadVarByteArray(buf)
+			if err != nil {
+				return 0, pe.Wrap(ErrBackupCorrupted, err.Error())
+			}
+			meta, err := NewDatabaseMetaFromBytes(metaBytes)
+			if err != nil {
+				return 0, pe.Wrapf(ErrBackupCorrupted, "invalid meta: %v", err)
+			}
+			if handlers.onMeta != nil {
+				if err := handlers.onMeta(meta); err != nil {
+					return 0, err
+				}
+			}
+			gotMeta = true
+		case recordType == backupRecordDoc && gotMeta:
+			collection, err := util.ReadVarString(buf)
+			if err != nil {
+				return 0, pe.Wrap(ErrBackupCorrupted, err.Error())
+			}
+			docId, err := util.ReadVarString(buf)
+			if err != nil {
+				return 0, pe.Wrap(ErrBackupCorrupted, err.Error())
+			}
+			snapshot, err := util.ReadVarByteArray(buf)
+			if err != nil {
+				return 0, pe.Wrap(ErrBackupCorrupted, err.Error())
+			}
+			doc, err := checkBackupSnapshot(snapshot)
+			if err != nil {
+				return 0, pe.Wrapf(ErrBackupCorrupted, "invalid snapshot of doc %s/%s: %v", collection, docId, err)
+			}
+			if handlers.onDoc != nil {
+				if err := handlers.onDoc(collection, docId, snapshot, doc); err != nil {
+					return 0, err
+				}
+			}
+			docs++
+		case recordType == backupRecordHistory && gotMeta:
+			collection, err := util.ReadVarString(buf)
+			if err != nil {
+				return 0, pe.Wrap(ErrBackupCorrupted, err.Error())
+			}
+			docId, err := util.ReadVarString(buf)
+			if err != nil {
+				return 0, pe.Wrap(ErrBackupCorrupted, err.Error())
+			}
+			seq, err := util.ReadUint64(buf)
+			if err != nil {
+				return 0, pe.Wrap(ErrBackupCorrupted, err.Error())
+			}
+			versionBytes, err := util.ReadVarByteArray(buf)
+			if err != nil {
+				return 0, pe.Wrap(ErrBackupCorrupted, err.Error())
+			}
+			version, err := NewDocVersionFromBytes(seq, versionBytes)
+			if err != nil {
+				return 0, pe.Wrapf(ErrBackupCorrupted, "invalid version %d of doc %s/%s: %v", seq, collection, docId, err)
+			}
+			if handlers.onHistory != nil {
+				if err := handlers.onHistory(collection, docId, version); err != nil {
+					return 0, err
+				}
+			}
+		case (recordType == backupRecordTombstone || recordType == backupRecordPurged) && gotMeta:
+			collection, err := util.ReadVarString(buf)
+			if err != nil {
+				return 0, pe.Wrap(ErrBackupCorrupted, err.Error())
+			}
+			docId, err := util.ReadVarString(buf)
+			if err != nil {
+				return 0, pe.Wrap(ErrBackupCorrupted, err.Error())
+			}
+			millis, err := util.ReadVarInt(buf)
+			if err != nil {
+				return 0, pe.Wrap(ErrBackupCorrupted, err.Error())
+			}
+			if handlers.onDocTime != nil {
+				if err := handlers.onDocTime(recordType, collection, docId, time.UnixMilli(millis)); err != nil {
+					return 0, err
+				}
+			}
+		case recordType == backupRecordEnd && gotMeta:
+			count, err := util.ReadVarUint(buf)
+			if err != nil {
+				return 0, pe.Wrap(ErrBackupCorrupted, err.Error())
+			}
+			if count != uint64(docs) {
+				return 0, pe.Wrapf(ErrBackupCorrupted, "expect %d docs, got %d", count, docs)
+			}
+			return docs, nil
+		default:
+			return 0, pe.Wrapf(ErrBackupCorrupted, "unexpected record type %q", recordType)
+		}
+	}
+}
+
+// checkBackupSnapshot checks the checksum of a doc snapshot of an archive and
+// imports it, so that a snapshot loro can't load is never restored
+func checkBackupSnapshot(snapshot []byte) (*loro.LoroDoc, error) {
+	if _, err := loro.InspectImport(snapshot, true); err != nil {
+		return nil, err
+	}
+	return docFromSnapshot(snapshot)
+}
+
+func writeBackupHeader(w io.Writer) error {
+	if _, err := io.WriteString(w, BACKUP_MAGIC); err != nil {
+		return pe.WithStack(err)
+	}
+	_, err := w.Write([]byte{BACKUP_VERSION})
+	return pe.WithStack(err)
+}
+
+func readBackupHeader(r io.Reader) error {
+	header := make([]byte, len(BACKUP_MAGIC)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return pe.Wrapf(ErrBackupCorrupted, "invalid header: %v", err)
+	}
+	if string(header[:len(BACKUP_MAGIC)]) != BACKUP_MAGIC {
+		return pe.Wrap(ErrBackupCorrupted, "not a backup archive")
+	}
+	if header[len(BACKUP_MAGIC)] != BACKUP_VERSION {
+		return pe.Errorf("unsupported backup version %d", header[len(BACKUP_MAGIC)])
+	}
+	return nil
+}
+
+func writeBackupRecord(w io.Writer, record []byte) error {
+	frame := binary.AppendUvarint(nil, uint64(len(record)))
+	frame = append(frame, record...)
+	frame = binary.BigEndian.AppendUint32(frame, crc32.Checksum(record, backupCrcTable))
+	_, err := w.Write(frame)
+	return pe.WithStack(err)
+}
+
+func readBackupRecord(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, pe.Wrapf(ErrBackupCorrupted, "truncated archive: %v", err)
+	}
+	// the length is not checksummed yet, don't trust it for allocation
+	var record bytes.Buffer
+	if _, err := io.CopyN(&record, r, int64(length)); err != nil {
+		return nil, pe.Wrapf(ErrBackupCorrupted, "truncated archive: %v", err)
+	}
+	var checksum [4]byte
+	if _, err := io.ReadFull(r, checksum[:]); err != nil {
+		return nil, pe.Wrapf(ErrBackupCorrupted, "truncated archive: %v", err)
+	}
+	if binary.BigEndian.Uint32(checksum[:]) != crc32.Checksum(record.Bytes(), backupCrcTable) {
+		return nil, pe.Wrap(ErrBackupCorrupted, "checksum mismatch")
+	}
+	return record.Bytes(), nil
+}
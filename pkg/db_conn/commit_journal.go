@@ -0,0 +1,232 @@
+package db_conn
+
+import (
+	"bytes"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	pe "github.com/pkg/errors"
+)
+
+// Commit journal
+//
+// A connection with a CommitJournal numbers its commits with a seq that
+// increases by one with every commit, and writes the committed transaction
+// under key_utils.CalcJournalKey(seq) in the same write as the commit. The
+// journaled transactions are the source of truth of the commits for the
+// journal: they can be read back in seq order with LoadJournal until they are
+// trimmed with TrimJournal, so a journal that falls behind, or a process that
+// stops before the journal handled a commit, doesn't lose it. The journal is
+// called with the commit lock held, so it sees the commits in commit order, and
+// it must return quickly since the next commit waits for it.
+
+// CommitJournal is notified of the commits of a connection, see SetCommitJournal
+type CommitJournal interface {
+	// Committed is called after tr was written with seq, the seq of the
+	// previous commit plus one
+	Committed(tr *Transaction, seq uint64)
+	// Rollbacked is called after tr was rolled back
+	Rollbacked(tr *Transaction, reason error)
+}
+
+// JournalEntry is a transaction of the commit journal
+type JournalEntry struct {
+	Seq         uint64
+	Transaction *Transaction
+}
+
+func encodeJournal(tr *Transaction, seq uint64) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := util.WriteVarUint(&buf, seq); err != nil {
+		return nil, err
+	}
+	if err := writeTransaction(&buf, tr); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeJournal(data []byte) (*Transaction, uint64, error) {
+	buf := bytes.NewBuffer(data)
+	seq, err := util.ReadVarUint(buf)
+	if err != nil {
+		return nil, 0, pe.Wrap(err, "invalid commit journal")
+	}
+	tr, err := ReadTransaction(buf)
+	if err != nil {
+		return nil, 0, pe.Wrap(err, "invalid commit journal")
+	}
+	return tr, seq, nil
+}
+
+func (conn *PebbleDbConn) SetCommitJournal(journal CommitJournal) error {
+	_, seq, err := conn.LastJournaled()
+	if err != nil {
+		return err
+	}
+	conn.mu.docsCache.Lock()
+	defer conn.mu.docsCache.Unlock()
+	conn.journal = journal
+	conn.journalSeq = seq
+	return nil
+}
+
+func (conn *PebbleDbConn) LastJournaled() (*Transaction, uint64, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return nil, 0, pe.Errorf("cannot load commit journal: current status = %d", status)
+	}
+	iter, err := conn.newJournalIter(0)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer iter.Close()
+	if !iter.Last() {
+		return nil, 0, iter.Error()
+	}
+	entry, err := conn.readJournalEntry(iter)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entry.Transaction, entry.Seq, nil
+}
+
+func (conn *PebbleDbConn) LoadJournal(after uint64, limit int) ([]*JournalEntry, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return nil, pe.Errorf("cannot load commit journal: current status = %d", status)
+	}
+	iter, err := conn.newJournalIter(after + 1)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	var entries []*JournalEntry
+	for iter.First(); iter.Valid() && len(entries) < limit; iter.Next() {
+		entry, err := conn.readJournalEntry(iter)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, iter.Error()
+}
+
+func (conn *PebbleDbConn) TrimJournal(seq uint64) error {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return pe.Errorf("cannot trim commit journal: current status = %d", status)
+	}
+	if conn.params.ReadOnly {
+		return ErrReadOnly
+	}
+	_, last, err := conn.LastJournaled()
+	if err != nil {
+		return err
+	}
+	// the re-encryption rewrites journal entries with the cache lock held
+	conn.mu.docsCache.Lock()
+	defer conn.mu.docsCache.Unlock()
+	return conn.pebbleDb.DeleteRange(key_utils.CalcJournalKey(0), key_utils.CalcJournalKey(min(seq, last)), conn.params.writeOptions())
+}
+
+// newJournalIter returns an iterator over the journal from seq
+func (conn *PebbleDbConn) newJournalIter(seq uint64) (*pebble.Iterator, error) {
+	return conn.pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: key_utils.CalcJournalKey(seq),
+		UpperBound: []byte{key_utils.JOURNAL_KEY_PREFIX[0] + 1},
+	})
+}
+
+func (conn *PebbleDbConn) readJournalEntry(iter *pebble.Iterator) (*JournalEntry, error) {
+	value, err := conn.keyring.openValue(iter.Key(), bytes.Clone(iter.Value()))
+	if err != nil {
+		return nil, pe.Wrap(err, "failed to decrypt commit journal")
+	}
+	tr, seq, err := decodeJournal(value)
+	if err != nil {
+		return nil, err
+	}
+	return &JournalEntry{Seq: seq, Transaction: tr}, nil
+}
+
+// writeJournal adds the journal entry of tr to batch if a journal is set,
+// returns the seq of tr, must hold the cache lock
+func (conn *PebbleDbConn) writeJournal(batch *pebble.Batch, tr *Transaction) (uint64, error) {
+	if conn.journal == nil {
+		return 0, nil
+	}
+	seq := conn.journalSeq + 1
+	value, err := encodeJournal(tr, seq)
+	if err != nil {
+		return 0, err
+	}
+	key := key_utils.CalcJournalKey(seq)
+	sealed, err := conn.keyring.sealValue(key, value)
+	if err != nil {
+		return 0, err
+	}
+	return seq, batch.Set(key, sealed, nil)
+}
+
+func (conn *MemDbConn) SetCommitJournal(journal CommitJournal) error {
+	if status := conn.GetStatus(); status != DbConnStatusRunning {
+		return pe.Errorf("cannot set commit journal: current status = %d", status)
+	}
+	conn.cacheMu.Lock()
+	defer conn.cacheMu.Unlock()
+	conn.journal = journal
+	return nil
+}
+
+func (conn *MemDbConn) LastJournaled() (*Transaction, uint64, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return nil, 0, pe.Errorf("cannot load commit journal: current status = %d", status)
+	}
+	conn.db.mu.RLock()
+	defer conn.db.mu.RUnlock()
+	if len(conn.db.journal) == 0 {
+		return nil, 0, nil
+	}
+	last := conn.db.journal[len(conn.db.journal)-1]
+	return last.Transaction, last.Seq, nil
+}
+
+func (conn *MemDbConn) LoadJournal(after uint64, limit int) ([]*JournalEntry, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return nil, pe.Errorf("cannot load commit journal: current status = %d", status)
+	}
+	conn.db.mu.RLock()
+	defer conn.db.mu.RUnlock()
+	var entries []*JournalEntry
+	for _, entry := range conn.db.journal {
+		if len(entries) == limit {
+			break
+		}
+		if entry.Seq > after {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (conn *MemDbConn) TrimJournal(seq uint64) error {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return pe.Errorf("cannot trim commit journal: current status = %d", status)
+	}
+	if conn.params.ReadOnly {
+		return ErrReadOnly
+	}
+	conn.db.mu.Lock()
+	defer conn.db.mu.Unlock()
+	i := 0
+	for i < len(conn.db.journal)-1 && conn.db.journal[i].Seq < seq {
+		i++
+	}
+	conn.db.journal = conn.db.journal[i:]
+	return nil
+}
@@ -0,0 +1,283 @@
+package db_conn
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/log"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	pe "github.com/pkg/errors"
+)
+
+// History compaction
+//
+// A stored snapshot carries the whole history of its doc, so it grows with
+// every edit. CompactHistory replaces the snapshot with a loro shallow snapshot
+// at the horizon, the newest version in the doc history committed before some
+// time, and removes the older versions from the history. The doc keeps its
+// current state and the history after the horizon.
+//
+// A client whose version of the doc predates the horizon can't be sent the
+// updates from its version and gets the whole snapshot instead. Updates it
+// made before the horizon and has not committed yet can't be imported, Commit
+// rejects them with ErrUpdateNotImported instead of storing the doc without
+// their changes.
+
+// ErrUpdateNotImported is returned by Commit for an update whose changes depend
+// on changes the stored doc doesn't have, such as an update made before the
+// horizon of a compaction
+var ErrUpdateNotImported = errors.New("update depends on changes missing from the doc")
+
+// DefaultHistoryCompactionInterval is the default time between two compactions
+const DefaultHistoryCompactionInterval = time.Hour
+
+type HistoryCompactionOptions struct {
+	// Retention is how long the history of a doc is kept in each compacted
+	// collection, collections not in the map are never compacted
+	Retention map[string]time.Duration
+	// Interval is the time between two compactions
+	Interval time.Duration
+}
+
+func (opts *HistoryCompactionOptions) EnsureDefaults() {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultHistoryCompactionInterval
+	}
+}
+
+// HistoryCompactor compacts the history of the docs of a connection
+// periodically, the statistics count the compacted docs and the collections
+// that failed to be compacted
+type HistoryCompactor struct {
+	*periodicJob
+	conn DbConnection
+	opts HistoryCompactionOptions
+}
+
+// NewHistoryCompactor creates a compactor for conn
+func NewHistoryCompactor(conn DbConnection, opts *HistoryCompactionOptions) *HistoryCompactor {
+	compactor := &HistoryCompactor{conn: conn}
+	if opts != nil {
+		compactor.opts = *opts
+	}
+	compactor.opts.EnsureDefaults()
+	compactor.periodicJob = newPeriodicJob("HistoryCompactor", "compacted %d docs", compactor.opts.Interval, compactor.compact)
+	return compactor
+}
+
+// compact compacts the history older than the retention of every configured
+// collection
+func (c *HistoryCompactor) compact(now time.Time) (compacted int, failures int, lastErr error) {
+	for collection, retention := range c.opts.Retention {
+		n, err := c.conn.CompactHistory(collection, now.Add(-retention))
+		compacted += n
+		if err != nil {
+			log.Errorf("HistoryCompactor.Run: failed to compact collection %s: %v", collection, err)
+			failures++
+			lastErr = err
+		}
+	}
+	return compacted, failures, lastErr
+}
+
+// docFromSnapshot creates a doc from a stored snapshot
+func docFromSnapshot(snapshot []byte) (*loro.LoroDoc, error) {
+	doc := loro.NewLoroDoc()
+	if _, err := doc.Import(snapshot); err != nil {
+		return nil, pe.Wrap(err, "invalid snapshot")
+	}
+	return doc, nil
+}
+
+// importUpdate imports update into doc, it fails with ErrUpdateNotImported if
+// loro rejects the update or some of its changes stay pending
+func importUpdate(doc *loro.LoroDoc, update []byte) error {
+	status, err := doc.Import(update)
+	if err != nil {
+		return pe.Wrap(ErrUpdateNotImported, err.Error())
+	}
+	pending := status.GetPending()
+	if pending != nil && !pending.IsEmpty() {
+		return ErrUpdateNotImported
+	}
+	return nil
+}
+
+// compactionHorizon returns the newest version of versions committed before
+// before, ok is false if no version is older than it, so there is nothing to
+// compact
+func compactionHorizon(versions []*DocVersion, before time.Time) (horizon *DocVersion, ok bool) {
+	for i, v := range versions {
+		if v.Timestamp >= before.UnixMilli() {
+			break
+		}
+		if i > 0 {
+			horizon, ok = v, true
+		}
+	}
+	return horizon, ok
+}
+
+// shallowSnapshot returns the shallow snapshot of doc at the horizon
+func shallowSnapshot(doc *loro.LoroDoc, horizon *DocVersion) ([]byte, error) {
+	frontiers := loro.NewFrontiersFromBytes(loro.NewRustBytesVec(horizon.Frontiers))
+	snapshot, err := doc.ExportShallowSnapshot(frontiers)
+	if err != nil {
+		return nil, pe.Wrapf(err, "failed to export shallow snapshot at version %d", horizon.Seq)
+	}
+	return snapshot.Bytes(), nil
+}
+
+func (conn *PebbleDbConn) CompactHistory(collectionName string, before time.Time) (int, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return 0, pe.Errorf("cannot compact history: current status = %d", status)
+	}
+	if conn.params.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	// commits and compactions are serialized by the cache lock
+	conn.mu.docsCache.Lock()
+	defer conn.mu.docsCache.Unlock()
+
+	lowerbound, err := key_utils.CalcCollectionLowerBound(collectionName)
+	if err != nil {
+		return 0, err
+	}
+	upperbound, err := key_utils.CalcCollectionUpperBound(collectionName)
+	if err != nil {
+		return 0, err
+	}
+	iter, err := conn.pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: lowerbound,
+		UpperBound: upperbound,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	batch := conn.pebbleDb.NewBatch()
+	defer batch.Close()
+	compacted := make(map[string]*loro.LoroDoc)
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, docId, err := key_utils.ParseDocKey(iter.Key())
+		if err != nil {
+			return 0, err
+		}
+		versions, err := conn.LoadDocHistory(collectionName, docId)
+		if err != nil {
+			return 0, err
+		}
+		horizon, ok := compactionHorizon(versions, before)
+		if !ok {
+			continue
+		}
+		doc, ok := conn.cache.docs.Get(string(iter.Key()))
+		if !ok {
+			stored, err := conn.openDoc(iter.Key(), iter.Value())
+			if err != nil {
+				return 0, err
+			}
+			doc, err = docFromSnapshot(stored)
+			if err != nil {
+				return 0, pe.Wrapf(err, "doc %s/%s", collectionName, docId)
+			}
+		}
+		if doc_visitor.IsDeleted(doc) {
+			// deleted docs are removed by the tombstone GC
+			continue
+		}
+		snapshot, err := shallowSnapshot(doc, horizon)
+		if err != nil {
+			return 0, pe.Wrapf(err, "doc %s/%s", collectionName, docId)
+		}
+		sealed, err := conn.keyring.sealValue(iter.Key(), snapshot)
+		if err != nil {
+			return 0, err
+		}
+		if err := batch.Set(iter.Key(), sealed, nil); err != nil {
+			return 0, err
+		}
+		historyLowerbound, err := key_utils.CalcDocHistoryLowerBound(collectionName, docId)
+		if err != nil {
+			return 0, err
+		}
+		horizonKey, err := key_utils.CalcDocHistoryKey(collectionName, docId, horizon.Seq)
+		if err != nil {
+			return 0, err
+		}
+		if err := batch.DeleteRange(historyLowerbound, horizonKey, nil); err != nil {
+			return 0, err
+		}
+		shallowDoc, err := docFromSnapshot(snapshot)
+		if err != nil {
+			return 0, pe.Wrapf(err, "doc %s/%s", collectionName, docId)
+		}
+		compacted[string(iter.Key())] = shallowDoc
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	if err := batch.Commit(conn.params.writeOptions()); err != nil {
+		return 0, err
+	}
+	for key, doc := range compacted {
+		conn.cache.docs.Set(key, doc)
+	}
+	return len(compacted), nil
+}
+
+func (conn *MemDbConn) CompactHistory(collectionName string, before time.Time) (int, error) {
+	if err := conn.checkWritable("compact history"); err != nil {
+		return 0, err
+	}
+
+	conn.cacheMu.Lock()
+	defer conn.cacheMu.Unlock()
+	conn.db.mu.Lock()
+	defer conn.db.mu.Unlock()
+
+	compacted := 0
+	for key, stored := range conn.db.docs {
+		collection, _, err := key_utils.ParseDocKey(util.String2Bytes(key))
+		if err != nil {
+			return compacted, err
+		}
+		if collection != collectionName {
+			continue
+		}
+		versions := conn.db.history[key]
+		horizon, ok := compactionHorizon(versions, before)
+		if !ok {
+			continue
+		}
+		doc, err := docFromSnapshot(stored)
+		if err != nil {
+			return compacted, pe.Wrapf(err, "doc %s", key)
+		}
+		if doc_visitor.IsDeleted(doc) {
+			continue
+		}
+		snapshot, err := shallowSnapshot(doc, horizon)
+		if err != nil {
+			return compacted, pe.Wrapf(err, "doc %s", key)
+		}
+		conn.db.docs[key] = snapshot
+		for i, v := range versions {
+			if v.Seq == horizon.Seq {
+				conn.db.history[key] = append([]*DocVersion(nil), versions[i:]...)
+				break
+			}
+		}
+		// cached docs still have the full history, load them again
+		delete(conn.cache, key)
+		compacted++
+	}
+	return compacted, nil
+}
@@ -1,6 +1,8 @@
 package db_conn
 
 import (
+	"time"
+
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
 )
@@ -22,6 +24,8 @@ type DbConnection interface {
 
 	// Connection Params
 	// GetConnParams()
+	// IsReadOnly reports whether the connection rejects writes with ErrReadOnly
+	IsReadOnly() bool
 
 	// Database Meta
 	GetDatabaseMeta() *DatabaseMeta
@@ -31,11 +35,41 @@ type DbConnection interface {
 	// Query Related
 	LoadDoc(collectionName, docID string) (*loro.LoroDoc, error)
 	LoadCollection(collectionName string) (map[string]*loro.LoroDoc, error)
+	// LoadDocHistory returns the versions of a doc recorded at commit, oldest first
+	LoadDocHistory(collectionName, docID string) ([]*DocVersion, error)
 	InvalidateCache()
 
 	// Transaction Related
 	Commit(tr *Transaction) error
 
+	// Tombstones, see TombstoneGc
+	// PurgeTombstones removes the docs deleted before deletedBefore and records
+	// their ids as purged, returns the number of purged docs
+	PurgeTombstones(deletedBefore time.Time) (int, error)
+	// IsPurged reports whether a doc was removed by PurgeTombstones
+	IsPurged(collectionName, docID string) (bool, error)
+	// ExpiredDocs returns at most limit docs of the TTL index that expire no
+	// later than now, the earliest first
+	ExpiredDocs(now time.Time, limit int) ([]ExpiredDoc, error)
+	// CompactHistory replaces the snapshots of the docs of a collection with
+	// shallow snapshots that drop the history committed before before, returns
+	// the number of compacted docs
+	CompactHistory(collectionName string, before time.Time) (int, error)
+
+	// Commit journal, see CommitJournal
+	// SetCommitJournal makes the connection number its commits and call
+	// journal on every commit and rollback
+	SetCommitJournal(journal CommitJournal) error
+	// LastJournaled returns the last transaction committed with a journal set
+	// and its seq, nil and 0 if there is none
+	LastJournaled() (*Transaction, uint64, error)
+	// LoadJournal returns at most limit journaled transactions with a seq
+	// greater than after, in seq order
+	LoadJournal(after uint64, limit int) ([]*JournalEntry, error)
+	// TrimJournal deletes the journaled transactions with a seq less than seq,
+	// the last one is always kept
+	TrimJournal(seq uint64) error
+
 	// Transaction Events
 	GetCommittedEb() *util.EventBus[*TransactionCommittedEvent]
 	GetRollbackedEb() *util.EventBus[*TransactionRollbackedEvent]
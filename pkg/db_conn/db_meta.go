@@ -3,7 +3,9 @@ package db_conn
 import (
 	"bytes"
 	"encoding/json"
+	"time"
 
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
 )
 
@@ -16,6 +18,18 @@ type DatabaseMeta struct {
 	// Permission definition in Js
 	permissionJs string
 	createdAt    uint64
+	// Layout of the document keys, one of key_utils.KEY_LAYOUT_*
+	keyLayout uint8
+}
+
+// NewDatabaseMeta creates the meta of a new database created now
+func NewDatabaseMeta(schema *DatabaseSchema, permissionJs string) *DatabaseMeta {
+	return &DatabaseMeta{
+		databaseSchema: schema,
+		permissionJs:   permissionJs,
+		createdAt:      uint64(time.Now().Unix()),
+		keyLayout:      key_utils.CURRENT_KEY_LAYOUT,
+	}
 }
 
 // ToBytes serializes the database meta to bytes
@@ -29,6 +43,7 @@ func (s *DatabaseMeta) ToBytes() ([]byte, error) {
 	util.WriteVarByteArray(&buf, schemaJsonStr)
 	util.WriteVarString(&buf, s.permissionJs)
 	util.WriteUint64(&buf, s.createdAt)
+	util.WriteUint8(&buf, s.keyLayout)
 	return buf.Bytes(), nil
 }
 
@@ -56,10 +71,19 @@ func NewDatabaseMetaFromBytes(data []byte) (*DatabaseMeta, error) {
 	if err != nil {
 		return nil, err
 	}
+	// meta written before the key layout was recorded uses the fixed-width layout
+	keyLayout := key_utils.KEY_LAYOUT_FIXED_WIDTH
+	if buf.Len() > 0 {
+		keyLayout, err = util.ReadUint8(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &DatabaseMeta{
 		databaseSchema: schema,
 		permissionJs:   permissionsJs,
 		createdAt:      createdAt,
+		keyLayout:      keyLayout,
 	}, nil
 }
 
@@ -75,3 +99,13 @@ func (s *DatabaseMeta) GetCollectionNames() []string {
 func (s *DatabaseMeta) GetPermissionJs() string {
 	return s.permissionJs
 }
+
+// GetKeyLayout 获取数据库文档键的格式，为 key_utils.KEY_LAYOUT_* 之一
+func (s *DatabaseMeta) GetKeyLayout() uint8 {
+	return s.keyLayout
+}
+
+// GetDatabaseSchema 获取数据库的 schema
+func (s *DatabaseMeta) GetDatabaseSchema() *DatabaseSchema {
+	return s.databaseSchema
+}
@@ -0,0 +1,216 @@
+package db_conn
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	pe "github.com/pkg/errors"
+)
+
+// DocVersion is a version in the history of a document, one is recorded for
+// every document changed by a committed transaction.
+type DocVersion struct {
+	// Seq orders the versions of a document, it increases with every commit
+	Seq uint64
+	// Frontiers is the encoded loro frontiers of the document after the commit,
+	// pass it to loro.LoroDoc.ForkAt to read the document as of this version
+	Frontiers []byte
+	TxID      string
+	Committer string
+	// Timestamp is the commit time in unix milliseconds
+	Timestamp int64
+}
+
+// ToBytes serializes the version, Seq is stored in the key and not included
+func (v *DocVersion) ToBytes() []byte {
+	var buf bytes.Buffer
+	util.WriteVarByteArray(&buf, v.Frontiers)
+	util.WriteVarString(&buf, v.TxID)
+	util.WriteVarString(&buf, v.Committer)
+	util.WriteVarInt(&buf, v.Timestamp)
+	return buf.Bytes()
+}
+
+// NewDocVersionFromBytes deserializes a version serialized by ToBytes
+func NewDocVersionFromBytes(seq uint64, data []byte) (*DocVersion, error) {
+	buf := bytes.NewBuffer(data)
+	frontiers, err := util.ReadVarByteArray(buf)
+	if err != nil {
+		return nil, err
+	}
+	txId, err := util.ReadVarString(buf)
+	if err != nil {
+		return nil, err
+	}
+	committer, err := util.ReadVarString(buf)
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := util.ReadVarInt(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &DocVersion{
+		Seq:       seq,
+		Frontiers: frontiers,
+		TxID:      txId,
+		Committer: committer,
+		Timestamp: timestamp,
+	}, nil
+}
+
+// historyRecorder collects the versions of the documents changed by a transaction
+type historyRecorder struct {
+	tr      *Transaction
+	now     time.Time
+	changed map[[2]string]*loro.LoroDoc // [collection, doc id] -> doc after the commit
+	order   [][2]string
+}
+
+func newHistoryRecorder(tr *Transaction) *historyRecorder {
+	return &historyRecorder{
+		tr:      tr,
+		now:     time.Now(),
+		changed: make(map[[2]string]*loro.LoroDoc),
+	}
+}
+
+// record marks the doc as changed, only the last state of a doc changed several
+// times in the transaction is recorded
+func (r *historyRecorder) record(collection, docId string, doc *loro.LoroDoc) {
+	key := [2]string{collection, docId}
+	if _, ok := r.changed[key]; !ok {
+		r.order = append(r.order, key)
+	}
+	r.changed[key] = doc
+}
+
+// versions returns the recorded docs and their versions in the order the docs
+// were first changed. The seq of a version is the commit time in nanoseconds,
+// or lastSeq + 1 if the clock went back, so the seqs of a doc keep increasing.
+func (r *historyRecorder) versions(lastSeq func(collection, docId string) (uint64, error)) ([][2]string, []*DocVersion, error) {
+	versions := make([]*DocVersion, 0, len(r.order))
+	for _, key := range r.order {
+		last, err := lastSeq(key[0], key[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		versions = append(versions, &DocVersion{
+			Seq:       max(uint64(r.now.UnixNano()), last+1),
+			Frontiers: r.changed[key].GetOplogFrontiers().Encode().Bytes(),
+			TxID:      r.tr.TxID,
+			Committer: r.tr.Committer,
+			Timestamp: r.now.UnixMilli(),
+		})
+	}
+	return r.order, versions, nil
+}
+
+// writeHistory adds the versions recorded by r to batch
+func (conn *PebbleDbConn) writeHistory(batch *pebble.Batch, r *historyRecorder) error {
+	docs, versions, err := r.versions(conn.lastHistorySeq)
+	if err != nil {
+		return err
+	}
+	for i, doc := range docs {
+		key, err := key_utils.CalcDocHistoryKey(doc[0], doc[1], versions[i].Seq)
+		if err != nil {
+			return err
+		}
+		sealed, err := conn.keyring.sealValue(key, versions[i].ToBytes())
+		if err != nil {
+			return err
+		}
+		if err := batch.Set(key, sealed, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastHistorySeq returns the seq of the last version of a doc, 0 if it has no history
+func (conn *PebbleDbConn) lastHistorySeq(collectionName, docID string) (uint64, error) {
+	lowerbound, err := key_utils.CalcDocHistoryLowerBound(collectionName, docID)
+	if err != nil {
+		return 0, err
+	}
+	upperbound, err := key_utils.CalcDocHistoryUpperBound(collectionName, docID)
+	if err != nil {
+		return 0, err
+	}
+	iter, err := conn.pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: lowerbound,
+		UpperBound: upperbound,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	if !iter.Last() {
+		return 0, iter.Error()
+	}
+	_, _, seq, err := key_utils.ParseDocHistoryKey(iter.Key())
+	return seq, err
+}
+
+func (conn *PebbleDbConn) LoadDocHistory(collectionName, docID string) ([]*DocVersion, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return nil, pe.Errorf("cannot load doc history: current status = %d", status)
+	}
+	lowerbound, err := key_utils.CalcDocHistoryLowerBound(collectionName, docID)
+	if err != nil {
+		return nil, err
+	}
+	upperbound, err := key_utils.CalcDocHistoryUpperBound(collectionName, docID)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := conn.pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: lowerbound,
+		UpperBound: upperbound,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	versions := make([]*DocVersion, 0)
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, _, seq, err := key_utils.ParseDocHistoryKey(iter.Key())
+		if err != nil {
+			return nil, err
+		}
+		versionBytes, err := conn.keyring.openValue(iter.Key(), iter.Value())
+		if err != nil {
+			return nil, pe.Wrapf(err, "failed to decrypt version %d of doc %s/%s", seq, collectionName, docID)
+		}
+		version, err := NewDocVersionFromBytes(seq, versionBytes)
+		if err != nil {
+			return nil, pe.Wrapf(err, "invalid version %d of doc %s/%s", seq, collectionName, docID)
+		}
+		versions = append(versions, version)
+	}
+	return versions, iter.Error()
+}
+
+func (conn *MemDbConn) LoadDocHistory(collectionName, docID string) ([]*DocVersion, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return nil, pe.Errorf("cannot load doc history: current status = %d", status)
+	}
+	keyBytes, err := key_utils.CalcDocKey(collectionName, docID)
+	if err != nil {
+		return nil, err
+	}
+	conn.db.mu.RLock()
+	defer conn.db.mu.RUnlock()
+	history := conn.db.history[string(keyBytes)]
+	versions := make([]*DocVersion, len(history))
+	copy(versions, history)
+	return versions, nil
+}
@@ -0,0 +1,328 @@
+package db_conn
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	pe "github.com/pkg/errors"
+)
+
+// Encryption at rest
+//
+// When a PebbleDbConn is given a keyring, doc snapshots, history versions, the
+// database meta and the commit journal are sealed with AES-GCM before they are
+// written. A sealed value is
+//
+//	encryptedValueMagic | version | key id (var string) | nonce | ciphertext
+//
+// and the pebble key of the value is authenticated with it, so a value can't
+// be moved to another key. Keys and indexes are not encrypted.
+//
+// The last key of a keyring is the active key, new values are sealed with it
+// and the other keys are only used to open values. To rotate, append a new key
+// to the keyring and restart: the re-encryption job of the connection seals
+// the values of older keys, and the plaintext values of a database created
+// without encryption, with the active key. A key can be removed from the
+// keyring once ReencryptionStats reports no stale values left.
+
+var (
+	// ErrEncryptionKeyMissing is returned when a value is sealed with a key that
+	// is not in the keyring, or the database is encrypted and no keyring is given
+	ErrEncryptionKeyMissing = errors.New("encryption key missing")
+	// ErrDecryptionFailed is returned when a sealed value fails authentication
+	ErrDecryptionFailed = errors.New("failed to decrypt value")
+)
+
+// DefaultEncryptionKeyEnv is the environment variable the keyring is read from
+// by tools that open databases directly
+const DefaultEncryptionKeyEnv = "RAPIERDB_ENCRYPTION_KEYS"
+
+// DefaultReencryptInterval is the default time between two re-encryption runs
+const DefaultReencryptInterval = time.Hour
+
+var encryptedValueMagic = []byte("\x00RENC")
+
+const encryptedValueVersion = 1
+
+// Keyring holds the AES keys of encrypted values by id
+type Keyring struct {
+	activeId string
+	aeads    map[string]cipher.AEAD
+}
+
+// ParseKeyring parses a keyring of "<key id>:<base64 key>" entries separated by
+// newlines or commas. Keys are 16, 24 or 32 bytes for AES-128, AES-192 or
+// AES-256, the last entry is the active key. Empty lines and lines starting
+// with # are skipped.
+func ParseKeyring(text string) (*Keyring, error) {
+	k := &Keyring{aeads: make(map[string]cipher.AEAD)}
+	entries := strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' })
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encodedKey, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, pe.Errorf("invalid keyring entry, expected <key id>:<base64 key>")
+		}
+		if _, ok := k.aeads[id]; ok {
+			return nil, pe.Errorf("duplicate key id %s", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+		if err != nil {
+			return nil, pe.Wrapf(err, "invalid key %s", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, pe.Wrapf(err, "invalid key %s", id)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, pe.WithStack(err)
+		}
+		k.aeads[id] = aead
+		k.activeId = id
+	}
+	if k.activeId == "" {
+		return nil, pe.Wrap(ErrEncryptionKeyMissing, "keyring is empty")
+	}
+	return k, nil
+}
+
+// LoadKeyringFile reads a keyring from a file, see ParseKeyring
+func LoadKeyringFile(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, pe.Wrapf(ErrEncryptionKeyMissing, "failed to read key file: %v", err)
+	}
+	return ParseKeyring(string(data))
+}
+
+// LoadKeyringEnv reads a keyring from an environment variable, see ParseKeyring
+func LoadKeyringEnv(name string) (*Keyring, error) {
+	text, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, pe.Wrapf(ErrEncryptionKeyMissing, "environment variable %s is not set", name)
+	}
+	return ParseKeyring(text)
+}
+
+// ActiveKeyId returns the id of the key new values are sealed with
+func (k *Keyring) ActiveKeyId() string {
+	return k.activeId
+}
+
+// sealValue encrypts the value of key with the active key, a nil keyring
+// returns the value as is
+func (k *Keyring) sealValue(key, value []byte) ([]byte, error) {
+	if k == nil {
+		return value, nil
+	}
+	aead := k.aeads[k.activeId]
+	var buf bytes.Buffer
+	buf.Write(encryptedValueMagic)
+	util.WriteUint8(&buf, encryptedValueVersion)
+	util.WriteVarString(&buf, k.activeId)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, pe.WithStack(err)
+	}
+	buf.Write(nonce)
+	return aead.Seal(buf.Bytes(), nonce, value, key), nil
+}
+
+// openValue decrypts a value of key sealed by sealValue, plaintext values are
+// returned as is
+func (k *Keyring) openValue(key, stored []byte) ([]byte, error) {
+	keyId, rest, sealed, err := parseSealedValue(stored)
+	if err != nil || !sealed {
+		return stored, err
+	}
+	if k == nil {
+		return nil, pe.Wrapf(ErrEncryptionKeyMissing, "value is encrypted with key %s, no keyring is given", keyId)
+	}
+	aead, ok := k.aeads[keyId]
+	if !ok {
+		return nil, pe.Wrapf(ErrEncryptionKeyMissing, "key %s is not in the keyring", keyId)
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, pe.Wrapf(ErrDecryptionFailed, "value of %q is truncated", key)
+	}
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, ciphertext, key)
+	if err != nil {
+		return nil, pe.Wrapf(ErrDecryptionFailed, "value of %q: %v", key, err)
+	}
+	return value, nil
+}
+
+// isStale reports whether a stored value is not sealed with the active key
+func (k *Keyring) isStale(stored []byte) bool {
+	keyId, _, sealed, err := parseSealedValue(stored)
+	return err == nil && (!sealed || keyId != k.activeId)
+}
+
+// parseSealedValue returns the key id and the nonce and ciphertext of a sealed
+// value, sealed is false for plaintext values
+func parseSealedValue(stored []byte) (keyId string, rest []byte, sealed bool, err error) {
+	if !bytes.HasPrefix(stored, encryptedValueMagic) {
+		return "", nil, false, nil
+	}
+	buf := bytes.NewBuffer(stored[len(encryptedValueMagic):])
+	version, err := util.ReadUint8(buf)
+	if err != nil {
+		return "", nil, true, pe.Wrap(ErrDecryptionFailed, "truncated encrypted value")
+	}
+	if version != encryptedValueVersion {
+		return "", nil, true, pe.Wrapf(ErrDecryptionFailed, "unknown encrypted value version %d", version)
+	}
+	if keyId, err = util.ReadVarString(buf); err != nil {
+		return "", nil, true, pe.Wrap(ErrDecryptionFailed, "truncated encrypted value")
+	}
+	return keyId, buf.Bytes(), true, nil
+}
+
+// loadKeyring loads the keyring configured by the params, nil if encryption is
+// disabled
+func (params *PebbleDbConnParams) loadKeyring() (*Keyring, error) {
+	switch {
+	case params.EncryptionKeyFile != "":
+		return LoadKeyringFile(params.EncryptionKeyFile)
+	case params.EncryptionKeyEnv != "":
+		return LoadKeyringEnv(params.EncryptionKeyEnv)
+	default:
+		return nil, nil
+	}
+}
+
+// openDoc decrypts a stored doc snapshot
+func (conn *PebbleDbConn) openDoc(key, stored []byte) ([]byte, error) {
+	snapshot, err := conn.keyring.openValue(key, stored)
+	if err != nil {
+		return nil, pe.Wrapf(err, "failed to decrypt doc %q", key)
+	}
+	return snapshot, nil
+}
+
+// reencryptBatchSize is the number of values re-encrypted with the cache lock held
+const reencryptBatchSize = 256
+
+// newReencryptor returns the job that seals the stale values of conn with the
+// active key, the statistics count the re-encrypted values
+func newReencryptor(conn *PebbleDbConn) *periodicJob {
+	return newPeriodicJob("PebbleDbConn.Reencrypt", "re-encrypted %d values", conn.params.ReencryptInterval, func(time.Time) (int, int, error) {
+		n, err := conn.reencrypt()
+		return n, 0, err
+	})
+}
+
+// Reencrypt seals the doc snapshots, the history versions, the meta and the
+// commit journal that are not sealed with the active key of the keyring, returns the number of
+// re-encrypted values. Commits are blocked for one batch of values at a time.
+func (conn *PebbleDbConn) Reencrypt() (int, error) {
+	return conn.reencryptor.Run()
+}
+
+// ReencryptionStats returns the statistics of the re-encryption runs so far
+func (conn *PebbleDbConn) ReencryptionStats() JobStats {
+	return conn.reencryptor.Stats()
+}
+
+func (conn *PebbleDbConn) reencrypt() (int, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return 0, pe.Errorf("cannot re-encrypt: current status = %d", status)
+	}
+	if conn.keyring == nil {
+		return 0, pe.Wrap(ErrEncryptionKeyMissing, "encryption is disabled")
+	}
+	if conn.params.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	reencrypted := 0
+	key := []byte(key_utils.STORAGE_META_KEY)
+	_, n, err := conn.reencryptBatch(key, append(key, 0))
+	reencrypted += n
+	if err != nil {
+		return reencrypted, err
+	}
+	for _, prefix := range []string{key_utils.DOC_KEY_PREFIX, key_utils.HISTORY_KEY_PREFIX, key_utils.JOURNAL_KEY_PREFIX} {
+		lowerbound := []byte(prefix)
+		upperbound := []byte{prefix[0] + 1}
+		for lowerbound != nil {
+			next, n, err := conn.reencryptBatch(lowerbound, upperbound)
+			reencrypted += n
+			if err != nil {
+				return reencrypted, err
+			}
+			lowerbound = next
+		}
+	}
+	return reencrypted, nil
+}
+
+// reencryptBatch re-encrypts the stale values of at most reencryptBatchSize
+// keys from lowerbound, returns the key to continue from, nil at upperbound,
+// and the number of re-encrypted values
+func (conn *PebbleDbConn) reencryptBatch(lowerbound, upperbound []byte) (next []byte, reencrypted int, err error) {
+	conn.mu.docsCache.Lock()
+	defer conn.mu.docsCache.Unlock()
+
+	iter, err := conn.pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: lowerbound,
+		UpperBound: upperbound,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer iter.Close()
+
+	batch := conn.pebbleDb.NewBatch()
+	defer batch.Close()
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		if n == reencryptBatchSize {
+			next = bytes.Clone(iter.Key())
+			break
+		}
+		n++
+		stored, err := iter.ValueAndErr()
+		if err != nil {
+			return nil, 0, err
+		}
+		if !conn.keyring.isStale(stored) {
+			continue
+		}
+		value, err := conn.keyring.openValue(iter.Key(), stored)
+		if err != nil {
+			return nil, 0, err
+		}
+		sealed, err := conn.keyring.sealValue(iter.Key(), value)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := batch.Set(iter.Key(), sealed, nil); err != nil {
+			return nil, 0, err
+		}
+		reencrypted++
+	}
+	if err := iter.Error(); err != nil {
+		return nil, 0, err
+	}
+	if err := batch.Commit(conn.params.writeOptions()); err != nil {
+		return nil, 0, err
+	}
+	return next, reencrypted, nil
+}
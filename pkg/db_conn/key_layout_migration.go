@@ -0,0 +1,97 @@
+package db_conn
+
+import (
+	"errors"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/log"
+	pe "github.com/pkg/errors"
+)
+
+// ErrKeyLayoutOutdated is returned when opening a database whose document keys
+// use an older layout than key_utils.CURRENT_KEY_LAYOUT
+var ErrKeyLayoutOutdated = errors.New("key layout outdated")
+
+// MigratePebbleDbKeyLayout rewrites all document keys of the pebble database at
+// path to key_utils.CURRENT_KEY_LAYOUT and records the new layout in the meta.
+//
+// The migration is offline: the database must not be opened by anyone else.
+// All keys and the meta are rewritten in a single batch, so the database is
+// either fully migrated or left untouched. Returns the number of migrated
+// documents, 0 if the database already uses the current layout.
+func MigratePebbleDbKeyLayout(path string) (int, error) {
+	pebbleOpts := pebble.Options{}
+	pebbleOpts.EnsureDefaults()
+	pebbleOpts.ErrorIfNotExists = true
+	pebbleDb, err := pebble.Open(path, &pebbleOpts)
+	if err != nil {
+		return 0, pe.Wrap(err, "failed to open pebble db")
+	}
+	defer pebbleDb.Close()
+
+	meta, err := loadDatabaseMeta(pebbleDb, nil)
+	if err != nil {
+		return 0, pe.Wrap(err, "failed to load database meta")
+	}
+	switch meta.keyLayout {
+	case key_utils.CURRENT_KEY_LAYOUT:
+		return 0, nil
+	case key_utils.KEY_LAYOUT_FIXED_WIDTH:
+	default:
+		return 0, pe.Errorf("unknown key layout %d", meta.keyLayout)
+	}
+
+	iter, err := pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(key_utils.DOC_KEY_PREFIX),
+		UpperBound: []byte{key_utils.DOC_KEY_PREFIX[0] + 1},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	batch := pebbleDb.NewBatch()
+	defer batch.Close()
+	migrated := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		oldKey := iter.Key()
+		collection, docId, err := key_utils.ParseFixedWidthDocKey(oldKey)
+		if err != nil {
+			return 0, err
+		}
+		newKey, err := key_utils.CalcDocKey(collection, docId)
+		if err != nil {
+			return 0, err
+		}
+		value, err := iter.ValueAndErr()
+		if err != nil {
+			return 0, err
+		}
+		// the batch copies keys and values, the iterator may reuse its buffers
+		if err := batch.Delete(oldKey, nil); err != nil {
+			return 0, err
+		}
+		if err := batch.Set(newKey, value, nil); err != nil {
+			return 0, err
+		}
+		migrated++
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	meta.keyLayout = key_utils.CURRENT_KEY_LAYOUT
+	metaBytes, err := meta.ToBytes()
+	if err != nil {
+		return 0, err
+	}
+	if err := batch.Set([]byte(key_utils.STORAGE_META_KEY), metaBytes, nil); err != nil {
+		return 0, err
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return 0, err
+	}
+	log.Infof("MigratePebbleDbKeyLayout: migrated %d docs of %s to key layout %d", migrated, path, key_utils.CURRENT_KEY_LAYOUT)
+	return migrated, nil
+}
@@ -0,0 +1,524 @@
+package db_conn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	pe "github.com/pkg/errors"
+)
+
+// ErrMemDbNotFound is returned when opening an in-memory database that was not created
+var ErrMemDbNotFound = errors.New("in-memory database not found")
+
+// memDb is the data of an in-memory database, shared by all connections to it
+type memDb struct {
+	mu   sync.RWMutex
+	meta *DatabaseMeta
+	// doc key -> doc snapshot
+	docs map[string][]byte
+	// doc key -> versions of the doc, oldest first
+	history map[string][]*DocVersion
+	// doc key of a deleted doc -> deletion time in unix milliseconds
+	tombstones map[string]int64
+	// doc key of a purged doc -> purge time in unix milliseconds
+	purged map[string]int64
+	// keys of the TTL index, see key_utils.CalcTtlKey
+	ttl map[string]struct{}
+	// transactions of the commit journal in seq order and the seq of the last one
+	journal    []*JournalEntry
+	journalSeq uint64
+}
+
+// memDbs holds the in-memory databases by name
+var memDbs = struct {
+	mu  sync.Mutex
+	dbs map[string]*memDb
+}{dbs: make(map[string]*memDb)}
+
+// CreateNewMemDb creates an in-memory database, it can be opened with
+// NewMemDbConnWithContext until DropMemDb is called. Returns an error if a
+// database with the same name exists.
+func CreateNewMemDb(name string, schema *DatabaseSchema, permissionJs string) error {
+	if name == "" {
+		return pe.Errorf("in-memory database name is empty")
+	}
+	memDbs.mu.Lock()
+	defer memDbs.mu.Unlock()
+	if _, ok := memDbs.dbs[name]; ok {
+		return pe.Errorf("in-memory database %s already exists", name)
+	}
+	memDbs.dbs[name] = &memDb{
+		meta:       NewDatabaseMeta(schema, permissionJs),
+		docs:       make(map[string][]byte),
+		history:    make(map[string][]*DocVersion),
+		tombstones: make(map[string]int64),
+		purged:     make(map[string]int64),
+		ttl:        make(map[string]struct{}),
+	}
+	return nil
+}
+
+// DropMemDb removes the in-memory database so it can no longer be opened.
+// Connections that are already open keep working on its data.
+func DropMemDb(name string) {
+	memDbs.mu.Lock()
+	defer memDbs.mu.Unlock()
+	delete(memDbs.dbs, name)
+}
+
+type MemDbConnParams struct {
+	// Name of a database created by CreateNewMemDb
+	Name string
+	// ReadOnly rejects Commit and meta updates with ErrReadOnly
+	ReadOnly bool
+}
+
+// MemDbConn is a DbConnection to an in-memory database. Nothing is persisted,
+// the data lives as long as the database is not dropped or some connection
+// still refers to it.
+//
+// Docs are stored as snapshots, LoadDoc and LoadCollection return docs that
+// are cached by the connection until the next InvalidateCache, like PebbleDbConn.
+type MemDbConn struct {
+	params *MemDbConnParams
+
+	db *memDb // init in Open
+
+	cache   map[string]*loro.LoroDoc
+	cacheMu sync.Mutex
+
+	// nil if no commit journal is set, guarded by cacheMu
+	journal CommitJournal
+
+	// Status Related
+	status   atomic.Int32
+	statusEb *util.EventBus[DbConnStatus]
+
+	// Context
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Transaction Related Event Bus
+	committedEb  *util.EventBus[*TransactionCommittedEvent]
+	rollbackedEb *util.EventBus[*TransactionRollbackedEvent]
+}
+
+var _ DbConnection = &MemDbConn{}
+
+func NewMemDbConnWithContext(ctx context.Context, params *MemDbConnParams) (*MemDbConn, error) {
+	if params.Name == "" {
+		return nil, pe.Errorf("in-memory database name is empty")
+	}
+	subCtx, cancel := context.WithCancel(ctx)
+	return &MemDbConn{
+		params:       params,
+		cache:        make(map[string]*loro.LoroDoc),
+		statusEb:     util.NewEventBus[DbConnStatus](),
+		ctx:          subCtx,
+		cancel:       cancel,
+		committedEb:  util.NewEventBus[*TransactionCommittedEvent](),
+		rollbackedEb: util.NewEventBus[*TransactionRollbackedEvent](),
+	}, nil
+}
+
+func (conn *MemDbConn) Open() (err error) {
+	if !conn.swapStatus(DbConnStatusNotReady, DbConnStatusOpening) {
+		return pe.Errorf("cannot open mem db conn: current status = %d", conn.GetStatus())
+	}
+
+	defer func() {
+		if err != nil {
+			conn.setStatus(DbConnStatusClosing)
+			conn.cancel()
+			conn.setStatus(DbConnStatusClosed)
+		}
+	}()
+
+	memDbs.mu.Lock()
+	db, ok := memDbs.dbs[conn.params.Name]
+	memDbs.mu.Unlock()
+	if !ok {
+		return pe.Wrapf(ErrMemDbNotFound, "name=%s", conn.params.Name)
+	}
+	conn.db = db
+
+	go func() {
+		<-conn.ctx.Done()
+		conn.Close()
+	}()
+
+	if !conn.swapStatus(DbConnStatusOpening, DbConnStatusRunning) {
+		return pe.Errorf("cannot open mem db conn: current status = %d", conn.GetStatus())
+	}
+	return nil
+}
+
+func (conn *MemDbConn) Close() error {
+	if !conn.swapStatus(DbConnStatusRunning, DbConnStatusClosing) {
+		if !conn.swapStatus(DbConnStatusError, DbConnStatusClosing) {
+			return pe.Errorf("cannot close mem db conn: current status = %d", conn.GetStatus())
+		}
+	}
+
+	conn.cancel()
+	conn.InvalidateCache()
+	conn.setStatus(DbConnStatusClosed)
+	return nil
+}
+
+func (conn *MemDbConn) GetDatabaseMeta() *DatabaseMeta {
+	if conn.db == nil {
+		return nil
+	}
+	conn.db.mu.RLock()
+	defer conn.db.mu.RUnlock()
+	return conn.db.meta
+}
+
+func (conn *MemDbConn) UpdateSchema(newSchema *DatabaseSchema) error {
+	if err := conn.checkWritable("update schema"); err != nil {
+		return err
+	}
+	conn.db.mu.Lock()
+	defer conn.db.mu.Unlock()
+	if newSchema.Version <= conn.db.meta.databaseSchema.Version {
+		return pe.Errorf("new schema version must be greater than old schema version")
+	}
+	if err := conn.reindexTtl(ttlChanged(conn.db.meta.databaseSchema, newSchema), newSchema); err != nil {
+		return pe.Wrapf(err, "failed to rebuild ttl index")
+	}
+	meta := *conn.db.meta
+	meta.databaseSchema = newSchema
+	conn.db.meta = &meta
+	return nil
+}
+
+func (conn *MemDbConn) UpdatePermissionJs(newPermissionJs string) error {
+	if err := conn.checkWritable("update permission"); err != nil {
+		return err
+	}
+	conn.db.mu.Lock()
+	defer conn.db.mu.Unlock()
+	meta := *conn.db.meta
+	meta.permissionJs = newPermissionJs
+	conn.db.meta = &meta
+	return nil
+}
+
+func (conn *MemDbConn) LoadDoc(collectionName, docID string) (*loro.LoroDoc, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return nil, pe.Errorf("cannot load doc: current status = %d", status)
+	}
+
+	keyBytes, err := key_utils.CalcDocKey(collectionName, docID)
+	if err != nil {
+		return nil, err
+	}
+	key := string(keyBytes)
+
+	conn.cacheMu.Lock()
+	defer conn.cacheMu.Unlock()
+	if doc, ok := conn.cache[key]; ok {
+		return doc, nil
+	}
+
+	conn.db.mu.RLock()
+	snapshot, ok := conn.db.docs[key]
+	conn.db.mu.RUnlock()
+	if !ok {
+		return nil, pe.Errorf("failed to load doc %s from collection %s: not found", docID, collectionName)
+	}
+	doc, err := docFromSnapshot(snapshot)
+	if err != nil {
+		return nil, pe.Wrapf(err, "failed to load doc %s from collection %s", docID, collectionName)
+	}
+	conn.cache[key] = doc
+	return doc, nil
+}
+
+func (conn *MemDbConn) LoadCollection(collectionName string) (map[string]*loro.LoroDoc, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return nil, pe.Errorf("cannot load collection: current status = %d", status)
+	}
+
+	lowerbound, err := key_utils.CalcCollectionLowerBound(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	upperbound, err := key_utils.CalcCollectionUpperBound(collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.cacheMu.Lock()
+	defer conn.cacheMu.Unlock()
+	conn.db.mu.RLock()
+	defer conn.db.mu.RUnlock()
+
+	result := make(map[string]*loro.LoroDoc)
+	for key, snapshot := range conn.db.docs {
+		keyBytes := []byte(key)
+		if bytes.Compare(keyBytes, lowerbound) < 0 || bytes.Compare(keyBytes, upperbound) >= 0 {
+			continue
+		}
+		docId, err := key_utils.GetDocIdFromKey(keyBytes)
+		if err != nil {
+			return nil, err
+		}
+		doc, ok := conn.cache[key]
+		if !ok {
+			doc, err = docFromSnapshot(snapshot)
+			if err != nil {
+				return nil, pe.Wrapf(err, "failed to load doc %s from collection %s", docId, collectionName)
+			}
+			conn.cache[key] = doc
+		}
+		result[docId] = doc
+	}
+	return result, nil
+}
+
+func (conn *MemDbConn) InvalidateCache() {
+	conn.cacheMu.Lock()
+	defer conn.cacheMu.Unlock()
+	conn.cache = make(map[string]*loro.LoroDoc)
+}
+
+// commitInner validates the transaction and computes the new snapshots without
+// touching the database, so a failed transaction leaves no trace
+func (conn *MemDbConn) commitInner(tr *Transaction, history *historyRecorder, ttlIndex *ttlIndexUpdate) (map[string][]byte, error) {
+	// doc key -> new snapshot, nil if the doc is not changed by the transaction yet
+	written := make(map[string][]byte)
+	current := func(key string) ([]byte, bool) {
+		if snapshot, ok := written[key]; ok {
+			return snapshot, true
+		}
+		snapshot, ok := conn.db.docs[key]
+		return snapshot, ok
+	}
+
+	for _, op := range tr.Operations {
+		switch op := op.(type) {
+		case *InsertOp:
+			keyBytes, err := key_utils.CalcDocKey(op.Collection, op.DocID)
+			if err != nil {
+				return nil, err
+			}
+			key := string(keyBytes)
+			if _, ok := current(key); ok {
+				return nil, pe.Errorf("doc already exists: %s", key)
+			}
+			doc, err := docFromSnapshot(op.Snapshot)
+			if err != nil {
+				return nil, pe.Wrapf(err, "doc %s", key)
+			}
+			written[key] = op.Snapshot
+			if err := ttlIndex.change(op.Collection, op.DocID, nil, doc); err != nil {
+				return nil, err
+			}
+			history.record(op.Collection, op.DocID, doc)
+		case *UpdateOp:
+			keyBytes, err := key_utils.CalcDocKey(op.Collection, op.DocID)
+			if err != nil {
+				return nil, err
+			}
+			key := string(keyBytes)
+			snapshot, ok := current(key)
+			if !ok {
+				return nil, pe.Errorf("doc does not exist: %s", key)
+			}
+			doc, err := docFromSnapshot(snapshot)
+			if err != nil {
+				return nil, pe.Wrapf(err, "doc %s", key)
+			}
+			oldDoc := doc.Fork()
+			if err := importUpdate(doc, op.Update); err != nil {
+				return nil, pe.Wrapf(err, "doc %s", key)
+			}
+			written[key] = doc.ExportSnapshot().Bytes()
+			if err := ttlIndex.change(op.Collection, op.DocID, oldDoc, doc); err != nil {
+				return nil, err
+			}
+			history.record(op.Collection, op.DocID, doc)
+		case *DeleteOp:
+			keyBytes, err := key_utils.CalcDocKey(op.Collection, op.DocID)
+			if err != nil {
+				return nil, err
+			}
+			key := string(keyBytes)
+			snapshot, ok := current(key)
+			if !ok {
+				return nil, pe.Errorf("doc does not exist: %s", key)
+			}
+			doc, err := docFromSnapshot(snapshot)
+			if err != nil {
+				return nil, pe.Wrapf(err, "doc %s", key)
+			}
+			oldDoc := doc.Fork()
+			doc_visitor.SetDeleted(doc, true)
+			written[key] = doc.ExportSnapshot().Bytes()
+			if err := ttlIndex.change(op.Collection, op.DocID, oldDoc, doc); err != nil {
+				return nil, err
+			}
+			history.record(op.Collection, op.DocID, doc)
+		}
+	}
+	return written, nil
+}
+
+func (conn *MemDbConn) Commit(tr *Transaction) error {
+	if err := conn.checkWritable("commit"); err != nil {
+		return err
+	}
+
+	conn.cacheMu.Lock()
+	conn.db.mu.Lock()
+	history := newHistoryRecorder(tr)
+	ttlIndex := newTtlIndexUpdate(conn.db.meta.databaseSchema)
+	written, err := conn.commitInner(tr, history, ttlIndex)
+	if err == nil {
+		err = conn.writeHistory(history)
+	}
+	if err == nil {
+		err = conn.writeTombstones(tr, history.now)
+	}
+	if err == nil {
+		conn.writeTtlIndex(ttlIndex)
+	}
+	if err == nil {
+		for key, snapshot := range written {
+			conn.db.docs[key] = snapshot
+			// keep the cached docs in sync with the database
+			if doc, ok := conn.cache[key]; ok {
+				if _, err := doc.Import(snapshot); err != nil {
+					// reloaded from the database on the next load
+					delete(conn.cache, key)
+				}
+			}
+		}
+		if conn.journal != nil {
+			conn.db.journalSeq++
+			conn.db.journal = append(conn.db.journal, &JournalEntry{Seq: conn.db.journalSeq, Transaction: tr})
+		}
+	}
+	seq := conn.db.journalSeq
+	conn.db.mu.Unlock()
+	// the journal is called before the next commit starts
+	if conn.journal != nil {
+		if err == nil {
+			conn.journal.Committed(tr, seq)
+		} else {
+			conn.journal.Rollbacked(tr, err)
+		}
+	}
+	conn.cacheMu.Unlock()
+
+	if err != nil {
+		conn.rollbackedEb.Publish(&TransactionRollbackedEvent{
+			Committer:   tr.Committer,
+			Reason:      err,
+			Transaction: tr,
+		})
+		return err
+	}
+	conn.committedEb.Publish(&TransactionCommittedEvent{
+		Committer:   tr.Committer,
+		Transaction: tr,
+	})
+	return nil
+}
+
+// writeHistory appends the versions recorded by r to the history, must hold the db lock
+func (conn *MemDbConn) writeHistory(r *historyRecorder) error {
+	docs, versions, err := r.versions(func(collection, docId string) (uint64, error) {
+		keyBytes, err := key_utils.CalcDocKey(collection, docId)
+		if err != nil {
+			return 0, err
+		}
+		history := conn.db.history[string(keyBytes)]
+		if len(history) == 0 {
+			return 0, nil
+		}
+		return history[len(history)-1].Seq, nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, doc := range docs {
+		keyBytes, err := key_utils.CalcDocKey(doc[0], doc[1])
+		if err != nil {
+			return err
+		}
+		key := string(keyBytes)
+		conn.db.history[key] = append(conn.db.history[key], versions[i])
+	}
+	return nil
+}
+
+func (conn *MemDbConn) IsReadOnly() bool {
+	return conn.params.ReadOnly
+}
+
+func (conn *MemDbConn) checkWritable(action string) error {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return pe.Errorf("cannot %s: current status = %d", action, status)
+	}
+	if conn.params.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+func (conn *MemDbConn) GetCommittedEb() *util.EventBus[*TransactionCommittedEvent] {
+	return conn.committedEb
+}
+
+func (conn *MemDbConn) GetRollbackedEb() *util.EventBus[*TransactionRollbackedEvent] {
+	return conn.rollbackedEb
+}
+
+func (conn *MemDbConn) GetStatus() DbConnStatus {
+	return DbConnStatus(conn.status.Load())
+}
+
+func (conn *MemDbConn) SubscribeStatusChange() <-chan DbConnStatus {
+	return conn.statusEb.Subscribe()
+}
+
+func (conn *MemDbConn) UnsubscribeStatusChange(ch <-chan DbConnStatus) {
+	conn.statusEb.Unsubscribe(ch)
+}
+
+func (conn *MemDbConn) WaitForStatus(targetStatus DbConnStatus) <-chan struct{} {
+	statusCh := conn.SubscribeStatusChange()
+	cleanup := func() {
+		conn.UnsubscribeStatusChange(statusCh)
+	}
+	return util.WaitForStatus(conn.GetStatus, targetStatus, statusCh, cleanup, 0)
+}
+
+func (conn *MemDbConn) setStatus(status DbConnStatus) {
+	conn.status.Store(int32(status))
+	conn.statusEb.Publish(status)
+}
+
+func (conn *MemDbConn) swapStatus(from, to DbConnStatus) bool {
+	if from == to {
+		return false
+	}
+	if !conn.status.CompareAndSwap(int32(from), int32(to)) {
+		return false
+	}
+	conn.statusEb.Publish(to)
+	return true
+}
@@ -2,6 +2,8 @@ package db_conn
 
 import (
 	"context"
+	"errors"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -32,11 +34,99 @@ type rollbackInfo struct {
 	toUpdate [][2]any // Document info to update, format: [key, doc object]
 }
 
+// ErrReadOnly is returned when writing through a read-only connection
+var ErrReadOnly = errors.New("database is read-only")
+
 type PebbleDbConnParams struct {
 	Path string
+
+	// ReadOnly opens the database in read-only mode, Commit and meta updates
+	// return ErrReadOnly
+	ReadOnly bool
+	// DisableWal disables the write-ahead log. Commits that are not yet flushed
+	// to sstables are lost on crash
+	DisableWal bool
+	// NoSync commits without waiting for the WAL to be synced to disk
+	NoSync bool
+	// CacheSize is the size of pebble's block cache in bytes, 0 means pebble's default
+	CacheSize int64
+	// MemTableSize is the size of a pebble memtable in bytes, 0 means pebble's default
+	MemTableSize uint64
+	// DocsCacheSize is the number of loaded docs kept in the LRU cache,
+	// defaults to DefaultDocsCacheSize
+	DocsCacheSize int
+
+	// CreateIfMissing creates the database on Open if there is no database at Path,
+	// using the schema js at SchemaPath and the permission js at PermissionPath
+	CreateIfMissing bool
+	SchemaPath      string
+	PermissionPath  string
+	// EncryptionKeyFile or EncryptionKeyEnv, at most one of them, enables the
+	// encryption of doc snapshots, history and meta with the keyring read from
+	// the file or the environment variable, see ParseKeyring. Open fails if the
+	// keyring can't be loaded or the database is encrypted with a key it
+	// doesn't hold.
+	EncryptionKeyFile string
+	EncryptionKeyEnv  string
+	// ReencryptInterval is the time between two runs of the re-encryption of
+	// stale values, defaults to DefaultReencryptInterval
+	ReencryptInterval time.Duration
+}
+
+func (params *PebbleDbConnParams) EnsureDefaults() {
+	if params.DocsCacheSize <= 0 {
+		params.DocsCacheSize = DefaultDocsCacheSize
+	}
+	if params.ReencryptInterval <= 0 {
+		params.ReencryptInterval = DefaultReencryptInterval
+	}
 }
 
-func (params *PebbleDbConnParams) EnsureDefaults() {}
+// Validate checks that the params are consistent
+func (params *PebbleDbConnParams) Validate() error {
+	if params.Path == "" {
+		return pe.Errorf("db path is empty")
+	}
+	if params.CacheSize < 0 {
+		return pe.Errorf("cache size must not be negative: %d", params.CacheSize)
+	}
+	if params.EncryptionKeyFile != "" && params.EncryptionKeyEnv != "" {
+		return pe.Errorf("encryption key file and encryption key env are exclusive")
+	}
+	if params.CreateIfMissing {
+		if params.ReadOnly {
+			return pe.Errorf("cannot create a missing database in read-only mode")
+		}
+		if params.SchemaPath == "" || params.PermissionPath == "" {
+			return pe.Errorf("schema path and permission path are required to create a missing database")
+		}
+	}
+	return nil
+}
+
+// pebbleOptions returns the options to open the pebble db with. The returned
+// cache, if any, must be unreferenced after opening.
+func (params *PebbleDbConnParams) pebbleOptions() *pebble.Options {
+	pebbleOpts := &pebble.Options{
+		ReadOnly:         params.ReadOnly,
+		DisableWAL:       params.DisableWal,
+		MemTableSize:     params.MemTableSize,
+		ErrorIfNotExists: true,
+	}
+	if params.CacheSize > 0 {
+		pebbleOpts.Cache = pebble.NewCache(params.CacheSize)
+	}
+	pebbleOpts.EnsureDefaults()
+	return pebbleOpts
+}
+
+// writeOptions returns the write options of commits
+func (params *PebbleDbConnParams) writeOptions() *pebble.WriteOptions {
+	if params.NoSync || params.DisableWal {
+		return pebble.NoSync
+	}
+	return pebble.Sync
+}
 
 type PebbleDbConn struct {
 	params *PebbleDbConnParams
@@ -46,6 +136,10 @@ type PebbleDbConn struct {
 	// Cache
 	cache Caches
 
+	// Encryption, keyring is nil if it is disabled
+	keyring     *Keyring
+	reencryptor *periodicJob
+
 	// Status Related
 	status   atomic.Int32
 	statusEb *util.EventBus[DbConnStatus]
@@ -57,6 +151,10 @@ type PebbleDbConn struct {
 	// Locks
 	mu Locks
 
+	// Commit journal, nil if none is set. Guarded by the cache lock
+	journal    CommitJournal
+	journalSeq uint64
+
 	// Transaction Related Event Bus
 	committedEb  *util.EventBus[*TransactionCommittedEvent]
 	rollbackedEb *util.EventBus[*TransactionRollbackedEvent]
@@ -73,13 +171,9 @@ func CreateNewPebbleDb(path string, schema *DatabaseSchema, permissionJs string)
 		return err
 	}
 
-	dbMeta := &DatabaseMeta{
-		databaseSchema: schema,
-		permissionJs:   permissionJs,
-		createdAt:      uint64(time.Now().Unix()),
-	}
+	dbMeta := NewDatabaseMeta(schema, permissionJs)
 
-	err = writeDatabaseMeta(pebbleDb, dbMeta)
+	err = writeDatabaseMeta(pebbleDb, dbMeta, nil)
 	if err != nil {
 		return err
 	}
@@ -93,13 +187,17 @@ func CreateNewPebbleDb(path string, schema *DatabaseSchema, permissionJs string)
 }
 
 func NewPebbleDbConnWithContext(ctx context.Context, params *PebbleDbConnParams) (*PebbleDbConn, error) {
+	params.EnsureDefaults()
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
 	subCtx, cancel := context.WithCancel(ctx)
 
 	conn := &PebbleDbConn{
 		params:   params,
 		pebbleDb: nil, // init later
 		cache: Caches{
-			docs: NewLruCache[loro.LoroDoc](DefaultDocsCacheSize),
+			docs: NewLruCache[loro.LoroDoc](params.DocsCacheSize),
 			meta: nil, // init later
 		},
 		status:   atomic.Int32{},
@@ -112,10 +210,15 @@ func NewPebbleDbConnWithContext(ctx context.Context, params *PebbleDbConnParams)
 		committedEb:  util.NewEventBus[*TransactionCommittedEvent](),
 		rollbackedEb: util.NewEventBus[*TransactionRollbackedEvent](),
 	}
+	conn.reencryptor = newReencryptor(conn)
 
 	return conn, nil
 }
 
+func (conn *PebbleDbConn) IsReadOnly() bool {
+	return conn.params.ReadOnly
+}
+
 func (conn *PebbleDbConn) Open() (err error) {
 	if !conn.swapStatus(DbConnStatusNotReady, DbConnStatusOpening) {
 		return pe.Errorf("cannot open pebble db conn: current status = %d", DbConnStatusNotReady)
@@ -132,21 +235,39 @@ func (conn *PebbleDbConn) Open() (err error) {
 		}
 	}()
 
+	if conn.params.CreateIfMissing {
+		if err := conn.createIfMissing(); err != nil {
+			return err
+		}
+	}
+
+	keyring, err := conn.params.loadKeyring()
+	if err != nil {
+		return pe.Wrap(err, "failed to load encryption keyring")
+	}
+	conn.keyring = keyring
+
 	// open pebble db
-	pebbleOpts := pebble.Options{}
-	pebbleOpts.EnsureDefaults()
-	pebbleOpts.ErrorIfNotExists = true
-	pebbleDb, err := pebble.Open(conn.params.Path, &pebbleOpts)
+	pebbleOpts := conn.params.pebbleOptions()
+	pebbleDb, err := pebble.Open(conn.params.Path, pebbleOpts)
+	if pebbleOpts.Cache != nil {
+		// pebble holds its own reference to the cache
+		pebbleOpts.Cache.Unref()
+	}
 	if err != nil {
 		return pe.Wrap(err, "failed to open pebble db")
 	}
 	conn.pebbleDb = pebbleDb
 
 	// load database meta
-	meta, err := loadDatabaseMeta(pebbleDb)
+	meta, err := loadDatabaseMeta(pebbleDb, keyring)
 	if err != nil {
 		return pe.Wrap(err, "failed to load database meta")
 	}
+	if meta.keyLayout != key_utils.CURRENT_KEY_LAYOUT {
+		return pe.Wrapf(ErrKeyLayoutOutdated, "database uses key layout %d, expected %d, migrate it with MigratePebbleDbKeyLayout",
+			meta.keyLayout, key_utils.CURRENT_KEY_LAYOUT)
+	}
 	conn.cache.meta = meta
 
 	// start a goroutine to listen to the context
@@ -161,9 +282,41 @@ func (conn *PebbleDbConn) Open() (err error) {
 		return pe.Errorf("cannot open pebble db conn: current status = %d", DbConnStatusNotReady)
 	}
 
+	if keyring != nil && !conn.params.ReadOnly {
+		// re-encrypt the values left stale by a key rotation right away
+		conn.reencryptor.start(conn.ctx, true)
+	}
+
 	return nil
 }
 
+// createIfMissing creates the database at the path of the connection from the
+// schema and permission files if the path does not exist or is empty
+func (conn *PebbleDbConn) createIfMissing() error {
+	entries, err := os.ReadDir(conn.params.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return pe.WithStack(err)
+	}
+	if len(entries) > 0 {
+		return nil
+	}
+
+	schemaJs, err := os.ReadFile(conn.params.SchemaPath)
+	if err != nil {
+		return pe.Wrap(err, "failed to read schema")
+	}
+	schema, err := NewDatabaseSchemaFromJs(string(schemaJs))
+	if err != nil {
+		return pe.Wrap(err, "failed to load schema")
+	}
+	permissionJs, err := os.ReadFile(conn.params.PermissionPath)
+	if err != nil {
+		return pe.Wrap(err, "failed to read permission")
+	}
+	log.Infof("PebbleDbConn: creating database at %s", conn.params.Path)
+	return CreateNewPebbleDb(conn.params.Path, schema, string(permissionJs))
+}
+
 func (conn *PebbleDbConn) Close() error {
 	if !conn.swapStatus(DbConnStatusRunning, DbConnStatusClosing) {
 		if !conn.swapStatus(DbConnStatusError, DbConnStatusClosing) {
@@ -192,13 +345,23 @@ func (conn *PebbleDbConn) UpdateSchema(newSchema *DatabaseSchema) error {
 	if conn.GetStatus() != DbConnStatusRunning {
 		return pe.Errorf("cannot update schema: current status = %d", conn.GetStatus())
 	}
+	if conn.params.ReadOnly {
+		return ErrReadOnly
+	}
 	oldSchema := conn.cache.meta.databaseSchema
 	if newSchema.Version <= oldSchema.Version {
 		return pe.Errorf("new schema version must be greater than old schema version")
 	}
+	// the TTL index is rebuilt with the commits stopped, so no commit indexes
+	// a doc with the old schema after the rebuild
+	conn.mu.docsCache.Lock()
+	defer conn.mu.docsCache.Unlock()
+	if err := conn.reindexTtl(ttlChanged(oldSchema, newSchema), newSchema); err != nil {
+		return pe.Wrapf(err, "failed to rebuild ttl index")
+	}
 	meta := conn.cache.meta
 	meta.databaseSchema = newSchema
-	return writeDatabaseMeta(conn.pebbleDb, meta)
+	return writeDatabaseMeta(conn.pebbleDb, meta, conn.keyring)
 }
 
 func (conn *PebbleDbConn) UpdatePermissionJs(newPermissionJs string) error {
@@ -206,9 +369,12 @@ func (conn *PebbleDbConn) UpdatePermissionJs(newPermissionJs string) error {
 	if conn.GetStatus() != DbConnStatusRunning {
 		return pe.Errorf("cannot update permission: current status = %d", conn.GetStatus())
 	}
+	if conn.params.ReadOnly {
+		return ErrReadOnly
+	}
 	meta := conn.cache.meta
 	meta.permissionJs = newPermissionJs
-	return writeDatabaseMeta(conn.pebbleDb, meta)
+	return writeDatabaseMeta(conn.pebbleDb, meta, conn.keyring)
 }
 
 func (conn *PebbleDbConn) LoadDoc(collectionName, docID string) (*loro.LoroDoc, error) {
@@ -241,12 +407,18 @@ func (conn *PebbleDbConn) LoadDoc(collectionName, docID string) (*loro.LoroDoc,
 	}
 
 	// Load from pebble db
-	snapshot, _, err := conn.pebbleDb.Get(keyBytes)
+	stored, _, err := conn.pebbleDb.Get(keyBytes)
 	if err != nil {
 		return nil, pe.Errorf("failed to load doc %s from collection %s: %w", docID, collectionName, err)
 	}
-	doc := loro.NewLoroDoc()
-	doc.Import(snapshot)
+	snapshot, err := conn.openDoc(keyBytes, stored)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := docFromSnapshot(snapshot)
+	if err != nil {
+		return nil, pe.Wrapf(err, "failed to load doc %s from collection %s", docID, collectionName)
+	}
 
 	conn.cache.docs.Set(string(keyBytes), doc)
 	return doc, nil
@@ -282,13 +454,18 @@ func (conn *PebbleDbConn) LoadCollection(collectionName string) (map[string]*lor
 	result := make(map[string]*loro.LoroDoc)
 	for iter.First(); iter.Valid(); iter.Next() {
 		key := iter.Key()
-		snapshot := iter.Value()
-		doc := loro.NewLoroDoc()
-		doc.Import(snapshot)
+		snapshot, err := conn.openDoc(key, iter.Value())
+		if err != nil {
+			return nil, err
+		}
 		docId, err := key_utils.GetDocIdFromKey(key)
 		if err != nil {
 			return nil, err
 		}
+		doc, err := docFromSnapshot(snapshot)
+		if err != nil {
+			return nil, pe.Wrapf(err, "failed to load doc %s from collection %s", docId, collectionName)
+		}
 		result[docId] = doc
 
 		conn.cache.docs.Set(string(key), doc)
@@ -302,6 +479,9 @@ func (conn *PebbleDbConn) InvalidateCache() {
 
 func (conn *PebbleDbConn) commitInner(tr *Transaction, rb *rollbackInfo) error {
 	batch := conn.pebbleDb.NewBatch()
+	defer batch.Close()
+	history := newHistoryRecorder(tr)
+	ttlIndex := newTtlIndexUpdate(conn.cache.meta.databaseSchema)
 
 	for _, op := range tr.Operations {
 		switch op := op.(type) {
@@ -322,15 +502,30 @@ func (conn *PebbleDbConn) commitInner(tr *Transaction, rb *rollbackInfo) error {
 				}
 
 				// Update cache
-				doc := loro.NewLoroDoc()
-				doc.Import(op.Snapshot)
+				doc, err := docFromSnapshot(op.Snapshot)
+				if err != nil {
+					return pe.Wrapf(err, "doc %s", key)
+				}
 				conn.cache.docs.Set(key, doc)
 
 				// Record rollback info
 				rb.toDelete = append(rb.toDelete, key)
 
-				// Add to batch
-				batch.Set(keyBytes, op.Snapshot, pebble.Sync)
+				// Add to batch, the id of a purged doc can be reused
+				sealed, err := conn.keyring.sealValue(keyBytes, op.Snapshot)
+				if err != nil {
+					return err
+				}
+				batch.Set(keyBytes, sealed, nil)
+				purgedKey, err := key_utils.CalcPurgedKey(collection, docID)
+				if err != nil {
+					return err
+				}
+				batch.Delete(purgedKey, nil)
+				if err := ttlIndex.change(collection, docID, nil, doc); err != nil {
+					return err
+				}
+				history.record(collection, docID, doc)
 			}
 		case *UpdateOp:
 			{
@@ -348,20 +543,30 @@ func (conn *PebbleDbConn) commitInner(tr *Transaction, rb *rollbackInfo) error {
 					return pe.Errorf("doc does not exist: %s", key)
 				}
 
-				// Update cache
+				// Record rollback info before the cached doc changes
 				forkedOldDoc := doc.Fork()
-				doc.Import(op.Update)
-				snapshot := doc.ExportSnapshot()
-
-				// Record rollback info
 				rbAction := [2]any{
 					key,
 					forkedOldDoc,
 				}
 				rb.toUpdate = append(rb.toUpdate, rbAction)
 
+				// Update cache
+				if err := importUpdate(doc, op.Update); err != nil {
+					return pe.Wrapf(err, "doc %s", key)
+				}
+				snapshot := doc.ExportSnapshot()
+
 				// Add to batch
-				batch.Set(keyBytes, snapshot.Bytes(), pebble.Sync)
+				sealed, err := conn.keyring.sealValue(keyBytes, snapshot.Bytes())
+				if err != nil {
+					return err
+				}
+				batch.Set(keyBytes, sealed, nil)
+				if err := ttlIndex.change(collection, docID, forkedOldDoc, doc); err != nil {
+					return err
+				}
+				history.record(collection, docID, doc)
 			}
 		case *DeleteOp:
 			{
@@ -391,13 +596,42 @@ func (conn *PebbleDbConn) commitInner(tr *Transaction, rb *rollbackInfo) error {
 				}
 				rb.toUpdate = append(rb.toUpdate, rbAction)
 
-				// Add to batch
-				batch.Set(keyBytes, snapshot.Bytes(), pebble.Sync)
+				// Add to batch, with the deletion time for the tombstone GC
+				sealed, err := conn.keyring.sealValue(keyBytes, snapshot.Bytes())
+				if err != nil {
+					return err
+				}
+				batch.Set(keyBytes, sealed, nil)
+				tombstoneKey, err := key_utils.CalcTombstoneKey(collection, docID)
+				if err != nil {
+					return err
+				}
+				batch.Set(tombstoneKey, encodeMillis(history.now), nil)
+				if err := ttlIndex.change(collection, docID, forkedOldDoc, doc); err != nil {
+					return err
+				}
+				history.record(collection, docID, doc)
 			}
 		}
 	}
 
-	return batch.Commit(pebble.Sync)
+	if err := conn.writeHistory(batch, history); err != nil {
+		return err
+	}
+	if err := writeTtlIndex(batch, ttlIndex); err != nil {
+		return err
+	}
+	seq, err := conn.writeJournal(batch, tr)
+	if err != nil {
+		return err
+	}
+	if err := batch.Commit(conn.params.writeOptions()); err != nil {
+		return err
+	}
+	if conn.journal != nil {
+		conn.journalSeq = seq
+	}
+	return nil
 }
 
 func (conn *PebbleDbConn) Commit(tr *Transaction) error {
@@ -405,6 +639,9 @@ func (conn *PebbleDbConn) Commit(tr *Transaction) error {
 	if status != DbConnStatusRunning {
 		return pe.Errorf("cannot commit: current status = %d", status)
 	}
+	if conn.params.ReadOnly {
+		return ErrReadOnly
+	}
 
 	conn.mu.docsCache.Lock()
 	defer conn.mu.docsCache.Unlock()
@@ -413,7 +650,10 @@ func (conn *PebbleDbConn) Commit(tr *Transaction) error {
 	err := conn.commitInner(tr, rb)
 
 	if err == nil {
-		// Commit succeeded, publish event
+		// Commit succeeded, journal and publish event
+		if conn.journal != nil {
+			conn.journal.Committed(tr, conn.journalSeq)
+		}
 		event := &TransactionCommittedEvent{
 			Committer:   tr.Committer,
 			Transaction: tr,
@@ -430,6 +670,9 @@ func (conn *PebbleDbConn) Commit(tr *Transaction) error {
 			doc := action[1].(*loro.LoroDoc)
 			conn.cache.docs.Set(key, doc)
 		}
+		if conn.journal != nil {
+			conn.journal.Rollbacked(tr, err)
+		}
 		event := &TransactionRollbackedEvent{
 			Committer:   tr.Committer,
 			Reason:      err,
@@ -484,7 +727,9 @@ func (conn *PebbleDbConn) swapStatus(from, to DbConnStatus) bool {
 	return true
 }
 
-func loadDatabaseMeta(pebbleDB *pebble.DB) (*DatabaseMeta, error) {
+// loadDatabaseMeta loads the meta of the database, keyring is nil if
+// encryption is disabled
+func loadDatabaseMeta(pebbleDB *pebble.DB, keyring *Keyring) (*DatabaseMeta, error) {
 	if pebbleDB == nil {
 		return nil, pe.Errorf("pebble db is nil")
 	}
@@ -498,10 +743,16 @@ func loadDatabaseMeta(pebbleDB *pebble.DB) (*DatabaseMeta, error) {
 		return nil, err
 	}
 
+	storageMetaBytes, err = keyring.openValue([]byte(key_utils.STORAGE_META_KEY), storageMetaBytes)
+	if err != nil {
+		return nil, err
+	}
 	return NewDatabaseMetaFromBytes(storageMetaBytes)
 }
 
-func writeDatabaseMeta(pebbleDB *pebble.DB, meta *DatabaseMeta) error {
+// writeDatabaseMeta writes the meta of the database, sealed with the active key
+// of keyring if it is not nil
+func writeDatabaseMeta(pebbleDB *pebble.DB, meta *DatabaseMeta, keyring *Keyring) error {
 	if pebbleDB == nil {
 		return pe.Errorf("pebble db is nil")
 	}
@@ -510,5 +761,9 @@ func writeDatabaseMeta(pebbleDB *pebble.DB, meta *DatabaseMeta) error {
 	if err != nil {
 		return err
 	}
+	metaBytes, err = keyring.sealValue([]byte(key_utils.STORAGE_META_KEY), metaBytes)
+	if err != nil {
+		return err
+	}
 	return pebbleDB.Set([]byte(key_utils.STORAGE_META_KEY), metaBytes, pebble.Sync)
 }
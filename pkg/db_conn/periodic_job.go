@@ -0,0 +1,107 @@
+package db_conn
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/log"
+)
+
+// JobStats are the statistics of the runs of a periodic job, such as the
+// tombstone GC or the TTL sweeper
+type JobStats struct {
+	// Runs is the number of finished runs, including failed ones
+	Runs int64
+	// Processed is the total number of items (docs, values) the runs handled
+	Processed int64
+	// Failures is the total number of items that failed, a run that fails as a
+	// whole counts as one
+	Failures      int64
+	LastRunAt     time.Time
+	LastDuration  time.Duration
+	LastProcessed int
+	// LastErr is the last error of the last run, nil if it succeeded
+	LastErr error
+}
+
+// jobFunc is a run of a periodic job started at now. It returns the number of
+// processed items, the number of failed items and the last error.
+type jobFunc func(now time.Time) (processed int, failures int, err error)
+
+// periodicJob runs a jobFunc on a ticker and keeps the statistics of the runs.
+// It is embedded by the background workers of the connections.
+type periodicJob struct {
+	// name is used in logs
+	name string
+	// done is the log message of a run that processed some items, with a %d
+	// for their number
+	done     string
+	interval time.Duration
+	run      jobFunc
+
+	mu    sync.Mutex
+	stats JobStats
+}
+
+func newPeriodicJob(name, done string, interval time.Duration, run jobFunc) *periodicJob {
+	return &periodicJob{name: name, done: done, interval: interval, run: run}
+}
+
+// Start runs the job every interval until ctx is done
+func (j *periodicJob) Start(ctx context.Context) {
+	j.start(ctx, false)
+}
+
+// start runs the job every interval until ctx is done, runNow also runs it
+// once right away
+func (j *periodicJob) start(ctx context.Context, runNow bool) {
+	go func() {
+		if runNow {
+			j.Run()
+		}
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				j.Run()
+			}
+		}
+	}()
+}
+
+// Run runs the job once and returns the number of processed items
+func (j *periodicJob) Run() (int, error) {
+	start := time.Now()
+	processed, failures, err := j.run(start)
+	if err != nil && failures == 0 {
+		failures = 1
+	}
+
+	j.mu.Lock()
+	j.stats.Runs++
+	j.stats.Processed += int64(processed)
+	j.stats.Failures += int64(failures)
+	j.stats.LastRunAt = start
+	j.stats.LastDuration = time.Since(start)
+	j.stats.LastProcessed = processed
+	j.stats.LastErr = err
+	j.mu.Unlock()
+
+	if err != nil {
+		log.Errorf("%s.Run: processed %d, %d failed: %v", j.name, processed, failures, err)
+	} else if processed > 0 {
+		log.Infof("%s.Run: "+j.done, j.name, processed)
+	}
+	return processed, err
+}
+
+// Stats returns the statistics of the runs so far
+func (j *periodicJob) Stats() JobStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stats
+}
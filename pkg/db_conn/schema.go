@@ -123,6 +123,16 @@ type DocSchema struct {
 type CollectionSchema struct {
 	Name      string     `json:"name"`
 	DocSchema *DocSchema `json:"docSchema"`
+	// Ttl expires the docs of the collection, nil if docs never expire
+	Ttl *TtlSchema `json:"ttl,omitempty"`
+}
+
+// TtlSchema declares that a doc expires Seconds after the date in its Field,
+// expired docs are deleted by TtlSweeper. Field must be a top-level DateSchema
+// field, docs without a date in it never expire.
+type TtlSchema struct {
+	Field   string `json:"field"`
+	Seconds int64  `json:"seconds"`
 }
 
 type DatabaseSchema struct {
@@ -258,9 +268,51 @@ func parseCollectionSchema(data map[string]any) (*CollectionSchema, error) {
 		return nil, fmt.Errorf("%w: %v", ErrInvalidDatabaseSchema, err)
 	}
 
+	var ttl *TtlSchema
+	if ttlData, ok := data["ttl"]; ok && ttlData != nil {
+		ttl, err = parseTtlSchema(ttlData, docSchema)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &CollectionSchema{
 		Name:      name,
 		DocSchema: docSchema,
+		Ttl:       ttl,
+	}, nil
+}
+
+func parseTtlSchema(data any, docSchema *DocSchema) (*TtlSchema, error) {
+	ttlData, ok := data.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid ttl", ErrInvalidDatabaseSchema)
+	}
+	field, ok := ttlData["field"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: ttl field is required", ErrInvalidDatabaseSchema)
+	}
+	if _, ok := docSchema.Fields[field].(*DateSchema); !ok {
+		return nil, fmt.Errorf("%w: ttl field %s must be a date field", ErrInvalidDatabaseSchema, field)
+	}
+	var seconds int64
+	switch v := ttlData["seconds"].(type) {
+	case int64:
+		seconds = v
+	case float64:
+		seconds = int64(v)
+		if float64(seconds) != v {
+			return nil, fmt.Errorf("%w: ttl seconds must be an integer", ErrInvalidDatabaseSchema)
+		}
+	default:
+		return nil, fmt.Errorf("%w: ttl seconds is required", ErrInvalidDatabaseSchema)
+	}
+	if seconds <= 0 {
+		return nil, fmt.Errorf("%w: ttl seconds must be positive", ErrInvalidDatabaseSchema)
+	}
+	return &TtlSchema{
+		Field:   field,
+		Seconds: seconds,
 	}, nil
 }
 
@@ -535,11 +587,18 @@ func (d *DatabaseSchema) ToJSON() map[string]any {
 }
 
 func (c *CollectionSchema) ToJSON() map[string]any {
-	return map[string]any{
+	ret := map[string]any{
 		"type":      COLLECTION_SCHEMA,
 		"name":      c.Name,
 		"docSchema": c.DocSchema.ToJSON(),
 	}
+	if c.Ttl != nil {
+		ret["ttl"] = map[string]any{
+			"field":   c.Ttl.Field,
+			"seconds": c.Ttl.Seconds,
+		}
+	}
+	return ret
 }
 
 func (d *DocSchema) ToJSON() map[string]any {
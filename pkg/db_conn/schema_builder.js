@@ -15,6 +15,7 @@ var ErrInvalidRecordValueSchema = new Error("Invalid record value schema");
 var ErrInvalidTreeNodeSchema = new Error("Invalid tree node schema");
 var ErrInvalidDocFields = new Error("Invalid doc fields");
 var ErrInvalidCollectionParams = new Error("Invalid collection params");
+var ErrInvalidTtl = new Error("Invalid ttl");
 var ErrInvalidDatabaseParams = new Error("Invalid database params");
 
 var anySymbol = { type: "any" };
@@ -552,18 +553,32 @@ Schema.doc = function (fields) {
   return ret;
 };
 
+// params.ttl is optional, { field, seconds } expires a doc `seconds` after
+// the date in its `field`
 Schema.collection = function (params) {
   if (
     typeof params !== "object" ||
     !("name" in params) ||
     !("docSchema" in params) ||
-    Object.keys(params).length !== 2
+    Object.keys(params).length !== ("ttl" in params ? 3 : 2)
   ) {
     throw ErrInvalidCollectionParams;
   }
 
   var _name = params.name;
   var _docSchema = params.docSchema;
+  var _ttl = params.ttl;
+
+  if (
+    _ttl !== undefined &&
+    (typeof _ttl !== "object" ||
+      typeof _ttl.field !== "string" ||
+      typeof _ttl.seconds !== "number" ||
+      !Number.isInteger(_ttl.seconds) ||
+      _ttl.seconds <= 0)
+  ) {
+    throw ErrInvalidTtl;
+  }
 
   if (typeof _name !== "string") {
     throw ErrInvalidCollectionParams;
@@ -581,11 +596,15 @@ Schema.collection = function (params) {
     _symbol: collectionSymbol,
     name: _name,
     toJSON: function () {
-      return {
+      var json = {
         type: "collection",
         name: _name,
         docSchema: _docSchema.toJSON(),
       };
+      if (_ttl !== undefined) {
+        json.ttl = { field: _ttl.field, seconds: _ttl.seconds };
+      }
+      return json;
     },
   };
   return ret;
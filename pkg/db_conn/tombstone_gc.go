@@ -0,0 +1,293 @@
+package db_conn
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	pe "github.com/pkg/errors"
+)
+
+// Tombstones
+//
+// A DeleteOp only marks the doc as deleted, so clients that are offline when it
+// is committed still learn of the delete when they sync. The deletion time of
+// every deleted doc is indexed under key_utils.TOMBSTONE_KEY_PREFIX, and
+// PurgeTombstones removes the docs deleted before some time together with their
+// history. The ids of purged docs are kept under key_utils.PURGED_KEY_PREFIX so
+// a client that still holds a purged doc can be told to delete it.
+//
+// Docs deleted before the tombstone index existed are not indexed and are never
+// purged.
+
+// ErrDocPurged is returned for changes to a doc removed by PurgeTombstones
+var ErrDocPurged = errors.New("doc was deleted and purged")
+
+const (
+	// DefaultTombstoneRetention is how long a deleted doc is kept by default
+	DefaultTombstoneRetention = 30 * 24 * time.Hour
+	// DefaultTombstoneGcInterval is the default time between two GC runs
+	DefaultTombstoneGcInterval = time.Hour
+)
+
+type TombstoneGcOptions struct {
+	// Retention is how long a deleted doc is kept before it is purged. It should
+	// be longer than clients are expected to stay offline, a client that comes
+	// back later loses its pending changes to the doc.
+	Retention time.Duration
+	// Interval is the time between two GC runs
+	Interval time.Duration
+}
+
+func (opts *TombstoneGcOptions) EnsureDefaults() {
+	if opts.Retention <= 0 {
+		opts.Retention = DefaultTombstoneRetention
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultTombstoneGcInterval
+	}
+}
+
+// TombstoneGc purges the deleted docs of a connection periodically, the
+// statistics count the purged docs
+type TombstoneGc struct {
+	*periodicJob
+	conn DbConnection
+	opts TombstoneGcOptions
+}
+
+// NewTombstoneGc creates a GC for conn, opts can be nil to use the defaults
+func NewTombstoneGc(conn DbConnection, opts *TombstoneGcOptions) *TombstoneGc {
+	gc := &TombstoneGc{conn: conn}
+	if opts != nil {
+		gc.opts = *opts
+	}
+	gc.opts.EnsureDefaults()
+	gc.periodicJob = newPeriodicJob("TombstoneGc", "purged %d deleted docs", gc.opts.Interval, gc.purge)
+	return gc
+}
+
+// purge purges the docs deleted more than Retention before now
+func (gc *TombstoneGc) purge(now time.Time) (int, int, error) {
+	purged, err := gc.conn.PurgeTombstones(now.Add(-gc.opts.Retention))
+	return purged, 0, err
+}
+
+func encodeMillis(t time.Time) []byte {
+	var buf bytes.Buffer
+	util.WriteVarInt(&buf, t.UnixMilli())
+	return buf.Bytes()
+}
+
+func decodeMillis(b []byte) (int64, error) {
+	return util.ReadVarInt(bytes.NewBuffer(b))
+}
+
+// isDeletedSnapshot reports whether the doc of snapshot is marked as deleted
+func isDeletedSnapshot(snapshot []byte) (bool, error) {
+	doc, err := docFromSnapshot(snapshot)
+	if err != nil {
+		return false, err
+	}
+	return doc_visitor.IsDeleted(doc), nil
+}
+
+func (conn *PebbleDbConn) PurgeTombstones(deletedBefore time.Time) (int, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return 0, pe.Errorf("cannot purge tombstones: current status = %d", status)
+	}
+	if conn.params.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	// commits and purges are serialized by the cache lock
+	conn.mu.docsCache.Lock()
+	defer conn.mu.docsCache.Unlock()
+
+	iter, err := conn.pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(key_utils.TOMBSTONE_KEY_PREFIX),
+		UpperBound: []byte{key_utils.TOMBSTONE_KEY_PREFIX[0] + 1},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	batch := conn.pebbleDb.NewBatch()
+	defer batch.Close()
+	purgedAt := encodeMillis(time.Now())
+	purgedKeys := make([]string, 0)
+	for iter.First(); iter.Valid(); iter.Next() {
+		deletedAt, err := decodeMillis(iter.Value())
+		if err != nil {
+			return 0, pe.Wrapf(err, "invalid tombstone %q", iter.Key())
+		}
+		if deletedAt >= deletedBefore.UnixMilli() {
+			continue
+		}
+		collection, docId, err := key_utils.ParseTombstoneKey(iter.Key())
+		if err != nil {
+			return 0, err
+		}
+		if err := batch.Delete(iter.Key(), nil); err != nil {
+			return 0, err
+		}
+
+		docKey, err := key_utils.CalcDocKey(collection, docId)
+		if err != nil {
+			return 0, err
+		}
+		stored, closer, err := conn.pebbleDb.Get(docKey)
+		if errors.Is(err, pebble.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		snapshot, err := conn.openDoc(docKey, stored)
+		closer.Close()
+		if err != nil {
+			return 0, err
+		}
+		deleted, err := isDeletedSnapshot(snapshot)
+		if err != nil {
+			return 0, pe.Wrapf(err, "doc %s/%s", collection, docId)
+		}
+		if !deleted {
+			// the doc was undeleted by a later update, drop the stale tombstone only
+			continue
+		}
+
+		if err := batch.Delete(docKey, nil); err != nil {
+			return 0, err
+		}
+		lowerbound, err := key_utils.CalcDocHistoryLowerBound(collection, docId)
+		if err != nil {
+			return 0, err
+		}
+		upperbound, err := key_utils.CalcDocHistoryUpperBound(collection, docId)
+		if err != nil {
+			return 0, err
+		}
+		if err := batch.DeleteRange(lowerbound, upperbound, nil); err != nil {
+			return 0, err
+		}
+		purgedKey, err := key_utils.CalcPurgedKey(collection, docId)
+		if err != nil {
+			return 0, err
+		}
+		if err := batch.Set(purgedKey, purgedAt, nil); err != nil {
+			return 0, err
+		}
+		purgedKeys = append(purgedKeys, string(docKey))
+	}
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	if err := batch.Commit(conn.params.writeOptions()); err != nil {
+		return 0, err
+	}
+	for _, key := range purgedKeys {
+		conn.cache.docs.Delete(key)
+	}
+	return len(purgedKeys), nil
+}
+
+func (conn *PebbleDbConn) IsPurged(collectionName, docID string) (bool, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return false, pe.Errorf("cannot check purged doc: current status = %d", status)
+	}
+	key, err := key_utils.CalcPurgedKey(collectionName, docID)
+	if err != nil {
+		return false, err
+	}
+	_, closer, err := conn.pebbleDb.Get(key)
+	if errors.Is(err, pebble.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	closer.Close()
+	return true, nil
+}
+
+// writeTombstones indexes the docs deleted by a committed transaction and
+// forgets the purged ids reused by its inserts, must hold the db lock
+func (conn *MemDbConn) writeTombstones(tr *Transaction, now time.Time) error {
+	for _, op := range tr.Operations {
+		switch op := op.(type) {
+		case *InsertOp:
+			keyBytes, err := key_utils.CalcDocKey(op.Collection, op.DocID)
+			if err != nil {
+				return err
+			}
+			delete(conn.db.purged, string(keyBytes))
+		case *DeleteOp:
+			keyBytes, err := key_utils.CalcDocKey(op.Collection, op.DocID)
+			if err != nil {
+				return err
+			}
+			conn.db.tombstones[string(keyBytes)] = now.UnixMilli()
+		}
+	}
+	return nil
+}
+
+func (conn *MemDbConn) PurgeTombstones(deletedBefore time.Time) (int, error) {
+	if err := conn.checkWritable("purge tombstones"); err != nil {
+		return 0, err
+	}
+
+	conn.cacheMu.Lock()
+	defer conn.cacheMu.Unlock()
+	conn.db.mu.Lock()
+	defer conn.db.mu.Unlock()
+
+	purgedAt := time.Now().UnixMilli()
+	purged := 0
+	for key, deletedAt := range conn.db.tombstones {
+		if deletedAt >= deletedBefore.UnixMilli() {
+			continue
+		}
+		snapshot, ok := conn.db.docs[key]
+		deleted := false
+		if ok {
+			var err error
+			if deleted, err = isDeletedSnapshot(snapshot); err != nil {
+				return purged, pe.Wrapf(err, "doc %s", key)
+			}
+		}
+		delete(conn.db.tombstones, key)
+		if !deleted {
+			continue
+		}
+		delete(conn.db.docs, key)
+		delete(conn.db.history, key)
+		delete(conn.cache, key)
+		conn.db.purged[key] = purgedAt
+		purged++
+	}
+	return purged, nil
+}
+
+func (conn *MemDbConn) IsPurged(collectionName, docID string) (bool, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return false, pe.Errorf("cannot check purged doc: current status = %d", status)
+	}
+	keyBytes, err := key_utils.CalcDocKey(collectionName, docID)
+	if err != nil {
+		return false, err
+	}
+	conn.db.mu.RLock()
+	defer conn.db.mu.RUnlock()
+	_, ok := conn.db.purged[string(keyBytes)]
+	return ok, nil
+}
@@ -0,0 +1,441 @@
+package db_conn
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	pe "github.com/pkg/errors"
+)
+
+// Document TTL
+//
+// A collection with a TtlSchema expires its docs some seconds after the date in
+// a field. The expiry time of every live doc of such a collection is indexed
+// under key_utils.TTL_KEY_PREFIX in the same batch as the commit that changes
+// the doc, so TtlSweeper finds the expired docs without scanning collections
+// and deletes them with ordinary DeleteOp transactions.
+
+// SystemCommitter is the committer of the transactions made by the server
+// itself, such as the deletes of TtlSweeper. No client has this id.
+const SystemCommitter = "@system"
+
+const (
+	// DefaultTtlSweepInterval is the default time between two sweeps
+	DefaultTtlSweepInterval = time.Minute
+	// DefaultTtlSweepBatchSize is the default number of docs deleted by a transaction
+	DefaultTtlSweepBatchSize = 100
+)
+
+// ExpiredDoc is a doc found in the TTL index
+type ExpiredDoc struct {
+	Collection string
+	DocID      string
+	ExpiresAt  time.Time
+}
+
+// docExpiresAt returns the expiry time of doc in unix milliseconds, ok is false
+// if the doc does not expire
+func docExpiresAt(collection *CollectionSchema, doc *loro.LoroDoc) (expiresAt uint64, ok bool) {
+	if collection == nil || collection.Ttl == nil || doc == nil || doc_visitor.IsDeleted(doc) {
+		return 0, false
+	}
+	value, err := doc.GetMap(doc_visitor.DATA_MAP_NAME).ToGoObject()
+	if err != nil {
+		return 0, false
+	}
+	// dates are stored as unix milliseconds
+	var millis int64
+	switch v := value[collection.Ttl.Field].(type) {
+	case int64:
+		millis = v
+	case float64:
+		millis = int64(v)
+	default:
+		return 0, false
+	}
+	millis += collection.Ttl.Seconds * 1000
+	return uint64(max(millis, 0)), true
+}
+
+// ttlIndexChange is a key added to or removed from the TTL index
+type ttlIndexChange struct {
+	key []byte
+	add bool
+}
+
+// ttlIndexUpdate collects the changes of the TTL index made by a transaction,
+// they must be applied in order
+type ttlIndexUpdate struct {
+	schema  *DatabaseSchema
+	changes []ttlIndexChange
+}
+
+func newTtlIndexUpdate(schema *DatabaseSchema) *ttlIndexUpdate {
+	return &ttlIndexUpdate{schema: schema}
+}
+
+// change records that a doc changed from oldDoc to newDoc, nil if the doc did
+// not exist before
+func (u *ttlIndexUpdate) change(collection, docId string, oldDoc, newDoc *loro.LoroDoc) error {
+	collectionSchema := u.schema.Collections[collection]
+	if collectionSchema == nil || collectionSchema.Ttl == nil {
+		return nil
+	}
+	oldExpiresAt, oldOk := docExpiresAt(collectionSchema, oldDoc)
+	newExpiresAt, newOk := docExpiresAt(collectionSchema, newDoc)
+	if oldOk == newOk && oldExpiresAt == newExpiresAt {
+		return nil
+	}
+	if oldOk {
+		key, err := key_utils.CalcTtlKey(oldExpiresAt, collection, docId)
+		if err != nil {
+			return err
+		}
+		u.changes = append(u.changes, ttlIndexChange{key: key, add: false})
+	}
+	if newOk {
+		key, err := key_utils.CalcTtlKey(newExpiresAt, collection, docId)
+		if err != nil {
+			return err
+		}
+		u.changes = append(u.changes, ttlIndexChange{key: key, add: true})
+	}
+	return nil
+}
+
+// ttlChanged returns the collections whose TTL differs between two schemas
+func ttlChanged(oldSchema, newSchema *DatabaseSchema) []string {
+	changed := make([]string, 0)
+	for name, newCollection := range newSchema.Collections {
+		var oldTtl *TtlSchema
+		if oldCollection := oldSchema.Collections[name]; oldCollection != nil {
+			oldTtl = oldCollection.Ttl
+		}
+		newTtl := newCollection.Ttl
+		if (oldTtl == nil) != (newTtl == nil) || (oldTtl != nil && *oldTtl != *newTtl) {
+			changed = append(changed, name)
+		}
+	}
+	for name, oldCollection := range oldSchema.Collections {
+		if _, ok := newSchema.Collections[name]; !ok && oldCollection.Ttl != nil {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// writeTtlIndex applies the changes of u to batch
+func writeTtlIndex(batch *pebble.Batch, u *ttlIndexUpdate) error {
+	for _, c := range u.changes {
+		var err error
+		if c.add {
+			err = batch.Set(c.key, nil, nil)
+		} else {
+			err = batch.Delete(c.key, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindexTtl rebuilds the TTL index of the collections whose TTL changed, the
+// caller must hold the cache lock so no commit runs concurrently
+func (conn *PebbleDbConn) reindexTtl(collections []string, schema *DatabaseSchema) error {
+	if len(collections) == 0 {
+		return nil
+	}
+	reindexed := make(map[string]bool, len(collections))
+	for _, name := range collections {
+		reindexed[name] = true
+	}
+
+	batch := conn.pebbleDb.NewBatch()
+	defer batch.Close()
+
+	// entries are ordered by expiry time, so the whole index is scanned
+	iter, err := conn.pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(key_utils.TTL_KEY_PREFIX),
+		UpperBound: []byte{key_utils.TTL_KEY_PREFIX[0] + 1},
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		_, collection, _, err := key_utils.ParseTtlKey(iter.Key())
+		if err != nil {
+			return err
+		}
+		if reindexed[collection] {
+			if err := batch.Delete(iter.Key(), nil); err != nil {
+				return err
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	u := newTtlIndexUpdate(schema)
+	for _, name := range collections {
+		lowerbound, err := key_utils.CalcCollectionLowerBound(name)
+		if err != nil {
+			return err
+		}
+		upperbound, err := key_utils.CalcCollectionUpperBound(name)
+		if err != nil {
+			return err
+		}
+		docIter, err := conn.pebbleDb.NewIter(&pebble.IterOptions{
+			LowerBound: lowerbound,
+			UpperBound: upperbound,
+		})
+		if err != nil {
+			return err
+		}
+		for docIter.First(); docIter.Valid(); docIter.Next() {
+			_, docId, err := key_utils.ParseDocKey(docIter.Key())
+			if err != nil {
+				docIter.Close()
+				return err
+			}
+			snapshot, err := conn.openDoc(docIter.Key(), docIter.Value())
+			if err != nil {
+				docIter.Close()
+				return err
+			}
+			doc, err := docFromSnapshot(snapshot)
+			if err != nil {
+				docIter.Close()
+				return pe.Wrapf(err, "doc %s/%s", name, docId)
+			}
+			if err := u.change(name, docId, nil, doc); err != nil {
+				docIter.Close()
+				return err
+			}
+		}
+		err = docIter.Error()
+		docIter.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeTtlIndex(batch, u); err != nil {
+		return err
+	}
+	return batch.Commit(conn.params.writeOptions())
+}
+
+func (conn *PebbleDbConn) ExpiredDocs(now time.Time, limit int) ([]ExpiredDoc, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return nil, pe.Errorf("cannot load expired docs: current status = %d", status)
+	}
+	iter, err := conn.pebbleDb.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(key_utils.TTL_KEY_PREFIX),
+		UpperBound: key_utils.CalcTtlUpperBound(uint64(max(now.UnixMilli(), 0)) + 1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	expired := make([]ExpiredDoc, 0)
+	for iter.First(); iter.Valid() && len(expired) < limit; iter.Next() {
+		expiresAt, collection, docId, err := key_utils.ParseTtlKey(iter.Key())
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, ExpiredDoc{
+			Collection: collection,
+			DocID:      docId,
+			ExpiresAt:  time.UnixMilli(int64(expiresAt)),
+		})
+	}
+	return expired, iter.Error()
+}
+
+// writeTtlIndex applies the changes of u to the index, must hold the db lock
+func (conn *MemDbConn) writeTtlIndex(u *ttlIndexUpdate) {
+	for _, c := range u.changes {
+		if c.add {
+			conn.db.ttl[string(c.key)] = struct{}{}
+		} else {
+			delete(conn.db.ttl, string(c.key))
+		}
+	}
+}
+
+// reindexTtl rebuilds the TTL index of the collections whose TTL changed, must
+// hold the db lock
+func (conn *MemDbConn) reindexTtl(collections []string, schema *DatabaseSchema) error {
+	if len(collections) == 0 {
+		return nil
+	}
+	reindexed := make(map[string]bool, len(collections))
+	for _, name := range collections {
+		reindexed[name] = true
+	}
+	for key := range conn.db.ttl {
+		_, collection, _, err := key_utils.ParseTtlKey([]byte(key))
+		if err != nil {
+			return err
+		}
+		if reindexed[collection] {
+			delete(conn.db.ttl, key)
+		}
+	}
+	u := newTtlIndexUpdate(schema)
+	for key, snapshot := range conn.db.docs {
+		collection, docId, err := key_utils.ParseDocKey([]byte(key))
+		if err != nil {
+			return err
+		}
+		if !reindexed[collection] {
+			continue
+		}
+		doc, err := docFromSnapshot(snapshot)
+		if err != nil {
+			return pe.Wrapf(err, "doc %s/%s", collection, docId)
+		}
+		if err := u.change(collection, docId, nil, doc); err != nil {
+			return err
+		}
+	}
+	conn.writeTtlIndex(u)
+	return nil
+}
+
+func (conn *MemDbConn) ExpiredDocs(now time.Time, limit int) ([]ExpiredDoc, error) {
+	status := conn.GetStatus()
+	if status != DbConnStatusRunning {
+		return nil, pe.Errorf("cannot load expired docs: current status = %d", status)
+	}
+	upperbound := string(key_utils.CalcTtlUpperBound(uint64(max(now.UnixMilli(), 0)) + 1))
+
+	conn.db.mu.RLock()
+	keys := make([]string, 0)
+	for key := range conn.db.ttl {
+		if key < upperbound {
+			keys = append(keys, key)
+		}
+	}
+	conn.db.mu.RUnlock()
+
+	sort.Strings(keys)
+	expired := make([]ExpiredDoc, 0, min(len(keys), limit))
+	for _, key := range keys[:min(len(keys), limit)] {
+		expiresAt, collection, docId, err := key_utils.ParseTtlKey([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, ExpiredDoc{
+			Collection: collection,
+			DocID:      docId,
+			ExpiresAt:  time.UnixMilli(int64(expiresAt)),
+		})
+	}
+	return expired, nil
+}
+
+type TtlSweeperOptions struct {
+	// Interval is the time between two sweeps
+	Interval time.Duration
+	// BatchSize is the number of docs deleted by a transaction
+	BatchSize int
+}
+
+func (opts *TtlSweeperOptions) EnsureDefaults() {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultTtlSweepInterval
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultTtlSweepBatchSize
+	}
+}
+
+// TtlSweeper deletes the expired docs of a connection periodically. The docs
+// are deleted by committing DeleteOp transactions from SystemCommitter, so
+// they are published on the committed event bus like any other delete. The
+// statistics count the deleted docs and the docs that failed to be deleted.
+type TtlSweeper struct {
+	*periodicJob
+	conn DbConnection
+	opts TtlSweeperOptions
+	seq  atomic.Int64 // used in transaction ids
+}
+
+// NewTtlSweeper creates a sweeper for conn, opts can be nil to use the defaults
+func NewTtlSweeper(conn DbConnection, opts *TtlSweeperOptions) *TtlSweeper {
+	sweeper := &TtlSweeper{conn: conn}
+	if opts != nil {
+		sweeper.opts = *opts
+	}
+	sweeper.opts.EnsureDefaults()
+	sweeper.periodicJob = newPeriodicJob("TtlSweeper", "deleted %d expired docs", sweeper.opts.Interval, sweeper.sweep)
+	return sweeper
+}
+
+func (s *TtlSweeper) sweep(now time.Time) (deleted int, failures int, lastErr error) {
+	// docs that failed to be deleted stay in the index, skip them in this sweep
+	failed := make(map[ExpiredDoc]bool)
+	for {
+		expired, err := s.conn.ExpiredDocs(now, s.opts.BatchSize+len(failed))
+		if err != nil {
+			return deleted, failures, err
+		}
+		batch := make([]ExpiredDoc, 0, len(expired))
+		for _, doc := range expired {
+			if !failed[doc] {
+				batch = append(batch, doc)
+			}
+		}
+		if len(batch) == 0 {
+			return deleted, failures, lastErr
+		}
+
+		if err := s.commitDeletes(batch); err == nil {
+			deleted += len(batch)
+		} else {
+			// a doc of the batch may have been deleted or changed meanwhile,
+			// delete the docs one by one so the others are not blocked
+			for _, doc := range batch {
+				if err := s.commitDeletes([]ExpiredDoc{doc}); err != nil {
+					failed[doc] = true
+					failures++
+					lastErr = err
+					continue
+				}
+				deleted++
+			}
+		}
+		if len(expired) < s.opts.BatchSize+len(failed) {
+			return deleted, failures, lastErr
+		}
+	}
+}
+
+func (s *TtlSweeper) commitDeletes(docs []ExpiredDoc) error {
+	txId := fmt.Sprintf("ttl-sweep-%d-%d", time.Now().UnixNano(), s.seq.Add(1))
+
+	ops := make([]TransactionOp, 0, len(docs))
+	for _, doc := range docs {
+		ops = append(ops, &DeleteOp{
+			Collection: doc.Collection,
+			DocID:      doc.DocID,
+		})
+	}
+	return s.conn.Commit(&Transaction{
+		TxID:       txId,
+		Committer:  SystemCommitter,
+		Operations: ops,
+	})
+}
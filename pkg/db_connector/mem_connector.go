@@ -0,0 +1,50 @@
+package db_connector
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	pe "github.com/pkg/errors"
+)
+
+type MemConnector struct{}
+
+var _ DbConnector = &MemConnector{}
+
+func NewMemConnector() *MemConnector {
+	return &MemConnector{}
+}
+
+// ConnectWithContext establishes a connection to an in-memory database created
+// by db_conn.CreateNewMemDb. A valid dbUrl is like:
+//
+//	mem://<name>?readonly=true
+func (c *MemConnector) ConnectWithContext(ctx context.Context, dbUrl string) (db_conn.DbConnection, error) {
+	parsedUrl, err := url.Parse(dbUrl)
+	if err != nil {
+		return nil, err
+	}
+	if parsedUrl.Scheme != "mem" {
+		return nil, pe.Errorf("invalid db url %s: scheme should be mem", dbUrl)
+	}
+
+	params := &db_conn.MemDbConnParams{Name: parsedUrl.Host + parsedUrl.Path}
+	for key, values := range parsedUrl.Query() {
+		switch key {
+		case "readonly":
+			if len(values) != 1 {
+				return nil, pe.Errorf("invalid db url %s: option %s is given %d times", dbUrl, key, len(values))
+			}
+			params.ReadOnly, err = strconv.ParseBool(values[0])
+			if err != nil {
+				return nil, pe.Wrapf(err, "invalid db url %s: invalid value of option %s", dbUrl, key)
+			}
+		default:
+			return nil, pe.Errorf("invalid db url %s: unknown option %s", dbUrl, key)
+		}
+	}
+
+	return db_conn.NewMemDbConnWithContext(ctx, params)
+}
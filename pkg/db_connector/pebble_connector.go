@@ -3,9 +3,12 @@ package db_connector
 import (
 	"context"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/log"
+	pe "github.com/pkg/errors"
 )
 
 type PebbleConnector struct{}
@@ -21,6 +24,23 @@ func NewPebbleConnector() *PebbleConnector {
 // It will parse the dbUrl to get the db path, and the options. A valid dbUrl is like:
 //
 //	rapierdb://<db-path>?readonly=true&enableWal=false
+//
+// Supported options, see db_conn.PebbleDbConnParams for details:
+//
+//	readonly=<bool>          open the database in read-only mode, default false
+//	enableWal=<bool>         write the write-ahead log, default true
+//	sync=<bool>              sync the WAL on every commit, default true
+//	cacheSize=<bytes>        pebble block cache size
+//	memTableSize=<bytes>     pebble memtable size
+//	docsCacheSize=<n>        number of docs kept in the doc cache
+//	createIfMissing=<bool>   create the database if it does not exist
+//	schema=<path>            schema js used to create the database
+//	permission=<path>        permission js used to create the database
+//	encryptionKeyFile=<path> encrypt values with the keyring in the file
+//	encryptionKeyEnv=<name>  encrypt values with the keyring in the env variable
+//	reencryptInterval=<dur>  time between two re-encryptions of stale values
+//
+// Unknown options are rejected.
 func (c *PebbleConnector) ConnectWithContext(ctx context.Context, dbUrl string) (db_conn.DbConnection, error) {
 	parsedUrl, err := url.Parse(dbUrl)
 	if err != nil {
@@ -30,13 +50,63 @@ func (c *PebbleConnector) ConnectWithContext(ctx context.Context, dbUrl string)
 	dbPath := parsedUrl.Path
 	log.Debugf("PebbleConnector.ConnectWithContext: dbPath=%s", dbPath)
 
-	queryParams := parsedUrl.Query()
-	_ = queryParams
+	params, err := parsePebbleDbConnParams(dbPath, parsedUrl.Query())
+	if err != nil {
+		return nil, pe.Wrapf(err, "invalid db url %s", dbUrl)
+	}
+
+	return db_conn.NewPebbleDbConnWithContext(ctx, params)
+}
 
-	return db_conn.NewPebbleDbConnWithContext(
-		ctx,
-		&db_conn.PebbleDbConnParams{
-			Path: dbPath,
-		},
-	)
+func parsePebbleDbConnParams(dbPath string, queryParams url.Values) (*db_conn.PebbleDbConnParams, error) {
+	params := &db_conn.PebbleDbConnParams{Path: dbPath}
+	for key, values := range queryParams {
+		if len(values) != 1 {
+			return nil, pe.Errorf("option %s is given %d times", key, len(values))
+		}
+		value := values[0]
+		var err error
+		switch key {
+		case "readonly":
+			params.ReadOnly, err = strconv.ParseBool(value)
+		case "enableWal":
+			var enableWal bool
+			enableWal, err = strconv.ParseBool(value)
+			params.DisableWal = !enableWal
+		case "sync":
+			var sync bool
+			sync, err = strconv.ParseBool(value)
+			params.NoSync = !sync
+		case "cacheSize":
+			params.CacheSize, err = strconv.ParseInt(value, 10, 64)
+		case "memTableSize":
+			params.MemTableSize, err = strconv.ParseUint(value, 10, 64)
+		case "docsCacheSize":
+			params.DocsCacheSize, err = strconv.Atoi(value)
+			if err == nil && params.DocsCacheSize <= 0 {
+				err = pe.Errorf("must be positive")
+			}
+		case "createIfMissing":
+			params.CreateIfMissing, err = strconv.ParseBool(value)
+		case "schema":
+			params.SchemaPath = value
+		case "permission":
+			params.PermissionPath = value
+		case "encryptionKeyFile":
+			params.EncryptionKeyFile = value
+		case "encryptionKeyEnv":
+			params.EncryptionKeyEnv = value
+		case "reencryptInterval":
+			params.ReencryptInterval, err = time.ParseDuration(value)
+			if err == nil && params.ReencryptInterval <= 0 {
+				err = pe.Errorf("must be positive")
+			}
+		default:
+			return nil, pe.Errorf("unknown option %s", key)
+		}
+		if err != nil {
+			return nil, pe.Wrapf(err, "invalid value of option %s: %s", key, value)
+		}
+	}
+	return params, nil
 }
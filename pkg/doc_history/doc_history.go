@@ -0,0 +1,142 @@
+// Package doc_history reads documents at past versions recorded by
+// db_conn.DbConnection.LoadDocHistory, diffs versions and restores them.
+package doc_history
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	pe "github.com/pkg/errors"
+)
+
+// DocAt returns a fork of doc as of the version with the encoded frontiers,
+// empty frontiers is the empty doc before any change. The frontiers must be
+// taken from the history of doc, loro does not check unknown frontiers.
+func DocAt(doc *loro.LoroDoc, frontiers []byte) *loro.LoroDoc {
+	if len(frontiers) == 0 {
+		return doc.ForkAt(loro.NewEmptyFrontiers())
+	}
+	return doc.ForkAt(loro.NewFrontiersFromBytes(loro.NewRustBytesVec(frontiers)))
+}
+
+// Value returns the data of doc as a JSON value
+func Value(doc *loro.LoroDoc) (map[string]any, error) {
+	return doc.GetMap(doc_visitor.DATA_MAP_NAME).ToGoObject()
+}
+
+// PatchOp is an operation of a JSON patch (RFC 6902)
+type PatchOp struct {
+	// "add", "remove" or "replace"
+	Op   string
+	Path string
+	// New value of add and replace
+	Value any
+}
+
+func (op PatchOp) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(map[string]any{"op": op.Op, "path": op.Path})
+	}
+	return json.Marshal(map[string]any{"op": op.Op, "path": op.Path, "value": op.Value})
+}
+
+// Diff returns the JSON patch that turns the value from into the value to.
+// Objects are diffed key by key, other values that differ are replaced as a whole.
+func Diff(from, to map[string]any) []PatchOp {
+	ops := make([]PatchOp, 0)
+	return diffObject(ops, "", from, to)
+}
+
+func diffObject(ops []PatchOp, path string, from, to map[string]any) []PatchOp {
+	keys := make([]string, 0, len(from)+len(to))
+	for key := range from {
+		keys = append(keys, key)
+	}
+	for key := range to {
+		if _, ok := from[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		keyPath := path + "/" + escapePointer(key)
+		fromValue, inFrom := from[key]
+		toValue, inTo := to[key]
+		switch {
+		case !inTo:
+			ops = append(ops, PatchOp{Op: "remove", Path: keyPath})
+		case !inFrom:
+			ops = append(ops, PatchOp{Op: "add", Path: keyPath, Value: toValue})
+		default:
+			fromObject, ok1 := fromValue.(map[string]any)
+			toObject, ok2 := toValue.(map[string]any)
+			if ok1 && ok2 {
+				ops = diffObject(ops, keyPath, fromObject, toObject)
+			} else if !reflect.DeepEqual(fromValue, toValue) {
+				ops = append(ops, PatchOp{Op: "replace", Path: keyPath, Value: toValue})
+			}
+		}
+	}
+	return ops
+}
+
+// escapePointer escapes a key as a JSON pointer (RFC 6901) segment
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// RestoreUpdate returns a loro update to doc that restores the data of the doc
+// to past, and doc with the update applied. doc is not modified.
+//
+// Every top-level field of past is set again with its past value. Fields that
+// did not exist in past are set to null, loro maps can't remove keys through
+// our bindings.
+func RestoreUpdate(doc, past *loro.LoroDoc) (update []byte, restored *loro.LoroDoc, err error) {
+	pastValue, err := Value(past)
+	if err != nil {
+		return nil, nil, err
+	}
+	currentValue, err := Value(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	restored = doc.Fork()
+	vv := restored.GetOplogVv()
+	dataMap := restored.GetMap(doc_visitor.DATA_MAP_NAME)
+	for key, value := range pastValue {
+		if current, ok := currentValue[key]; ok && reflect.DeepEqual(current, value) {
+			continue
+		}
+		if err := dataMap.InsertValueCoerce(key, value); err != nil {
+			return nil, nil, pe.Wrapf(err, "failed to restore field %s", key)
+		}
+	}
+	for key, value := range currentValue {
+		if _, ok := pastValue[key]; ok || value == nil {
+			continue
+		}
+		if err := dataMap.InsertValueCoerce(key, nil); err != nil {
+			return nil, nil, pe.Wrapf(err, "failed to restore field %s", key)
+		}
+	}
+	return restored.ExportUpdatesFrom(vv).Bytes(), restored, nil
+}
+
+// FromValue returns a new doc whose data is value. The doc shares no history
+// with the doc value was read from.
+func FromValue(value map[string]any) (*loro.LoroDoc, error) {
+	doc := loro.NewLoroDoc()
+	dataMap := doc.GetMap(doc_visitor.DATA_MAP_NAME)
+	for key, v := range value {
+		if err := dataMap.InsertValueCoerce(key, v); err != nil {
+			return nil, pe.Wrapf(err, "failed to set field %s", key)
+		}
+	}
+	return doc, nil
+}
@@ -88,10 +88,12 @@ func IsFindOne(input StateResolverInput) bool {
 	return isFindOne
 }
 
+// HasSkip 对设置了游标的查询也返回 true。Match 不检查游标，
+// 游标窗口之外的文档不能按排序位置插入结果集，只能重新运行查询
 func HasSkip(input StateResolverInput) bool {
 	q, isFindMany := input.lq.(*query.FindManyListeningQuery)
 	if isFindMany {
-		return q.Query.Skip > 0
+		return q.Query.Skip > 0 || q.Query.HasCursor()
 	} else {
 		panic("find one query is not supported")
 	}
@@ -388,7 +390,10 @@ func getCurrDoc(input StateResolverInput) *loro.LoroDoc {
 	switch op := input.op.(type) {
 	case *db_conn.InsertOp:
 		doc := loro.NewLoroDoc()
-		doc.Import(op.Snapshot)
+		if _, err := doc.Import(op.Snapshot); err != nil {
+			log.Warnf("In getCurrDoc, import snapshot error: %v", err)
+			return nil
+		}
 		return doc
 	case *db_conn.DeleteOp:
 		return nil
@@ -398,7 +403,10 @@ func getCurrDoc(input StateResolverInput) *loro.LoroDoc {
 			return nil
 		}
 		forked := prevDoc.Fork()
-		forked.Import(op.Update)
+		if _, err := forked.Import(op.Update); err != nil {
+			log.Warnf("In getCurrDoc, import update error: %v", err)
+			return nil
+		}
 		return forked
 	default:
 		panic("unknown transaction op")
@@ -0,0 +1,128 @@
+package transpiler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrBudgetExceeded 表示执行超出了 Limits 中的某项限制
+var ErrBudgetExceeded = errors.New("execution budget exceeded")
+
+// 执行预算中各项限制的名称，出现在 BudgetExceededError 中
+const (
+	LimitSteps      = "steps"
+	LimitDeadline   = "deadline"
+	LimitDbQueries  = "db queries"
+	LimitResultSize = "result size"
+)
+
+// Limits 限制一次函数调用可以消耗的资源，值为 0 的字段表示不限制
+type Limits struct {
+	// 最多执行的语句和表达式数
+	MaxSteps int64
+	// 最长执行时间
+	Timeout time.Duration
+	// 最多执行的数据库查询数
+	MaxDbQueries int64
+	// 所有数据库查询最多一共返回的文档数
+	MaxResultSize int64
+}
+
+// BudgetExceededError 是执行超出预算时返回的错误，它不能被 JS 代码中的 try/catch 捕获
+type BudgetExceededError struct {
+	// 被超出的限制，为 LimitSteps、LimitDeadline、LimitDbQueries 或 LimitResultSize
+	Limit string
+	// 限制的值，deadline 超时时为 0
+	Max int64
+}
+
+func (e *BudgetExceededError) Error() string {
+	if e.Limit == LimitDeadline {
+		return fmt.Sprintf("%v: deadline exceeded", ErrBudgetExceeded)
+	}
+	return fmt.Sprintf("%v: more than %d %s", ErrBudgetExceeded, e.Max, e.Limit)
+}
+
+func (e *BudgetExceededError) Unwrap() error {
+	return ErrBudgetExceeded
+}
+
+// deadlineCheckInterval 每执行多少步检查一次 context 是否超时
+const deadlineCheckInterval = 64
+
+// Budget 记录一次函数调用已经消耗的资源
+//
+// Budget 挂在 Scope 上，子作用域共享父作用域的 Budget。
+// nil Budget 不做任何限制
+type Budget struct {
+	ctx        context.Context
+	limits     Limits
+	steps      int64
+	dbQueries  int64
+	resultSize int64
+}
+
+// NewBudget 创建新的执行预算，limits.Timeout 不为 0 时在 ctx 的基础上设置超时，
+// 调用方应在执行结束后调用返回的 cancel 函数
+func NewBudget(ctx context.Context, limits Limits) (*Budget, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	cancel := context.CancelFunc(func() {})
+	if limits.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+	}
+	return &Budget{ctx: ctx, limits: limits}, cancel
+}
+
+// Step 消耗一步，超出步数限制或 context 已超时时返回 BudgetExceededError
+func (b *Budget) Step() error {
+	if b == nil {
+		return nil
+	}
+	b.steps++
+	if b.limits.MaxSteps > 0 && b.steps > b.limits.MaxSteps {
+		return &BudgetExceededError{Limit: LimitSteps, Max: b.limits.MaxSteps}
+	}
+	if b.steps%deadlineCheckInterval == 1 && b.ctx.Err() != nil {
+		return &BudgetExceededError{Limit: LimitDeadline}
+	}
+	return nil
+}
+
+// ChargeQuery 在执行数据库查询前调用，超出查询次数限制或 context 已超时时返回 BudgetExceededError
+func (b *Budget) ChargeQuery() error {
+	if b == nil {
+		return nil
+	}
+	if b.ctx.Err() != nil {
+		return &BudgetExceededError{Limit: LimitDeadline}
+	}
+	b.dbQueries++
+	if b.limits.MaxDbQueries > 0 && b.dbQueries > b.limits.MaxDbQueries {
+		return &BudgetExceededError{Limit: LimitDbQueries, Max: b.limits.MaxDbQueries}
+	}
+	return nil
+}
+
+// ChargeResult 在数据库查询返回 n 个文档后调用，超出结果大小限制时返回 BudgetExceededError
+func (b *Budget) ChargeResult(n int) error {
+	if b == nil {
+		return nil
+	}
+	b.resultSize += int64(n)
+	if b.limits.MaxResultSize > 0 && b.resultSize > b.limits.MaxResultSize {
+		return &BudgetExceededError{Limit: LimitResultSize, Max: b.limits.MaxResultSize}
+	}
+	return nil
+}
+
+// Context 返回预算对应的 context，nil Budget 返回 context.Background()
+func (b *Budget) Context() context.Context {
+	if b == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
@@ -0,0 +1,1575 @@
+package transpiler
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	pe "github.com/pkg/errors"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/ast"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/token"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+)
+
+// 编译执行
+//
+// executeExpression 每次执行都要重新遍历 AST，并按节点类型分派；变量查找需要沿着作用域链逐级查 map；
+// 属性访问需要按顺序尝试每个 PropAccessHandler。权限规则对每个订阅者的每个文档都要执行，这些开销都在热路径上。
+//
+// Compile 预先将函数表达式的 AST 编译为一棵 Go 闭包树：
+//   - 函数的参数和函数体中声明的变量在编译时分配到 frame 的槽位中，运行时按下标访问；
+//     编译时无法解析的变量（作用域中的变量和内置全局对象）仍然在 Scope 中动态查找
+//   - 每个属性访问位置缓存上次成功处理访问的 PropAccessHandler，下次访问同类型的对象时直接使用
+//
+// 编译器只支持一部分语法，遇到不支持的语法时整个函数回退到解释执行，两种方式的执行结果相同。
+// 循环、switch、try 和标签语句的编译见 compile_control_flow.go
+
+// errNotCompilable 表示 AST 中有编译器不支持的语法
+var errNotCompilable = errors.New("not compilable")
+
+func notCompilable(node any) error {
+	return pe.Wrapf(errNotCompilable, "%T", node)
+}
+
+// frame 是编译后的函数一次调用的运行时环境
+type frame struct {
+	// 函数的参数和局部变量
+	slots []any
+	// 定义该函数的函数的 frame，用于访问外层函数的变量
+	parent *frame
+	// 编译时无法解析的变量在这里查找
+	scope *Scope
+	// 执行预算，nil 表示不限制
+	budget *Budget
+	// 属性访问处理器，nil 表示使用 scope.PropGetter 且不缓存
+	handlers []PropAccessHandler
+}
+
+func (f *frame) up(depth int) *frame {
+	for ; depth > 0; depth-- {
+		f = f.parent
+	}
+	return f
+}
+
+type compiledExpr func(f *frame) (any, error)
+
+// compiledStmt 执行一条语句，returned 表示执行了 return 语句，此时 result 是返回值
+type compiledStmt func(f *frame) (result any, returned bool, err error)
+
+// funcLayout 记录一个函数的参数和局部变量在 frame.slots 中的位置
+//
+// 解释执行时，块语句不会创建新的作用域，函数中声明的变量都在函数的作用域中，同名变量共用一个槽位。
+// 只有 for (let ...)、声明了循环变量的 for...of / for...in 和 catch 会创建新的作用域，
+// 其中声明的变量（包括循环体中声明的变量）放在 blocks 中，占用单独的槽位
+type funcLayout struct {
+	slots map[string]int
+	// 正在编译的语句所在的作用域，内层在后
+	blocks []map[string]int
+	// 槽位总数
+	size   int
+	parent *funcLayout
+}
+
+func (l *funcLayout) alloc() int {
+	idx := l.size
+	l.size++
+	return idx
+}
+
+// declare 返回当前函数中名为 name 的变量的槽位，优先使用最内层作用域中的变量，不存在时在函数中分配
+func (l *funcLayout) declare(name string) int {
+	if idx, ok := l.lookup(name); ok {
+		return idx
+	}
+	idx := l.alloc()
+	l.slots[name] = idx
+	return idx
+}
+
+func (l *funcLayout) lookup(name string) (int, bool) {
+	for i := len(l.blocks) - 1; i >= 0; i-- {
+		if idx, ok := l.blocks[i][name]; ok {
+			return idx, true
+		}
+	}
+	idx, ok := l.slots[name]
+	return idx, ok
+}
+
+// pushBlock 进入一个新的作用域，为 names 分配新的槽位并返回这些槽位
+func (l *funcLayout) pushBlock(names []string) []int {
+	block := make(map[string]int, len(names))
+	idxs := make([]int, 0, len(names))
+	for _, name := range names {
+		if _, ok := block[name]; ok {
+			continue
+		}
+		idx := l.alloc()
+		block[name] = idx
+		idxs = append(idxs, idx)
+	}
+	l.blocks = append(l.blocks, block)
+	return idxs
+}
+
+func (l *funcLayout) popBlock() {
+	l.blocks = l.blocks[:len(l.blocks)-1]
+}
+
+// resolve 返回变量所在的函数相对当前函数的层数和槽位，不是局部变量时返回 false
+func (l *funcLayout) resolve(name string) (depth int, idx int, ok bool) {
+	for current := l; current != nil; current = current.parent {
+		if idx, ok := current.lookup(name); ok {
+			return depth, idx, true
+		}
+		depth++
+	}
+	return 0, 0, false
+}
+
+type compiler struct {
+	layout *funcLayout
+}
+
+// CompiledFunc 是预先编译好的 JS 函数表达式，可以多次绑定到不同的作用域上执行
+type CompiledFunc struct {
+	// 原始 AST，不能编译时用于解释执行
+	expr ast.Expr
+	// 编译结果，为 nil 时回退到解释执行
+	fn *compiledFunction
+}
+
+// Compile 将 JS 函数表达式（箭头函数或 function 表达式）的 AST 编译为 CompiledFunc
+func Compile(expr ast.Expr) (*CompiledFunc, error) {
+	switch expr.(type) {
+	case *ast.ArrowFunctionLiteral, *ast.FunctionLiteral:
+	default:
+		return nil, pe.WithStack(fmt.Errorf("input is not a function expression: %T", expr))
+	}
+
+	c := &compiler{}
+	fn, err := c.compileFunctionLiteral(expr)
+	if errors.Is(err, errNotCompilable) {
+		return &CompiledFunc{expr: expr}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &CompiledFunc{expr: expr, fn: fn}, nil
+}
+
+// IsCompiled 返回函数是否被编译，为 false 时 Bind 返回的函数解释执行
+func (cf *CompiledFunc) IsCompiled() bool {
+	return cf.fn != nil
+}
+
+// Bind 在作用域 ctx 中创建函数，函数中无法在编译时解析的变量从 ctx 中查找，
+// 执行时使用 ctx 的执行预算
+func (cf *CompiledFunc) Bind(ctx *Scope) (func(...any) (any, error), error) {
+	if cf.fn == nil {
+		return TranspileJsAstToGoFunc(cf.expr, ctx)
+	}
+
+	root := &frame{
+		scope:    ctx,
+		budget:   ctx.GetBudget(),
+		handlers: ctx.PropHandlers,
+	}
+	fn, err := cf.fn.closure()(root)
+	if err != nil {
+		return nil, err
+	}
+	return fn.(func(...any) (any, error)), nil
+}
+
+// Call 在作用域 ctx 中调用一次函数，结果与先 Bind 再调用相同。
+// vars 是只在这次调用中可见的变量，在 ctx 之前查找；budget 是这次调用的执行预算，为 nil 时使用 ctx 的预算
+//
+// 编译后的函数直接在新的 frame 中执行，不需要为每次调用创建作用域链和绑定函数，
+// 适合在同一个作用域中以不同的执行预算并发调用同一个函数，例如权限规则
+func (cf *CompiledFunc) Call(ctx *Scope, vars map[string]any, budget *Budget, args ...any) (any, error) {
+	if vars == nil {
+		vars = make(map[string]any)
+	}
+	callScope := &Scope{
+		Vars:         vars,
+		Parent:       ctx,
+		PropGetter:   ctx.PropGetter,
+		PropMutator:  ctx.PropMutator,
+		PropHandlers: ctx.PropHandlers,
+		Budget:       budget,
+	}
+	if cf.fn == nil {
+		goFunc, err := TranspileJsAstToGoFunc(cf.expr, callScope)
+		if err != nil {
+			return nil, err
+		}
+		return goFunc(args...)
+	}
+	root := &frame{
+		scope:    callScope,
+		budget:   callScope.GetBudget(),
+		handlers: callScope.PropHandlers,
+	}
+	return cf.fn.call(root, args)
+}
+
+// CompileJsAstToGoFunc 与 TranspileJsAstToGoFunc 相同，但会先编译函数
+func CompileJsAstToGoFunc(expr ast.Expr, ctx *Scope) (func(...any) (any, error), error) {
+	cf, err := Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return cf.Bind(ctx)
+}
+
+// CompileJsScriptToGoFunc 与 TranspileJsScriptToGoFunc 相同，但会先编译函数
+func CompileJsScriptToGoFunc(jsScript string, ctx *Scope) (func(...any) (any, error), error) {
+	fnExpr, err := parseFunctionExpression(jsScript)
+	if err != nil {
+		return nil, err
+	}
+	return CompileJsAstToGoFunc(fnExpr, ctx)
+}
+
+func (c *compiler) compileExpressions(exprs []ast.Expression) ([]compiledExpr, error) {
+	compiled := make([]compiledExpr, len(exprs))
+	for i, expr := range exprs {
+		var err error
+		compiled[i], err = c.compileExpression(expr.Expr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return compiled, nil
+}
+
+func evalAll(f *frame, exprs []compiledExpr) ([]any, error) {
+	values := make([]any, len(exprs))
+	for i, expr := range exprs {
+		val, err := expr(f)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = val
+	}
+	return values, nil
+}
+
+func (c *compiler) compileExpression(expr ast.Expr) (compiledExpr, error) {
+	switch expr.(type) {
+	case *ast.NumberLiteral, *ast.StringLiteral, *ast.BooleanLiteral, *ast.NullLiteral,
+		*ast.ArrowFunctionLiteral, *ast.FunctionLiteral:
+		return c.compileNode(expr)
+	}
+	compiled, err := c.compileNode(expr)
+	if err != nil {
+		return nil, err
+	}
+	// 与解释执行一样，运行时错误带上出错的表达式的位置
+	return atSource(compiled, expr.Idx0()), nil
+}
+
+func (c *compiler) compileNode(expr ast.Expr) (compiledExpr, error) {
+	switch e := expr.(type) {
+	case *ast.NumberLiteral:
+		return constant(e.Value), nil
+	case *ast.StringLiteral:
+		return constant(e.Value), nil
+	case *ast.BooleanLiteral:
+		return constant(e.Value), nil
+	case *ast.NullLiteral:
+		return constant(nil), nil
+	case *ast.Identifier:
+		return c.compileIdentifier(e.Name), nil
+	case *ast.ObjectLiteral:
+		return c.compileObjectLiteral(e)
+	case *ast.ArrayLiteral:
+		return c.compileArrayLiteral(e)
+	case *ast.TemplateLiteral:
+		return c.compileTemplateLiteral(e)
+	case *ast.MemberExpression:
+		return c.compileMemberExpression(e)
+	case *ast.CallExpression:
+		return c.compileCallExpression(e)
+	case *ast.OptionalChain:
+		return c.compileOptionalChain(e)
+	case *ast.Optional:
+		return c.compileOptional(e)
+	case *ast.BinaryExpression:
+		return c.compileBinaryExpression(e)
+	case *ast.UnaryExpression:
+		return c.compileUnaryExpression(e)
+	case *ast.ConditionalExpression:
+		return c.compileConditionalExpression(e)
+	case *ast.AssignExpression:
+		return c.compileAssignExpression(e)
+	case *ast.UpdateExpression:
+		return c.compileUpdateExpression(e)
+	case *ast.SequenceExpression:
+		return c.compileSequenceExpression(e)
+	case *ast.AwaitExpression:
+		return c.compileAwaitExpression(e)
+	case *ast.ArrowFunctionLiteral, *ast.FunctionLiteral:
+		fn, err := c.compileFunctionLiteral(e)
+		if err != nil {
+			return nil, err
+		}
+		return fn.closure(), nil
+	default:
+		return nil, notCompilable(expr)
+	}
+}
+
+func constant(value any) compiledExpr {
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+}
+
+func (c *compiler) compileIdentifier(name string) compiledExpr {
+	depth, idx, ok := c.layout.resolve(name)
+	if !ok {
+		// 编译时无法解析，在作用域和内置全局对象中查找
+		return func(f *frame) (any, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, err
+			}
+			if val, ok := lookupIdentifier(name, f.scope); ok {
+				return val, nil
+			}
+			return nil, pe.WithStack(fmt.Errorf("undefined identifier: %s", name))
+		}
+	}
+	if depth == 0 {
+		return func(f *frame) (any, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, err
+			}
+			return f.slots[idx], nil
+		}
+	}
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		return f.up(depth).slots[idx], nil
+	}
+}
+
+// compileSetter 编译对变量 name 的赋值
+func (c *compiler) compileSetter(name string) func(f *frame, value any) {
+	depth, idx, ok := c.layout.resolve(name)
+	if !ok {
+		return func(f *frame, value any) {
+			f.scope.SetVar(name, value)
+		}
+	}
+	return func(f *frame, value any) {
+		f.up(depth).slots[idx] = value
+	}
+}
+
+func (c *compiler) compileObjectLiteral(e *ast.ObjectLiteral) (compiledExpr, error) {
+	type objectProp struct {
+		key    compiledExpr
+		value  compiledExpr
+		spread bool
+	}
+	props := make([]objectProp, len(e.Value))
+	for i, prop := range e.Value {
+		switch p := prop.Prop.(type) {
+		case *ast.PropertyKeyed:
+			key, err := c.compileExpression(p.Key.Expr)
+			if err != nil {
+				return nil, err
+			}
+			value, err := c.compileExpression(p.Value.Expr)
+			if err != nil {
+				return nil, err
+			}
+			props[i] = objectProp{key: key, value: value}
+		case *ast.PropertyShort:
+			var value compiledExpr
+			if hasInitializer(p.Initializer) {
+				var err error
+				value, err = c.compileExpression(p.Initializer.Expr)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				value = c.compileShorthandValue(p.Name.Name)
+			}
+			props[i] = objectProp{key: constant(p.Name.Name), value: value}
+		case *ast.SpreadElement:
+			value, err := c.compileExpression(p.Expression.Expr)
+			if err != nil {
+				return nil, err
+			}
+			props[i] = objectProp{value: value, spread: true}
+		default:
+			return nil, notCompilable(prop.Prop)
+		}
+	}
+
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		obj := make(map[string]any, len(props))
+		for _, prop := range props {
+			if prop.spread {
+				value, err := prop.value(f)
+				if err != nil {
+					return nil, err
+				}
+				spread, ok := value.(map[string]any)
+				if !ok {
+					return nil, pe.WithStack(fmt.Errorf("spread operator only supports objects: %T", value))
+				}
+				for k, v := range spread {
+					obj[k] = v
+				}
+				continue
+			}
+
+			keyValue, err := prop.key(f)
+			if err != nil {
+				return nil, err
+			}
+			key, err := objectKey(keyValue)
+			if err != nil {
+				return nil, err
+			}
+			value, err := prop.value(f)
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = value
+		}
+		return obj, nil
+	}, nil
+}
+
+// compileShorthandValue 编译对象字面量 {a} 中 a 的值，与解释执行一致，不查找内置全局对象
+func (c *compiler) compileShorthandValue(name string) compiledExpr {
+	if _, _, ok := c.layout.resolve(name); ok {
+		return c.compileIdentifier(name)
+	}
+	return func(f *frame) (any, error) {
+		value, ok := f.scope.GetVar(name)
+		if !ok {
+			return nil, pe.WithStack(fmt.Errorf("undefined identifier in object literal: %s", name))
+		}
+		return value, nil
+	}
+}
+
+// objectKey 将对象字面量中键的值转换为属性名
+func objectKey(key any) (string, error) {
+	switch k := key.(type) {
+	case string:
+		return k, nil
+	case nil:
+		return "null", nil
+	case map[string]any:
+		return "", pe.WithStack(fmt.Errorf("object cannot be used as key: %T", k))
+	default:
+		return fmt.Sprint(k), nil
+	}
+}
+
+func (c *compiler) compileArrayLiteral(e *ast.ArrayLiteral) (compiledExpr, error) {
+	elems, err := c.compileExpressions(e.Value)
+	if err != nil {
+		return nil, err
+	}
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		return evalAll(f, elems)
+	}, nil
+}
+
+func (c *compiler) compileTemplateLiteral(e *ast.TemplateLiteral) (compiledExpr, error) {
+	if e.Tag != nil {
+		return nil, notCompilable(e)
+	}
+	exprs, err := c.compileExpressions(e.Expressions)
+	if err != nil {
+		return nil, err
+	}
+	elems := e.Elements
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		var sb strings.Builder
+		for i, elem := range elems {
+			sb.WriteString(elem.Parsed)
+			if i < len(exprs) {
+				val, err := exprs[i](f)
+				if err != nil {
+					return nil, err
+				}
+				sb.WriteString(toJsString(val))
+			}
+		}
+		return sb.String(), nil
+	}, nil
+}
+
+// compileProp 编译属性访问 obj.prop 或 obj[expr] 中的属性名
+//
+// 计算属性的值只能是字符串或数字，toString 为 true 时数字会转换为字符串（方法调用时）
+func (c *compiler) compileProp(prop ast.MemberProp, toString bool) (compiledExpr, error) {
+	switch p := prop.(type) {
+	case *ast.Identifier:
+		name := p.Name
+		return func(f *frame) (any, error) { return name, nil }, nil
+	case *ast.ComputedProperty:
+		expr, err := c.compileExpression(p.Expr.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *frame) (any, error) {
+			val, err := expr(f)
+			if err != nil {
+				return nil, err
+			}
+			if toString {
+				return fmt.Sprint(val), nil
+			}
+			switch val := val.(type) {
+			case string:
+				return val, nil
+			case int, int16, int32, int64, uint, uint16, uint32, uint64, float32, float64:
+				return util.ToInt(val), nil
+			default:
+				return nil, pe.WithStack(fmt.Errorf("unsupported property type: %T", val))
+			}
+		}, nil
+	default:
+		return nil, notCompilable(prop)
+	}
+}
+
+func (c *compiler) compileMemberExpression(e *ast.MemberExpression) (compiledExpr, error) {
+	obj, err := c.compileExpression(e.Object.Expr)
+	if err != nil {
+		return nil, err
+	}
+	prop, err := c.compileProp(e.Property.Prop, false)
+	if err != nil {
+		return nil, err
+	}
+	site := &propSite{}
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		objValue, err := obj(f)
+		if err != nil {
+			return nil, err
+		}
+		propValue, err := prop(f)
+		if err != nil {
+			return nil, err
+		}
+		return site.get(f, PropAccess{Prop: propValue}, objValue)
+	}, nil
+}
+
+func (c *compiler) compileCallExpression(e *ast.CallExpression) (compiledExpr, error) {
+	args, err := c.compileExpressions(e.ArgumentList)
+	if err != nil {
+		return nil, err
+	}
+
+	// 方法调用 obj.method()
+	if member, ok := e.Callee.Expr.(*ast.MemberExpression); ok {
+		obj, err := c.compileExpression(member.Object.Expr)
+		if err != nil {
+			return nil, err
+		}
+		prop, err := c.compileProp(member.Property.Prop, true)
+		if err != nil {
+			return nil, err
+		}
+		site := &propSite{}
+		return func(f *frame) (any, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, err
+			}
+			objValue, err := obj(f)
+			if err != nil {
+				return nil, err
+			}
+			propValue, err := prop(f)
+			if err != nil {
+				return nil, err
+			}
+			argValues, err := evalAll(f, args)
+			if err != nil {
+				return nil, err
+			}
+			return site.get(f, PropAccess{Prop: propValue, Args: argValues, IsCall: true}, objValue)
+		}, nil
+	}
+
+	// 普通函数调用
+	callee, err := c.compileExpression(e.Callee.Expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		calleeValue, err := callee(f)
+		if err != nil {
+			return nil, err
+		}
+		argValues, err := evalAll(f, args)
+		if err != nil {
+			return nil, err
+		}
+		return callFunction(calleeValue, argValues)
+	}, nil
+}
+
+// callFunction 调用 Go 函数 callee，JS 函数直接调用，其他函数通过反射调用
+func callFunction(callee any, args []any) (any, error) {
+	if jsFunc, ok := callee.(func(...any) (any, error)); ok {
+		return jsFunc(args...)
+	}
+
+	fn := reflect.ValueOf(callee)
+	if !fn.IsValid() || fn.Kind() != reflect.Func {
+		return nil, pe.WithStack(fmt.Errorf("not a callable function: %v", callee))
+	}
+	results := fn.Call(reflectCallArgs(fn.Type(), args))
+	if len(results) == 0 {
+		return nil, nil
+	}
+	if err := callError(results); err != nil {
+		return nil, err
+	}
+	// 特殊处理 fmt.Println 类函数
+	if len(results) == 2 && fn.Type().Out(0).Kind() == reflect.Int {
+		n, _ := results[0].Interface().(int)
+		return n, nil
+	}
+	return results[0].Interface(), nil
+}
+
+func (c *compiler) compileAwaitExpression(e *ast.AwaitExpression) (compiledExpr, error) {
+	argument, err := c.compileExpression(e.Argument.Expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		value, err := argument(f)
+		if err != nil {
+			return nil, err
+		}
+		return await(value, f.budget)
+	}, nil
+}
+
+func (c *compiler) compileOptionalChain(e *ast.OptionalChain) (compiledExpr, error) {
+	base, err := c.compileExpression(e.Base.Expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		val, err := base(f)
+		if errors.Is(err, errOptionalShortCircuit) {
+			return nil, nil
+		}
+		return val, err
+	}, nil
+}
+
+func (c *compiler) compileOptional(e *ast.Optional) (compiledExpr, error) {
+	inner, err := c.compileExpression(e.Expr.Expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		val, err := inner(f)
+		if err != nil {
+			return nil, err
+		}
+		if isNil(val) {
+			return nil, errOptionalShortCircuit
+		}
+		return val, nil
+	}, nil
+}
+
+func (c *compiler) compileBinaryExpression(e *ast.BinaryExpression) (compiledExpr, error) {
+	left, err := c.compileExpression(e.Left.Expr)
+	if err != nil {
+		return nil, err
+	}
+	right, err := c.compileExpression(e.Right.Expr)
+	if err != nil {
+		return nil, err
+	}
+	operator := e.Operator
+
+	switch operator {
+	case token.LogicalAnd, token.LogicalOr:
+		// 与解释执行一致：结果总是布尔值，右侧出错时视为 false
+		isAnd := operator == token.LogicalAnd
+		return func(f *frame) (any, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, err
+			}
+			leftValue, err := left(f)
+			if err != nil {
+				return nil, err
+			}
+			if isTruthy(leftValue) != isAnd {
+				return !isAnd, nil
+			}
+			rightValue, err := right(f)
+			if errors.Is(err, ErrBudgetExceeded) {
+				return nil, err
+			}
+			if err != nil {
+				return false, nil
+			}
+			return isTruthy(rightValue), nil
+		}, nil
+
+	case token.Coalesce:
+		return func(f *frame) (any, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, err
+			}
+			leftValue, err := left(f)
+			if err != nil {
+				return nil, err
+			}
+			if !isNil(leftValue) {
+				return leftValue, nil
+			}
+			return right(f)
+		}, nil
+	}
+
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		leftValue, err := left(f)
+		if err != nil {
+			return nil, err
+		}
+		rightValue, err := right(f)
+		if err != nil {
+			return nil, err
+		}
+		return applyBinaryOperator(operator, leftValue, rightValue, f.scope)
+	}, nil
+}
+
+func (c *compiler) compileUnaryExpression(e *ast.UnaryExpression) (compiledExpr, error) {
+	if e.Operator == token.Typeof {
+		return c.compileTypeof(e.Operand.Expr)
+	}
+
+	operand, err := c.compileExpression(e.Operand.Expr)
+	if err != nil {
+		return nil, err
+	}
+	switch e.Operator {
+	case token.Not, token.Minus, token.Plus:
+	default:
+		return nil, notCompilable(e)
+	}
+	operator := e.Operator
+
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		val, err := operand(f)
+		if err != nil {
+			return nil, err
+		}
+		switch operator {
+		case token.Not:
+			return !isTruthy(val), nil
+		case token.Minus:
+			if num, ok := toFloat64(val); ok {
+				return -num, nil
+			}
+			return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: -%v", val))
+		default:
+			if num, ok := toFloat64(val); ok {
+				return num, nil
+			}
+			return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: +%v", val))
+		}
+	}, nil
+}
+
+// compileTypeof 编译 typeof 运算，对未声明的变量返回 "undefined" 而不是报错
+func (c *compiler) compileTypeof(operand ast.Expr) (compiledExpr, error) {
+	switch e := operand.(type) {
+	case *ast.NullLiteral:
+		return constant("object"), nil
+	case *ast.Identifier:
+		if _, _, ok := c.layout.resolve(e.Name); !ok {
+			name := e.Name
+			return func(f *frame) (any, error) {
+				if err := f.budget.Step(); err != nil {
+					return nil, err
+				}
+				val, ok := lookupIdentifier(name, f.scope)
+				if !ok {
+					return "undefined", nil
+				}
+				return typeOf(val), nil
+			}, nil
+		}
+	}
+
+	compiled, err := c.compileExpression(operand)
+	if err != nil {
+		return nil, err
+	}
+	return func(f *frame) (any, error) {
+		val, err := compiled(f)
+		if err != nil {
+			return nil, err
+		}
+		return typeOf(val), nil
+	}, nil
+}
+
+func (c *compiler) compileConditionalExpression(e *ast.ConditionalExpression) (compiledExpr, error) {
+	test, err := c.compileExpression(e.Test.Expr)
+	if err != nil {
+		return nil, err
+	}
+	consequent, err := c.compileExpression(e.Consequent.Expr)
+	if err != nil {
+		return nil, err
+	}
+	alternate, err := c.compileExpression(e.Alternate.Expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		testValue, err := test(f)
+		if err != nil {
+			return nil, err
+		}
+		if isTruthy(testValue) {
+			return consequent(f)
+		}
+		return alternate(f)
+	}, nil
+}
+
+// compileAssignTarget 编译赋值目标，返回读取当前值和赋值的函数，只支持变量和对象属性
+func (c *compiler) compileAssignTarget(target ast.Expr) (get compiledExpr, set func(f *frame, value any) error, err error) {
+	switch t := target.(type) {
+	case *ast.Identifier:
+		setter := c.compileSetter(t.Name)
+		return c.compileIdentifier(t.Name), func(f *frame, value any) error {
+			setter(f, value)
+			return nil
+		}, nil
+
+	case *ast.MemberExpression:
+		get, err := c.compileMemberExpression(t)
+		if err != nil {
+			return nil, nil, err
+		}
+		obj, err := c.compileExpression(t.Object.Expr)
+		if err != nil {
+			return nil, nil, err
+		}
+		prop, err := c.compileProp(t.Property.Prop, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		return get, func(f *frame, value any) error {
+			objValue, err := obj(f)
+			if err != nil {
+				return err
+			}
+			propValue, err := prop(f)
+			if err != nil {
+				return err
+			}
+			return f.scope.PropMutator(objValue, propValue, value)
+		}, nil
+
+	default:
+		return nil, nil, notCompilable(target)
+	}
+}
+
+func (c *compiler) compileAssignExpression(e *ast.AssignExpression) (compiledExpr, error) {
+	get, set, err := c.compileAssignTarget(e.Left.Expr)
+	if err != nil {
+		return nil, err
+	}
+	right, err := c.compileExpression(e.Right.Expr)
+	if err != nil {
+		return nil, err
+	}
+	operator := e.Operator
+
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		// 复合赋值（如 +=）先取出左值的当前值
+		var current any
+		if operator != token.Assign {
+			current, err = get(f)
+			if err != nil {
+				return nil, err
+			}
+		}
+		value, err := right(f)
+		if err != nil {
+			return nil, err
+		}
+		if operator != token.Assign {
+			value, err = applyBinaryOperator(operator, current, value, f.scope)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := set(f, value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}, nil
+}
+
+func (c *compiler) compileUpdateExpression(e *ast.UpdateExpression) (compiledExpr, error) {
+	get, set, err := c.compileAssignTarget(e.Operand.Expr)
+	if err != nil {
+		return nil, err
+	}
+	delta := 1.0
+	if e.Operator == token.Decrement {
+		delta = -1
+	}
+	postfix := e.Postfix
+	operator := e.Operator
+
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		operand, err := get(f)
+		if err != nil {
+			return nil, err
+		}
+		oldValue, ok := toFloat64(operand)
+		if !ok {
+			return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: %v%v", operand, operator))
+		}
+		newValue := oldValue + delta
+		if err := set(f, newValue); err != nil {
+			return nil, err
+		}
+		if postfix {
+			return oldValue, nil
+		}
+		return newValue, nil
+	}, nil
+}
+
+func (c *compiler) compileSequenceExpression(e *ast.SequenceExpression) (compiledExpr, error) {
+	exprs, err := c.compileExpressions(e.Sequence)
+	if err != nil {
+		return nil, err
+	}
+	return func(f *frame) (any, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, err
+		}
+		var result any
+		for _, expr := range exprs {
+			var err error
+			result, err = expr(f)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}, nil
+}
+
+// hasInitializer 判断是否有默认值或初始值（也用于数组解构的剩余元素），
+// 解析器可能生成 Expr 为 nil 的空表达式
+func hasInitializer(initializer *ast.Expression) bool {
+	return initializer != nil && initializer.Expr != nil
+}
+
+// paramBinder 将一个实参绑定到新调用的 frame 中
+type paramBinder func(f *frame, arg any) error
+
+// compiledFunction 是编译后的函数，每次调用在新的 frame 中执行
+type compiledFunction struct {
+	// frame 的槽位数
+	size    int
+	binders []paramBinder
+	// 函数体，stmts 和 expr 只有一个不为 nil
+	stmts []compiledStmt
+	expr  compiledExpr
+}
+
+// compileFunctionLiteral 编译箭头函数或 function 表达式
+func (c *compiler) compileFunctionLiteral(expr ast.Expr) (*compiledFunction, error) {
+	switch e := expr.(type) {
+	case *ast.ArrowFunctionLiteral:
+		if e.ParameterList.Rest != nil {
+			return nil, notCompilable(e)
+		}
+		switch body := e.Body.Body.(type) {
+		case *ast.BlockStatement:
+			return c.compileFunction(e.ParameterList.List, body.List, nil)
+		case *ast.Expression:
+			return c.compileFunction(e.ParameterList.List, nil, body.Expr)
+		}
+		return nil, notCompilable(e.Body.Body)
+	case *ast.FunctionLiteral:
+		if e.Generator || e.ParameterList.Rest != nil {
+			return nil, notCompilable(e)
+		}
+		return c.compileFunction(e.ParameterList.List, e.Body.List, nil)
+	}
+	return nil, notCompilable(expr)
+}
+
+// compileFunction 编译函数，函数体为 body 语句列表或表达式 bodyExpr 之一
+func (c *compiler) compileFunction(params ast.VariableDeclarators, body ast.Statements, bodyExpr ast.Expr) (*compiledFunction, error) {
+	layout := &funcLayout{slots: make(map[string]int), parent: c.layout}
+	inner := &compiler{layout: layout}
+
+	// 先为参数和函数体中声明的变量分配槽位，再编译函数体，
+	// 这样函数体中的变量引用在编译时就能解析到槽位
+	fn := &compiledFunction{binders: make([]paramBinder, len(params))}
+	for i, param := range params {
+		binder, err := inner.compileBinding(param.Target.Target, param.Initializer)
+		if err != nil {
+			return nil, err
+		}
+		fn.binders[i] = binder
+	}
+	for _, stmt := range body {
+		if err := declareVars(stmt.Stmt, layout); err != nil {
+			return nil, err
+		}
+	}
+
+	if bodyExpr != nil {
+		var err error
+		fn.expr, err = inner.compileExpression(bodyExpr)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		fn.stmts = make([]compiledStmt, len(body))
+		for i, stmt := range body {
+			var err error
+			fn.stmts[i], err = inner.compileStatement(stmt.Stmt)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	// 函数体编译完后才知道块作用域一共用了多少槽位
+	fn.size = layout.size
+	return fn, nil
+}
+
+// closure 返回在 frame 中创建函数的表达式，创建的函数的外层 frame 是创建时的 frame
+func (fn *compiledFunction) closure() compiledExpr {
+	return func(parent *frame) (any, error) {
+		if err := parent.budget.Step(); err != nil {
+			return nil, err
+		}
+		return func(args ...any) (any, error) {
+			return fn.call(parent, args)
+		}, nil
+	}
+}
+
+// call 以 parent 为外层 frame 调用函数
+func (fn *compiledFunction) call(parent *frame, args []any) (any, error) {
+	f := &frame{
+		slots:    make([]any, fn.size),
+		parent:   parent,
+		scope:    parent.scope,
+		budget:   parent.budget,
+		handlers: parent.handlers,
+	}
+	for i, bind := range fn.binders {
+		var arg any
+		if i < len(args) {
+			arg = args[i]
+		}
+		if err := bind(f, arg); err != nil {
+			return nil, err
+		}
+	}
+
+	if fn.expr != nil {
+		return fn.expr(f)
+	}
+	for _, stmt := range fn.stmts {
+		result, returned, err := stmt(f)
+		if err != nil {
+			return nil, err
+		}
+		if returned {
+			return result, nil
+		}
+	}
+	return nil, nil
+}
+
+// compileBinding 为绑定目标（参数或变量声明）中的变量分配槽位，返回将值绑定到这些变量的函数
+//
+// 与解释执行一致：对象解构只支持 {a, b = 1} 形式，取属性失败时视为 undefined；
+// 数组解构只支持由变量组成的 [a, , b]，值不是数组时不绑定
+func (c *compiler) compileBinding(target ast.Target, initializer *ast.Expression) (paramBinder, error) {
+	var defaultValue compiledExpr
+	if hasInitializer(initializer) {
+		var err error
+		defaultValue, err = c.compileExpression(initializer.Expr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch t := target.(type) {
+	case *ast.Identifier:
+		idx := c.layout.declare(t.Name)
+		return func(f *frame, arg any) error {
+			f.slots[idx] = arg
+			return nil
+		}, nil
+
+	case *ast.ObjectPattern:
+		if t.Rest != nil {
+			return nil, notCompilable(t)
+		}
+		type shortProp struct {
+			name         string
+			idx          int
+			defaultValue compiledExpr
+			site         *propSite
+		}
+		props := make([]shortProp, len(t.Properties))
+		for i, prop := range t.Properties {
+			p, ok := prop.Prop.(*ast.PropertyShort)
+			if !ok {
+				return nil, notCompilable(prop.Prop)
+			}
+			props[i] = shortProp{name: p.Name.Name, idx: c.layout.declare(p.Name.Name), site: &propSite{}}
+			if hasInitializer(p.Initializer) {
+				var err error
+				props[i].defaultValue, err = c.compileExpression(p.Initializer.Expr)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		return func(f *frame, arg any) error {
+			if arg == nil && defaultValue != nil {
+				var err error
+				arg, err = defaultValue(f)
+				if err != nil {
+					return err
+				}
+			}
+			if arg == nil {
+				return nil
+			}
+			for _, prop := range props {
+				value, err := prop.site.get(f, PropAccess{Prop: prop.name}, arg)
+				if errors.Is(err, ErrBudgetExceeded) {
+					return err
+				}
+				if err != nil {
+					value = nil
+				}
+				if value == nil && prop.defaultValue != nil {
+					value, err = prop.defaultValue(f)
+					if err != nil {
+						return err
+					}
+				}
+				f.slots[prop.idx] = value
+			}
+			return nil
+		}, nil
+
+	case *ast.ArrayPattern:
+		if hasInitializer(t.Rest) {
+			return nil, notCompilable(t)
+		}
+		// 数组解构中每个位置对应的槽位，-1 表示空位
+		idxs := make([]int, len(t.Elements))
+		for i, elem := range t.Elements {
+			if elem.Expr == nil {
+				idxs[i] = -1
+				continue
+			}
+			id, ok := elem.Expr.(*ast.Identifier)
+			if !ok {
+				return nil, notCompilable(elem.Expr)
+			}
+			idxs[i] = c.layout.declare(id.Name)
+		}
+		return func(f *frame, arg any) error {
+			if arg == nil && defaultValue != nil {
+				var err error
+				arg, err = defaultValue(f)
+				if err != nil {
+					return err
+				}
+			}
+			arr, ok := arg.([]any)
+			if !ok {
+				return nil
+			}
+			for i, idx := range idxs {
+				if idx < 0 {
+					continue
+				}
+				if i < len(arr) {
+					f.slots[idx] = arr[i]
+				} else {
+					f.slots[idx] = nil
+				}
+			}
+			return nil
+		}, nil
+
+	default:
+		return nil, notCompilable(target)
+	}
+}
+
+// declareVars 为语句中（不包括嵌套函数中）声明的变量分配槽位，
+// 新作用域中声明的变量由编译该作用域的语句单独分配，见 scopedVars
+func declareVars(stmt ast.Stmt, layout *funcLayout) error {
+	var names []string
+	if err := collectVars(stmt, &names); err != nil {
+		return err
+	}
+	for _, name := range names {
+		layout.declare(name)
+	}
+	return nil
+}
+
+// collectVars 收集语句中声明的变量名，不进入嵌套函数和会创建新作用域的语句
+func collectVars(stmt ast.Stmt, names *[]string) error {
+	switch s := stmt.(type) {
+	case *ast.VariableDeclaration:
+		for _, decl := range s.List {
+			if err := collectTargetNames(decl.Target.Target, names); err != nil {
+				return err
+			}
+		}
+	case *ast.BlockStatement:
+		for _, stmt := range s.List {
+			if err := collectVars(stmt.Stmt, names); err != nil {
+				return err
+			}
+		}
+	case *ast.IfStatement:
+		if err := collectVars(s.Consequent.Stmt, names); err != nil {
+			return err
+		}
+		if s.Alternate != nil {
+			return collectVars(s.Alternate.Stmt, names)
+		}
+	case *ast.WhileStatement:
+		return collectVars(s.Body.Stmt, names)
+	case *ast.DoWhileStatement:
+		return collectVars(s.Body.Stmt, names)
+	case *ast.ForStatement:
+		if s.Initializer != nil {
+			if _, scoped := s.Initializer.Initializer.(*ast.VariableDeclaration); scoped {
+				return nil
+			}
+		}
+		return collectVars(s.Body.Stmt, names)
+	case *ast.ForOfStatement:
+		if _, scoped := s.Into.Into.(*ast.VariableDeclaration); scoped {
+			return nil
+		}
+		return collectVars(s.Body.Stmt, names)
+	case *ast.ForInStatement:
+		if _, scoped := s.Into.Into.(*ast.VariableDeclaration); scoped {
+			return nil
+		}
+		return collectVars(s.Body.Stmt, names)
+	case *ast.SwitchStatement:
+		for _, c := range s.Body {
+			for _, stmt := range c.Consequent {
+				if err := collectVars(stmt.Stmt, names); err != nil {
+					return err
+				}
+			}
+		}
+	case *ast.TryStatement:
+		if err := collectVars(s.Body, names); err != nil {
+			return err
+		}
+		if s.Finally != nil {
+			return collectVars(s.Finally, names)
+		}
+	case *ast.LabelledStatement:
+		return collectVars(s.Statement.Stmt, names)
+	}
+	return nil
+}
+
+func collectTargetNames(target ast.Target, names *[]string) error {
+	switch t := target.(type) {
+	case *ast.Identifier:
+		*names = append(*names, t.Name)
+	case *ast.ObjectPattern:
+		for _, prop := range t.Properties {
+			if p, ok := prop.Prop.(*ast.PropertyShort); ok {
+				*names = append(*names, p.Name.Name)
+			}
+		}
+	case *ast.ArrayPattern:
+		for _, elem := range t.Elements {
+			if id, ok := elem.Expr.(*ast.Identifier); ok {
+				*names = append(*names, id.Name)
+			}
+		}
+	default:
+		return notCompilable(target)
+	}
+	return nil
+}
+
+func (c *compiler) compileStatement(stmt ast.Stmt) (compiledStmt, error) {
+	switch s := stmt.(type) {
+	case *ast.ReturnStatement:
+		if s.Argument == nil {
+			return func(f *frame) (any, bool, error) {
+				if err := f.budget.Step(); err != nil {
+					return nil, false, err
+				}
+				return nil, true, nil
+			}, nil
+		}
+		arg, err := c.compileExpression(s.Argument.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *frame) (any, bool, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, false, err
+			}
+			result, err := arg(f)
+			if err != nil {
+				return nil, false, err
+			}
+			return result, true, nil
+		}, nil
+
+	case *ast.ExpressionStatement:
+		expr, err := c.compileExpression(s.Expression.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *frame) (any, bool, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, false, err
+			}
+			_, err := expr(f)
+			return nil, false, err
+		}, nil
+
+	case *ast.BlockStatement:
+		stmts := make([]compiledStmt, len(s.List))
+		for i, stmt := range s.List {
+			var err error
+			stmts[i], err = c.compileStatement(stmt.Stmt)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return func(f *frame) (any, bool, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, false, err
+			}
+			for _, stmt := range stmts {
+				result, returned, err := stmt(f)
+				if err != nil || returned {
+					return result, returned, err
+				}
+			}
+			return nil, false, nil
+		}, nil
+
+	case *ast.IfStatement:
+		test, err := c.compileExpression(s.Test.Expr)
+		if err != nil {
+			return nil, err
+		}
+		consequent, err := c.compileStatement(s.Consequent.Stmt)
+		if err != nil {
+			return nil, err
+		}
+		var alternate compiledStmt
+		if s.Alternate != nil {
+			alternate, err = c.compileStatement(s.Alternate.Stmt)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return func(f *frame) (any, bool, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, false, err
+			}
+			testValue, err := test(f)
+			if err != nil {
+				return nil, false, err
+			}
+			if isTruthy(testValue) {
+				return consequent(f)
+			}
+			if alternate != nil {
+				return alternate(f)
+			}
+			return nil, false, nil
+		}, nil
+
+	case *ast.VariableDeclaration:
+		type declarator struct {
+			init compiledExpr
+			bind paramBinder
+		}
+		decls := make([]declarator, len(s.List))
+		for i, decl := range s.List {
+			if hasInitializer(decl.Initializer) {
+				init, err := c.compileExpression(decl.Initializer.Expr)
+				if err != nil {
+					return nil, err
+				}
+				decls[i].init = init
+			}
+			bind, err := c.compileBinding(decl.Target.Target, nil)
+			if err != nil {
+				return nil, err
+			}
+			decls[i].bind = bind
+		}
+		return func(f *frame) (any, bool, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, false, err
+			}
+			for _, decl := range decls {
+				var value any
+				if decl.init != nil {
+					var err error
+					value, err = decl.init(f)
+					if err != nil {
+						return nil, false, err
+					}
+				}
+				if err := decl.bind(f, value); err != nil {
+					return nil, false, err
+				}
+			}
+			return nil, false, nil
+		}, nil
+
+	case *ast.EmptyStatement:
+		return func(f *frame) (any, bool, error) {
+			return nil, false, f.budget.Step()
+		}, nil
+
+	case *ast.ForStatement, *ast.ForOfStatement, *ast.ForInStatement, *ast.WhileStatement, *ast.DoWhileStatement:
+		return c.compileLoop(s, "")
+
+	case *ast.BreakStatement:
+		label := labelName(s.Label)
+		return func(f *frame) (any, bool, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, false, err
+			}
+			return nil, false, &breakSignal{label: label}
+		}, nil
+
+	case *ast.ContinueStatement:
+		label := labelName(s.Label)
+		return func(f *frame) (any, bool, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, false, err
+			}
+			return nil, false, &continueSignal{label: label}
+		}, nil
+
+	case *ast.LabelledStatement:
+		return c.compileLabelledStatement(s)
+
+	case *ast.SwitchStatement:
+		return c.compileSwitch(s)
+
+	case *ast.TryStatement:
+		return c.compileTry(s)
+
+	case *ast.ThrowStatement:
+		arg, err := c.compileExpression(s.Argument.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *frame) (any, bool, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, false, err
+			}
+			value, err := arg(f)
+			if err != nil {
+				return nil, false, err
+			}
+			return nil, false, &ThrowError{Value: value}
+		}, nil
+
+	default:
+		return nil, notCompilable(stmt)
+	}
+}
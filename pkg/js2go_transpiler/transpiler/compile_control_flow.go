@@ -0,0 +1,519 @@
+package transpiler
+
+import (
+	"errors"
+	"fmt"
+
+	pe "github.com/pkg/errors"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/ast"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js_value"
+)
+
+// 循环、switch、try 和标签语句的编译
+//
+// 与解释执行一致（见 control_flow.go）：break / continue 以 breakSignal / continueSignal 的形式沿调用栈向上传播，
+// 由对应的循环、switch 或标签语句处理；return 通过 compiledStmt 的 returned 结束所在的函数。
+//
+// 解释执行时 for (let ...)、声明了循环变量的 for...of / for...in 以及 catch 会创建新的作用域，
+// 编译时为其中声明的变量分配单独的槽位（见 funcLayout.pushBlock），进入作用域时清空。
+// for...of / for...in 每次迭代都创建新的作用域，循环体中的闭包会捕获当次迭代的变量，
+// 槽位无法表达这一点，所以循环体或 catch 中有嵌套函数时回退到解释执行
+
+// compileLoop 编译循环语句，label 是循环上的标签（没有则为空）
+func (c *compiler) compileLoop(stmt ast.Stmt, label string) (compiledStmt, error) {
+	switch s := stmt.(type) {
+	case *ast.WhileStatement:
+		test, err := c.compileExpression(s.Test.Expr)
+		if err != nil {
+			return nil, err
+		}
+		body, err := c.compileStatement(s.Body.Stmt)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *frame) (any, bool, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, false, err
+			}
+			for {
+				testValue, err := test(f)
+				if err != nil {
+					return nil, false, err
+				}
+				if !isTruthy(testValue) {
+					return nil, false, nil
+				}
+				result, returned, stop, err := runLoopBody(f, body, label)
+				if stop || err != nil {
+					return result, returned, err
+				}
+			}
+		}, nil
+
+	case *ast.DoWhileStatement:
+		test, err := c.compileExpression(s.Test.Expr)
+		if err != nil {
+			return nil, err
+		}
+		body, err := c.compileStatement(s.Body.Stmt)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *frame) (any, bool, error) {
+			if err := f.budget.Step(); err != nil {
+				return nil, false, err
+			}
+			for {
+				result, returned, stop, err := runLoopBody(f, body, label)
+				if stop || err != nil {
+					return result, returned, err
+				}
+				testValue, err := test(f)
+				if err != nil {
+					return nil, false, err
+				}
+				if !isTruthy(testValue) {
+					return nil, false, nil
+				}
+			}
+		}, nil
+
+	case *ast.ForStatement:
+		return c.compileFor(s, label)
+
+	case *ast.ForOfStatement:
+		return c.compileForInto(s.Into, s.Source.Expr, s.Body.Stmt, label, func(f *frame, source any) ([]any, error) {
+			return iterate(source, f.scope)
+		})
+
+	case *ast.ForInStatement:
+		return c.compileForInto(s.Into, s.Source.Expr, s.Body.Stmt, label, func(f *frame, source any) ([]any, error) {
+			return enumerableKeys(source)
+		})
+
+	default:
+		return nil, notCompilable(stmt)
+	}
+}
+
+// runLoopBody 执行一次循环体，stop 表示循环是否应该结束，规则与 executeLoopBody 相同
+func runLoopBody(f *frame, body compiledStmt, label string) (result any, returned bool, stop bool, err error) {
+	result, returned, err = body(f)
+	if err != nil {
+		var brk *breakSignal
+		if errors.As(err, &brk) && (brk.label == "" || brk.label == label) {
+			return nil, false, true, nil
+		}
+		var cont *continueSignal
+		if errors.As(err, &cont) && (cont.label == "" || cont.label == label) {
+			return nil, false, false, nil
+		}
+		return nil, false, true, err
+	}
+	if returned {
+		return result, true, true, nil
+	}
+	return nil, false, false, nil
+}
+
+func (c *compiler) compileFor(s *ast.ForStatement, label string) (compiledStmt, error) {
+	var initStmt compiledStmt
+	var initExpr compiledExpr
+	var blockIdxs []int
+	if s.Initializer != nil {
+		switch init := s.Initializer.Initializer.(type) {
+		case *ast.VariableDeclaration:
+			// let / const 声明的循环变量和循环体中声明的变量只在循环内可见
+			names, err := scopedVars(init, s.Body.Stmt)
+			if err != nil {
+				return nil, err
+			}
+			blockIdxs = c.layout.pushBlock(names)
+			defer c.layout.popBlock()
+			initStmt, err = c.compileStatement(init)
+			if err != nil {
+				return nil, err
+			}
+		case *ast.Expression:
+			if init.Expr != nil {
+				var err error
+				initExpr, err = c.compileExpression(init.Expr)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	var test, update compiledExpr
+	if s.Test != nil && s.Test.Expr != nil {
+		var err error
+		test, err = c.compileExpression(s.Test.Expr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.Update != nil && s.Update.Expr != nil {
+		var err error
+		update, err = c.compileExpression(s.Update.Expr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	body, err := c.compileStatement(s.Body.Stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(f *frame) (any, bool, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, false, err
+		}
+		clearSlots(f, blockIdxs)
+		if initStmt != nil {
+			if _, _, err := initStmt(f); err != nil {
+				return nil, false, err
+			}
+		}
+		if initExpr != nil {
+			if _, err := initExpr(f); err != nil {
+				return nil, false, err
+			}
+		}
+		for {
+			if test != nil {
+				testValue, err := test(f)
+				if err != nil {
+					return nil, false, err
+				}
+				if !isTruthy(testValue) {
+					return nil, false, nil
+				}
+			}
+			result, returned, stop, err := runLoopBody(f, body, label)
+			if stop || err != nil {
+				return result, returned, err
+			}
+			if update != nil {
+				if _, err := update(f); err != nil {
+					return nil, false, err
+				}
+			}
+		}
+	}, nil
+}
+
+// compileForInto 编译 for...of / for...in，items 返回要迭代的值
+func (c *compiler) compileForInto(into *ast.ForInto, sourceExpr ast.Expr, bodyStmt ast.Stmt, label string, items func(f *frame, source any) ([]any, error)) (compiledStmt, error) {
+	// 循环变量的作用域不包括 source
+	source, err := c.compileExpression(sourceExpr)
+	if err != nil {
+		return nil, err
+	}
+
+	var bind paramBinder
+	var blockIdxs []int
+	switch target := into.Into.(type) {
+	case *ast.VariableDeclaration:
+		if len(target.List) != 1 || containsFunction(bodyStmt) {
+			return nil, notCompilable(target)
+		}
+		names, err := scopedVars(target, bodyStmt)
+		if err != nil {
+			return nil, err
+		}
+		blockIdxs = c.layout.pushBlock(names)
+		defer c.layout.popBlock()
+		bind, err = c.compileScopedBinding(target.List[0].Target.Target)
+		if err != nil {
+			return nil, err
+		}
+	case *ast.Expression:
+		ident, ok := target.Expr.(*ast.Identifier)
+		if !ok {
+			return nil, notCompilable(target.Expr)
+		}
+		set := c.compileSetter(ident.Name)
+		bind = func(f *frame, value any) error {
+			set(f, value)
+			return nil
+		}
+	default:
+		return nil, notCompilable(into.Into)
+	}
+
+	body, err := c.compileStatement(bodyStmt)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(f *frame) (any, bool, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, false, err
+		}
+		sourceValue, err := source(f)
+		if err != nil {
+			return nil, false, err
+		}
+		values, err := items(f, sourceValue)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, value := range values {
+			// 每次迭代都进入新的作用域
+			clearSlots(f, blockIdxs)
+			if err := bind(f, value); err != nil {
+				return nil, false, err
+			}
+			result, returned, stop, err := runLoopBody(f, body, label)
+			if stop || err != nil {
+				return result, returned, err
+			}
+		}
+		return nil, false, nil
+	}, nil
+}
+
+// compileLabelledStatement 编译带标签的语句，规则与 executeLabelledStatement 相同
+func (c *compiler) compileLabelledStatement(s *ast.LabelledStatement) (compiledStmt, error) {
+	label := s.Label.Name
+	// 解释执行把 a: 1 当作对象字面量 { a: 1 }，这里不模拟这种行为
+	if expr, ok := s.Statement.Stmt.(*ast.ExpressionStatement); ok && label == "a" {
+		if _, ok := expr.Expression.Expr.(*ast.NumberLiteral); ok {
+			return nil, notCompilable(s)
+		}
+	}
+
+	if isLoop(s.Statement.Stmt) {
+		return c.compileLoop(s.Statement.Stmt, label)
+	}
+	stmt, err := c.compileStatement(s.Statement.Stmt)
+	if err != nil {
+		return nil, err
+	}
+	return func(f *frame) (any, bool, error) {
+		result, returned, err := stmt(f)
+		var brk *breakSignal
+		if errors.As(err, &brk) && brk.label == label {
+			return nil, false, nil
+		}
+		return result, returned, err
+	}, nil
+}
+
+// compileSwitch 编译 switch 语句，规则与 executeSwitch 相同
+func (c *compiler) compileSwitch(s *ast.SwitchStatement) (compiledStmt, error) {
+	discriminant, err := c.compileExpression(s.Discriminant.Expr)
+	if err != nil {
+		return nil, err
+	}
+	type switchCase struct {
+		// default 分支的 test 为 nil
+		test       compiledExpr
+		consequent []compiledStmt
+	}
+	cases := make([]switchCase, len(s.Body))
+	for i, sc := range s.Body {
+		if sc.Test != nil {
+			cases[i].test, err = c.compileExpression(sc.Test.Expr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		cases[i].consequent = make([]compiledStmt, len(sc.Consequent))
+		for j, stmt := range sc.Consequent {
+			cases[i].consequent[j], err = c.compileStatement(stmt.Stmt)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	defaultIdx := s.Default
+
+	return func(f *frame) (any, bool, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, false, err
+		}
+		value, err := discriminant(f)
+		if err != nil {
+			return nil, false, err
+		}
+
+		start := -1
+		for i, sc := range cases {
+			if sc.test == nil {
+				continue
+			}
+			test, err := sc.test(f)
+			if err != nil {
+				return nil, false, err
+			}
+			if eq, err := js_value.DeepComapreJsValue(value, test); err == nil && eq == 0 {
+				start = i
+				break
+			}
+		}
+		if start == -1 {
+			start = defaultIdx
+		}
+		if start < 0 || start >= len(cases) {
+			return nil, false, nil
+		}
+
+		for _, sc := range cases[start:] {
+			for _, stmt := range sc.consequent {
+				result, returned, err := stmt(f)
+				if err != nil {
+					var brk *breakSignal
+					if errors.As(err, &brk) && brk.label == "" {
+						return nil, false, nil
+					}
+					return nil, false, err
+				}
+				if returned {
+					return result, true, nil
+				}
+			}
+		}
+		return nil, false, nil
+	}, nil
+}
+
+// compileTry 编译 try...catch...finally 语句，规则与 executeTry 相同
+func (c *compiler) compileTry(s *ast.TryStatement) (compiledStmt, error) {
+	body, err := c.compileStatement(s.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var catchBody compiledStmt
+	var bindParam paramBinder
+	var catchIdxs []int
+	if s.Catch != nil {
+		if containsFunction(s.Catch) {
+			return nil, notCompilable(s.Catch)
+		}
+		var names []string
+		if s.Catch.Parameter != nil {
+			if err := collectTargetNames(s.Catch.Parameter.Target, &names); err != nil {
+				return nil, err
+			}
+		}
+		if err := collectVars(s.Catch.Body, &names); err != nil {
+			return nil, err
+		}
+		catchIdxs = c.layout.pushBlock(names)
+		if s.Catch.Parameter != nil {
+			bindParam, err = c.compileScopedBinding(s.Catch.Parameter.Target)
+			if err != nil {
+				c.layout.popBlock()
+				return nil, err
+			}
+		}
+		catchBody, err = c.compileStatement(s.Catch.Body)
+		c.layout.popBlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var finally compiledStmt
+	if s.Finally != nil {
+		finally, err = c.compileStatement(s.Finally)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(f *frame) (any, bool, error) {
+		if err := f.budget.Step(); err != nil {
+			return nil, false, err
+		}
+		result, returned, err := body(f)
+		if errors.Is(err, ErrBudgetExceeded) {
+			return nil, false, err
+		}
+
+		if err != nil && catchBody != nil && isCatchable(err) {
+			clearSlots(f, catchIdxs)
+			if bindParam != nil {
+				if err := bindParam(f, thrownValue(err)); err != nil {
+					return nil, false, err
+				}
+			}
+			result, returned, err = catchBody(f)
+			if errors.Is(err, ErrBudgetExceeded) {
+				return nil, false, err
+			}
+		}
+
+		if finally != nil {
+			finallyResult, finallyReturned, finallyErr := finally(f)
+			if finallyErr != nil {
+				return nil, false, finallyErr
+			}
+			if finallyReturned {
+				return finallyResult, true, nil
+			}
+		}
+		return result, returned, err
+	}, nil
+}
+
+// compileScopedBinding 编译循环变量和 catch 参数的绑定，与 bindTarget 一致，
+// 对象解构的值为 null 或 undefined 时报错
+func (c *compiler) compileScopedBinding(target ast.Target) (paramBinder, error) {
+	bind, err := c.compileBinding(target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := target.(*ast.ObjectPattern); !ok {
+		return bind, nil
+	}
+	return func(f *frame, value any) error {
+		if value == nil {
+			return pe.WithStack(fmt.Errorf("cannot destructure %v", value))
+		}
+		return bind(f, value)
+	}, nil
+}
+
+// scopedVars 返回新作用域中声明的变量：decl 声明的变量和 body 中声明的变量
+func scopedVars(decl *ast.VariableDeclaration, body ast.Stmt) ([]string, error) {
+	var names []string
+	if err := collectVars(decl, &names); err != nil {
+		return nil, err
+	}
+	if err := collectVars(body, &names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func clearSlots(f *frame, idxs []int) {
+	for _, idx := range idxs {
+		f.slots[idx] = nil
+	}
+}
+
+// containsFunction 判断节点中是否有嵌套的函数
+func containsFunction(node ast.VisitableNode) bool {
+	v := &functionFinder{}
+	v.V = v
+	node.VisitWith(v)
+	return v.found
+}
+
+type functionFinder struct {
+	ast.NoopVisitor
+	found bool
+}
+
+func (v *functionFinder) VisitFunctionLiteral(n *ast.FunctionLiteral) {
+	v.found = true
+}
+
+func (v *functionFinder) VisitArrowFunctionLiteral(n *ast.ArrowFunctionLiteral) {
+	v.found = true
+}
@@ -0,0 +1,497 @@
+package transpiler
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	pe "github.com/pkg/errors"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/ast"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js_value"
+)
+
+// ThrowError 表示 JS 代码中 throw 抛出且没有被 catch 捕获的值
+//
+// 调用方可以用 errors.As 取出被抛出的值：
+//
+//	var throwErr *transpiler.ThrowError
+//	if errors.As(err, &throwErr) {
+//		fmt.Println(throwErr.Value)
+//	}
+type ThrowError struct {
+	Value any
+}
+
+func (e *ThrowError) Error() string {
+	return fmt.Sprintf("uncaught exception: %v", e.Value)
+}
+
+// breakSignal 和 continueSignal 以 error 的形式沿调用栈向上传播，
+// 直到被对应的循环、switch 或标签语句处理。label 为空表示没有标签
+type breakSignal struct {
+	label string
+}
+
+func (s *breakSignal) Error() string {
+	if s.label == "" {
+		return "illegal break statement"
+	}
+	return fmt.Sprintf("undefined label: %s", s.label)
+}
+
+type continueSignal struct {
+	label string
+}
+
+func (s *continueSignal) Error() string {
+	if s.label == "" {
+		return "illegal continue statement"
+	}
+	return fmt.Sprintf("undefined label: %s", s.label)
+}
+
+// returnSignal 表示执行了 return 语句，与 break / continue 一样沿调用栈向上传播，
+// 由所在的函数体取出返回值
+type returnSignal struct {
+	value any
+}
+
+func (s *returnSignal) Error() string {
+	return "illegal return statement"
+}
+
+func labelName(label *ast.Identifier) string {
+	if label == nil {
+		return ""
+	}
+	return label.Name
+}
+
+// isLoop 判断语句是否是循环语句
+func isLoop(stmt ast.Stmt) bool {
+	switch stmt.(type) {
+	case *ast.ForStatement, *ast.ForOfStatement, *ast.ForInStatement, *ast.WhileStatement, *ast.DoWhileStatement:
+		return true
+	default:
+		return false
+	}
+}
+
+// executeLabelledStatement 执行带标签的语句
+//
+// 标签在循环上时，break label 和 continue label 由循环处理；
+// 在其他语句上时，只能通过 break label 跳出该语句
+func executeLabelledStatement(s *ast.LabelledStatement, ctx *Scope) (any, error) {
+	label := s.Label.Name
+	if isLoop(s.Statement.Stmt) {
+		return executeLoop(s.Statement.Stmt, ctx, label)
+	}
+
+	result, err := executeStatement(s.Statement.Stmt, ctx)
+	var brk *breakSignal
+	if errors.As(err, &brk) && brk.label == label {
+		return nil, nil
+	}
+	return result, err
+}
+
+// executeLoop 执行循环语句，label 是循环上的标签（没有则为空）
+//
+// 循环体中的 return 以 returnSignal 的形式结束循环并继续向上传播
+func executeLoop(stmt ast.Stmt, ctx *Scope, label string) (any, error) {
+	switch s := stmt.(type) {
+	case *ast.ForStatement:
+		return executeFor(s, ctx, label)
+	case *ast.ForOfStatement:
+		return executeForOf(s, ctx, label)
+	case *ast.ForInStatement:
+		return executeForIn(s, ctx, label)
+	case *ast.WhileStatement:
+		for {
+			test, err := executeExpression(s.Test.Expr, ctx)
+			if err != nil {
+				return nil, err
+			}
+			if !isTruthy(test) {
+				return nil, nil
+			}
+			result, stop, err := executeLoopBody(s.Body.Stmt, ctx, label)
+			if stop || err != nil {
+				return result, err
+			}
+		}
+	case *ast.DoWhileStatement:
+		for {
+			result, stop, err := executeLoopBody(s.Body.Stmt, ctx, label)
+			if stop || err != nil {
+				return result, err
+			}
+			test, err := executeExpression(s.Test.Expr, ctx)
+			if err != nil {
+				return nil, err
+			}
+			if !isTruthy(test) {
+				return nil, nil
+			}
+		}
+	default:
+		return nil, pe.WithStack(fmt.Errorf("unsupported loop statement: %T", stmt))
+	}
+}
+
+// executeLoopBody 执行一次循环体，stop 表示循环是否应该结束
+//
+//   - break（或 break 到该循环的标签）：结束循环
+//   - continue（或 continue 到该循环的标签）：进入下一次迭代
+//   - 其他标签的 break / continue、return 以及异常：结束循环并继续向上传播
+func executeLoopBody(body ast.Stmt, ctx *Scope, label string) (result any, stop bool, err error) {
+	result, err = executeStatement(body, ctx)
+	if err != nil {
+		var brk *breakSignal
+		if errors.As(err, &brk) && (brk.label == "" || brk.label == label) {
+			return nil, true, nil
+		}
+		var cont *continueSignal
+		if errors.As(err, &cont) && (cont.label == "" || cont.label == label) {
+			return nil, false, nil
+		}
+		return nil, true, err
+	}
+	if result != nil {
+		return result, true, nil
+	}
+	return nil, false, nil
+}
+
+func executeFor(s *ast.ForStatement, ctx *Scope, label string) (any, error) {
+	// let / const 声明的循环变量只在循环内可见
+	loopCtx := ctx
+	if s.Initializer != nil {
+		switch init := s.Initializer.Initializer.(type) {
+		case *ast.VariableDeclaration:
+			loopCtx = NewScope(ctx, ctx.PropGetter, ctx.PropMutator)
+			if _, err := executeStatement(init, loopCtx); err != nil {
+				return nil, err
+			}
+		case *ast.Expression:
+			if _, err := executeExpression(init.Expr, ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for {
+		if s.Test != nil && s.Test.Expr != nil {
+			test, err := executeExpression(s.Test.Expr, loopCtx)
+			if err != nil {
+				return nil, err
+			}
+			if !isTruthy(test) {
+				return nil, nil
+			}
+		}
+		result, stop, err := executeLoopBody(s.Body.Stmt, loopCtx, label)
+		if stop || err != nil {
+			return result, err
+		}
+		if s.Update != nil && s.Update.Expr != nil {
+			if _, err := executeExpression(s.Update.Expr, loopCtx); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func executeForOf(s *ast.ForOfStatement, ctx *Scope, label string) (any, error) {
+	source, err := executeExpression(s.Source.Expr, ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, err := iterate(source, ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		result, stop, err := executeForIntoBody(s.Into, item, s.Body.Stmt, ctx, label)
+		if stop || err != nil {
+			return result, err
+		}
+	}
+	return nil, nil
+}
+
+func executeForIn(s *ast.ForInStatement, ctx *Scope, label string) (any, error) {
+	source, err := executeExpression(s.Source.Expr, ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := enumerableKeys(source)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		result, stop, err := executeForIntoBody(s.Into, key, s.Body.Stmt, ctx, label)
+		if stop || err != nil {
+			return result, err
+		}
+	}
+	return nil, nil
+}
+
+// executeForIntoBody 将 value 绑定到 for...of / for...in 的循环变量，然后执行一次循环体
+//
+// 声明的循环变量每次迭代都在新的作用域中，与 JS 中 let / const 的语义一致
+func executeForIntoBody(into *ast.ForInto, value any, body ast.Stmt, ctx *Scope, label string) (any, bool, error) {
+	iterCtx := ctx
+	switch target := into.Into.(type) {
+	case *ast.VariableDeclaration:
+		if len(target.List) != 1 {
+			return nil, true, pe.WithStack(errors.New("invalid left-hand side in for loop"))
+		}
+		iterCtx = NewScope(ctx, ctx.PropGetter, ctx.PropMutator)
+		if err := bindTarget(target.List[0].Target.Target, value, iterCtx); err != nil {
+			return nil, true, err
+		}
+	case *ast.Expression:
+		ident, ok := target.Expr.(*ast.Identifier)
+		if !ok {
+			return nil, true, pe.WithStack(fmt.Errorf("unsupported for loop target: %T", target.Expr))
+		}
+		ctx.SetVar(ident.Name, value)
+	}
+	return executeLoopBody(body, iterCtx, label)
+}
+
+// bindTarget 将 value 绑定到 ctx 中的声明目标，支持标识符、对象解构和数组解构
+func bindTarget(target ast.Target, value any, ctx *Scope) error {
+	switch t := target.(type) {
+	case *ast.Identifier:
+		ctx.Vars[t.Name] = value
+	case *ast.ObjectPattern:
+		if value == nil {
+			return pe.WithStack(fmt.Errorf("cannot destructure %v", value))
+		}
+		for _, prop := range t.Properties {
+			if p, ok := prop.Prop.(*ast.PropertyShort); ok {
+				propValue, _ := ctx.PropGetter([]PropAccess{{Prop: p.Name.Name}}, value)
+				if propValue == nil && p.Initializer != nil {
+					var err error
+					propValue, err = executeExpression(p.Initializer.Expr, ctx)
+					if err != nil {
+						return err
+					}
+				}
+				ctx.Vars[p.Name.Name] = propValue
+			}
+		}
+	case *ast.ArrayPattern:
+		arr, _ := value.([]any)
+		for i, elem := range t.Elements {
+			if id, ok := elem.Expr.(*ast.Identifier); ok {
+				if i < len(arr) {
+					ctx.Vars[id.Name] = arr[i]
+				} else {
+					ctx.Vars[id.Name] = nil
+				}
+			}
+		}
+	default:
+		return pe.WithStack(fmt.Errorf("unsupported binding target: %T", target))
+	}
+	return nil
+}
+
+// iterate 返回 for...of 迭代 source 得到的所有值
+//
+// 除了 Go 切片和字符串外，其他对象通过 PropGetter 的 length 和下标访问迭代，
+// 因此可以迭代 LoroList 等由 PropGetter 支持的列表
+func iterate(source any, ctx *Scope) ([]any, error) {
+	switch v := source.(type) {
+	case []any:
+		return v, nil
+	case string:
+		items := make([]any, 0, len(v))
+		for _, r := range v {
+			items = append(items, string(r))
+		}
+		return items, nil
+	}
+
+	if isNil(source) {
+		return nil, pe.WithStack(fmt.Errorf("%v is not iterable", source))
+	}
+
+	val := reflect.ValueOf(source)
+	if val.Kind() == reflect.Slice || val.Kind() == reflect.Array {
+		items := make([]any, val.Len())
+		for i := range items {
+			items[i] = val.Index(i).Interface()
+		}
+		return items, nil
+	}
+
+	length, err := ctx.PropGetter([]PropAccess{{Prop: "length"}}, source)
+	if err != nil {
+		return nil, pe.WithStack(fmt.Errorf("%T is not iterable", source))
+	}
+	n, ok := toInt(length)
+	if !ok {
+		return nil, pe.WithStack(fmt.Errorf("%T is not iterable", source))
+	}
+	items := make([]any, n)
+	for i := range items {
+		items[i], err = ctx.PropGetter([]PropAccess{{Prop: i}}, source)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// enumerableKeys 返回 for...in 枚举 source 得到的所有键
+//
+// 对象的键按字典序排列，数组和字符串的键是下标的字符串形式，null 和 undefined 不产生任何键
+func enumerableKeys(source any) ([]any, error) {
+	if isNil(source) {
+		return nil, nil
+	}
+
+	switch v := source.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		ret := make([]any, len(keys))
+		for i, key := range keys {
+			ret[i] = key
+		}
+		return ret, nil
+	case string:
+		return indexKeys(len([]rune(v))), nil
+	}
+
+	val := reflect.ValueOf(source)
+	if val.Kind() == reflect.Slice || val.Kind() == reflect.Array {
+		return indexKeys(val.Len()), nil
+	}
+	return nil, pe.WithStack(fmt.Errorf("cannot enumerate keys of %T", source))
+}
+
+func indexKeys(n int) []any {
+	keys := make([]any, n)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	return keys
+}
+
+// executeSwitch 执行 switch 语句
+//
+// 使用严格相等匹配 case，匹配后依次执行后续所有 case（fall through），直到遇到 break；
+// 没有 case 匹配时从 default 开始执行
+func executeSwitch(s *ast.SwitchStatement, ctx *Scope) (any, error) {
+	discriminant, err := executeExpression(s.Discriminant.Expr, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	start := -1
+	for i, c := range s.Body {
+		if c.Test == nil {
+			continue
+		}
+		test, err := executeExpression(c.Test.Expr, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if eq, err := js_value.DeepComapreJsValue(discriminant, test); err == nil && eq == 0 {
+			start = i
+			break
+		}
+	}
+	if start == -1 {
+		start = s.Default
+	}
+	if start < 0 || start >= len(s.Body) {
+		return nil, nil
+	}
+
+	for _, c := range s.Body[start:] {
+		for _, stmt := range c.Consequent {
+			result, err := executeStatement(stmt.Stmt, ctx)
+			if err != nil {
+				var brk *breakSignal
+				if errors.As(err, &brk) && brk.label == "" {
+					return nil, nil
+				}
+				return nil, err
+			}
+			if result != nil {
+				return result, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// executeTry 执行 try...catch...finally 语句
+//
+// catch 可以捕获 throw 抛出的值，以及执行中产生的其他错误（此时绑定为 { name, message } 对象）；
+// finally 总会执行，如果 finally 中执行了 return 或产生了异常，会覆盖 try / catch 的结果。
+// 超出执行预算时立即终止，既不执行 catch 也不执行 finally
+func executeTry(s *ast.TryStatement, ctx *Scope) (any, error) {
+	result, err := executeStatement(s.Body, ctx)
+	if errors.Is(err, ErrBudgetExceeded) {
+		return nil, err
+	}
+
+	if err != nil && s.Catch != nil && isCatchable(err) {
+		catchCtx := NewScope(ctx, ctx.PropGetter, ctx.PropMutator)
+		if s.Catch.Parameter != nil {
+			if err := bindTarget(s.Catch.Parameter.Target, thrownValue(err), catchCtx); err != nil {
+				return nil, err
+			}
+		}
+		result, err = executeStatement(s.Catch.Body, catchCtx)
+		if errors.Is(err, ErrBudgetExceeded) {
+			return nil, err
+		}
+	}
+
+	if s.Finally != nil {
+		finallyResult, finallyErr := executeStatement(s.Finally, ctx)
+		if finallyErr != nil {
+			return nil, finallyErr
+		}
+		if finallyResult != nil {
+			return finallyResult, nil
+		}
+	}
+	return result, err
+}
+
+// isCatchable 判断错误能否被 catch 捕获，break / continue / return 不是异常，
+// 超出执行预算也不能被 JS 代码处理，它们都不能被捕获
+func isCatchable(err error) bool {
+	var brk *breakSignal
+	var cont *continueSignal
+	var ret *returnSignal
+	return !errors.As(err, &brk) && !errors.As(err, &cont) && !errors.As(err, &ret) && !errors.Is(err, ErrBudgetExceeded)
+}
+
+// thrownValue 返回 catch 绑定的值
+func thrownValue(err error) any {
+	var throwErr *ThrowError
+	if errors.As(err, &throwErr) {
+		return throwErr.Value
+	}
+	return map[string]any{
+		"name":    "Error",
+		"message": err.Error(),
+	}
+}
@@ -0,0 +1,286 @@
+package transpiler
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	pe "github.com/pkg/errors"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/ast"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/token"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+)
+
+// builtinGlobals 是所有作用域都能访问的内置全局对象，作用域中的同名变量优先
+var builtinGlobals = map[string]any{
+	"undefined": nil,
+	"Array": map[string]any{
+		"isArray": isArray,
+	},
+}
+
+// lookupIdentifier 先在作用域中查找变量，找不到时再查找内置全局对象
+func lookupIdentifier(name string, ctx *Scope) (any, bool) {
+	if val, ok := ctx.GetVar(name); ok {
+		return val, true
+	}
+	val, ok := builtinGlobals[name]
+	return val, ok
+}
+
+// isArray 实现 Array.isArray，Go 切片、数组以及 Loro 列表都视为数组
+func isArray(v any) bool {
+	switch v.(type) {
+	case *loro.LoroList, *loro.LoroMovableList:
+		return !isNil(v)
+	}
+	if isNil(v) {
+		return false
+	}
+	kind := reflect.TypeOf(v).Kind()
+	return kind == reflect.Slice || kind == reflect.Array
+}
+
+// errOptionalShortCircuit 表示可选链 a?.b 中 a 为 null 或 undefined，
+// 它会沿着可选链向上传播，由最外层的 OptionalChain 转换为 undefined
+var errOptionalShortCircuit = errors.New("optional chain short circuit")
+
+func executeOptionalChain(e *ast.OptionalChain, ctx *Scope) (any, error) {
+	val, err := executeExpression(e.Base.Expr, ctx)
+	if errors.Is(err, errOptionalShortCircuit) {
+		return nil, nil
+	}
+	return val, err
+}
+
+func executeOptional(e *ast.Optional, ctx *Scope) (any, error) {
+	val, err := executeExpression(e.Expr.Expr, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if isNil(val) {
+		return nil, errOptionalShortCircuit
+	}
+	return val, nil
+}
+
+// executeTemplateLiteral 执行模板字符串，不支持带标签的模板
+func executeTemplateLiteral(e *ast.TemplateLiteral, ctx *Scope) (any, error) {
+	if e.Tag != nil {
+		return nil, pe.WithStack(errors.New("tagged template is not supported"))
+	}
+
+	var sb strings.Builder
+	for i, elem := range e.Elements {
+		sb.WriteString(elem.Parsed)
+		if i < len(e.Expressions) {
+			val, err := executeExpression(e.Expressions[i].Expr, ctx)
+			if err != nil {
+				return nil, err
+			}
+			sb.WriteString(toJsString(val))
+		}
+	}
+	return sb.String(), nil
+}
+
+// executeUpdateExpression 执行 ++ 和 --，前缀形式返回新值，后缀形式返回旧值
+func executeUpdateExpression(e *ast.UpdateExpression, ctx *Scope) (any, error) {
+	operand, err := executeExpression(e.Operand.Expr, ctx)
+	if err != nil {
+		return nil, err
+	}
+	oldValue, ok := toFloat64(operand)
+	if !ok {
+		return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: %v%v", operand, e.Operator))
+	}
+
+	newValue := oldValue + 1
+	if e.Operator == token.Decrement {
+		newValue = oldValue - 1
+	}
+	if err := assignTo(e.Operand.Expr, newValue, ctx); err != nil {
+		return nil, err
+	}
+
+	if e.Postfix {
+		return oldValue, nil
+	}
+	return newValue, nil
+}
+
+// executeSequenceExpression 依次执行逗号分隔的表达式，返回最后一个表达式的值
+func executeSequenceExpression(e *ast.SequenceExpression, ctx *Scope) (any, error) {
+	var result any
+	for _, expr := range e.Sequence {
+		var err error
+		result, err = executeExpression(expr.Expr, ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// assignTo 将 value 赋给变量或对象属性
+func assignTo(target ast.Expr, value any, ctx *Scope) error {
+	switch target := target.(type) {
+	case *ast.Identifier:
+		// 变量赋值，赋给声明该变量的作用域
+		ctx.SetVar(target.Name, value)
+		return nil
+
+	case *ast.MemberExpression:
+		// 对象属性赋值
+		obj, err := executeExpression(target.Object.Expr, ctx)
+		if err != nil {
+			return err
+		}
+
+		// 获取属性名
+		var propName any
+		switch prop := target.Property.Prop.(type) {
+		case *ast.Identifier:
+			propName = prop.Name
+		case *ast.ComputedProperty:
+			val, err := executeExpression(prop.Expr.Expr, ctx)
+			if err != nil {
+				return err
+			}
+			// 将计算结果转换为字符串或整数，因为属性名只能是字符串或整数
+			switch val := val.(type) {
+			case string:
+				propName = val
+			case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+				propName = util.ToInt(val)
+			default:
+				return pe.WithStack(fmt.Errorf("unsupported property type: %T", val))
+			}
+		default:
+			return pe.WithStack(fmt.Errorf("unsupported property type: %T", prop))
+		}
+
+		// 使用 PropMutator 设置属性值
+		return ctx.PropMutator(obj, propName, value)
+
+	default:
+		return pe.WithStack(fmt.Errorf("invalid assignment target: %T", target))
+	}
+}
+
+// executeTypeof 执行 typeof 运算，对未声明的变量返回 "undefined" 而不是报错
+func executeTypeof(operand ast.Expr, ctx *Scope) (any, error) {
+	switch e := operand.(type) {
+	case *ast.Identifier:
+		val, ok := lookupIdentifier(e.Name, ctx)
+		if !ok {
+			return "undefined", nil
+		}
+		return typeOf(val), nil
+	case *ast.NullLiteral:
+		return "object", nil
+	}
+
+	val, err := executeExpression(operand, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return typeOf(val), nil
+}
+
+// typeOf 返回值在 JS 中 typeof 的结果
+//
+// Go 中 null 和 undefined 都表示为 nil，这里统一视为 undefined
+func typeOf(v any) string {
+	if isNil(v) {
+		return "undefined"
+	}
+	switch v.(type) {
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return "number"
+	}
+	if reflect.TypeOf(v).Kind() == reflect.Func {
+		return "function"
+	}
+	return "object"
+}
+
+// hasProperty 实现 key in obj
+func hasProperty(obj any, key any, ctx *Scope) (any, error) {
+	if isNil(obj) {
+		return nil, pe.WithStack(fmt.Errorf("cannot use 'in' operator to search for '%v' in %v", key, obj))
+	}
+	switch obj.(type) {
+	case string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return nil, pe.WithStack(fmt.Errorf("cannot use 'in' operator to search for '%v' in %v", key, obj))
+	}
+
+	if m, ok := obj.(map[string]any); ok {
+		_, exists := m[toJsString(key)]
+		return exists, nil
+	}
+
+	val := reflect.ValueOf(obj)
+	if val.Kind() == reflect.Slice || val.Kind() == reflect.Array {
+		if key == "length" {
+			return true, nil
+		}
+		index, err := strconv.Atoi(toJsString(key))
+		if err != nil {
+			return false, nil
+		}
+		return index >= 0 && index < val.Len(), nil
+	}
+
+	// 其他对象通过 PropGetter 判断属性是否存在
+	var prop any = toJsString(key)
+	if index, ok := toInt(key); ok {
+		prop = index
+	}
+	propValue, err := ctx.PropGetter([]PropAccess{{Prop: prop}}, obj)
+	return err == nil && !isNil(propValue), nil
+}
+
+// toJsString 将值转换为字符串，与 JS 中 String(v) 的结果一致
+func toJsString(v any) string {
+	if isNil(v) {
+		return "undefined"
+	}
+	switch val := v.(type) {
+	case string:
+		return val
+	case bool:
+		return strconv.FormatBool(val)
+	case []any:
+		parts := make([]string, len(val))
+		for i, item := range val {
+			if !isNil(item) {
+				parts[i] = toJsString(item)
+			}
+		}
+		return strings.Join(parts, ",")
+	case map[string]any:
+		return "[object Object]"
+	}
+	if f, ok := toFloat64(v); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// callError 返回函数调用结果中的错误：最后一个返回值是非 nil 的 error 时返回它
+func callError(results []reflect.Value) error {
+	last := results[len(results)-1]
+	if last.Kind() != reflect.Interface || !last.Type().Implements(reflect.TypeOf((*error)(nil)).Elem()) || last.IsNil() {
+		return nil
+	}
+	return last.Interface().(error)
+}
@@ -0,0 +1,60 @@
+package transpiler
+
+import (
+	"context"
+)
+
+// 异步调用
+//
+// JS 代码在同步器的 goroutine 上同步执行，没有事件循环。async 函数按普通函数执行，直接返回结果；
+// Go 实现的宿主函数可以返回 *Promise 表示一个正在进行的异步调用（例如请求外部的策略服务），
+// JS 代码用 await 阻塞等待它的结果：
+//
+//	const allowed = await policy.check("post:edit", docId);
+//
+// 宿主函数在调用时就开始执行，所以先发起多个调用再逐个 await 时这些调用是并发的。
+// await 其他值时直接返回这个值，与 JS 相同
+
+// Promise 是一个异步调用的结果
+type Promise struct {
+	done  chan struct{}
+	value any
+	err   error
+}
+
+// NewPromise 在新的 goroutine 中执行 fn，返回代表其结果的 Promise
+func NewPromise(fn func() (any, error)) *Promise {
+	p := &Promise{done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		p.value, p.err = fn()
+	}()
+	return p
+}
+
+// ResolvedPromise 返回一个已经完成的 Promise
+func ResolvedPromise(value any, err error) *Promise {
+	p := &Promise{done: make(chan struct{}), value: value, err: err}
+	close(p.done)
+	return p
+}
+
+// Await 等待 Promise 完成，ctx 先结束时返回 BudgetExceededError，
+// 这样 await 不会超出执行预算的时间限制
+func (p *Promise) Await(ctx context.Context) (any, error) {
+	select {
+	case <-p.done:
+		return p.value, p.err
+	case <-ctx.Done():
+		return nil, &BudgetExceededError{Limit: LimitDeadline}
+	}
+}
+
+// await 实现 await 表达式，value 不是 Promise 时直接返回
+func await(value any, budget *Budget) (any, error) {
+	p, ok := value.(*Promise)
+	if !ok {
+		return value, nil
+	}
+	return p.Await(budget.Context())
+}
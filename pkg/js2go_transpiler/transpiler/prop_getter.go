@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync/atomic"
 
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js_value"
 	pe "github.com/pkg/errors"
@@ -73,12 +74,57 @@ func NewPropGetter(propAccessHandlers ...PropAccessHandler) PropGetter {
 //		{Prop: "slice", Args: []any{1, 2}, IsCall: true},
 //		{Prop: "toUpperCase", IsCall: true},
 //	}
-var DefaultPropGetter = NewPropGetter(
+var DefaultPropGetter = NewPropGetter(defaultPropHandlers...)
+
+var defaultPropHandlers = []PropAccessHandler{
 	StringPropAccessHandler,
 	ArrayPropAccessHandler,
 	MethodCallHandler,
 	DataFieldAccessHandler,
-)
+}
+
+// propSite 是编译后代码中的一个属性访问位置，它缓存上次在这里成功处理访问的处理器
+//
+// 这里假设处理器能否处理一次访问只取决于对象的类型和属性名：
+// 同一位置再次访问同类型的对象时先尝试缓存的处理器，它不支持时再按顺序尝试所有处理器
+type propSite struct {
+	cache atomic.Pointer[siteHandler]
+}
+
+type siteHandler struct {
+	handlers *PropAccessHandler // 处理器列表的第一个元素，用于区分不同的处理器列表
+	typ      reflect.Type
+	index    int
+}
+
+func (s *propSite) get(f *frame, access PropAccess, obj any) (any, error) {
+	handlers := f.handlers
+	if len(handlers) == 0 {
+		return f.scope.PropGetter([]PropAccess{access}, obj)
+	}
+
+	typ := reflect.TypeOf(obj)
+	if cached := s.cache.Load(); cached != nil && cached.handlers == &handlers[0] && cached.typ == typ {
+		result, err := handlers[cached.index](access, obj)
+		if err == nil || !pe.Is(err, ErrPropNotSupport) {
+			return result, err
+		}
+	}
+
+	for i, handler := range handlers {
+		result, err := handler(access, obj)
+		if err == nil {
+			s.cache.Store(&siteHandler{handlers: &handlers[0], typ: typ, index: i})
+			return result, nil
+		}
+		// 如果错误是 ErrPropNotSupport，则继续尝试下一个处理器
+		if pe.Is(err, ErrPropNotSupport) {
+			continue
+		}
+		return nil, err
+	}
+	return nil, pe.Wrapf(ErrPropNotSupport, "unsupported property access: obj=%v, access=%v", obj, access)
+}
 
 func GetField(obj any, fieldKey string) any {
 	val := reflect.ValueOf(obj)
@@ -127,14 +173,13 @@ func MethodCallHandler(access PropAccess, obj any) (any, error) {
 	// 先尝试获取方法
 	method := val.MethodByName(prop)
 	if method.IsValid() {
-		args := make([]reflect.Value, len(access.Args))
-		for i, arg := range access.Args {
-			args[i] = reflect.ValueOf(arg)
-		}
-		results := method.Call(args)
+		results := method.Call(reflectCallArgs(method.Type(), access.Args))
 		if len(results) == 0 {
 			return nil, nil
 		}
+		if err := callError(results); pe.Is(err, ErrBudgetExceeded) {
+			return nil, err
+		}
 		// Js 不支持多值返回，因此仅返回第一个返回值
 		return results[0].Interface(), nil
 	}
@@ -152,18 +197,42 @@ func MethodCallHandler(access PropAccess, obj any) (any, error) {
 	}
 
 	// 调用函数
-	args := make([]reflect.Value, len(access.Args))
-	for i, arg := range access.Args {
-		args[i] = reflect.ValueOf(arg)
-	}
-	results := fieldVal.Call(args)
+	results := fieldVal.Call(reflectCallArgs(fieldVal.Type(), access.Args))
 	if len(results) == 0 {
 		return nil, nil
 	}
+	// 被调用的函数超出了执行预算时，整个调用必须终止
+	if err := callError(results); pe.Is(err, ErrBudgetExceeded) {
+		return nil, err
+	}
 	// Js 不支持多值返回，因此仅返回第一个返回值
 	return results[0].Interface(), nil
 }
 
+// reflectCallArgs 将参数转换为调用 fnType 类型的函数所需的 reflect.Value
+//
+// nil 参数会转换为对应形参类型的零值，否则 reflect.Value.Call 会 panic
+func reflectCallArgs(fnType reflect.Type, args []any) []reflect.Value {
+	values := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		if arg != nil {
+			values[i] = reflect.ValueOf(arg)
+			continue
+		}
+		var paramType reflect.Type
+		switch {
+		case fnType.IsVariadic() && i >= fnType.NumIn()-1:
+			paramType = fnType.In(fnType.NumIn() - 1).Elem()
+		case i < fnType.NumIn():
+			paramType = fnType.In(i)
+		default:
+			paramType = reflect.TypeOf((*any)(nil)).Elem()
+		}
+		values[i] = reflect.Zero(paramType)
+	}
+	return values
+}
+
 func DataFieldAccessHandler(access PropAccess, obj any) (any, error) {
 	if access.IsCall {
 		return nil, ErrPropNotSupport
@@ -175,10 +244,23 @@ func DataFieldAccessHandler(access PropAccess, obj any) (any, error) {
 		if field != nil {
 			return field, nil
 		}
+		// map 中存在但值为 null 的键
+		if hasMapKey(obj, prop) {
+			return nil, nil
+		}
 	}
 	return nil, ErrPropNotSupport
 }
 
+// hasMapKey 判断 obj 是否是包含键 key 的 map
+func hasMapKey(obj any, key string) bool {
+	val := reflect.ValueOf(obj)
+	if val.Kind() != reflect.Map || val.Type().Key().Kind() != reflect.String {
+		return false
+	}
+	return val.MapIndex(reflect.ValueOf(key).Convert(val.Type().Key())).IsValid()
+}
+
 func ArrayPropAccessHandler(access PropAccess, obj any) (any, error) {
 	// 检查是否是切片类型
 	val := reflect.ValueOf(obj)
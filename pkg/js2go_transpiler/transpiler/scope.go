@@ -8,26 +8,41 @@ type Scope struct {
 	PropGetter func(chain []PropAccess, obj any) (any, error)
 	// 属性赋值器
 	PropMutator PropSetter
+	// 构造 PropGetter 的属性访问处理器，不为 nil 时编译后的代码会在每个访问位置缓存选中的处理器，
+	// 为 nil 时编译后的代码直接调用 PropGetter
+	PropHandlers []PropAccessHandler
 	// 父级上下文
 	Parent *Scope
+	// 执行预算，为 nil 时使用父级上下文的预算
+	Budget *Budget
 }
 
 // NewScope 创建新的作用域
 func NewScope(parent *Scope, propGetter PropGetter, propMutator PropSetter) *Scope {
+	var propHandlers []PropAccessHandler
 	if propGetter == nil {
 		propGetter = DefaultPropGetter
+		propHandlers = defaultPropHandlers
 	}
 	if propMutator == nil {
 		propMutator = DefaultPropSetter
 	}
 	return &Scope{
-		Vars:        make(map[string]any),
-		Parent:      parent, // 保留父级引用
-		PropGetter:  propGetter,
-		PropMutator: propMutator,
+		Vars:         make(map[string]any),
+		Parent:       parent, // 保留父级引用
+		PropGetter:   propGetter,
+		PropMutator:  propMutator,
+		PropHandlers: propHandlers,
 	}
 }
 
+// NewScopeWithHandlers 创建新的作用域，属性访问器由 handlers 按顺序构造
+func NewScopeWithHandlers(parent *Scope, propMutator PropSetter, handlers ...PropAccessHandler) *Scope {
+	scope := NewScope(parent, NewPropGetter(handlers...), propMutator)
+	scope.PropHandlers = handlers
+	return scope
+}
+
 // GetVar 变量查找当前作用域内的变量，会向上追溯
 func (ctx *Scope) GetVar(name string) (any, bool) {
 	current := ctx
@@ -39,3 +54,27 @@ func (ctx *Scope) GetVar(name string) (any, bool) {
 	}
 	return nil, false
 }
+
+// SetVar 给变量赋值，会向上追溯到声明该变量的作用域；
+// 如果变量在所有作用域中都不存在，则在当前作用域中创建
+func (ctx *Scope) SetVar(name string, value any) {
+	current := ctx
+	for current != nil {
+		if _, ok := current.Vars[name]; ok {
+			current.Vars[name] = value
+			return
+		}
+		current = current.Parent
+	}
+	ctx.Vars[name] = value
+}
+
+// GetBudget 返回当前作用域使用的执行预算，会向上追溯，都没有设置时返回 nil
+func (ctx *Scope) GetBudget() *Budget {
+	for current := ctx; current != nil; current = current.Parent {
+		if current.Budget != nil {
+			return current.Budget
+		}
+	}
+	return nil
+}
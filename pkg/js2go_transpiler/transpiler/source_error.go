@@ -0,0 +1,52 @@
+package transpiler
+
+import (
+	"errors"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/ast"
+)
+
+// SourceError 记录运行时错误发生在哪个表达式上
+//
+// Idx 是出错的最内层表达式在源码中的位置（从 1 开始的字节偏移），
+// 调用方可以结合源码换算成行号和列号：
+//
+//	var srcErr *transpiler.SourceError
+//	if errors.As(err, &srcErr) {
+//		fmt.Println(srcErr.Idx)
+//	}
+type SourceError struct {
+	Idx ast.Idx
+	Err error
+}
+
+func (e *SourceError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// withSourceIdx 给 err 附上出错位置 idx，已经有位置的错误保留更内层的位置，
+// break / continue 不是错误，不需要位置
+func withSourceIdx(err error, idx ast.Idx) error {
+	var srcErr *SourceError
+	var brk *breakSignal
+	var cont *continueSignal
+	if errors.As(err, &srcErr) || errors.As(err, &brk) || errors.As(err, &cont) {
+		return err
+	}
+	return &SourceError{Idx: idx, Err: err}
+}
+
+// atSource 在编译后的表达式出错时附上它在源码中的位置
+func atSource(expr compiledExpr, idx ast.Idx) compiledExpr {
+	return func(f *frame) (any, error) {
+		value, err := expr(f)
+		if err != nil {
+			return nil, withSourceIdx(err, idx)
+		}
+		return value, nil
+	}
+}
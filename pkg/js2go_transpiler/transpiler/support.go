@@ -0,0 +1,119 @@
+package transpiler
+
+import (
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/ast"
+)
+
+// IsBuiltinGlobal 判断 name 是不是所有作用域都能访问的内置全局对象
+func IsBuiltinGlobal(name string) bool {
+	_, ok := builtinGlobals[name]
+	return ok
+}
+
+// UnsupportedSyntax 是一处执行时不支持的语法
+type UnsupportedSyntax struct {
+	// 语法在源码中的位置（从 1 开始的字节偏移）
+	Idx ast.Idx
+	// 语法的描述，例如 "new expression"
+	Syntax string
+}
+
+// FindUnsupportedSyntax 返回 node 中执行时不支持的语法
+//
+// 这些语法有的在执行到时报错，有的会被静默忽略（例如 generator 函数按普通函数执行），
+// 在加载权限定义等时候检查可以尽早发现问题
+func FindUnsupportedSyntax(node ast.VisitableNode) []UnsupportedSyntax {
+	v := &unsupportedSyntaxFinder{}
+	v.V = v
+	node.VisitWith(v)
+	return v.found
+}
+
+type unsupportedSyntaxFinder struct {
+	ast.NoopVisitor
+	found []UnsupportedSyntax
+}
+
+func (v *unsupportedSyntaxFinder) report(idx ast.Idx, syntax string) {
+	v.found = append(v.found, UnsupportedSyntax{Idx: idx, Syntax: syntax})
+}
+
+func (v *unsupportedSyntaxFinder) VisitFunctionLiteral(n *ast.FunctionLiteral) {
+	if n.Generator {
+		v.report(n.Idx0(), "generator function")
+	}
+	n.VisitChildrenWith(v)
+}
+
+func (v *unsupportedSyntaxFinder) VisitParameterList(n *ast.ParameterList) {
+	if n.Rest != nil {
+		v.report(n.Rest.Idx0(), "rest parameter")
+	}
+	n.VisitChildrenWith(v)
+}
+
+func (v *unsupportedSyntaxFinder) VisitTemplateLiteral(n *ast.TemplateLiteral) {
+	if n.Tag != nil {
+		v.report(n.Idx0(), "tagged template")
+	}
+	n.VisitChildrenWith(v)
+}
+
+// 对象字面量中的展开是支持的，只检查被展开的表达式
+func (v *unsupportedSyntaxFinder) VisitObjectLiteral(n *ast.ObjectLiteral) {
+	for i := range n.Value {
+		if spread, ok := n.Value[i].Prop.(*ast.SpreadElement); ok {
+			spread.Expression.VisitWith(v)
+			continue
+		}
+		n.Value[i].VisitWith(v)
+	}
+}
+
+func (v *unsupportedSyntaxFinder) VisitSpreadElement(n *ast.SpreadElement) {
+	v.report(n.Idx0(), "spread element")
+	n.VisitChildrenWith(v)
+}
+
+func (v *unsupportedSyntaxFinder) VisitNewExpression(n *ast.NewExpression) {
+	v.report(n.Idx0(), "new expression")
+	n.VisitChildrenWith(v)
+}
+
+func (v *unsupportedSyntaxFinder) VisitRegExpLiteral(n *ast.RegExpLiteral) {
+	v.report(n.Idx0(), "regular expression")
+}
+
+func (v *unsupportedSyntaxFinder) VisitThisExpression(n *ast.ThisExpression) {
+	v.report(n.Idx0(), "this")
+}
+
+func (v *unsupportedSyntaxFinder) VisitSuperExpression(n *ast.SuperExpression) {
+	v.report(n.Idx0(), "super")
+}
+
+func (v *unsupportedSyntaxFinder) VisitYieldExpression(n *ast.YieldExpression) {
+	v.report(n.Idx0(), "yield expression")
+	n.VisitChildrenWith(v)
+}
+
+func (v *unsupportedSyntaxFinder) VisitClassLiteral(n *ast.ClassLiteral) {
+	v.report(n.Idx0(), "class")
+}
+
+func (v *unsupportedSyntaxFinder) VisitClassDeclaration(n *ast.ClassDeclaration) {
+	v.report(n.Idx0(), "class")
+}
+
+func (v *unsupportedSyntaxFinder) VisitMetaProperty(n *ast.MetaProperty) {
+	v.report(n.Idx0(), "meta property")
+}
+
+func (v *unsupportedSyntaxFinder) VisitWithStatement(n *ast.WithStatement) {
+	v.report(n.Idx0(), "with statement")
+	n.VisitChildrenWith(v)
+}
+
+func (v *unsupportedSyntaxFinder) VisitDebuggerStatement(n *ast.DebuggerStatement) {
+	v.report(n.Idx0(), "debugger statement")
+}
@@ -52,6 +52,10 @@ func Execute(js string, ctx *Scope) (any, error) {
 	// 执行所有语句，但不返回值
 	for _, stmt := range program.Body {
 		_, err = executeStatement(stmt.Stmt, ctx)
+		var ret *returnSignal
+		if errors.As(err, &ret) {
+			break
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -87,6 +91,15 @@ func TranspileJsScriptToGoFunc(jsScript string, ctx *Scope) (func(...any) (any,
 		ctx = NewScope(nil, ctx.PropGetter, ctx.PropMutator)
 	}
 
+	fnExpr, err := parseFunctionExpression(jsScript)
+	if err != nil {
+		return nil, err
+	}
+	return TranspileJsAstToGoFunc(fnExpr, ctx)
+}
+
+// parseFunctionExpression 解析单个箭头函数或匿名函数表达式
+func parseFunctionExpression(jsScript string) (ast.Expr, error) {
 	// 将函数包装为变量声明语句
 	wrappedJS := "var _ = " + jsScript + ";"
 
@@ -112,26 +125,50 @@ func TranspileJsScriptToGoFunc(jsScript string, ctx *Scope) (func(...any) (any,
 	}
 
 	// 验证函数类型
-	var fnExpr ast.Expr
 	switch expr := init.Expr.(type) {
-	case *ast.ArrowFunctionLiteral:
-		fnExpr = expr
-	case *ast.FunctionLiteral:
-		fnExpr = expr
+	case *ast.ArrowFunctionLiteral, *ast.FunctionLiteral:
+		return expr, nil
 	default:
 		return nil, pe.WithStack(errors.New("input is not a function expression"))
 	}
+}
 
-	return TranspileJsAstToGoFunc(fnExpr, ctx)
+// executeFunctionBody 执行函数体，返回 return 语句的值，没有执行 return 时返回 nil
+func executeFunctionBody(body ast.Statements, ctx *Scope) (any, error) {
+	for _, stmt := range body {
+		result, err := executeStatement(stmt.Stmt, ctx)
+		if err != nil {
+			var ret *returnSignal
+			if errors.As(err, &ret) {
+				return ret.value, nil
+			}
+			return nil, err
+		}
+		if result != nil {
+			return result, nil
+		}
+	}
+	return nil, nil
 }
 
 func executeStatement(stmt ast.Stmt, ctx *Scope) (any, error) {
+	if err := ctx.GetBudget().Step(); err != nil {
+		return nil, err
+	}
+
 	switch s := stmt.(type) {
 	case *ast.ReturnStatement:
+		// return 以 returnSignal 的形式向上传播，直到所在的函数体，
+		// 这样嵌套在块、循环、switch 和 try 中的 return 也能结束函数，包括返回 null 的情况
+		var value any
 		if s.Argument != nil {
-			return executeExpression(s.Argument.Expr, ctx)
+			var err error
+			value, err = executeExpression(s.Argument.Expr, ctx)
+			if err != nil {
+				return nil, err
+			}
 		}
-		return nil, nil
+		return nil, &returnSignal{value: value}
 
 	case *ast.ExpressionStatement:
 		// 执行表达式但不返回值
@@ -139,18 +176,12 @@ func executeStatement(stmt ast.Stmt, ctx *Scope) (any, error) {
 		return nil, err
 
 	case *ast.BlockStatement:
-		// 执行块中的每个语句，并检查是否有返回值
+		// 执行块中的每个语句，return 以 returnSignal 的形式随 err 传播
 		for _, stmt := range s.List {
 			result, err := executeStatement(stmt.Stmt, ctx)
 			if err != nil {
 				return nil, err
 			}
-			// 对于 return 语句，需要特殊处理，我们需要传播所有返回值，包括 nil 和 false
-			if _, isReturn := stmt.Stmt.(*ast.ReturnStatement); isReturn {
-				return result, nil
-			}
-
-			// 对于其他可能生成返回值的语句（如 IfStatement 内部包含 return），检查 result
 			if result != nil {
 				return result, nil
 			}
@@ -248,7 +279,29 @@ func executeStatement(stmt ast.Stmt, ctx *Scope) (any, error) {
 				}
 			}
 		}
-		return nil, pe.WithStack(fmt.Errorf("unsupported label statement: %v", s.Label.Name))
+		return executeLabelledStatement(s, ctx)
+
+	case *ast.ForStatement, *ast.ForOfStatement, *ast.ForInStatement, *ast.WhileStatement, *ast.DoWhileStatement:
+		return executeLoop(s, ctx, "")
+
+	case *ast.BreakStatement:
+		return nil, &breakSignal{label: labelName(s.Label)}
+
+	case *ast.ContinueStatement:
+		return nil, &continueSignal{label: labelName(s.Label)}
+
+	case *ast.SwitchStatement:
+		return executeSwitch(s, ctx)
+
+	case *ast.ThrowStatement:
+		value, err := executeExpression(s.Argument.Expr, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &ThrowError{Value: value}
+
+	case *ast.TryStatement:
+		return executeTry(s, ctx)
 
 	case *ast.FunctionDeclaration:
 		// 处理函数声明
@@ -318,12 +371,7 @@ func executeStatement(stmt ast.Stmt, ctx *Scope) (any, error) {
 				}
 			}
 
-			var result any
-			for _, stmt := range fnLit.Body.List {
-				if ret, err := executeStatement(stmt.Stmt, childCtx); err == nil {
-					result = ret // 捕获最后一个返回值
-				}
-			}
+			result, _ := executeFunctionBody(fnLit.Body.List, childCtx)
 			return result
 		}
 
@@ -336,13 +384,26 @@ func executeStatement(stmt ast.Stmt, ctx *Scope) (any, error) {
 }
 
 func executeExpression(expr ast.Expr, ctx *Scope) (any, error) {
+	value, err := evaluateExpression(expr, ctx)
+	if err != nil {
+		return nil, withSourceIdx(err, expr.Idx0())
+	}
+	return value, nil
+}
+
+// evaluateExpression 执行单个表达式，出错位置由 executeExpression 附加
+func evaluateExpression(expr ast.Expr, ctx *Scope) (any, error) {
+	if err := ctx.GetBudget().Step(); err != nil {
+		return nil, err
+	}
+
 	switch e := expr.(type) {
 	case *ast.NumberLiteral:
 		return e.Value, nil
 	case *ast.StringLiteral:
 		return e.Value, nil
 	case *ast.Identifier:
-		if val, ok := ctx.GetVar(e.Name); ok {
+		if val, ok := lookupIdentifier(e.Name, ctx); ok {
 			return val, nil
 		}
 		return nil, pe.WithStack(fmt.Errorf("undefined identifier: %s", e.Name))
@@ -544,13 +605,13 @@ func executeExpression(expr ast.Expr, ctx *Scope) (any, error) {
 			return nil, err
 		}
 
-		args := make([]reflect.Value, len(e.ArgumentList))
+		args := make([]any, len(e.ArgumentList))
 		for i, arg := range e.ArgumentList {
 			val, err := executeExpression(arg.Expr, ctx)
 			if err != nil {
 				return nil, err
 			}
-			args[i] = reflect.ValueOf(val)
+			args[i] = val
 		}
 
 		// 调用函数
@@ -559,10 +620,13 @@ func executeExpression(expr ast.Expr, ctx *Scope) (any, error) {
 			return nil, pe.WithStack(fmt.Errorf("not a callable function: %v", callee))
 		}
 
-		results := fn.Call(args)
+		results := fn.Call(reflectCallArgs(fn.Type(), args))
 		if len(results) == 0 {
 			return nil, nil
 		}
+		if err := callError(results); err != nil {
+			return nil, err
+		}
 
 		// 特殊处理 fmt.Println 类函数
 		if len(results) == 2 && fn.Type().Out(0).Kind() == reflect.Int {
@@ -572,6 +636,28 @@ func executeExpression(expr ast.Expr, ctx *Scope) (any, error) {
 
 		return results[0].Interface(), nil
 
+	case *ast.TemplateLiteral:
+		return executeTemplateLiteral(e, ctx)
+
+	case *ast.OptionalChain:
+		return executeOptionalChain(e, ctx)
+
+	case *ast.Optional:
+		return executeOptional(e, ctx)
+
+	case *ast.UpdateExpression:
+		return executeUpdateExpression(e, ctx)
+
+	case *ast.SequenceExpression:
+		return executeSequenceExpression(e, ctx)
+
+	case *ast.AwaitExpression:
+		value, err := executeExpression(e.Argument.Expr, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return await(value, ctx.GetBudget())
+
 	case *ast.BooleanLiteral:
 		return e.Value, nil
 
@@ -605,6 +691,12 @@ func executeExpression(expr ast.Expr, ctx *Scope) (any, error) {
 				return false, nil
 			}
 			return isTruthy(right), nil
+
+		case token.Coalesce: // ??
+			if !isNil(left) {
+				return left, nil
+			}
+			return executeExpression(e.Right.Expr, ctx)
 		}
 
 		right, err := executeExpression(e.Right.Expr, ctx)
@@ -613,103 +705,13 @@ func executeExpression(expr ast.Expr, ctx *Scope) (any, error) {
 		}
 
 		// 执行运算
-		switch e.Operator {
-		case token.Plus:
-			// 字符串拼接
-			if ls, ok := left.(string); ok {
-				// 如果左边是字符串，将右边转换为字符串并拼接
-				return ls + fmt.Sprintf("%v", right), nil
-			} else if rs, ok := right.(string); ok {
-				// 如果右边是字符串，将左边转换为字符串并拼接
-				return fmt.Sprintf("%v", left) + rs, nil
-			}
-			// 数字相加
-			lv, lok := toFloat64(left)
-			rv, rok := toFloat64(right)
-			if !lok || !rok {
-				return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: %v + %v", left, right))
-			}
-			return lv + rv, nil
+		return applyBinaryOperator(e.Operator, left, right, ctx)
 
-		case token.Minus:
-			lv, lok := toFloat64(left)
-			rv, rok := toFloat64(right)
-			if !lok || !rok {
-				return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: %v - %v", left, right))
-			}
-			return lv - rv, nil
-
-		case token.Multiply:
-			lv, lok := toFloat64(left)
-			rv, rok := toFloat64(right)
-			if !lok || !rok {
-				return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: %v * %v", left, right))
-			}
-			return lv * rv, nil
-
-		case token.Slash:
-			lv, lok := toFloat64(left)
-			rv, rok := toFloat64(right)
-			if !lok || !rok {
-				return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: %v / %v", left, right))
-			}
-			if rv == 0 {
-				return nil, pe.WithStack(fmt.Errorf("division by zero"))
-			}
-			return lv / rv, nil
-
-		case token.Remainder:
-			lv, lok := toFloat64(left)
-			rv, rok := toFloat64(right)
-			if !lok || !rok {
-				return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: %v %% %v", left, right))
-			}
-			if rv == 0 {
-				return nil, pe.WithStack(fmt.Errorf("division by zero"))
-			}
-			return float64(int64(lv) % int64(rv)), nil
-
-		case token.Equal, token.StrictEqual:
-			cmp, err := js_value.DeepComapreJsValue(left, right)
-			if err != nil {
-				return nil, err
-			}
-			return cmp == 0, nil
-		case token.NotEqual, token.StrictNotEqual:
-			cmp, err := js_value.DeepComapreJsValue(left, right)
-			if err != nil {
-				return nil, err
-			}
-			return cmp != 0, nil
-		case token.Greater:
-			cmp, err := js_value.DeepComapreJsValue(left, right)
-			if err != nil {
-				return nil, err
-			}
-			return cmp > 0, nil
-		case token.Less:
-			cmp, err := js_value.DeepComapreJsValue(left, right)
-			if err != nil {
-				return nil, err
-			}
-			return cmp < 0, nil
-		case token.GreaterOrEqual:
-			cmp, err := js_value.DeepComapreJsValue(left, right)
-			if err != nil {
-				return nil, err
-			}
-			return cmp >= 0, nil
-		case token.LessOrEqual:
-			cmp, err := js_value.DeepComapreJsValue(left, right)
-			if err != nil {
-				return nil, err
-			}
-			return cmp <= 0, nil
-		default:
-			return nil, pe.WithStack(fmt.Errorf("unsupported operator: %v", e.Operator))
+	case *ast.UnaryExpression:
+		if e.Operator == token.Typeof {
+			return executeTypeof(e.Operand.Expr, ctx)
 		}
 
-	case *ast.UnaryExpression:
 		operand, err := executeExpression(e.Operand.Expr, ctx)
 		if err != nil {
 			return nil, err
@@ -746,17 +748,34 @@ func executeExpression(expr ast.Expr, ctx *Scope) (any, error) {
 		return executeExpression(e.Alternate.Expr, ctx)
 
 	case *ast.AssignExpression:
+		// 复合赋值（如 +=）先取出左值的当前值
+		var current any
+		if e.Operator != token.Assign {
+			var err error
+			current, err = executeExpression(e.Left.Expr, ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		// 获取右值
 		right, err := executeExpression(e.Right.Expr, ctx)
 		if err != nil {
 			return nil, err
 		}
+		if e.Operator != token.Assign {
+			right, err = applyBinaryOperator(e.Operator, current, right, ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
 
 		// 处理左值
 		switch target := e.Left.Expr.(type) {
-		case *ast.Identifier:
-			// 变量赋值
-			ctx.Vars[target.Name] = right
+		case *ast.Identifier, *ast.MemberExpression:
+			if err := assignTo(target, right, ctx); err != nil {
+				return nil, err
+			}
 			return right, nil
 
 		case *ast.ObjectPattern:
@@ -802,43 +821,6 @@ func executeExpression(expr ast.Expr, ctx *Scope) (any, error) {
 			}
 			return right, nil
 
-		case *ast.MemberExpression:
-			// 对象属性赋值
-			obj, err := executeExpression(target.Object.Expr, ctx)
-			if err != nil {
-				return nil, err
-			}
-
-			// 获取属性名
-			var propName any
-			switch prop := target.Property.Prop.(type) {
-			case *ast.Identifier:
-				propName = prop.Name
-			case *ast.ComputedProperty:
-				val, err := executeExpression(prop.Expr.Expr, ctx)
-				if err != nil {
-					return nil, err
-				}
-				// 将计算结果转换为字符串或整数，因为属性名只能是字符串或整数
-				switch val := val.(type) {
-				case string:
-					propName = val
-				case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
-					propName = util.ToInt(val)
-				default:
-					return nil, pe.WithStack(fmt.Errorf("unsupported property type: %T", val))
-				}
-			default:
-				return nil, pe.WithStack(fmt.Errorf("unsupported property type: %T", prop))
-			}
-
-			// 使用 PropMutator 设置属性值
-			err = ctx.PropMutator(obj, propName, right)
-			if err != nil {
-				return nil, err
-			}
-			return right, nil
-
 		default:
 			return nil, pe.WithStack(fmt.Errorf("invalid assignment target: %T", target))
 		}
@@ -934,18 +916,7 @@ func executeExpression(expr ast.Expr, ctx *Scope) (any, error) {
 				}
 			}
 
-			// 修改函数体执行逻辑，支持 early return
-			for _, stmt := range e.Body.List {
-				ret, err := executeStatement(stmt.Stmt, childCtx)
-				if err != nil {
-					return nil, err
-				}
-				// 如果语句产生了非 nil 返回值（例如 return 语句），立即返回
-				if _, isReturn := stmt.Stmt.(*ast.ReturnStatement); isReturn || ret != nil {
-					return ret, nil
-				}
-			}
-			return nil, nil
+			return executeFunctionBody(e.Body.List, childCtx)
 		}, nil
 
 	case *ast.ArrowFunctionLiteral:
@@ -982,10 +953,8 @@ func executeExpression(expr ast.Expr, ctx *Scope) (any, error) {
 							switch p := prop.Prop.(type) {
 							case *ast.PropertyShort:
 								propName := p.Name.Name
-								value, err := ctx.PropGetter([]PropAccess{{Prop: propName, IsCall: false}}, objArg)
-								if err != nil {
-									continue
-								}
+								// 属性不存在时视为 undefined
+								value, _ := ctx.PropGetter([]PropAccess{{Prop: propName, IsCall: false}}, objArg)
 
 								// 如果属性值为nil且存在默认值，则使用默认值
 								if value == nil && p.Initializer != nil {
@@ -1034,17 +1003,7 @@ func executeExpression(expr ast.Expr, ctx *Scope) (any, error) {
 			switch body := e.Body.Body.(type) {
 			case *ast.BlockStatement:
 				// 使用代码块的箭头函数
-				for _, stmt := range body.List {
-					ret, err := executeStatement(stmt.Stmt, childCtx)
-					if err != nil {
-						return nil, err
-					}
-					// 如果语句产生了非 nil 返回值（例如 return 语句），立即返回
-					if ret != nil {
-						return ret, nil
-					}
-				}
-				return nil, nil
+				return executeFunctionBody(body.List, childCtx)
 			case *ast.Expression:
 				// 表达式体箭头函数
 				ret, err := executeExpression(body.Expr, childCtx)
@@ -1059,6 +1018,107 @@ func executeExpression(expr ast.Expr, ctx *Scope) (any, error) {
 	}
 }
 
+// applyBinaryOperator 计算二元运算 left operator right 的结果，不包括 &&、|| 和 ?? 等短路运算
+func applyBinaryOperator(operator token.Token, left, right any, ctx *Scope) (any, error) {
+	switch operator {
+	case token.Plus:
+		// 字符串拼接
+		if ls, ok := left.(string); ok {
+			// 如果左边是字符串，将右边转换为字符串并拼接
+			return ls + fmt.Sprintf("%v", right), nil
+		} else if rs, ok := right.(string); ok {
+			// 如果右边是字符串，将左边转换为字符串并拼接
+			return fmt.Sprintf("%v", left) + rs, nil
+		}
+		// 数字相加
+		lv, lok := toFloat64(left)
+		rv, rok := toFloat64(right)
+		if !lok || !rok {
+			return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: %v + %v", left, right))
+		}
+		return lv + rv, nil
+
+	case token.Minus:
+		lv, lok := toFloat64(left)
+		rv, rok := toFloat64(right)
+		if !lok || !rok {
+			return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: %v - %v", left, right))
+		}
+		return lv - rv, nil
+
+	case token.Multiply:
+		lv, lok := toFloat64(left)
+		rv, rok := toFloat64(right)
+		if !lok || !rok {
+			return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: %v * %v", left, right))
+		}
+		return lv * rv, nil
+
+	case token.Slash:
+		lv, lok := toFloat64(left)
+		rv, rok := toFloat64(right)
+		if !lok || !rok {
+			return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: %v / %v", left, right))
+		}
+		if rv == 0 {
+			return nil, pe.WithStack(fmt.Errorf("division by zero"))
+		}
+		return lv / rv, nil
+
+	case token.Remainder:
+		lv, lok := toFloat64(left)
+		rv, rok := toFloat64(right)
+		if !lok || !rok {
+			return nil, pe.WithStack(fmt.Errorf("invalid numeric operation: %v %% %v", left, right))
+		}
+		if rv == 0 {
+			return nil, pe.WithStack(fmt.Errorf("division by zero"))
+		}
+		return float64(int64(lv) % int64(rv)), nil
+
+	case token.Equal, token.StrictEqual:
+		cmp, err := js_value.DeepComapreJsValue(left, right)
+		if err != nil {
+			return nil, err
+		}
+		return cmp == 0, nil
+	case token.NotEqual, token.StrictNotEqual:
+		cmp, err := js_value.DeepComapreJsValue(left, right)
+		if err != nil {
+			return nil, err
+		}
+		return cmp != 0, nil
+	case token.Greater:
+		cmp, err := js_value.DeepComapreJsValue(left, right)
+		if err != nil {
+			return nil, err
+		}
+		return cmp > 0, nil
+	case token.Less:
+		cmp, err := js_value.DeepComapreJsValue(left, right)
+		if err != nil {
+			return nil, err
+		}
+		return cmp < 0, nil
+	case token.GreaterOrEqual:
+		cmp, err := js_value.DeepComapreJsValue(left, right)
+		if err != nil {
+			return nil, err
+		}
+		return cmp >= 0, nil
+	case token.LessOrEqual:
+		cmp, err := js_value.DeepComapreJsValue(left, right)
+		if err != nil {
+			return nil, err
+		}
+		return cmp <= 0, nil
+	case token.In:
+		return hasProperty(right, left, ctx)
+	default:
+		return nil, pe.WithStack(fmt.Errorf("unsupported operator: %v", operator))
+	}
+}
+
 // toFloat64 将值转换为 float64，并返回是否转换成功
 func toFloat64(v any) (float64, bool) {
 	switch val := v.(type) {
@@ -0,0 +1,59 @@
+package key_utils
+
+import (
+	"strings"
+
+	pe "github.com/pkg/errors"
+)
+
+// The fixed-width layout (KEY_LAYOUT_FIXED_WIDTH) is only kept to migrate
+// databases created before the escaped layout.
+
+const (
+	COLLECTION_SIZE_IN_BYTES = 16 // Maximum bytes for collection name
+	DOC_ID_SIZE_IN_BYTES     = 16 // Maximum bytes for document ID
+)
+
+// Total bytes for a fixed-width document key = prefix(1) + collection name bytes(16) + sep(1) + doc id bytes(16)
+var KEY_SIZE_IN_BYTES = 1 + COLLECTION_SIZE_IN_BYTES + 1 + DOC_ID_SIZE_IN_BYTES
+
+// CalcFixedWidthDocKey calculates the key for a document in the fixed-width layout.
+// Key format is "d<collectionName>:<docID>", each field is padded with 0x00 to a fixed length.
+// Returns an error if collectionName or docID exceeds the maximum length limit.
+func CalcFixedWidthDocKey(collectionName, docID string) ([]byte, error) {
+	if len(collectionName) > COLLECTION_SIZE_IN_BYTES {
+		return nil, pe.Errorf("collection name too large: %s", collectionName)
+	}
+	if len(docID) > DOC_ID_SIZE_IN_BYTES {
+		return nil, pe.Errorf("doc id too large: %s", docID)
+	}
+
+	result := make([]byte, KEY_SIZE_IN_BYTES)
+	n := copy(result, DOC_KEY_PREFIX)
+	copy(result[n:], collectionName)
+	n += COLLECTION_SIZE_IN_BYTES
+	result[n] = ':'
+	n++
+	copy(result[n:], docID)
+	return result, nil
+}
+
+// IsFixedWidthDocKey reports whether key has the shape of a fixed-width document key.
+func IsFixedWidthDocKey(key []byte) bool {
+	return len(key) == KEY_SIZE_IN_BYTES &&
+		strings.HasPrefix(string(key), DOC_KEY_PREFIX) &&
+		key[len(DOC_KEY_PREFIX)+COLLECTION_SIZE_IN_BYTES] == ':'
+}
+
+// ParseFixedWidthDocKey extracts the collection name and the document ID from a
+// fixed-width document key, trailing 0x00 bytes of both fields are removed.
+func ParseFixedWidthDocKey(key []byte) (collectionName string, docID string, err error) {
+	if !IsFixedWidthDocKey(key) {
+		return "", "", pe.Errorf("not a fixed-width doc key: %q", key)
+	}
+	n := len(DOC_KEY_PREFIX)
+	collectionName = strings.TrimRight(string(key[n:n+COLLECTION_SIZE_IN_BYTES]), "\x00")
+	n += COLLECTION_SIZE_IN_BYTES + 1
+	docID = strings.TrimRight(string(key[n:n+DOC_ID_SIZE_IN_BYTES]), "\x00")
+	return collectionName, docID, nil
+}
@@ -1,127 +1,278 @@
 package key_utils
 
 import (
-	"strings"
+	"bytes"
+	"encoding/binary"
 
 	pe "github.com/pkg/errors"
 )
 
 const (
-	STORAGE_META_KEY         = "m" // Key for storing metadata
-	DOC_KEY_PREFIX           = "d" // Prefix for document keys
-	COLLECTION_SIZE_IN_BYTES = 16  // Maximum bytes for collection name
-	DOC_ID_SIZE_IN_BYTES     = 16  // Maximum bytes for document ID
+	STORAGE_META_KEY     = "m" // Key for storing metadata
+	DOC_KEY_PREFIX       = "d" // Prefix for document keys
+	HISTORY_KEY_PREFIX   = "h" // Prefix for document history keys
+	TOMBSTONE_KEY_PREFIX = "t" // Prefix for the index of deleted documents
+	PURGED_KEY_PREFIX    = "p" // Prefix for the records of purged documents
+	TTL_KEY_PREFIX       = "x" // Prefix for the index of document expiry times
+	JOURNAL_KEY_PREFIX   = "j" // Prefix for the transactions of the commit journal
 )
 
-// Total bytes for a document key = prefix(1) + collection name bytes(16) + sep(1) + doc id bytes(16)
-var KEY_SIZE_IN_BYTES = 1 + COLLECTION_SIZE_IN_BYTES + 1 + DOC_ID_SIZE_IN_BYTES
+// Key layouts. The layout used by a database is recorded in its meta, databases
+// created with an older layout have to be migrated before they can be opened.
+const (
+	// KEY_LAYOUT_FIXED_WIDTH pads collection names and doc ids to a fixed length,
+	// see CalcFixedWidthDocKey
+	KEY_LAYOUT_FIXED_WIDTH uint8 = 1
+	// KEY_LAYOUT_ESCAPED is the variable-length layout described in CalcDocKey
+	KEY_LAYOUT_ESCAPED uint8 = 2
+	// CURRENT_KEY_LAYOUT is the layout of the keys calculated by CalcDocKey
+	CURRENT_KEY_LAYOUT = KEY_LAYOUT_ESCAPED
+)
+
+const (
+	escapeByte     = 0x00
+	escapedNul     = 0xFF // 0x00 0xFF is a 0x00 byte in the collection name
+	terminatorByte = 0x01 // 0x00 0x01 ends the collection name
+)
 
 // CalcDocKey calculates the key for a document.
-// Key format is "d<collectionName>:<docID>", each field is padded to a fixed length.
-// Returns an error if collectionName or docID exceeds the maximum length limit.
+//
+// Key format is "d<escaped collectionName>\x00\x01<docID>". 0x00 bytes in the
+// collection name are escaped as 0x00 0xFF, so the terminator 0x00 0x01 is
+// unambiguous and sorts before any other continuation of the name. Keys of a
+// collection are therefore contiguous, ordered by doc id, and collections are
+// ordered by name.
+//
+// Returns an error if collectionName is empty.
 func CalcDocKey(collectionName, docID string) ([]byte, error) {
-	// Check length limits first
-	if len(collectionName) > COLLECTION_SIZE_IN_BYTES {
-		return nil, pe.Errorf("collection name too large: %s", collectionName)
-	}
-	if len(docID) > DOC_ID_SIZE_IN_BYTES {
-		return nil, pe.Errorf("doc id too large: %s", docID)
+	return calcPrefixedDocKey(DOC_KEY_PREFIX, collectionName, docID)
+}
+
+// appendEscaped appends s with 0x00 bytes escaped, followed by the terminator
+func appendEscaped(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == escapeByte {
+			dst = append(dst, escapeByte, escapedNul)
+			continue
+		}
+		dst = append(dst, s[i])
 	}
+	return append(dst, escapeByte, terminatorByte)
+}
 
-	result := make([]byte, KEY_SIZE_IN_BYTES)
-	n := copy(result, DOC_KEY_PREFIX)
+// CalcTombstoneKey calculates the key of a deleted document in the tombstone
+// index. The layout is the one of CalcDocKey with the prefix "t".
+// Returns an error if collectionName is empty.
+func CalcTombstoneKey(collectionName, docID string) ([]byte, error) {
+	return calcPrefixedDocKey(TOMBSTONE_KEY_PREFIX, collectionName, docID)
+}
+
+// CalcPurgedKey calculates the key of the record of a purged document. The
+// layout is the one of CalcDocKey with the prefix "p".
+// Returns an error if collectionName is empty.
+func CalcPurgedKey(collectionName, docID string) ([]byte, error) {
+	return calcPrefixedDocKey(PURGED_KEY_PREFIX, collectionName, docID)
+}
 
-	// Pad collection name
-	collectionNameLen := copy(result[n:], collectionName)
-	for i := n + collectionNameLen; i < n+COLLECTION_SIZE_IN_BYTES; i++ {
-		result[i] = 0
+// ParseTombstoneKey extracts the collection name and the document ID from a tombstone key.
+func ParseTombstoneKey(key []byte) (collectionName string, docID string, err error) {
+	return parsePrefixedDocKey(TOMBSTONE_KEY_PREFIX, "tombstone", key)
+}
+
+// ParsePurgedKey extracts the collection name and the document ID from a purged key.
+func ParsePurgedKey(key []byte) (collectionName string, docID string, err error) {
+	return parsePrefixedDocKey(PURGED_KEY_PREFIX, "purged", key)
+}
+
+func calcPrefixedDocKey(prefix, collectionName, docID string) ([]byte, error) {
+	if collectionName == "" {
+		return nil, pe.Errorf("collection name is empty")
 	}
-	n += COLLECTION_SIZE_IN_BYTES
-	result[n] = ':'
-	n++
+	result := make([]byte, 0, len(prefix)+len(collectionName)+2+len(docID))
+	result = append(result, prefix...)
+	result = appendEscaped(result, collectionName)
+	result = append(result, docID...)
+	return result, nil
+}
 
-	// Pad document ID
-	docIDLen := copy(result[n:], docID)
-	for i := n + docIDLen; i < n+DOC_ID_SIZE_IN_BYTES; i++ {
-		result[i] = 0
+func parsePrefixedDocKey(prefix, kind string, key []byte) (collectionName string, docID string, err error) {
+	if !bytes.HasPrefix(key, []byte(prefix)) {
+		return "", "", pe.Errorf("not a %s key: %q", kind, key)
 	}
+	collectionName, rest, err := cutEscaped(key[len(prefix):])
+	if err != nil {
+		return "", "", pe.Wrapf(err, "invalid %s key: %q", kind, key)
+	}
+	if collectionName == "" {
+		return "", "", pe.Errorf("empty collection name in %s key: %q", kind, key)
+	}
+	return collectionName, string(rest), nil
+}
 
+// CalcTtlKey calculates the key of a document in the TTL index.
+//
+// Key format is "x<expiresAt><escaped collectionName>\x00\x01<docID>",
+// expiresAt is a big-endian uint64 of unix milliseconds, so the index is
+// ordered by expiry time.
+//
+// Returns an error if collectionName is empty.
+func CalcTtlKey(expiresAt uint64, collectionName, docID string) ([]byte, error) {
+	if collectionName == "" {
+		return nil, pe.Errorf("collection name is empty")
+	}
+	result := make([]byte, 0, len(TTL_KEY_PREFIX)+8+len(collectionName)+2+len(docID))
+	result = append(result, TTL_KEY_PREFIX...)
+	result = binary.BigEndian.AppendUint64(result, expiresAt)
+	result = appendEscaped(result, collectionName)
+	result = append(result, docID...)
 	return result, nil
 }
 
-// CalcCollectionLowerBound calculates the lower bound of the key range for a collection.
-// Lower bound format is "d<collectionName>:", each field is padded to a fixed length, followed by 0s.
-// Returns an error if collectionName exceeds the maximum length limit.
-func CalcCollectionLowerBound(collectionName string) ([]byte, error) {
-	result := make([]byte, KEY_SIZE_IN_BYTES)
-	n := copy(result, DOC_KEY_PREFIX)
+// CalcTtlUpperBound calculates the exclusive upper bound of the keys of the
+// documents in the TTL index that expire before expiresAt. The lower bound of
+// the index is TTL_KEY_PREFIX.
+func CalcTtlUpperBound(expiresAt uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(TTL_KEY_PREFIX), expiresAt)
+}
 
-	// Pad collection name
-	collectionNameLen := copy(result[n:], collectionName)
-	if collectionNameLen > COLLECTION_SIZE_IN_BYTES {
-		return nil, pe.Errorf("collection name too large: %s", collectionName)
+// ParseTtlKey extracts the expiry time, the collection name and the document ID
+// from a TTL index key.
+func ParseTtlKey(key []byte) (expiresAt uint64, collectionName string, docID string, err error) {
+	if !bytes.HasPrefix(key, []byte(TTL_KEY_PREFIX)) || len(key) < len(TTL_KEY_PREFIX)+8 {
+		return 0, "", "", pe.Errorf("not a ttl key: %q", key)
 	}
-	for i := n + collectionNameLen; i < n+COLLECTION_SIZE_IN_BYTES; i++ {
-		result[i] = 0
+	expiresAt = binary.BigEndian.Uint64(key[len(TTL_KEY_PREFIX):])
+	collectionName, rest, err := cutEscaped(key[len(TTL_KEY_PREFIX)+8:])
+	if err != nil || collectionName == "" {
+		return 0, "", "", pe.Errorf("invalid ttl key: %q", key)
 	}
-	n += COLLECTION_SIZE_IN_BYTES
-	result[n] = ':'
-	n++
+	return expiresAt, collectionName, string(rest), nil
+}
+
+// CalcJournalKey calculates the key of the transaction committed with seq in
+// the commit journal.
+//
+// Key format is "j<seq>", seq is a big-endian uint64, so the journal is ordered
+// by seq.
+func CalcJournalKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte(JOURNAL_KEY_PREFIX), seq)
+}
 
-	// Pad the document ID part with 0s
-	for i := n; i < KEY_SIZE_IN_BYTES; i++ {
-		result[i] = 0
+// CalcDocHistoryKey calculates the key of a version in the history of a document.
+//
+// Key format is "h<escaped collectionName>\x00\x01<escaped docID>\x00\x01<seq>",
+// seq is a big-endian uint64, so the versions of a document are contiguous and
+// ordered by seq.
+//
+// Returns an error if collectionName is empty.
+func CalcDocHistoryKey(collectionName, docID string, seq uint64) ([]byte, error) {
+	result, err := CalcDocHistoryLowerBound(collectionName, docID)
+	if err != nil {
+		return nil, err
 	}
+	return binary.BigEndian.AppendUint64(result, seq), nil
+}
 
-	return result, nil
+// CalcDocHistoryLowerBound calculates the (inclusive) lower bound of the key
+// range of the history of a document.
+// Returns an error if collectionName is empty.
+func CalcDocHistoryLowerBound(collectionName, docID string) ([]byte, error) {
+	if collectionName == "" {
+		return nil, pe.Errorf("collection name is empty")
+	}
+	result := make([]byte, 0, len(HISTORY_KEY_PREFIX)+len(collectionName)+len(docID)+12)
+	result = append(result, HISTORY_KEY_PREFIX...)
+	result = appendEscaped(result, collectionName)
+	return appendEscaped(result, docID), nil
 }
 
-// CalcCollectionUpperBound calculates the upper bound of the key range for a collection.
-// Upper bound format is "d<collectionName>:", each field is padded to a fixed length, followed by 0xFF.
-// Returns an error if collectionName exceeds the maximum length limit.
-func CalcCollectionUpperBound(collectionName string) ([]byte, error) {
-	result := make([]byte, KEY_SIZE_IN_BYTES)
-	n := copy(result, DOC_KEY_PREFIX)
+// CalcDocHistoryUpperBound calculates the exclusive upper bound of the key range
+// of the history of a document.
+// Returns an error if collectionName is empty.
+func CalcDocHistoryUpperBound(collectionName, docID string) ([]byte, error) {
+	result, err := CalcDocHistoryLowerBound(collectionName, docID)
+	if err != nil {
+		return nil, err
+	}
+	result[len(result)-1]++
+	return result, nil
+}
 
-	// Pad collection name
-	collectionNameLen := copy(result[n:], collectionName)
-	if collectionNameLen > COLLECTION_SIZE_IN_BYTES {
-		return nil, pe.Errorf("collection name too large: %s", collectionName)
+// ParseDocHistoryKey extracts the collection name, the document ID and the seq
+// from a document history key.
+func ParseDocHistoryKey(key []byte) (collectionName string, docID string, seq uint64, err error) {
+	if !bytes.HasPrefix(key, []byte(HISTORY_KEY_PREFIX)) {
+		return "", "", 0, pe.Errorf("not a doc history key: %q", key)
 	}
-	for i := n + collectionNameLen; i < n+COLLECTION_SIZE_IN_BYTES; i++ {
-		result[i] = 0
+	rest := key[len(HISTORY_KEY_PREFIX):]
+	collectionName, rest, err = cutEscaped(rest)
+	if err != nil || collectionName == "" {
+		return "", "", 0, pe.Errorf("invalid doc history key: %q", key)
 	}
-	n += COLLECTION_SIZE_IN_BYTES
-	result[n] = ':'
-	n++
+	docID, rest, err = cutEscaped(rest)
+	if err != nil || len(rest) != 8 {
+		return "", "", 0, pe.Errorf("invalid doc history key: %q", key)
+	}
+	return collectionName, docID, binary.BigEndian.Uint64(rest), nil
+}
 
-	// Pad the document ID part with 0xFF
-	for i := n; i < KEY_SIZE_IN_BYTES; i++ {
-		result[i] = 0xFF
+// cutEscaped unescapes the leading escaped string of b and returns it with the
+// bytes after its terminator
+func cutEscaped(b []byte) (string, []byte, error) {
+	s := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] != escapeByte {
+			s = append(s, b[i])
+			continue
+		}
+		if i+1 >= len(b) {
+			break
+		}
+		switch b[i+1] {
+		case escapedNul:
+			s = append(s, escapeByte)
+			i++
+		case terminatorByte:
+			return string(s), b[i+2:], nil
+		default:
+			return "", nil, pe.Errorf("invalid escape")
+		}
 	}
+	return "", nil, pe.Errorf("unterminated string")
+}
+
+// CalcCollectionLowerBound calculates the (inclusive) lower bound of the key
+// range for a collection, which is the key of the empty doc id.
+// Returns an error if collectionName is empty.
+func CalcCollectionLowerBound(collectionName string) ([]byte, error) {
+	return CalcDocKey(collectionName, "")
+}
 
+// CalcCollectionUpperBound calculates the exclusive upper bound of the key range
+// for a collection, it replaces the terminator 0x00 0x01 of the lower bound with 0x00 0x02.
+// Returns an error if collectionName is empty.
+func CalcCollectionUpperBound(collectionName string) ([]byte, error) {
+	result, err := CalcCollectionLowerBound(collectionName)
+	if err != nil {
+		return nil, err
+	}
+	result[len(result)-1]++
 	return result, nil
 }
 
+// ParseDocKey extracts the collection name and the document ID from a document key.
+func ParseDocKey(key []byte) (collectionName string, docID string, err error) {
+	return parsePrefixedDocKey(DOC_KEY_PREFIX, "doc", key)
+}
+
 // GetCollectionNameFromKey extracts the collection name from a document key.
 func GetCollectionNameFromKey(key []byte) (string, error) {
-	if len(key) < len(DOC_KEY_PREFIX)+COLLECTION_SIZE_IN_BYTES {
-		return "", pe.Errorf("key too short: %v", key)
-	}
-	n := len(DOC_KEY_PREFIX)
-	// Remove trailing null bytes
-	collectionName := string(key[n : n+COLLECTION_SIZE_IN_BYTES])
-	return strings.TrimRight(collectionName, "\x00"), nil
+	collectionName, _, err := ParseDocKey(key)
+	return collectionName, err
 }
 
 // GetDocIdFromKey extracts the document ID from a document key.
 func GetDocIdFromKey(key []byte) (string, error) {
-	expectedLen := len(DOC_KEY_PREFIX) + COLLECTION_SIZE_IN_BYTES + 1 + DOC_ID_SIZE_IN_BYTES
-	if len(key) < expectedLen {
-		return "", pe.Errorf("key too short: %v", key)
-	}
-	n := len(DOC_KEY_PREFIX) + COLLECTION_SIZE_IN_BYTES + 1 // +1 to skip the colon
-	// Remove trailing null bytes
-	docId := string(key[n : n+DOC_ID_SIZE_IN_BYTES])
-	return strings.TrimRight(docId, "\x00"), nil
+	_, docID, err := ParseDocKey(key)
+	return docID, err
 }
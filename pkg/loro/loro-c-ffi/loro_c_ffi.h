@@ -29,7 +29,7 @@ extern void* frontiers_new_empty();
 extern void* vv_new_empty();
 extern void* fork_doc(void* doc_ptr);
 extern void* fork_doc_at(void* doc_ptr, void* frontiers_ptr);
-extern void* diff_loro_doc(void* doc_ptr, void* v1_ptr, void* v2_ptr);
+extern void* diff_loro_doc(void* doc_ptr, void* v1_ptr, void* v2_ptr, uint8_t* err);
 extern void destroy_diff_batch(void* ptr);
 extern void diff_batch_events(void* ptr, void** cids_ptr, void** events_ptr);
 extern void destroy_container_id(void* ptr);
@@ -58,7 +58,7 @@ extern void* export_loro_doc_snapshot(void* doc_ptr);
 extern void* export_loro_doc_all_updates(void* doc_ptr);
 extern void* export_loro_doc_updates_from(void* doc_ptr, void* from_ptr);
 extern void* export_loro_doc_updates_till(void* doc_ptr, void* till_ptr);
-extern void* loro_doc_import(void* doc_ptr, void* vec_ptr);
+extern void* loro_doc_import(void* doc_ptr, void* vec_ptr, uint8_t* err);
 extern void loro_doc_decode_import_blob_meta(
   void* blob,
   int check_checksum,
@@ -72,6 +72,10 @@ extern void loro_doc_decode_import_blob_meta(
   uint32_t* change_num
 );
 extern void* loro_doc_get_by_path(void* doc_ptr, char* path_ptr);
+extern void* loro_doc_export_shallow_snapshot(void* doc_ptr, void* frontiers_ptr, uint8_t* err);
+extern int loro_doc_is_shallow(void* doc_ptr);
+extern void* loro_doc_get_path_to_container(void* doc_ptr, void* cid_ptr);
+extern void* loro_doc_shallow_since_vv(void* doc_ptr);
 
 // Loro Import Status
 extern void destroy_import_status(void* ptr);
@@ -94,6 +98,8 @@ extern void destroy_diff_event(void* ptr);
 extern void* diff_event_get_list_diff(void* ptr);
 extern void* diff_event_get_text_delta(void* ptr);
 extern void* diff_event_get_map_delta(void* ptr);
+extern void* map_delta_updated_keys(void* ptr);
+extern void destroy_c_string(char* ptr);
 extern void* diff_event_get_tree_diff(void* ptr);
 
 // Rust Bytes Vec
@@ -136,6 +142,7 @@ extern void* loro_map_get_list(void* ptr, char* key_ptr, uint8_t* err);
 extern void* loro_map_get_movable_list(void* ptr, char* key_ptr, uint8_t* err);
 extern void* loro_map_get_map(void* ptr, char* key_ptr, uint8_t* err);
 extern void loro_map_insert_null(void* ptr, char* key_ptr, uint8_t* err);
+extern void loro_map_delete(void* ptr, char* key_ptr, uint8_t* err);
 extern void loro_map_insert_bool(void* ptr, char* key_ptr, int bool_value, uint8_t* err);
 extern void loro_map_insert_double(void* ptr, char* key_ptr, double double_value, uint8_t* err);
 extern void loro_map_insert_i64(void* ptr, char* key_ptr, int64_t int_value, uint8_t* err);
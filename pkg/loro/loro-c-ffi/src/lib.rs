@@ -175,14 +175,23 @@ pub extern "C" fn new_vec_from_bytes(
 pub extern "C" fn loro_doc_import(
     doc_ptr: *mut LoroDoc,
     vec_ptr: *mut Vec<u8>,
+    err: *mut u8,
 ) -> *mut ImportStatus {
     unsafe {
         let doc = &mut *doc_ptr;
         let vec = &mut *vec_ptr;
-        let status = doc.import(vec).unwrap();
-        let boxed = Box::new(status);
-        let ptr = Box::into_raw(boxed);
-        ptr
+        // 导入失败（例如依赖浅快照之前的历史）时设置 err 并返回空指针，而不是 panic
+        match doc.import(vec) {
+            Ok(status) => {
+                let boxed = Box::new(status);
+                let ptr = Box::into_raw(boxed);
+                ptr
+            }
+            Err(_) => {
+                *err = 1;
+                std::ptr::null_mut()
+            }
+        }
     }
 }
 
@@ -566,15 +575,24 @@ pub extern "C" fn diff_loro_doc(
     doc_ptr: *mut LoroDoc,
     v1_ptr: *mut Frontiers,
     v2_ptr: *mut Frontiers,
+    err: *mut u8,
 ) -> *mut DiffBatch {
     unsafe {
         let doc1 = &*doc_ptr;
         let v1 = &*v1_ptr;
         let v2 = &*v2_ptr;
-        let diff = doc1.diff(v1, v2).unwrap();
-        let boxed = Box::new(diff);
-        let ptr = Box::into_raw(boxed);
-        ptr
+        // 版本不在文档历史中（例如在浅快照之前）时设置 err，而不是 panic
+        match doc1.diff(v1, v2) {
+            Ok(diff) => {
+                let boxed = Box::new(diff);
+                let ptr = Box::into_raw(boxed);
+                ptr
+            }
+            Err(_) => {
+                *err = 1;
+                std::ptr::null_mut()
+            }
+        }
     }
 }
 
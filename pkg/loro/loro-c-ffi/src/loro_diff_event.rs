@@ -1,3 +1,5 @@
+use std::ffi::{c_char, CString};
+
 use loro::{
     event::{Diff, ListDiffItem, MapDelta},
     TextDelta, TreeDiff,
@@ -70,6 +72,27 @@ pub extern "C" fn diff_event_get_map_delta(ptr: *mut Diff) -> *mut MapDelta {
     }
 }
 
+// 返回 MapDelta 中被设置或删除的键，每个键是一个 C 字符串，用 destroy_c_string 释放
+#[no_mangle]
+pub extern "C" fn map_delta_updated_keys(ptr: *mut MapDelta) -> *mut Vec<*mut u8> {
+    unsafe {
+        let delta = &*ptr;
+        let keys: Vec<*mut u8> = delta
+            .updated
+            .keys()
+            .map(|key| CString::new(key.as_str()).unwrap_or_default().into_raw() as *mut u8)
+            .collect();
+        Box::into_raw(Box::new(keys))
+    }
+}
+
+#[no_mangle]
+pub extern "C" fn destroy_c_string(ptr: *mut c_char) {
+    unsafe {
+        let _ = CString::from_raw(ptr);
+    }
+}
+
 #[no_mangle]
 pub extern "C" fn diff_event_get_tree_diff(ptr: *mut Diff) -> *mut TreeDiff {
     unsafe {
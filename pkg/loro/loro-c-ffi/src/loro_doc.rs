@@ -1,6 +1,9 @@
-use std::ffi::{c_schar, CStr};
+use std::ffi::{c_schar, CStr, CString};
 
-use loro::{EncodedBlobMode, Frontiers, LoroDoc, LoroMap, ValueOrContainer, VersionVector};
+use loro::{
+    ContainerID, EncodedBlobMode, ExportMode, Frontiers, Index, LoroDoc, LoroMap,
+    ValueOrContainer, VersionVector,
+};
 
 #[no_mangle]
 pub extern "C" fn loro_doc_decode_import_blob_meta(
@@ -61,6 +64,76 @@ pub extern "C" fn loro_doc_get_by_path(
     }
 }
 
+#[no_mangle]
+pub extern "C" fn loro_doc_export_shallow_snapshot(
+    doc: *mut LoroDoc,
+    frontiers: *mut Frontiers,
+    err: *mut u8,
+) -> *mut Vec<u8> {
+    unsafe {
+        let doc = &*doc;
+        let frontiers = &*frontiers;
+        match doc.export(ExportMode::shallow_snapshot(frontiers)) {
+            Ok(snapshot) => Box::into_raw(Box::new(snapshot)),
+            Err(..) => {
+                *err = 1;
+                std::ptr::null_mut()
+            }
+        }
+    }
+}
+
+// 返回容器在文档中的路径，从根容器的名字开始，列表中的位置以下标表示，
+// 每一段是一个 C 字符串，用 destroy_c_string 释放。容器不在文档中时返回空指针
+#[no_mangle]
+pub extern "C" fn loro_doc_get_path_to_container(
+    doc: *mut LoroDoc,
+    cid: *mut ContainerID,
+) -> *mut Vec<*mut u8> {
+    unsafe {
+        let doc = &*doc;
+        let cid = &*cid;
+        match doc.get_path_to_container(cid) {
+            Some(path) => {
+                let segments: Vec<*mut u8> = path
+                    .iter()
+                    .map(|(_, index)| {
+                        let segment = match index {
+                            Index::Key(key) => key.to_string(),
+                            Index::Seq(seq) => seq.to_string(),
+                            Index::Node(node) => format!("{:?}", node),
+                        };
+                        CString::new(segment).unwrap_or_default().into_raw() as *mut u8
+                    })
+                    .collect();
+                Box::into_raw(Box::new(segments))
+            }
+            None => std::ptr::null_mut(),
+        }
+    }
+}
+
+#[no_mangle]
+pub extern "C" fn loro_doc_is_shallow(doc: *mut LoroDoc) -> i32 {
+    unsafe {
+        let doc = &*doc;
+        if doc.is_shallow() {
+            1
+        } else {
+            0
+        }
+    }
+}
+
+#[no_mangle]
+pub extern "C" fn loro_doc_shallow_since_vv(doc: *mut LoroDoc) -> *mut VersionVector {
+    unsafe {
+        let doc = &*doc;
+        let vv = doc.shallow_since_vv().to_vv();
+        Box::into_raw(Box::new(vv))
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -74,4 +147,22 @@ mod tests {
         let result = doc.get_by_str_path("root/textField");
         assert!(result.is_some());
     }
+
+    #[test]
+    fn test_shallow_snapshot() {
+        let doc = LoroDoc::new();
+        let t = doc.get_text("text");
+        t.insert(0, "hello").unwrap();
+        doc.commit();
+        let frontiers = doc.oplog_frontiers();
+        t.insert(5, " world").unwrap();
+        doc.commit();
+        let snapshot = doc
+            .export(ExportMode::shallow_snapshot(&frontiers))
+            .unwrap();
+        let shallow = LoroDoc::new();
+        shallow.import(&snapshot).unwrap();
+        assert!(shallow.is_shallow());
+        assert_eq!(shallow.get_text("text").to_string(), "hello world");
+    }
 }
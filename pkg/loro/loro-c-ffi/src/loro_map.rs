@@ -292,6 +292,17 @@ pub extern "C" fn loro_map_insert_null(ptr: *mut LoroMap, key_ptr: *const c_char
     }
 }
 
+#[no_mangle]
+pub extern "C" fn loro_map_delete(ptr: *mut LoroMap, key_ptr: *const c_char, err: *mut u8) {
+    unsafe {
+        let map = &mut *ptr;
+        let key = CStr::from_ptr(key_ptr).to_string_lossy().into_owned();
+        if map.delete(&key).is_err() {
+            *err = 1;
+        }
+    }
+}
+
 #[no_mangle]
 pub extern "C" fn loro_map_insert_bool(
     ptr: *mut LoroMap,
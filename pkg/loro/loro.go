@@ -30,6 +30,8 @@ const (
 var (
 	ErrLoroEncodeFailed = pe.New("loro encode failed")
 	ErrLoroDecodeFailed = pe.New("loro decode failed")
+	ErrLoroImportFailed = pe.New("loro import failed")
+	ErrLoroDiffFailed   = pe.New("loro diff failed")
 	ErrLoroGetNull      = pe.New("loro get null")
 )
 
@@ -129,6 +131,19 @@ func (vec *RustPtrVec) GetData() []unsafe.Pointer {
 	return unsafe.Slice((*unsafe.Pointer)(dataPtr), len)
 }
 
+// takeCStrings 将 Rust 中元素为 C 字符串的 Vec 转换为 []string，并释放 Rust 侧的内存
+func takeCStrings(ptr unsafe.Pointer) []string {
+	vec := &RustPtrVec{ptr: ptr}
+	data := vec.GetData()
+	result := make([]string, len(data))
+	for i, strPtr := range data {
+		result[i] = C.GoString((*C.char)(strPtr))
+		C.destroy_c_string((*C.char)(strPtr))
+	}
+	vec.Destroy()
+	return result
+}
+
 // ----------- Loro Doc -----------
 
 type LoroDoc struct {
@@ -260,17 +275,59 @@ func (doc *LoroDoc) ExportUpdatesTill(till *VersionVector) *RustBytesVec {
 	return bytesVec
 }
 
+// 导出 frontiers 处的浅快照。浅快照包含文档的当前状态和 frontiers 之后的历史，
+// 丢弃 frontiers 之前的历史，导入浅快照得到的文档无法回到 frontiers 之前的版本。
+// frontiers 必须是文档历史中的版本
+func (doc *LoroDoc) ExportShallowSnapshot(frontiers *Frontiers) (*RustBytesVec, error) {
+	var err C.uint8_t
+	ptr := C.loro_doc_export_shallow_snapshot(doc.Ptr, frontiers.ptr, &err)
+	if err != 0 {
+		return nil, ErrLoroEncodeFailed
+	}
+	bytesVec := &RustBytesVec{
+		ptr: ptr,
+	}
+	runtime.SetFinalizer(bytesVec, func(vec *RustBytesVec) {
+		vec.Destroy()
+	})
+	return bytesVec, nil
+}
+
+// 文档是否由浅快照导入，即是否丢弃了部分历史
+func (doc *LoroDoc) IsShallow() bool {
+	return C.loro_doc_is_shallow(doc.Ptr) != 0
+}
+
+// 浅快照的起始版本，文档只有这个版本之后的历史。不是浅快照时为空版本向量
+func (doc *LoroDoc) ShallowSinceVv() *VersionVector {
+	ptr := C.loro_doc_shallow_since_vv(doc.Ptr)
+	vv := &VersionVector{
+		ptr: unsafe.Pointer(ptr),
+	}
+	runtime.SetFinalizer(vv, func(vv *VersionVector) {
+		vv.Destroy()
+	})
+	return vv
+}
+
 // 导入快照 / 更新（都是一堆字节）
-func (doc *LoroDoc) Import(data []byte) *ImportStatus {
+//
+// 数据损坏或依赖文档没有的历史（例如浅快照之前的历史）时导入失败，返回 ErrLoroImportFailed，
+// 此时没有任何更改被合入。缺少依赖的更改不算失败，见 ImportStatus.GetPending
+func (doc *LoroDoc) Import(data []byte) (*ImportStatus, error) {
 	snapshot := NewRustBytesVec(data)
-	ptr := C.loro_doc_import(doc.Ptr, snapshot.ptr)
+	var err C.uint8_t
+	ptr := C.loro_doc_import(doc.Ptr, snapshot.ptr, &err)
+	if err != 0 {
+		return nil, ErrLoroImportFailed
+	}
 	status := &ImportStatus{
 		ptr: unsafe.Pointer(ptr),
 	}
 	runtime.SetFinalizer(status, func(status *ImportStatus) {
 		status.Destroy()
 	})
-	return status
+	return status, nil
 }
 
 func (doc *LoroDoc) GetOplogVv() *VersionVector {
@@ -361,15 +418,30 @@ func (doc *LoroDoc) ForkAt(frontiers *Frontiers) *LoroDoc {
 	return loroDoc
 }
 
-func (doc *LoroDoc) Diff(v1, v2 *Frontiers) *DiffBatch {
-	ptr := C.diff_loro_doc(doc.Ptr, v1.ptr, v2.ptr)
+// 计算文档从版本 v1 到版本 v2 的变化，版本不在文档的历史中时返回 ErrLoroDiffFailed
+func (doc *LoroDoc) Diff(v1, v2 *Frontiers) (*DiffBatch, error) {
+	var err C.uint8_t
+	ptr := C.diff_loro_doc(doc.Ptr, v1.ptr, v2.ptr, &err)
+	if err != 0 {
+		return nil, ErrLoroDiffFailed
+	}
 	diffBatch := &DiffBatch{
 		ptr: unsafe.Pointer(ptr),
 	}
 	runtime.SetFinalizer(diffBatch, func(d *DiffBatch) {
 		d.Destroy()
 	})
-	return diffBatch
+	return diffBatch, nil
+}
+
+// 获取容器在文档中的路径，从根容器的名字开始，例如 ["data", "address"]，
+// 列表中的位置以下标表示。容器不在文档中时 ok 为 false
+func (doc *LoroDoc) GetPathToContainer(cid *ContainerId) (path []string, ok bool) {
+	ptr := C.loro_doc_get_path_to_container(doc.Ptr, cid.ptr)
+	if ptr == nil {
+		return nil, false
+	}
+	return takeCStrings(unsafe.Pointer(ptr)), true
 }
 
 // ----------- Import Status ------------
@@ -721,6 +793,18 @@ func (m *LoroMap) InsertValueCoerce(key string, value any) error {
 	return m.InsertValue(key, coerced)
 }
 
+// Delete 从 LoroMap 中删除指定 key，key 不存在时什么也不做
+func (m *LoroMap) Delete(key string) error {
+	var errCode C.uint8_t
+	keyPtr := C.CString(key)
+	defer C.free(unsafe.Pointer(keyPtr))
+	C.loro_map_delete(m.ptr, keyPtr, &errCode)
+	if errCode != 0 {
+		return pe.Errorf("delete from map, key=%s", key)
+	}
+	return nil
+}
+
 // InsertContainer 插入一个 LoroContainer 到 LoroMap 中
 //
 // 返回插入后，连接到 LoroMap 的 LoroContainer，
@@ -1684,8 +1768,8 @@ type DiffBatch struct {
 }
 
 type CidEventPair struct {
-	ContainerId ContainerId
-	DiffEvent   DiffEvent
+	ContainerId *ContainerId
+	DiffEvent   *DiffEvent
 }
 
 func (d *DiffBatch) Destroy() {
@@ -1709,8 +1793,8 @@ func (d *DiffBatch) GetEvents() []CidEventPair {
 		cid := &ContainerId{ptr: cidPtr}
 		diffEvent := &DiffEvent{ptr: eventPtr}
 		pair := CidEventPair{
-			ContainerId: *cid,
-			DiffEvent:   *diffEvent,
+			ContainerId: cid,
+			DiffEvent:   diffEvent,
 		}
 		runtime.SetFinalizer(cid, func(cid *ContainerId) {
 			cid.Destroy()
@@ -1940,6 +2024,12 @@ func (md *MapDelta) Destroy() {
 	C.destroy_map_delta(md.ptr)
 }
 
+// 获取 MapDelta 中被设置或删除的键
+func (md *MapDelta) GetUpdatedKeys() []string {
+	ptr := C.map_delta_updated_keys(md.ptr)
+	return takeCStrings(unsafe.Pointer(ptr))
+}
+
 // ------------ Tree Diff -----------
 
 type TreeDiff struct {
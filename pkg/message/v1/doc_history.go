@@ -0,0 +1,196 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+)
+
+// 文档历史请求的操作
+const (
+	// 列出文档的所有版本
+	DOC_HISTORY_LIST uint8 = 1
+	// 读取文档在 Seq 版本时的快照
+	DOC_HISTORY_READ uint8 = 2
+	// 比较 FromSeq 和 Seq 两个版本，返回 JSON Patch
+	DOC_HISTORY_DIFF uint8 = 3
+	// 将文档恢复到 Seq 版本，RequestId 作为恢复事务的 TxID，
+	// 事务的结果和普通事务一样通过 AckTransactionMessageV1 / TransactionFailedMessageV1 通知
+	DOC_HISTORY_RESTORE uint8 = 4
+)
+
+// DocHistoryMessageV1 由客户端发送给服务端，请求文档的历史版本
+//
+// 版本用 DocVersionV1.Seq 标识，Seq 为 0 表示文档创建之前的空文档
+type DocHistoryMessageV1 struct {
+	RequestId  string
+	Action     uint8
+	Collection string
+	DocId      string
+	// DOC_HISTORY_DIFF 的起始版本
+	FromSeq uint64
+	// DOC_HISTORY_READ / DOC_HISTORY_RESTORE 的目标版本，DOC_HISTORY_DIFF 的结束版本
+	Seq uint64
+}
+
+var _ Message = &DocHistoryMessageV1{}
+
+func (m *DocHistoryMessageV1) isMessage() {}
+
+func (m *DocHistoryMessageV1) DebugSprint() string {
+	return fmt.Sprintf("DocHistoryMessageV1{RequestId: %s, Action: %d, Doc: %s.%s, FromSeq: %d, Seq: %d}",
+		m.RequestId, m.Action, m.Collection, m.DocId, m.FromSeq, m.Seq)
+}
+
+func (m *DocHistoryMessageV1) Type() uint8 {
+	return MSG_TYPE_DOC_HISTORY_V1
+}
+
+// Encode 将 DocHistoryMessageV1 编码为 []byte
+func (m *DocHistoryMessageV1) Encode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	util.WriteUint8(buf, m.Type())
+	util.WriteVarString(buf, m.RequestId)
+	util.WriteUint8(buf, m.Action)
+	util.WriteVarString(buf, m.Collection)
+	util.WriteVarString(buf, m.DocId)
+	util.WriteVarUint(buf, m.FromSeq)
+	util.WriteVarUint(buf, m.Seq)
+	return buf.Bytes(), nil
+}
+
+func decodeDocHistoryMessageV1(b *bytes.Buffer) (*DocHistoryMessageV1, error) {
+	m := &DocHistoryMessageV1{}
+	var err error
+	if m.RequestId, err = util.ReadVarString(b); err != nil {
+		return nil, err
+	}
+	if m.Action, err = util.ReadUint8(b); err != nil {
+		return nil, err
+	}
+	if m.Collection, err = util.ReadVarString(b); err != nil {
+		return nil, err
+	}
+	if m.DocId, err = util.ReadVarString(b); err != nil {
+		return nil, err
+	}
+	if m.FromSeq, err = util.ReadVarUint(b); err != nil {
+		return nil, err
+	}
+	if m.Seq, err = util.ReadVarUint(b); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DocVersionV1 是文档历史中的一个版本
+type DocVersionV1 struct {
+	Seq uint64
+	// 编码后的 loro frontiers
+	Frontiers []byte
+	TxID      string
+	Committer string
+	// 提交时间，unix 毫秒
+	Timestamp int64
+}
+
+// DocHistoryRespMessageV1 由服务端发送给客户端，响应 DocHistoryMessageV1
+//
+// Error 不为空表示请求失败，被权限规则拒绝时 Denial 是拒绝请求的权限检查结果
+type DocHistoryRespMessageV1 struct {
+	RequestId string
+	// DOC_HISTORY_LIST 的结果
+	Versions []DocVersionV1
+	// DOC_HISTORY_READ 的结果，文档在该版本的快照
+	Snapshot []byte
+	// DOC_HISTORY_DIFF 的结果，JSON Patch (RFC 6902)
+	Patch  []byte
+	Error  string
+	Denial *PermissionDenialV1
+}
+
+var _ Message = &DocHistoryRespMessageV1{}
+
+func (m *DocHistoryRespMessageV1) isMessage() {}
+
+func (m *DocHistoryRespMessageV1) DebugSprint() string {
+	return fmt.Sprintf("DocHistoryRespMessageV1{RequestId: %s, Versions: %d, Snapshot: %d bytes, Patch: %s, Error: %s}",
+		m.RequestId, len(m.Versions), len(m.Snapshot), m.Patch, m.Error)
+}
+
+func (m *DocHistoryRespMessageV1) Type() uint8 {
+	return MSG_TYPE_DOC_HISTORY_RESP_V1
+}
+
+// Encode 将 DocHistoryRespMessageV1 编码为 []byte
+func (m *DocHistoryRespMessageV1) Encode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	util.WriteUint8(buf, m.Type())
+	util.WriteVarString(buf, m.RequestId)
+	util.WriteVarUint(buf, uint64(len(m.Versions)))
+	for _, v := range m.Versions {
+		util.WriteVarUint(buf, v.Seq)
+		util.WriteVarByteArray(buf, v.Frontiers)
+		util.WriteVarString(buf, v.TxID)
+		util.WriteVarString(buf, v.Committer)
+		util.WriteVarInt(buf, v.Timestamp)
+	}
+	util.WriteVarByteArray(buf, m.Snapshot)
+	util.WriteVarByteArray(buf, m.Patch)
+	util.WriteVarString(buf, m.Error)
+	if m.Denial != nil {
+		if err := m.Denial.encode(buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeDocHistoryRespMessageV1(b *bytes.Buffer) (*DocHistoryRespMessageV1, error) {
+	m := &DocHistoryRespMessageV1{}
+	var err error
+	if m.RequestId, err = util.ReadVarString(b); err != nil {
+		return nil, err
+	}
+	nVersions, err := util.ReadVarUint(b)
+	if err != nil {
+		return nil, err
+	}
+	m.Versions = make([]DocVersionV1, 0, min(nVersions, uint64(b.Len())))
+	for i := uint64(0); i < nVersions; i++ {
+		v := DocVersionV1{}
+		if v.Seq, err = util.ReadVarUint(b); err != nil {
+			return nil, err
+		}
+		if v.Frontiers, err = util.ReadVarByteArray(b); err != nil {
+			return nil, err
+		}
+		if v.TxID, err = util.ReadVarString(b); err != nil {
+			return nil, err
+		}
+		if v.Committer, err = util.ReadVarString(b); err != nil {
+			return nil, err
+		}
+		if v.Timestamp, err = util.ReadVarInt(b); err != nil {
+			return nil, err
+		}
+		m.Versions = append(m.Versions, v)
+	}
+	if m.Snapshot, err = util.ReadVarByteArray(b); err != nil {
+		return nil, err
+	}
+	if m.Patch, err = util.ReadVarByteArray(b); err != nil {
+		return nil, err
+	}
+	if m.Error, err = util.ReadVarString(b); err != nil {
+		return nil, err
+	}
+	// Denial 编码在消息末尾
+	if b.Len() > 0 {
+		if m.Denial, err = decodePermissionDenialV1(b); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -20,13 +20,16 @@ const (
 	MSG_TYPE_POST_TRANSACTION_V1    uint8 = 1
 	MSG_TYPE_SUBSCRIPTION_UPDATE_V1 uint8 = 2
 	// MSG_TYPE_POST_DOC_V1            uint8 = 3
-	MSG_TYPE_ACK_TRANSACTION_V1    uint8 = 4
-	MSG_TYPE_TRANSACTION_FAILED_V1 uint8 = 5
-	MSG_TYPE_VERSION_QUERY_V1      uint8 = 6
-	MSG_TYPE_VERSION_QUERY_RESP_V1 uint8 = 7
-	MSG_TYPE_SUBSCRIPTION_RESET_V1 uint8 = 8
-	MSG_TYPE_SYNC_V1               uint8 = 9
-	MSG_TYPE_VERSION_GAP_V1        uint8 = 10
+	MSG_TYPE_ACK_TRANSACTION_V1     uint8 = 4
+	MSG_TYPE_TRANSACTION_FAILED_V1  uint8 = 5
+	MSG_TYPE_VERSION_QUERY_V1       uint8 = 6
+	MSG_TYPE_VERSION_QUERY_RESP_V1  uint8 = 7
+	MSG_TYPE_SUBSCRIPTION_RESET_V1  uint8 = 8
+	MSG_TYPE_SYNC_V1                uint8 = 9
+	MSG_TYPE_VERSION_GAP_V1         uint8 = 10
+	MSG_TYPE_SUBSCRIPTION_FAILED_V1 uint8 = 11
+	MSG_TYPE_DOC_HISTORY_V1         uint8 = 12
+	MSG_TYPE_DOC_HISTORY_RESP_V1    uint8 = 13
 )
 
 func DecodeMessage(b *bytes.Buffer) (Message, error) {
@@ -54,6 +57,12 @@ func DecodeMessage(b *bytes.Buffer) (Message, error) {
 		return decodeSyncMessageV1(b)
 	case MSG_TYPE_VERSION_GAP_V1:
 		return decodeVersionGapMessageV1(b)
+	case MSG_TYPE_SUBSCRIPTION_FAILED_V1:
+		return decodeSubscriptionFailedMessageV1(b)
+	case MSG_TYPE_DOC_HISTORY_V1:
+		return decodeDocHistoryMessageV1(b)
+	case MSG_TYPE_DOC_HISTORY_RESP_V1:
+		return decodeDocHistoryRespMessageV1(b)
 	default:
 		return nil, errors.New("未知的消息类型")
 	}
@@ -0,0 +1,68 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+)
+
+// SubscriptionFailedMessageV1 由服务端发送给客户端
+// 表示客户端订阅的查询没有通过校验（例如引用了 schema 中不存在的字段），
+// 该查询不会被订阅，并附上了失败的原因
+type SubscriptionFailedMessageV1 struct {
+	Query  query.Query
+	Reason error
+}
+
+var _ Message = &SubscriptionFailedMessageV1{}
+
+func (m *SubscriptionFailedMessageV1) isMessage() {}
+
+func (m *SubscriptionFailedMessageV1) DebugSprint() string {
+	return fmt.Sprintf("SubscriptionFailedMessageV1{Query: %s, Reason: %v}", m.Query.DebugSprint(), m.Reason)
+}
+
+// Encode 将 SubscriptionFailedMessageV1 编码为 []byte
+func (m *SubscriptionFailedMessageV1) Encode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	util.WriteUint8(buf, m.Type())
+	encoded, err := m.Query.Encode()
+	if err != nil {
+		return nil, err
+	}
+	err = util.WriteVarString(buf, string(encoded))
+	if err != nil {
+		return nil, err
+	}
+	err = util.WriteVarString(buf, m.Reason.Error())
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSubscriptionFailedMessageV1(b *bytes.Buffer) (*SubscriptionFailedMessageV1, error) {
+	queryStr, err := util.ReadVarString(b)
+	if err != nil {
+		return nil, err
+	}
+	q, err := query.DecodeQuery([]byte(queryStr))
+	if err != nil {
+		return nil, err
+	}
+	reason, err := util.ReadVarString(b)
+	if err != nil {
+		return nil, err
+	}
+	return &SubscriptionFailedMessageV1{
+		Query:  q,
+		Reason: errors.New(reason),
+	}, nil
+}
+
+func (m *SubscriptionFailedMessageV1) Type() uint8 {
+	return MSG_TYPE_SUBSCRIPTION_FAILED_V1
+}
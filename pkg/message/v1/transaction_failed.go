@@ -10,9 +10,30 @@ import (
 
 // TransactionFailedMessageV1 由服务端发送给客户端
 // 表示客户端的事务提交失败，并附上了失败的原因
+//
+// 事务没有通过权限检查时，Denial 是拒绝该事务的权限检查结果，其他情况下为 nil。
+// Denial 编码在消息末尾，旧版本的解码器会忽略它
 type TransactionFailedMessageV1 struct {
 	TxID   string
 	Reason error
+	Denial *PermissionDenialV1
+}
+
+// PermissionDenialV1 描述事务中哪个操作被哪条权限规则拒绝
+type PermissionDenialV1 struct {
+	// 拒绝操作的规则，例如 canUpdate，字段规则为 fields.<字段路径>.canWrite
+	Rule       string
+	Collection string
+	DocId      string
+	// 被拒绝的操作在事务中的下标
+	OpIndex int
+	// 规则返回的拒绝原因
+	Reason string
+	// 规则执行失败的原因，规则正常返回时为空
+	Error string
+	// 规则出错的位置在权限定义中的行号和列号，从 1 开始，未知时为 0
+	Line   int
+	Column int
 }
 
 var _ Message = &TransactionFailedMessageV1{}
@@ -20,6 +41,9 @@ var _ Message = &TransactionFailedMessageV1{}
 func (m *TransactionFailedMessageV1) isMessage() {}
 
 func (m *TransactionFailedMessageV1) DebugSprint() string {
+	if m.Denial != nil {
+		return fmt.Sprintf("TransactionFailedMessageV1{TxID: %s, Reason: %v, Denial: %+v}", m.TxID, m.Reason, *m.Denial)
+	}
 	return fmt.Sprintf("TransactionFailedMessageV1{TxID: %s, Reason: %v}", m.TxID, m.Reason)
 }
 
@@ -35,9 +59,35 @@ func (m *TransactionFailedMessageV1) Encode() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if m.Denial != nil {
+		err = m.Denial.encode(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return buf.Bytes(), nil
 }
 
+func (d *PermissionDenialV1) encode(buf *bytes.Buffer) error {
+	for _, s := range []string{d.Rule, d.Collection, d.DocId} {
+		if err := util.WriteVarString(buf, s); err != nil {
+			return err
+		}
+	}
+	if err := util.WriteVarInt(buf, int64(d.OpIndex)); err != nil {
+		return err
+	}
+	for _, s := range []string{d.Reason, d.Error} {
+		if err := util.WriteVarString(buf, s); err != nil {
+			return err
+		}
+	}
+	if err := util.WriteVarUint(buf, uint64(d.Line)); err != nil {
+		return err
+	}
+	return util.WriteVarUint(buf, uint64(d.Column))
+}
+
 // DecodeTransactionFailedMessageV1 从 bytes.Buffer 中解码得到 TransactionFailedMessageV1
 // 如果解码失败，返回 nil
 func decodeTransactionFailedMessageV1(b *bytes.Buffer) (*TransactionFailedMessageV1, error) {
@@ -49,10 +99,51 @@ func decodeTransactionFailedMessageV1(b *bytes.Buffer) (*TransactionFailedMessag
 	if err != nil {
 		return nil, err
 	}
-	return &TransactionFailedMessageV1{
+	msg := &TransactionFailedMessageV1{
 		TxID:   txID,
 		Reason: errors.New(reason),
-	}, nil
+	}
+	// 旧版本编码的消息没有 Denial
+	if b.Len() > 0 {
+		msg.Denial, err = decodePermissionDenialV1(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func decodePermissionDenialV1(b *bytes.Buffer) (*PermissionDenialV1, error) {
+	d := &PermissionDenialV1{}
+	for _, s := range []*string{&d.Rule, &d.Collection, &d.DocId} {
+		v, err := util.ReadVarString(b)
+		if err != nil {
+			return nil, err
+		}
+		*s = v
+	}
+	opIndex, err := util.ReadVarInt(b)
+	if err != nil {
+		return nil, err
+	}
+	d.OpIndex = int(opIndex)
+	for _, s := range []*string{&d.Reason, &d.Error} {
+		v, err := util.ReadVarString(b)
+		if err != nil {
+			return nil, err
+		}
+		*s = v
+	}
+	line, err := util.ReadVarUint(b)
+	if err != nil {
+		return nil, err
+	}
+	column, err := util.ReadVarUint(b)
+	if err != nil {
+		return nil, err
+	}
+	d.Line, d.Column = int(line), int(column)
+	return d, nil
 }
 
 func (m *TransactionFailedMessageV1) Type() uint8 {
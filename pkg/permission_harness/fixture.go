@@ -0,0 +1,112 @@
+package permission_harness
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	pe "github.com/pkg/errors"
+)
+
+// 测试用例中的操作
+const (
+	OpView   = "view"
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// 测试用例期望的结果
+const (
+	ExpectAllow = "allow"
+	ExpectDeny  = "deny"
+)
+
+// Fixture 是一组权限规则的测试用例，下面是一个 JSON 格式的例子：
+//
+//	{
+//	  "schemaFile": "schema.js",
+//	  "permissionFile": "permission.js",
+//	  "seed": {
+//	    "users": { "u1": { "id": "u1", "role": "normal" } },
+//	    "postMetas": { "p1": { "id": "p1", "owner": "u2", "title": "hello" } }
+//	  },
+//	  "cases": [
+//	    {
+//	      "name": "不能修改别人的文章",
+//	      "clientId": "u1",
+//	      "op": "update",
+//	      "collection": "postMetas",
+//	      "docId": "p1",
+//	      "change": { "title": "hacked" },
+//	      "expect": "deny"
+//	    }
+//	  ]
+//	}
+type Fixture struct {
+	// 数据库 schema 的 Js 定义
+	Schema string `json:"schema"`
+	// Schema 为空时从这个文件中读取，相对路径相对于 fixture 文件所在的目录
+	SchemaFile string `json:"schemaFile"`
+	// 权限的 Js 定义
+	Permission string `json:"permission"`
+	// Permission 为空时从这个文件中读取，相对路径相对于 fixture 文件所在的目录
+	PermissionFile string `json:"permissionFile"`
+	// 数据库中的初始文档，集合名 -> 文档 ID -> 文档
+	Seed  map[string]map[string]map[string]any `json:"seed"`
+	Cases []Case                               `json:"cases"`
+}
+
+// Case 是一个测试用例，检查客户端 ClientId 能否对 Collection 中的文档 DocId 执行操作 Op
+type Case struct {
+	Name       string `json:"name"`
+	ClientId   string `json:"clientId"`
+	Op         string `json:"op"`
+	Collection string `json:"collection"`
+	DocId      string `json:"docId"`
+	// create 时为新文档，update 时为要修改的字段，修改后的文档是初始文档加上这些字段
+	Change map[string]any `json:"change"`
+	// ExpectAllow 或 ExpectDeny
+	Expect string `json:"expect"`
+	// 期望的拒绝原因，为空时不检查
+	Reason string `json:"reason"`
+	// view 时期望客户端不能读取的字段，为 nil 时不检查
+	Unreadable []string `json:"unreadable"`
+}
+
+// LoadFixture 从 JSON 文件中加载测试用例，并读取其中引用的 schema 和权限文件
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, pe.WithStack(err)
+	}
+	fixture := &Fixture{}
+	if err := json.Unmarshal(data, fixture); err != nil {
+		return nil, pe.Wrapf(err, "invalid fixture %s", path)
+	}
+	dir := filepath.Dir(path)
+	if fixture.Schema == "" && fixture.SchemaFile != "" {
+		fixture.Schema, err = readRelative(dir, fixture.SchemaFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fixture.Permission == "" && fixture.PermissionFile != "" {
+		fixture.Permission, err = readRelative(dir, fixture.PermissionFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fixture, nil
+}
+
+func readRelative(dir string, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", pe.WithStack(err)
+	}
+	return string(data), nil
+}
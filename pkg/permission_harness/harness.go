@@ -0,0 +1,264 @@
+package permission_harness
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query_executor"
+	pe "github.com/pkg/errors"
+)
+
+// Harness 在 fixture 的初始文档上执行权限规则，不需要创建真正的数据库
+type Harness struct {
+	permission  *permission_proxy.Permissions
+	conn        *db_conn.MemDbConn
+	db          *permission_proxy.DbWrapper
+	diagnostics []permission_proxy.Diagnostic
+}
+
+// Result 是一个测试用例的执行结果
+type Result struct {
+	Case   Case
+	Passed bool
+	// 权限检查的结果
+	Decision permission_proxy.Decision
+	// view 时客户端不能读取的字段
+	Unreadable []string
+	// 用例本身有问题时（例如文档不存在）的错误
+	Err error
+}
+
+func (r Result) String() string {
+	status := "PASS"
+	if !r.Passed {
+		status = "FAIL"
+	}
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "%s %s", status, r.Case.Name)
+	switch {
+	case r.Err != nil:
+		fmt.Fprintf(&sb, ": %v", r.Err)
+	case !r.Passed:
+		fmt.Fprintf(&sb, ": expected %s", r.Case.Expect)
+		if r.Case.Reason != "" {
+			fmt.Fprintf(&sb, " (%s)", r.Case.Reason)
+		}
+		if r.Case.Unreadable != nil {
+			fmt.Fprintf(&sb, " with unreadable fields %v", r.Case.Unreadable)
+		}
+		fmt.Fprintf(&sb, ", got %s", r.Decision)
+		if r.Case.Unreadable != nil {
+			fmt.Fprintf(&sb, " with unreadable fields %v", r.Unreadable)
+		}
+	default:
+		fmt.Fprintf(&sb, ": %s", r.Decision)
+	}
+	return sb.String()
+}
+
+var memDbSeq atomic.Int64
+
+// newSeededConn 创建一个写入了初始文档的内存数据库，返回它的只读连接
+func newSeededConn(schema *db_conn.DatabaseSchema, permissionJs string, seed []db_conn.TransactionOp) (*db_conn.MemDbConn, error) {
+	name := fmt.Sprintf("permission_harness_%d", memDbSeq.Add(1))
+	if err := db_conn.CreateNewMemDb(name, schema, permissionJs); err != nil {
+		return nil, err
+	}
+	// 打开的连接仍然可以访问数据库
+	defer db_conn.DropMemDb(name)
+
+	seedConn, err := db_conn.NewMemDbConnWithContext(context.Background(), &db_conn.MemDbConnParams{Name: name})
+	if err != nil {
+		return nil, err
+	}
+	if err := seedConn.Open(); err != nil {
+		return nil, err
+	}
+	defer seedConn.Close()
+	err = seedConn.Commit(&db_conn.Transaction{
+		TxID:       name,
+		Committer:  "permission_harness",
+		Operations: seed,
+	})
+	if err != nil {
+		return nil, pe.Wrap(err, "failed to load seed docs")
+	}
+
+	conn, err := db_conn.NewMemDbConnWithContext(context.Background(), &db_conn.MemDbConnParams{Name: name, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Open(); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// New 解析 fixture 中的 schema 和权限定义，并加载初始文档
+func New(fixture *Fixture) (*Harness, error) {
+	schema, err := db_conn.NewDatabaseSchemaFromJs(fixture.Schema)
+	if err != nil {
+		return nil, err
+	}
+	permission, err := permission_proxy.NewPermissionFromJs(fixture.Permission)
+	if err != nil {
+		return nil, err
+	}
+	seed := make([]db_conn.TransactionOp, 0)
+	for collection, seedDocs := range fixture.Seed {
+		if _, ok := schema.Collections[collection]; !ok {
+			return nil, pe.Errorf("seed collection %s is not defined in schema", collection)
+		}
+		for docId, value := range seedDocs {
+			doc, err := newDoc(nil, value)
+			if err != nil {
+				return nil, pe.Wrapf(err, "invalid seed doc %s/%s", collection, docId)
+			}
+			seed = append(seed, &db_conn.InsertOp{
+				Collection: collection,
+				DocID:      docId,
+				Snapshot:   doc.ExportSnapshot().Bytes(),
+			})
+		}
+	}
+	conn, err := newSeededConn(schema, fixture.Permission, seed)
+	if err != nil {
+		return nil, err
+	}
+	return &Harness{
+		permission: permission,
+		conn:       conn,
+		db: &permission_proxy.DbWrapper{
+			QueryExecutor: query_executor.NewQueryExecutor(conn),
+		},
+		diagnostics: permission.Analyze(schema),
+	}, nil
+}
+
+// Diagnostics 返回对照 fixture 的 schema 静态检查权限定义发现的问题
+func (h *Harness) Diagnostics() []permission_proxy.Diagnostic {
+	return h.diagnostics
+}
+
+// newDoc 创建一个文档，文档的内容是 base（可以为 nil）加上 fields 中的字段
+func newDoc(base *loro.LoroDoc, fields map[string]any) (*loro.LoroDoc, error) {
+	doc := loro.NewLoroDoc()
+	if base != nil {
+		doc = base.Fork()
+	}
+	dataMap := doc.GetMap(doc_visitor.DATA_MAP_NAME)
+	for key, value := range fields {
+		if err := dataMap.InsertValueCoerce(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// Run 执行一个测试用例
+func (h *Harness) Run(c Case) Result {
+	result := Result{Case: c}
+	if c.Expect != ExpectAllow && c.Expect != ExpectDeny {
+		result.Err = pe.Errorf("invalid expect %q, should be %q or %q", c.Expect, ExpectAllow, ExpectDeny)
+		return result
+	}
+
+	switch c.Op {
+	case OpView:
+		doc, err := h.conn.LoadDoc(c.Collection, c.DocId)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		params := permission_proxy.CanViewParams{
+			Collection: c.Collection,
+			DocId:      c.DocId,
+			Doc:        doc,
+			ClientId:   c.ClientId,
+			Db:         h.db,
+		}
+		result.Decision = h.permission.DecideView(params)
+		if result.Decision.Allowed {
+			result.Unreadable = h.permission.UnreadableFields(params)
+		}
+	case OpCreate:
+		doc, err := newDoc(nil, c.Change)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		result.Decision = h.permission.DecideCreate(permission_proxy.CanCreateParams{
+			Collection: c.Collection,
+			DocId:      c.DocId,
+			NewDoc:     doc,
+			ClientId:   c.ClientId,
+			Db:         h.db,
+		})
+	case OpUpdate:
+		oldDoc, err := h.conn.LoadDoc(c.Collection, c.DocId)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		newDoc, err := newDoc(oldDoc, c.Change)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		result.Decision = h.permission.DecideUpdate(permission_proxy.CanUpdateParams{
+			Collection: c.Collection,
+			DocId:      c.DocId,
+			NewDoc:     newDoc,
+			OldDoc:     oldDoc,
+			ClientId:   c.ClientId,
+			Db:         h.db,
+		})
+	case OpDelete:
+		doc, err := h.conn.LoadDoc(c.Collection, c.DocId)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		result.Decision = h.permission.DecideDelete(permission_proxy.CanDeleteParams{
+			Collection: c.Collection,
+			DocId:      c.DocId,
+			Doc:        doc,
+			ClientId:   c.ClientId,
+			Db:         h.db,
+		})
+	default:
+		result.Err = pe.Errorf("invalid op %q", c.Op)
+		return result
+	}
+
+	result.Passed = result.Decision.Allowed == (c.Expect == ExpectAllow) &&
+		(c.Reason == "" || c.Reason == result.Decision.Reason) &&
+		(c.Unreadable == nil || sameFields(c.Unreadable, result.Unreadable))
+	return result
+}
+
+// RunAll 按顺序执行 fixture 中的所有测试用例
+func (h *Harness) RunAll(fixture *Fixture) []Result {
+	results := make([]Result, 0, len(fixture.Cases))
+	for _, c := range fixture.Cases {
+		results = append(results, h.Run(c))
+	}
+	return results
+}
+
+func sameFields(want, got []string) bool {
+	if len(want) == 0 && len(got) == 0 {
+		return true
+	}
+	want = append([]string(nil), want...)
+	sort.Strings(want)
+	return reflect.DeepEqual(want, got)
+}
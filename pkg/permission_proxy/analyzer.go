@@ -0,0 +1,366 @@
+package permission_proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/ast"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/transpiler"
+)
+
+// 诊断信息的严重程度
+const (
+	// 规则在运行时一定会出错，或者引用了 schema 中不存在的东西
+	SeverityError = "error"
+	// 规则可能不按预期执行
+	SeverityWarning = "warning"
+)
+
+// Diagnostic 是静态检查权限定义时发现的一个问题
+type Diagnostic struct {
+	Severity   string
+	Collection string
+	// 出问题的规则，例如 canView 或 fields.email.canRead，集合本身的问题为空
+	Rule    string
+	Message string
+	// 问题在权限定义中的行号和列号，从 1 开始，未知时为 0
+	Line   int
+	Column int
+}
+
+func (d Diagnostic) String() string {
+	sb := strings.Builder{}
+	if d.Line > 0 {
+		fmt.Fprintf(&sb, "%d:%d: ", d.Line, d.Column)
+	}
+	fmt.Fprintf(&sb, "%s: %s", d.Severity, d.Collection)
+	if d.Rule != "" {
+		fmt.Fprintf(&sb, ".%s", d.Rule)
+	}
+	fmt.Fprintf(&sb, ": %s", d.Message)
+	return sb.String()
+}
+
+// HasErrors 判断 diagnostics 中是否有 SeverityError 级别的问题
+func HasErrors(diagnostics []Diagnostic) bool {
+	for _, d := range diagnostics {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// docFieldDeleted 是软删除标记字段，所有文档都有，不在 schema 中定义
+const docFieldDeleted = "deleted"
+
+// Analyze 对照数据库 schema 静态检查权限定义，返回发现的问题
+//
+//   - 规则引用的集合和字段规则的字段必须在 schema 中定义
+//   - 规则中的变量必须是参数、局部变量、NewPermissionFuncScope 中的全局变量或者注册的宿主对象，
+//     宿主对象的函数必须已经注册
+//   - db.<集合> 中的集合和 doc.<字段>（包括 newDoc、oldDoc）中的字段必须在 schema 中定义
+//   - 执行时不支持的语法
+//
+// 这些检查都是保守的，通过检查的规则仍然可能在运行时出错。
+// 宿主对象需要在检查之前注册，参见 RegisterHostObject
+func (p *Permissions) Analyze(schema *db_conn.DatabaseSchema) []Diagnostic {
+	globals := NewPermissionFuncScope().Vars
+	var diagnostics []Diagnostic
+	report := func(severity, collection, rule string, idx ast.Idx, format string, args ...any) {
+		line, column := p.position(int(idx))
+		diagnostics = append(diagnostics, Diagnostic{
+			Severity:   severity,
+			Collection: collection,
+			Rule:       rule,
+			Message:    fmt.Sprintf(format, args...),
+			Line:       line,
+			Column:     column,
+		})
+	}
+
+	for _, re := range p.ruleExprs {
+		collectionSchema := schema.Collections[re.collection]
+		if collectionSchema == nil {
+			report(SeverityError, re.collection, re.rule, re.expr.Idx0(), "collection %s is not defined in schema", re.collection)
+		} else if field, ok := strings.CutPrefix(re.rule, "fields."); ok {
+			field = field[:strings.LastIndex(field, ".")]
+			if !hasDocField(collectionSchema, strings.Split(field, ".")[0]) {
+				report(SeverityError, re.collection, re.rule, re.expr.Idx0(), "field %s is not defined in schema", field)
+			}
+		}
+
+		for _, unsupported := range transpiler.FindUnsupportedSyntax(re.expr) {
+			report(SeverityWarning, re.collection, re.rule, unsupported.Idx, "%s is not supported", unsupported.Syntax)
+		}
+
+		declared := declaredNames(re.expr)
+		for _, ref := range referencedIdentifiers(re.expr) {
+			if _, ok := declared[ref.Name]; ok {
+				continue
+			}
+			if _, ok := globals[ref.Name]; ok || transpiler.IsBuiltinGlobal(ref.Name) {
+				continue
+			}
+			if _, ok := p.hostObjects[ref.Name]; ok {
+				continue
+			}
+			report(SeverityError, re.collection, re.rule, ref.Idx, "undefined identifier %s", ref.Name)
+		}
+
+		roles := paramRoles(re.expr)
+		for _, access := range memberAccesses(re.expr) {
+			if object, ok := access.object.(*ast.Identifier); ok {
+				if host, ok := p.hostObjects[object.Name]; ok {
+					if _, shadowed := declared[object.Name]; !shadowed && host.Funcs[access.prop] == nil {
+						report(SeverityError, re.collection, re.rule, access.idx, "host function %s.%s is not defined", object.Name, access.prop)
+					}
+					continue
+				}
+			}
+			switch roles.of(access.object) {
+			case "db":
+				if _, ok := schema.Collections[access.prop]; !ok {
+					report(SeverityError, re.collection, re.rule, access.idx, "collection %s is not defined in schema", access.prop)
+				}
+			case "doc", "newDoc", "oldDoc":
+				if collectionSchema != nil && !hasDocField(collectionSchema, access.prop) {
+					report(SeverityError, re.collection, re.rule, access.idx, "field %s is not defined in schema of collection %s", access.prop, re.collection)
+				}
+			}
+		}
+	}
+	return diagnostics
+}
+
+func hasDocField(collectionSchema *db_conn.CollectionSchema, field string) bool {
+	if field == docFieldDeleted {
+		return true
+	}
+	if collectionSchema.DocSchema == nil {
+		return false
+	}
+	_, ok := collectionSchema.DocSchema.Fields[field]
+	return ok
+}
+
+// declaredNames 返回 node 中声明的所有名字，包括参数、变量、函数名和 catch 参数
+//
+// 和解释执行一样不区分块作用域，嵌套函数中声明的名字也算在内，
+// 所以这里只能发现完全没有声明过的变量
+func declaredNames(node ast.VisitableNode) map[string]struct{} {
+	v := &declarationCollector{names: make(map[string]struct{})}
+	v.V = v
+	node.VisitWith(v)
+	return v.names
+}
+
+type declarationCollector struct {
+	ast.NoopVisitor
+	names map[string]struct{}
+}
+
+func (v *declarationCollector) VisitVariableDeclarator(n *ast.VariableDeclarator) {
+	v.addTarget(n.Target.Target)
+	n.VisitChildrenWith(v)
+}
+
+func (v *declarationCollector) VisitFunctionLiteral(n *ast.FunctionLiteral) {
+	if n.Name != nil {
+		v.names[n.Name.Name] = struct{}{}
+	}
+	if n.ParameterList.Rest != nil {
+		v.addTarget(n.ParameterList.Rest)
+	}
+	n.VisitChildrenWith(v)
+}
+
+func (v *declarationCollector) VisitArrowFunctionLiteral(n *ast.ArrowFunctionLiteral) {
+	if n.ParameterList.Rest != nil {
+		v.addTarget(n.ParameterList.Rest)
+	}
+	n.VisitChildrenWith(v)
+}
+
+func (v *declarationCollector) VisitCatchStatement(n *ast.CatchStatement) {
+	if n.Parameter != nil {
+		v.addTarget(n.Parameter.Target)
+	}
+	n.VisitChildrenWith(v)
+}
+
+// addTarget 记录解构目标中声明的名字，for-in/of 中的 let/const/var 声明
+// 也是 VariableDeclarator，不需要单独处理
+func (v *declarationCollector) addTarget(target ast.Expr) {
+	switch t := target.(type) {
+	case *ast.Identifier:
+		v.names[t.Name] = struct{}{}
+	case *ast.ObjectPattern:
+		for _, prop := range t.Properties {
+			switch p := prop.Prop.(type) {
+			case *ast.PropertyShort:
+				v.names[p.Name.Name] = struct{}{}
+			case *ast.PropertyKeyed:
+				v.addTarget(p.Value.Expr)
+			}
+		}
+		if t.Rest != nil {
+			v.addTarget(t.Rest)
+		}
+	case *ast.ArrayPattern:
+		for _, elem := range t.Elements {
+			if elem.Expr != nil {
+				v.addTarget(elem.Expr)
+			}
+		}
+		if t.Rest != nil {
+			v.addTarget(t.Rest.Expr)
+		}
+	case *ast.AssignExpression:
+		// 带默认值的解构
+		v.addTarget(t.Left.Expr)
+	}
+}
+
+type identifierRef struct {
+	Name string
+	Idx  ast.Idx
+}
+
+// referencedIdentifiers 返回 node 中作为变量引用的标识符，不包括属性名和标签
+func referencedIdentifiers(node ast.VisitableNode) []identifierRef {
+	v := &referenceCollector{}
+	v.V = v
+	node.VisitWith(v)
+	return v.refs
+}
+
+type referenceCollector struct {
+	ast.NoopVisitor
+	refs []identifierRef
+}
+
+func (v *referenceCollector) VisitIdentifier(n *ast.Identifier) {
+	v.refs = append(v.refs, identifierRef{Name: n.Name, Idx: n.Idx})
+}
+
+func (v *referenceCollector) VisitMemberExpression(n *ast.MemberExpression) {
+	n.Object.VisitWith(v)
+	if computed, ok := n.Property.Prop.(*ast.ComputedProperty); ok {
+		computed.VisitWith(v)
+	}
+}
+
+func (v *referenceCollector) VisitPropertyKeyed(n *ast.PropertyKeyed) {
+	if n.Computed {
+		n.Key.VisitWith(v)
+	}
+	n.Value.VisitWith(v)
+}
+
+func (v *referenceCollector) VisitLabelledStatement(n *ast.LabelledStatement) {
+	n.Statement.VisitWith(v)
+}
+
+func (v *referenceCollector) VisitBreakStatement(n *ast.BreakStatement) {}
+
+func (v *referenceCollector) VisitContinueStatement(n *ast.ContinueStatement) {}
+
+// roles 记录规则参数中 doc、newDoc、oldDoc、db 等属性在规则函数中的名字
+type roles struct {
+	// 解构出来的局部变量名 -> 参数属性名
+	aliases map[string]string
+	// 没有解构时参数的名字
+	param string
+}
+
+// paramRoles 分析规则函数的第一个参数，它可以被解构（({ doc, db }) => ...），
+// 也可以作为一个整体使用（(params) => params.doc）
+func paramRoles(expr ast.Expr) roles {
+	r := roles{aliases: make(map[string]string)}
+	var params ast.ParameterList
+	switch fn := expr.(type) {
+	case *ast.ArrowFunctionLiteral:
+		params = fn.ParameterList
+	case *ast.FunctionLiteral:
+		params = fn.ParameterList
+	}
+	if len(params.List) == 0 {
+		return r
+	}
+	switch target := params.List[0].Target.Target.(type) {
+	case *ast.Identifier:
+		r.param = target.Name
+	case *ast.ObjectPattern:
+		for _, prop := range target.Properties {
+			switch p := prop.Prop.(type) {
+			case *ast.PropertyShort:
+				r.aliases[p.Name.Name] = p.Name.Name
+			case *ast.PropertyKeyed:
+				key, ok := p.Key.Expr.(*ast.StringLiteral)
+				if !ok {
+					continue
+				}
+				if alias, ok := p.Value.Expr.(*ast.Identifier); ok {
+					r.aliases[alias.Name] = key.Value
+				}
+			}
+		}
+	}
+	return r
+}
+
+// of 返回 expr 对应的参数属性名，expr 不是参数的属性时返回空字符串
+func (r roles) of(expr ast.Expr) string {
+	switch e := expr.(type) {
+	case *ast.Identifier:
+		return r.aliases[e.Name]
+	case *ast.MemberExpression:
+		object, ok := e.Object.Expr.(*ast.Identifier)
+		if !ok || r.param == "" || object.Name != r.param {
+			return ""
+		}
+		prop, _ := staticPropName(e)
+		return prop
+	}
+	return ""
+}
+
+type memberAccess struct {
+	object ast.Expr
+	prop   string
+	idx    ast.Idx
+}
+
+// memberAccesses 返回 node 中所有属性名可以静态确定的属性访问 a.b 和 a["b"]
+func memberAccesses(node ast.VisitableNode) []memberAccess {
+	v := &memberAccessCollector{}
+	v.V = v
+	node.VisitWith(v)
+	return v.accesses
+}
+
+type memberAccessCollector struct {
+	ast.NoopVisitor
+	accesses []memberAccess
+}
+
+func (v *memberAccessCollector) VisitMemberExpression(n *ast.MemberExpression) {
+	if prop, idx := staticPropName(n); prop != "" {
+		v.accesses = append(v.accesses, memberAccess{object: n.Object.Expr, prop: prop, idx: idx})
+	}
+	n.VisitChildrenWith(v)
+}
+
+func staticPropName(n *ast.MemberExpression) (string, ast.Idx) {
+	switch prop := n.Property.Prop.(type) {
+	case *ast.Identifier:
+		return prop.Name, prop.Idx
+	case *ast.ComputedProperty:
+		if str, ok := prop.Expr.Expr.(*ast.StringLiteral); ok {
+			return str.Value, str.Idx
+		}
+	}
+	return "", 0
+}
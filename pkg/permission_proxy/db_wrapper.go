@@ -16,6 +16,30 @@ import (
 // view of a database in the permission system
 type DbWrapper struct {
 	QueryExecutor *query_executor.QueryExecutor
+	// the execution budget queries are charged to, nil means unlimited
+	Budget *transpiler.Budget
+	// results of host function calls shared by all rules checked with this
+	// wrapper, usually the rules of one transaction, nil disables caching
+	HostCalls *HostCallCache
+}
+
+// WithBudget returns a copy of the wrapper whose queries are charged to budget
+func (dw *DbWrapper) WithBudget(budget *transpiler.Budget) *DbWrapper {
+	if dw == nil {
+		return nil
+	}
+	return &DbWrapper{
+		QueryExecutor: dw.QueryExecutor,
+		Budget:        budget,
+		HostCalls:     dw.HostCalls,
+	}
+}
+
+func (dw *DbWrapper) hostCallCache() *HostCallCache {
+	if dw == nil {
+		return nil
+	}
+	return dw.HostCalls
 }
 
 // allow users to write `db["<collection_name>"]` to get a collection wrapper
@@ -30,6 +54,7 @@ func DbWrapperAccessHandler(access transpiler.PropAccess, obj any) (any, error)
 				return &CollectionWrapper{
 					QueryExecutor: dbWrapper.QueryExecutor,
 					Collection:    collection,
+					Budget:        dbWrapper.Budget,
 				}, nil
 			}
 		}
@@ -40,6 +65,7 @@ func DbWrapperAccessHandler(access transpiler.PropAccess, obj any) (any, error)
 type CollectionWrapper struct {
 	QueryExecutor *query_executor.QueryExecutor
 	Collection    string
+	Budget        *transpiler.Budget
 }
 
 // allow users to write
@@ -49,6 +75,8 @@ type CollectionWrapper struct {
 //	  sort: [...],
 //	  skip: 0,
 //	  limit: 10,
+//	  after: "<cursor>",
+//	  before: "<cursor>",
 //	})
 //
 // to create and execute a findMany query
@@ -71,6 +99,8 @@ func CollectionWrapperAccessHandler(access transpiler.PropAccess, obj any) (any,
 				sort := transpiler.GetField(access.Args[0], "sort")
 				skip := transpiler.GetField(access.Args[0], "skip")
 				limit := transpiler.GetField(access.Args[0], "limit")
+				after := transpiler.GetField(access.Args[0], "after")
+				before := transpiler.GetField(access.Args[0], "before")
 
 				q := &query.FindManyQuery{
 					Collection: cw.Collection,
@@ -94,6 +124,7 @@ func CollectionWrapperAccessHandler(access transpiler.PropAccess, obj any) (any,
 								return nil, errors.WithStack(fmt.Errorf("invalid query: sort must be a []SortField"))
 							}
 						}
+						q.Sort = sortArray
 					} else {
 						return nil, errors.WithStack(fmt.Errorf("invalid query: sort must be a []SortField"))
 					}
@@ -119,11 +150,33 @@ func CollectionWrapperAccessHandler(access transpiler.PropAccess, obj any) (any,
 					}
 				}
 
+				// construct cursors
+				if after != nil {
+					if v, ok := after.(string); ok {
+						q.After = v
+					} else {
+						return nil, errors.WithStack(fmt.Errorf("invalid query: after must be a cursor string"))
+					}
+				}
+				if before != nil {
+					if v, ok := before.(string); ok {
+						q.Before = v
+					} else {
+						return nil, errors.WithStack(fmt.Errorf("invalid query: before must be a cursor string"))
+					}
+				}
+
 				// execute query
+				if err := cw.Budget.ChargeQuery(); err != nil {
+					return nil, err
+				}
 				docs, err := cw.QueryExecutor.FindMany(q)
 				if err != nil {
 					return nil, errors.WithStack(err)
 				}
+				if err := cw.Budget.ChargeResult(len(docs)); err != nil {
+					return nil, err
+				}
 
 				return docs, nil
 			} else if access.Prop == "findOne" {
@@ -141,10 +194,18 @@ func CollectionWrapperAccessHandler(access transpiler.PropAccess, obj any) (any,
 					return nil, errors.WithStack(fmt.Errorf("invalid query: filter must be a QueryFilterExpr"))
 				}
 
+				if err := cw.Budget.ChargeQuery(); err != nil {
+					return nil, err
+				}
 				doc, err := cw.QueryExecutor.FindOne(q)
 				if err != nil {
 					return nil, errors.WithStack(err)
 				}
+				if doc != nil {
+					if err := cw.Budget.ChargeResult(1); err != nil {
+						return nil, err
+					}
+				}
 
 				return doc, nil
 			}
@@ -158,11 +219,11 @@ func ToQueryFilterExpr(v any) (qfe.QueryFilterExpr, error) {
 	case qfe.QueryFilterExpr:
 		return val, nil
 	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, string, nil:
-		return &qfe.ValueExpr{Value: val}, nil
+		return qfe.NewValueExpr(val), nil
 	case []interface{}:
-		return &qfe.ValueExpr{Value: val}, nil
+		return qfe.NewValueExpr(val), nil
 	case map[string]interface{}:
-		return &qfe.ValueExpr{Value: val}, nil
+		return qfe.NewValueExpr(val), nil
 	default:
 		return nil, errors.WithStack(fmt.Errorf("unsupported value type: %T", v))
 	}
@@ -189,6 +250,48 @@ func FieldWrapper(field string) qfe.QueryFilterExpr {
 	}
 }
 
+func EqIgnoreCaseWrapper(o1 any, o2 any) qfe.QueryFilterExpr {
+	return qfe.NewEqIgnoreCaseExpr(mustToQueryFilterExpr(o1), mustToQueryFilterExpr(o2))
+}
+
+func AddWrapper(o1 any, o2 any) qfe.QueryFilterExpr {
+	return qfe.NewAddExpr(mustToQueryFilterExpr(o1), mustToQueryFilterExpr(o2))
+}
+
+func SubWrapper(o1 any, o2 any) qfe.QueryFilterExpr {
+	return qfe.NewSubExpr(mustToQueryFilterExpr(o1), mustToQueryFilterExpr(o2))
+}
+
+func ModWrapper(o1 any, o2 any) qfe.QueryFilterExpr {
+	return qfe.NewModExpr(mustToQueryFilterExpr(o1), mustToQueryFilterExpr(o2))
+}
+
+func NowWrapper() qfe.QueryFilterExpr {
+	return qfe.NewNowExpr()
+}
+
+func DatePartWrapper(target any, part string) qfe.QueryFilterExpr {
+	return qfe.NewDatePartExpr(mustToQueryFilterExpr(target), qfe.DatePart(part))
+}
+
+func IsTypeWrapper(target any, expected string) qfe.QueryFilterExpr {
+	return qfe.NewIsTypeExpr(mustToQueryFilterExpr(target), qfe.ValueType(expected))
+}
+
+// ElemMatchWrapper 的 cond 中使用的路径相对于数组元素，
+// 可以用 field("$") 表示元素本身
+func ElemMatchWrapper(path string, cond any) qfe.QueryFilterExpr {
+	return qfe.NewElemMatchExpr(qfe.NewValueExpr(path), mustToQueryFilterExpr(cond))
+}
+
+func mustToQueryFilterExpr(v any) qfe.QueryFilterExpr {
+	expr, err := ToQueryFilterExpr(v)
+	if err != nil {
+		panic(err)
+	}
+	return expr
+}
+
 func SortAscWrapper(path string) query.SortField {
 	return query.SortField{
 		Field: path,
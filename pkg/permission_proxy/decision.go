@@ -0,0 +1,113 @@
+package permission_proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/transpiler"
+)
+
+var (
+	// ErrNoCollectionRule 表示权限定义中没有集合的规则
+	ErrNoCollectionRule = errors.New("no rule for collection")
+	// ErrRuleNotDefined 表示集合的规则中没有定义需要的规则函数
+	ErrRuleNotDefined = errors.New("rule not defined")
+)
+
+// Decision 是一次权限检查的结果
+//
+// 规则函数可以返回 bool，也可以返回 { allow: false, reason: "not owner" }
+// 这样的对象来说明拒绝的原因
+type Decision struct {
+	Allowed bool
+	// 做出决定的规则，例如 canUpdate，字段规则为 fields.<字段路径>.canWrite
+	Rule       string
+	Collection string
+	DocId      string
+	// 被检查的操作在事务中的下标，不是事务中的操作时为 -1
+	OpIndex int
+	// 规则返回的拒绝原因
+	Reason string
+	// 规则执行失败的原因，规则正常返回时为 nil
+	Err error
+	// 规则出错的位置在权限定义中的行号和列号，从 1 开始，未知时为 0
+	Line   int
+	Column int
+}
+
+func (d Decision) String() string {
+	sb := strings.Builder{}
+	if d.Allowed {
+		sb.WriteString("allowed by ")
+	} else {
+		sb.WriteString("denied by ")
+	}
+	fmt.Fprintf(&sb, "%s of %s", d.Rule, d.Collection)
+	if d.DocId != "" {
+		fmt.Fprintf(&sb, "/%s", d.DocId)
+	}
+	if d.OpIndex >= 0 {
+		fmt.Fprintf(&sb, " (op %d)", d.OpIndex)
+	}
+	if d.Reason != "" {
+		fmt.Fprintf(&sb, ": %s", d.Reason)
+	}
+	if d.Err != nil {
+		fmt.Fprintf(&sb, ": %v", d.Err)
+		if d.Line > 0 {
+			fmt.Fprintf(&sb, " at %d:%d", d.Line, d.Column)
+		}
+	}
+	return sb.String()
+}
+
+// decide 在新的执行预算内执行规则函数 fn，bindParams 返回使用 db 查询数据库的规则参数，
+// 传给 bindParams 的 db 是 db 绑定到这个预算上的副本
+//
+// 规则返回 Promise 时（例如没有 await 宿主函数的结果就直接返回）等待它的结果
+func (p *Permissions) decide(decision Decision, fn CollectionRuleFunc, db *DbWrapper, bindParams func(db *DbWrapper) any) Decision {
+	if fn == nil {
+		decision.Err = ErrRuleNotDefined
+		return decision
+	}
+	ctx := withHostCallCache(context.Background(), db.hostCallCache())
+	budget, cancel := transpiler.NewBudget(ctx, p.Limits)
+	defer cancel()
+	ret, err := fn(budget, bindParams(db.WithBudget(budget)))
+	if promise, ok := ret.(*transpiler.Promise); ok && err == nil {
+		ret, err = promise.Await(budget.Context())
+	}
+	if err != nil {
+		logRuleError(decision.Rule, decision.Collection, err)
+		decision.Err = err
+		var srcErr *transpiler.SourceError
+		if errors.As(err, &srcErr) {
+			decision.Line, decision.Column = p.position(int(srcErr.Idx))
+		}
+		return decision
+	}
+	switch ret := ret.(type) {
+	case bool:
+		decision.Allowed = ret
+	case map[string]any:
+		allow, _ := ret["allow"].(bool)
+		reason, _ := ret["reason"].(string)
+		decision.Allowed = allow
+		decision.Reason = reason
+	}
+	return decision
+}
+
+// position 将权限定义中从 1 开始的字节偏移 idx 换算为行号和列号
+func (p *Permissions) position(idx int) (line int, column int) {
+	if idx <= 0 || idx > len(p.JsDef)+1 {
+		return 0, 0
+	}
+	before := p.JsDef[:idx-1]
+	line = strings.Count(before, "\n") + 1
+	column = utf8.RuneCountInString(before[strings.LastIndex(before, "\n")+1:]) + 1
+	return line, column
+}
@@ -0,0 +1,307 @@
+package permission_proxy
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/ast"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+)
+
+// ErrRedactedDocUpdate 表示客户端基于去掉了字段的文档副本提交的修改无法合入原文档，
+// 例如修改了不能读取的字段，或者修改所基于的副本不是最新的，参见 RedactedSnapshot
+var ErrRedactedDocUpdate = errors.New("update is based on a redacted copy of the doc")
+
+// FieldRule 是集合中一个字段的读写权限，没有定义的规则表示允许
+//
+//	fields: {
+//	  // 只有管理员可以看到 email
+//	  email: {
+//	    canRead: ({ docId, doc, field, clientId, db }) => clientId === "admin",
+//	  },
+//	  // owner 只能在创建文档时设置
+//	  owner: {
+//	    canWrite: ({ docId, newDoc, oldDoc, field, clientId, db }) => oldDoc === null,
+//	  },
+//	}
+//
+// 字段名是以 . 分隔的路径，规则同时作用于路径下的所有子字段
+type FieldRule struct {
+	CanRead  CollectionRuleFunc
+	CanWrite CollectionRuleFunc
+}
+
+type CanReadParams struct {
+	Collection string
+	DocId      string
+	Doc        *loro.LoroDoc
+	Field      string
+	ClientId   string
+	Db         *DbWrapper
+}
+
+type CanWriteParams struct {
+	Collection string
+	DocId      string
+	NewDoc     *loro.LoroDoc
+	// 创建文档时为 nil
+	OldDoc   *loro.LoroDoc
+	Field    string
+	ClientId string
+	Db       *DbWrapper
+}
+
+// HasFieldReadRules 检查集合中是否有字段定义了 canRead 规则
+func (p *Permissions) HasFieldReadRules(collection string) bool {
+	rule, ok := p.Rules[collection]
+	if !ok {
+		return false
+	}
+	for _, fieldRule := range rule.Fields {
+		if fieldRule.CanRead != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// UnreadableFields 返回文档中客户端不能读取的字段，按字段名排序
+func (p *Permissions) UnreadableFields(params CanViewParams) []string {
+	return p.unreadableFields(params, true)
+}
+
+// UnreadableRuleFields 返回定义了 canRead 规则且客户端不能读取的字段，按字段名排序。
+// 与 UnreadableFields 不同，当前文档中不存在的字段也会被检查，
+// 用于文档的历史版本，历史版本中可能有当前已经删除的字段
+func (p *Permissions) UnreadableRuleFields(params CanViewParams) []string {
+	return p.unreadableFields(params, false)
+}
+
+// unreadableFields 对定义了 canRead 规则的字段逐个检查，onlyPresent 为 true 时跳过当前文档中不存在的字段
+func (p *Permissions) unreadableFields(params CanViewParams, onlyPresent bool) []string {
+	rule, ok := p.Rules[params.Collection]
+	if !ok {
+		return nil
+	}
+	var fields []string
+	for field, fieldRule := range rule.Fields {
+		if fieldRule.CanRead == nil {
+			continue
+		}
+		if onlyPresent {
+			if _, err := doc_visitor.VisitDocByPath(params.Doc, field); err != nil {
+				continue
+			}
+		}
+		if !p.canRead(fieldRule, CanReadParams{
+			Collection: params.Collection,
+			DocId:      params.DocId,
+			Doc:        params.Doc,
+			Field:      field,
+			ClientId:   params.ClientId,
+			Db:         params.Db,
+		}) {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (p *Permissions) canRead(fieldRule FieldRule, params CanReadParams) bool {
+	decision := Decision{
+		Rule:       "fields." + params.Field + ".canRead",
+		Collection: params.Collection,
+		DocId:      params.DocId,
+		OpIndex:    -1,
+	}
+	return p.decide(decision, fieldRule.CanRead, params.Db, func(db *DbWrapper) any {
+		params.Db = db
+		return params
+	}).Allowed
+}
+
+// decideWriteFields 检查客户端能否写入从 oldDoc 到 newDoc 被修改的所有字段，oldDoc 为 nil 表示创建文档，
+// 所有字段都可以写入时返回文档级别的检查结果 decision
+func (p *Permissions) decideWriteFields(decision Decision, rule CollectionRule, params CanWriteParams) Decision {
+	if len(rule.Fields) == 0 {
+		return decision
+	}
+	changed, err := ChangedFields(params.OldDoc, params.NewDoc)
+	if err != nil {
+		logRuleError("canWrite", params.Collection, err)
+		decision.Allowed = false
+		decision.Err = err
+		return decision
+	}
+	fields := make([]string, 0, len(rule.Fields))
+	for field := range rule.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		fieldRule := rule.Fields[field]
+		if fieldRule.CanWrite == nil || !OverlapsAny(field, changed) {
+			continue
+		}
+		fieldDecision := p.decide(Decision{
+			Rule:       "fields." + field + ".canWrite",
+			Collection: params.Collection,
+			DocId:      params.DocId,
+			OpIndex:    -1,
+		}, fieldRule.CanWrite, params.Db, func(db *DbWrapper) any {
+			fieldParams := params
+			fieldParams.Field = field
+			fieldParams.Db = db
+			return fieldParams
+		})
+		if !fieldDecision.Allowed {
+			return fieldDecision
+		}
+	}
+	return decision
+}
+
+// ChangedFields 返回从 oldDoc 到 newDoc 被修改（设置或删除）的字段路径，oldDoc 为 nil 时返回 newDoc 中的所有字段。
+// newDoc 必须包含 oldDoc 的全部历史，例如 oldDoc.Fork() 导入更新后的文档
+//
+// 路径由 loro 的 Diff 得到：对象中被修改的键是 MapDelta 中的键，
+// 列表和文本容器中的修改视为整个容器被修改，列表中的位置以下标表示，例如 tags.0.name
+func ChangedFields(oldDoc, newDoc *loro.LoroDoc) ([]string, error) {
+	from := loro.NewEmptyFrontiers()
+	if oldDoc != nil {
+		from = oldDoc.GetOplogFrontiers()
+	}
+	diff, err := newDoc.Diff(from, newDoc.GetOplogFrontiers())
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, event := range diff.GetEvents() {
+		path, ok := newDoc.GetPathToContainer(event.ContainerId)
+		// 只关心数据容器中的字段，已经被删除的容器由它的父容器中的修改体现
+		if !ok || len(path) == 0 || path[0] != doc_visitor.DATA_MAP_NAME {
+			continue
+		}
+		prefix := strings.Join(path[1:], ".")
+		if event.DiffEvent.GetType() == loro.DIFF_EVENT_TYPE_MAP {
+			for _, key := range event.DiffEvent.GetMapDiff().GetUpdatedKeys() {
+				paths = append(paths, joinFieldPath(prefix, key))
+			}
+		} else if prefix != "" {
+			paths = append(paths, prefix)
+		}
+	}
+	return paths, nil
+}
+
+func joinFieldPath(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// OverlapsAny 检查字段 field 与 paths 中的某个路径是否相同或者互为父子路径
+func OverlapsAny(field string, paths []string) bool {
+	for _, path := range paths {
+		if path == field || strings.HasPrefix(path, field+".") || strings.HasPrefix(field, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactedSnapshot 返回去掉客户端不能读取的字段后的文档快照，
+// 客户端可以读取所有字段时 redacted 为 false，此时应该发送原文档
+//
+// loro 快照中包含文档的全部历史，删除字段后再导出快照仍然能看到被删除的值，
+// 因此去掉字段后的快照是用剩余字段的值构建的新文档，它与原文档没有共同的历史，
+// 客户端收到后应该替换本地的文档，而不是合并，之后这个文档的修改也总是以完整快照的形式发送。
+// 基于这个副本的修改不能直接导入原文档，服务端用 ChangedFields 找出副本中被修改的字段，
+// 再把这些字段的新值写入原文档，修改了不能读取的字段时以 ErrRedactedDocUpdate 拒绝事务
+func (p *Permissions) RedactedSnapshot(params CanViewParams) (snapshot []byte, redacted bool, err error) {
+	fields := p.UnreadableFields(params)
+	if len(fields) == 0 {
+		return nil, false, nil
+	}
+	value, err := params.Doc.GetMap(doc_visitor.DATA_MAP_NAME).ToGoObject()
+	if err != nil {
+		return nil, true, err
+	}
+	RedactValue(value, fields)
+	doc := loro.NewLoroDoc()
+	dataMap := doc.GetMap(doc_visitor.DATA_MAP_NAME)
+	for key, v := range value {
+		if err := dataMap.InsertValueCoerce(key, v); err != nil {
+			return nil, true, err
+		}
+	}
+	return doc.ExportSnapshot().Bytes(), true, nil
+}
+
+// RedactValue 从文档的值 value 中删除 fields 中的字段，字段的格式与 UnreadableFields 的返回值相同
+func RedactValue(value map[string]any, fields []string) {
+	for _, field := range fields {
+		deleteFieldPath(value, field)
+	}
+}
+
+func deleteFieldPath(value map[string]any, path string) {
+	segments := strings.Split(path, ".")
+	for _, segment := range segments[:len(segments)-1] {
+		next, ok := value[segment].(map[string]any)
+		if !ok {
+			return
+		}
+		value = next
+	}
+	delete(value, segments[len(segments)-1])
+}
+
+// newFieldRules 从 fields 的定义中生成字段规则
+func (p *Permissions) newFieldRules(collection string, expr ast.Expr) (map[string]FieldRule, error) {
+	fieldsExpr, ok := expr.(*ast.ObjectLiteral)
+	if !ok {
+		return nil, ErrInvalidPermissionDefinition
+	}
+	fields := make(map[string]FieldRule, len(fieldsExpr.Value))
+	for _, prop := range fieldsExpr.Value {
+		fieldKeyed, ok := prop.Prop.(*ast.PropertyKeyed)
+		if !ok {
+			return nil, ErrInvalidPermissionDefinition
+		}
+		fieldKey, ok := fieldKeyed.Key.Expr.(*ast.StringLiteral)
+		if !ok || fieldKey.Value == "" {
+			return nil, ErrInvalidPermissionDefinition
+		}
+		ruleFuncs, ok := fieldKeyed.Value.Expr.(*ast.ObjectLiteral)
+		if !ok {
+			return nil, ErrInvalidPermissionDefinition
+		}
+		fieldRule := FieldRule{}
+		for _, ruleFunc := range ruleFuncs.Value {
+			name, ruleFuncExpr, err := parseRuleFunc(ruleFunc)
+			if err != nil {
+				return nil, err
+			}
+			goFunc, err := p.newRuleFunc(ruleFuncExpr)
+			if err != nil {
+				return nil, err
+			}
+			p.ruleExprs = append(p.ruleExprs, ruleExpr{collection, "fields." + fieldKey.Value + "." + name, ruleFuncExpr})
+			switch name {
+			case "canRead":
+				fieldRule.CanRead = goFunc
+			case "canWrite":
+				fieldRule.CanWrite = goFunc
+			default:
+				return nil, ErrInvalidPermissionDefinition
+			}
+		}
+		fields[fieldKey.Value] = fieldRule
+	}
+	return fields, nil
+}
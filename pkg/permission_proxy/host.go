@@ -0,0 +1,150 @@
+package permission_proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/transpiler"
+	pe "github.com/pkg/errors"
+)
+
+// 宿主函数
+//
+// 权限规则可以调用注册的 Go 函数访问外部系统，例如请求单独的策略服务：
+//
+//	canUpdate: async ({ docId }) => await policy.check("post:edit", docId),
+//
+// 宿主函数在新的 goroutine 中执行，规则中的调用立即返回一个 Promise，用 await 等待结果。
+// 每次调用都有超时时间，await 也受规则执行预算的时间限制，所以调用宿主函数的规则
+// 通常需要比 DefaultRuleLimits 更长的 Timeout。
+// 同一个事务中参数相同的调用只执行一次，参见 HostCallCache
+
+// ErrHostCallTimeout 表示宿主函数没有在 HostObject.Timeout 内返回
+var ErrHostCallTimeout = errors.New("host call timeout")
+
+// DefaultHostCallTimeout 是 HostObject.Timeout 为 0 时单次调用的超时时间
+const DefaultHostCallTimeout = time.Second
+
+// HostFunc 是权限规则可以调用的 Go 函数，args 是规则传入的参数，
+// ctx 在调用超时后被取消
+type HostFunc func(ctx context.Context, args []any) (any, error)
+
+// HostObject 是一组宿主函数，注册后在权限规则中作为全局对象使用
+type HostObject struct {
+	// 函数名 -> 函数
+	Funcs map[string]HostFunc
+	// 单次调用的超时时间，为 0 时使用 DefaultHostCallTimeout
+	Timeout time.Duration
+}
+
+// RegisterHostObject 将 obj 注册为权限规则中名为 name 的全局对象，
+// 必须在执行规则之前注册
+func (p *Permissions) RegisterHostObject(name string, obj *HostObject) {
+	p.hostObjects[name] = obj
+}
+
+// HostCallCache 缓存宿主函数的调用结果，同一个事务中参数相同的调用只执行一次
+//
+// 缓存的是调用对应的 Promise，所以失败的调用也会被缓存。nil HostCallCache 不缓存
+type HostCallCache struct {
+	mu       sync.Mutex
+	promises map[string]*transpiler.Promise
+}
+
+func NewHostCallCache() *HostCallCache {
+	return &HostCallCache{promises: make(map[string]*transpiler.Promise)}
+}
+
+// getOrCall 返回 key 对应的调用，没有缓存时用 call 发起调用，key 为空时不缓存
+func (c *HostCallCache) getOrCall(key string, call func() *transpiler.Promise) *transpiler.Promise {
+	if c == nil || key == "" {
+		return call()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if promise, ok := c.promises[key]; ok {
+		return promise
+	}
+	promise := call()
+	c.promises[key] = promise
+	return promise
+}
+
+type hostCallCacheKey struct{}
+
+// withHostCallCache 将 cache 放入规则执行预算的 context 中，规则中调用宿主函数时从中取出
+func withHostCallCache(ctx context.Context, cache *HostCallCache) context.Context {
+	if cache == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, hostCallCacheKey{}, cache)
+}
+
+func hostCallCacheFrom(ctx context.Context) *HostCallCache {
+	cache, _ := ctx.Value(hostCallCacheKey{}).(*HostCallCache)
+	return cache
+}
+
+// boundHostObject 是绑定到一次规则执行上的 HostObject
+type boundHostObject struct {
+	name   string
+	obj    *HostObject
+	budget *transpiler.Budget
+}
+
+// call 发起一次宿主函数调用
+func (b *boundHostObject) call(funcName string, fn HostFunc, args []any) *transpiler.Promise {
+	// 调用的结果可能被同一个事务中的其他规则使用，所以不随本次规则执行结束而取消
+	ctx := context.WithoutCancel(b.budget.Context())
+	cacheKey := ""
+	if argsJson, err := json.Marshal(args); err == nil {
+		cacheKey = fmt.Sprintf("%s.%s%s", b.name, funcName, argsJson)
+	}
+	timeout := b.obj.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHostCallTimeout
+	}
+	return hostCallCacheFrom(ctx).getOrCall(cacheKey, func() *transpiler.Promise {
+		return transpiler.NewPromise(func() (any, error) {
+			callCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			type result struct {
+				value any
+				err   error
+			}
+			// 宿主函数不响应 ctx 时也要按时返回
+			resultCh := make(chan result, 1)
+			go func() {
+				value, err := fn(callCtx, args)
+				resultCh <- result{value, err}
+			}()
+			select {
+			case r := <-resultCh:
+				return r.value, r.err
+			case <-callCtx.Done():
+				return nil, pe.Wrapf(ErrHostCallTimeout, "%s.%s after %v", b.name, funcName, timeout)
+			}
+		})
+	})
+}
+
+// HostObjectAccessHandler 允许在权限规则中调用宿主函数，例如 policy.check("post:edit", docId)
+func HostObjectAccessHandler(access transpiler.PropAccess, obj any) (any, error) {
+	bound, ok := obj.(*boundHostObject)
+	if !ok {
+		return nil, transpiler.ErrPropNotSupport
+	}
+	funcName, _ := access.Prop.(string)
+	fn, ok := bound.obj.Funcs[funcName]
+	if !ok {
+		return nil, pe.Errorf("host function %s.%v not found", bound.name, access.Prop)
+	}
+	if !access.IsCall {
+		return nil, pe.Errorf("host function %s.%s must be called", bound.name, funcName)
+	}
+	return bound.call(funcName, fn, access.Args), nil
+}
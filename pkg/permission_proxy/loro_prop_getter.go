@@ -133,7 +133,7 @@ func LoroMovableListAccessHandler(access transpiler.PropAccess, obj any) (any, e
 				if prop < 0 || prop >= int(len) {
 					return nil, errors.WithStack(fmt.Errorf("index out of range: %d", prop))
 				}
-				val, err := lm.Get(len)
+				val, err := lm.Get(uint32(prop))
 				if err != nil {
 					return nil, err
 				}
@@ -2,11 +2,12 @@ package permission_proxy
 
 import (
 	"errors"
-	"fmt"
+	"time"
 
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/ast"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/parser"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/transpiler"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/log"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
 )
 
@@ -17,17 +18,44 @@ type Permissions struct {
 	Rules map[string]CollectionRule
 	// 权限定义的 Js 代码，序列化和反序列化时仅处理 JsDef 即可
 	JsDef string
+	// 每次执行权限规则的资源限制
+	Limits transpiler.Limits
+	// 所有规则函数的 AST，按定义的顺序排列，用于静态检查，参见 Analyze
+	ruleExprs []ruleExpr
+	// 注册的宿主对象，参见 RegisterHostObject
+	hostObjects map[string]*HostObject
+}
+
+type ruleExpr struct {
+	collection string
+	// 规则名，字段规则为 fields.<字段路径>.canRead 或 fields.<字段路径>.canWrite
+	rule string
+	expr ast.Expr
 }
 
 var ErrInvalidPermissionDefinition = errors.New("invalid permission definition")
 
-type CollectionRuleFunc = func(...any) (any, error)
+// DefaultRuleLimits 是权限规则默认的资源限制，
+// 权限规则在同步器的 goroutine 上同步执行，出问题的规则不能阻塞所有客户端
+var DefaultRuleLimits = transpiler.Limits{
+	MaxSteps:      100_000,
+	Timeout:       100 * time.Millisecond,
+	MaxDbQueries:  16,
+	MaxResultSize: 1000,
+}
+
+// CollectionRuleFunc 在执行预算 budget 内执行一条权限规则
+type CollectionRuleFunc = func(budget *transpiler.Budget, args ...any) (any, error)
 
 type CollectionRule struct {
 	CanView   CollectionRuleFunc
 	CanCreate CollectionRuleFunc
 	CanUpdate CollectionRuleFunc
 	CanDelete CollectionRuleFunc
+	// 字段级别的读写权限，键为字段路径，参见 FieldRule
+	Fields map[string]FieldRule
+	// canView 规则的 AST，用于推导查询过滤条件，参见 ViewFilter
+	canViewExpr ast.Expr
 }
 
 type CanViewParams struct {
@@ -40,19 +68,21 @@ type CanViewParams struct {
 
 // CanView 检查客户端是否有权限查看指定集合中的指定文档
 func (p *Permissions) CanView(params CanViewParams) bool {
+	return p.DecideView(params).Allowed
+}
+
+// DecideView 与 CanView 相同，但返回完整的检查结果
+func (p *Permissions) DecideView(params CanViewParams) Decision {
+	decision := Decision{Rule: "canView", Collection: params.Collection, DocId: params.DocId, OpIndex: -1}
 	rule, ok := p.Rules[params.Collection]
 	if !ok {
-		return false
+		decision.Err = ErrNoCollectionRule
+		return decision
 	}
-	ret, err := rule.CanView(params)
-	if err != nil {
-		fmt.Printf("can view error: %v", err)
-		return false
-	}
-	if b, ok := ret.(bool); ok {
-		return b
-	}
-	return false
+	return p.decide(decision, rule.CanView, params.Db, func(db *DbWrapper) any {
+		params.Db = db
+		return params
+	})
 }
 
 type CanCreateParams struct {
@@ -65,19 +95,31 @@ type CanCreateParams struct {
 
 // CanCreate 检查客户端是否有权限创建指定集合中的文档
 func (p *Permissions) CanCreate(params CanCreateParams) bool {
+	return p.DecideCreate(params).Allowed
+}
+
+// DecideCreate 与 CanCreate 相同，但返回完整的检查结果
+func (p *Permissions) DecideCreate(params CanCreateParams) Decision {
+	decision := Decision{Rule: "canCreate", Collection: params.Collection, DocId: params.DocId, OpIndex: -1}
 	rule, ok := p.Rules[params.Collection]
 	if !ok {
-		return false
-	}
-	ret, err := rule.CanCreate(params)
-	if err != nil {
-		fmt.Printf("can create error: %+v\n", err)
-		return false
-	}
-	if b, ok := ret.(bool); ok {
-		return b
-	}
-	return false
+		decision.Err = ErrNoCollectionRule
+		return decision
+	}
+	decision = p.decide(decision, rule.CanCreate, params.Db, func(db *DbWrapper) any {
+		params.Db = db
+		return params
+	})
+	if !decision.Allowed {
+		return decision
+	}
+	return p.decideWriteFields(decision, rule, CanWriteParams{
+		Collection: params.Collection,
+		DocId:      params.DocId,
+		NewDoc:     params.NewDoc,
+		ClientId:   params.ClientId,
+		Db:         params.Db,
+	})
 }
 
 type CanUpdateParams struct {
@@ -91,19 +133,32 @@ type CanUpdateParams struct {
 
 // CanUpdate 检查客户端是否有权限更新指定集合中的指定文档
 func (p *Permissions) CanUpdate(params CanUpdateParams) bool {
+	return p.DecideUpdate(params).Allowed
+}
+
+// DecideUpdate 与 CanUpdate 相同，但返回完整的检查结果
+func (p *Permissions) DecideUpdate(params CanUpdateParams) Decision {
+	decision := Decision{Rule: "canUpdate", Collection: params.Collection, DocId: params.DocId, OpIndex: -1}
 	rule, ok := p.Rules[params.Collection]
 	if !ok {
-		return false
-	}
-	ret, err := rule.CanUpdate(params)
-	if err != nil {
-		fmt.Printf("can update error: %v", err)
-		return false
-	}
-	if b, ok := ret.(bool); ok {
-		return b
-	}
-	return false
+		decision.Err = ErrNoCollectionRule
+		return decision
+	}
+	decision = p.decide(decision, rule.CanUpdate, params.Db, func(db *DbWrapper) any {
+		params.Db = db
+		return params
+	})
+	if !decision.Allowed {
+		return decision
+	}
+	return p.decideWriteFields(decision, rule, CanWriteParams{
+		Collection: params.Collection,
+		DocId:      params.DocId,
+		NewDoc:     params.NewDoc,
+		OldDoc:     params.OldDoc,
+		ClientId:   params.ClientId,
+		Db:         params.Db,
+	})
 }
 
 type CanDeleteParams struct {
@@ -116,19 +171,30 @@ type CanDeleteParams struct {
 
 // CanDelete 检查客户端是否有权限删除指定集合中的指定文档
 func (p *Permissions) CanDelete(params CanDeleteParams) bool {
+	return p.DecideDelete(params).Allowed
+}
+
+// DecideDelete 与 CanDelete 相同，但返回完整的检查结果
+func (p *Permissions) DecideDelete(params CanDeleteParams) Decision {
+	decision := Decision{Rule: "canDelete", Collection: params.Collection, DocId: params.DocId, OpIndex: -1}
 	rule, ok := p.Rules[params.Collection]
 	if !ok {
-		return false
-	}
-	ret, err := rule.CanDelete(params)
-	if err != nil {
-		fmt.Printf("can delete error: %v", err)
-		return false
+		decision.Err = ErrNoCollectionRule
+		return decision
 	}
-	if b, ok := ret.(bool); ok {
-		return b
+	return p.decide(decision, rule.CanDelete, params.Db, func(db *DbWrapper) any {
+		params.Db = db
+		return params
+	})
+}
+
+// logRuleError 记录权限规则执行失败的原因，超出执行预算的规则需要单独指出
+func logRuleError(ruleName string, collection string, err error) {
+	if errors.Is(err, transpiler.ErrBudgetExceeded) {
+		log.Warnf("permission rule %s of collection %s aborted: %v", ruleName, collection, err)
+		return
 	}
-	return false
+	log.Warnf("permission rule %s of collection %s failed: %+v", ruleName, collection, err)
 }
 
 func (cr *CollectionRule) SetValidator(name string, fn CollectionRuleFunc) {
@@ -147,9 +213,12 @@ func (cr *CollectionRule) SetValidator(name string, fn CollectionRuleFunc) {
 }
 
 func NewPermissionFuncScope() *transpiler.Scope {
-	propGetter := transpiler.NewPropGetter(
+	scope := transpiler.NewScopeWithHandlers(
+		nil,
+		transpiler.DefaultPropSetter,
 		DbWrapperAccessHandler,
 		CollectionWrapperAccessHandler,
+		HostObjectAccessHandler,
 		DocWithIdAccessHandler,
 		LoroDocAccessHandler,
 		LoroTextAccessHandler,
@@ -161,10 +230,16 @@ func NewPermissionFuncScope() *transpiler.Scope {
 		transpiler.DataFieldAccessHandler,
 		transpiler.MethodCallHandler,
 	)
-	propMutator := transpiler.DefaultPropSetter
-	scope := transpiler.NewScope(nil, propGetter, propMutator)
 	scope.Vars["eq"] = EqWrapper
 	scope.Vars["field"] = FieldWrapper
+	scope.Vars["eqIgnoreCase"] = EqIgnoreCaseWrapper
+	scope.Vars["add"] = AddWrapper
+	scope.Vars["sub"] = SubWrapper
+	scope.Vars["mod"] = ModWrapper
+	scope.Vars["now"] = NowWrapper
+	scope.Vars["datePart"] = DatePartWrapper
+	scope.Vars["isType"] = IsTypeWrapper
+	scope.Vars["elemMatch"] = ElemMatchWrapper
 	scope.Vars["asc"] = SortAscWrapper
 	scope.Vars["desc"] = SortDescWrapper
 	scope.Vars["log"] = LogWrapper // TODO 仅用于测试
@@ -194,14 +269,18 @@ func NewPermissionFuncScope() *transpiler.Scope {
 // 我们需要先使用 parser 解析出这个 Js 权限定义的 AST，
 // 然后手工提取出所有集合对应的 canView, canCreate, canUpdate, canDelete 四个函数
 // 然后使用 transpiler 将这四个函数转换为 Go 函数
+//
+// 集合规则中还可以用 fields 定义字段级别的 canRead, canWrite 规则，参见 FieldRule
 func NewPermissionFromJs(js string) (*Permissions, error) {
 	program, err := parser.ParseFile(js)
 	if err != nil {
 		return nil, err
 	}
 	permission := Permissions{
-		Rules: make(map[string]CollectionRule),
-		JsDef: js,
+		Rules:       make(map[string]CollectionRule),
+		JsDef:       js,
+		Limits:      DefaultRuleLimits,
+		hostObjects: make(map[string]*HostObject),
 	}
 
 	exprStmt, ok := program.Body[0].Stmt.(*ast.ExpressionStatement)
@@ -238,40 +317,35 @@ func NewPermissionFromJs(js string) (*Permissions, error) {
 	if !ok {
 		return nil, ErrInvalidPermissionDefinition
 	}
-	if len(arg0.Value) != 2 {
-		return nil, ErrInvalidPermissionDefinition
-	}
-	prop0, ok := arg0.Value[0].Prop.(*ast.PropertyKeyed)
-	if !ok {
-		return nil, ErrInvalidPermissionDefinition
-	}
-	prop0Key, ok := prop0.Key.Expr.(*ast.StringLiteral)
-	if !ok {
-		return nil, ErrInvalidPermissionDefinition
-	}
-	if prop0Key.Value != "version" {
-		return nil, ErrInvalidPermissionDefinition
+	// version 和 rules 可以按任意顺序出现，其他属性被忽略
+	var versionExpr *ast.StringLiteral
+	var rulesExpr *ast.ObjectLiteral
+	for _, prop := range arg0.Value {
+		propKeyed, ok := prop.Prop.(*ast.PropertyKeyed)
+		if !ok {
+			continue
+		}
+		propKey, ok := propKeyed.Key.Expr.(*ast.StringLiteral)
+		if !ok {
+			continue
+		}
+		switch propKey.Value {
+		case "version":
+			versionExpr, ok = propKeyed.Value.Expr.(*ast.StringLiteral)
+			if !ok {
+				return nil, ErrInvalidPermissionDefinition
+			}
+		case "rules":
+			rulesExpr, ok = propKeyed.Value.Expr.(*ast.ObjectLiteral)
+			if !ok {
+				return nil, ErrInvalidPermissionDefinition
+			}
+		}
 	}
-	versionExpr, ok := prop0.Value.Expr.(*ast.StringLiteral)
-	if !ok {
+	if versionExpr == nil || rulesExpr == nil {
 		return nil, ErrInvalidPermissionDefinition
 	}
 	permission.Version = versionExpr.Value
-	prop1, ok := arg0.Value[1].Prop.(*ast.PropertyKeyed)
-	if !ok {
-		return nil, ErrInvalidPermissionDefinition
-	}
-	prop1Key, ok := prop1.Key.Expr.(*ast.StringLiteral)
-	if !ok {
-		return nil, ErrInvalidPermissionDefinition
-	}
-	if prop1Key.Value != "rules" {
-		return nil, ErrInvalidPermissionDefinition
-	}
-	rulesExpr, ok := prop1.Value.Expr.(*ast.ObjectLiteral)
-	if !ok {
-		return nil, ErrInvalidPermissionDefinition
-	}
 
 	for _, prop := range rulesExpr.Value {
 		propKeyed, ok := prop.Prop.(*ast.PropertyKeyed)
@@ -289,36 +363,78 @@ func NewPermissionFromJs(js string) (*Permissions, error) {
 			return nil, ErrInvalidPermissionDefinition
 		}
 		for _, ruleFunc := range ruleFuncs.Value {
-			ruleFuncKeyed, ok := ruleFunc.Prop.(*ast.PropertyKeyed)
-			if !ok {
-				return nil, ErrInvalidPermissionDefinition
+			if fieldsKeyed, ok := ruleFunc.Prop.(*ast.PropertyKeyed); ok {
+				if key, ok := fieldsKeyed.Key.Expr.(*ast.StringLiteral); ok && key.Value == "fields" {
+					fields, err := permission.newFieldRules(collectionName, fieldsKeyed.Value.Expr)
+					if err != nil {
+						return nil, err
+					}
+					collectionRule.Fields = fields
+					continue
+				}
 			}
-			ruleFuncKey, ok := ruleFuncKeyed.Key.Expr.(*ast.StringLiteral)
-			if !ok {
-				return nil, ErrInvalidPermissionDefinition
+			ruleFuncName, ruleFuncExpr, err := parseRuleFunc(ruleFunc)
+			if err != nil {
+				return nil, err
 			}
-			ruleFuncName := ruleFuncKey.Value
 			if ruleFuncName != "canView" && ruleFuncName != "canCreate" && ruleFuncName != "canUpdate" && ruleFuncName != "canDelete" {
 				return nil, ErrInvalidPermissionDefinition
 			}
-			var ruleFuncExpr ast.Expr
-			switch ruleFuncKeyed.Value.Expr.(type) {
-			case *ast.ArrowFunctionLiteral:
-				ruleFuncExpr = ruleFuncKeyed.Value.Expr
-			case *ast.FunctionLiteral:
-				ruleFuncExpr = ruleFuncKeyed.Value.Expr
-			default:
-				return nil, ErrInvalidPermissionDefinition
-			}
-			scope := NewPermissionFuncScope()
-			goFunc, err := transpiler.TranspileJsAstToGoFunc(ruleFuncExpr, scope)
+			goFunc, err := permission.newRuleFunc(ruleFuncExpr)
 			if err != nil {
 				return nil, err
 			}
 			collectionRule.SetValidator(ruleFuncName, goFunc)
+			permission.ruleExprs = append(permission.ruleExprs, ruleExpr{collectionName, ruleFuncName, ruleFuncExpr})
+			if ruleFuncName == "canView" {
+				collectionRule.canViewExpr = ruleFuncExpr
+			}
 		}
 		permission.Rules[collectionName] = collectionRule
 	}
 
 	return &permission, nil
 }
+
+// parseRuleFunc 从 name: (...) => ... 形式的属性中取出规则名和规则函数
+func parseRuleFunc(prop ast.Property) (string, ast.Expr, error) {
+	ruleFuncKeyed, ok := prop.Prop.(*ast.PropertyKeyed)
+	if !ok {
+		return "", nil, ErrInvalidPermissionDefinition
+	}
+	ruleFuncKey, ok := ruleFuncKeyed.Key.Expr.(*ast.StringLiteral)
+	if !ok {
+		return "", nil, ErrInvalidPermissionDefinition
+	}
+	switch ruleFuncKeyed.Value.Expr.(type) {
+	case *ast.ArrowFunctionLiteral, *ast.FunctionLiteral:
+		return ruleFuncKey.Value, ruleFuncKeyed.Value.Expr, nil
+	default:
+		return "", nil, ErrInvalidPermissionDefinition
+	}
+}
+
+// newRuleFunc 将规则函数的 AST 编译为 CollectionRuleFunc
+//
+// 规则函数只编译和绑定一次，每次调用在 NewPermissionFuncScope 中以这次调用的执行预算执行，
+// 并发的调用之间互不影响，参见 transpiler.CompiledFunc.Call。
+// 注册的宿主对象在每次调用时绑定到这次调用的执行预算上
+func (p *Permissions) newRuleFunc(ruleFuncExpr ast.Expr) (CollectionRuleFunc, error) {
+	scope := NewPermissionFuncScope()
+	hostObjects := p.hostObjects
+	compiled, err := transpiler.Compile(ruleFuncExpr)
+	if err != nil {
+		return nil, err
+	}
+	// 先绑定一次，尽早发现错误
+	if _, err := compiled.Bind(scope); err != nil {
+		return nil, err
+	}
+	return func(budget *transpiler.Budget, args ...any) (any, error) {
+		vars := make(map[string]any, len(hostObjects))
+		for name, obj := range hostObjects {
+			vars[name] = &boundHostObject{name: name, obj: obj, budget: budget}
+		}
+		return compiled.Call(scope, vars, budget, args...)
+	}, nil
+}
@@ -1,18 +1,45 @@
 package permission_proxy
 
-import "github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+import (
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/transpiler"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/log"
+	qfe "github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/query_filter_expr"
+)
 
 type PermissionProxy struct {
 	conn       db_conn.DbConnection
 	permission *Permissions
 }
 
-func NewPermissionProxy(dbConn db_conn.DbConnection) (*PermissionProxy, error) {
+// PermissionProxyOptions 是创建 PermissionProxy 的可选参数
+type PermissionProxyOptions struct {
+	// 权限规则中可以使用的宿主对象，名字 -> 对象，参见 RegisterHostObject
+	HostObjects map[string]*HostObject
+	// 每次执行权限规则的资源限制，为 nil 时使用 DefaultRuleLimits。
+	// 调用宿主函数的规则需要等待外部系统，通常需要更长的 Timeout
+	Limits *transpiler.Limits
+}
+
+// NewPermissionProxy 加载 dbConn 中的权限定义，opts 可以为 nil
+func NewPermissionProxy(dbConn db_conn.DbConnection, opts *PermissionProxyOptions) (*PermissionProxy, error) {
 	permissionJs := dbConn.GetDatabaseMeta().GetPermissionJs()
 	permission, err := NewPermissionFromJs(permissionJs)
 	if err != nil {
 		return nil, err
 	}
+	if opts != nil {
+		for name, obj := range opts.HostObjects {
+			permission.RegisterHostObject(name, obj)
+		}
+		if opts.Limits != nil {
+			permission.Limits = *opts.Limits
+		}
+	}
+	// 静态检查可能误报，发现的问题只记录日志，不阻止加载
+	for _, d := range permission.Analyze(dbConn.GetDatabaseMeta().GetDatabaseSchema()) {
+		log.Warnf("permission definition: %s", d)
+	}
 
 	return &PermissionProxy{
 		conn:       dbConn,
@@ -35,3 +62,43 @@ func (p *PermissionProxy) CanUpdate(params CanUpdateParams) bool {
 func (p *PermissionProxy) CanDelete(params CanDeleteParams) bool {
 	return p.permission.CanDelete(params)
 }
+
+func (p *PermissionProxy) DecideView(params CanViewParams) Decision {
+	return p.permission.DecideView(params)
+}
+
+func (p *PermissionProxy) DecideCreate(params CanCreateParams) Decision {
+	return p.permission.DecideCreate(params)
+}
+
+func (p *PermissionProxy) DecideUpdate(params CanUpdateParams) Decision {
+	return p.permission.DecideUpdate(params)
+}
+
+func (p *PermissionProxy) DecideDelete(params CanDeleteParams) Decision {
+	return p.permission.DecideDelete(params)
+}
+
+// ViewFilter 返回客户端 clientId 能查看 collection 中的文档的必要条件，参见 Permissions.ViewFilter
+func (p *PermissionProxy) ViewFilter(collection string, clientId string) qfe.QueryFilterExpr {
+	return p.permission.ViewFilter(collection, clientId)
+}
+
+func (p *PermissionProxy) HasFieldReadRules(collection string) bool {
+	return p.permission.HasFieldReadRules(collection)
+}
+
+// UnreadableFields 返回文档中客户端不能读取的字段，参见 Permissions.UnreadableFields
+func (p *PermissionProxy) UnreadableFields(params CanViewParams) []string {
+	return p.permission.UnreadableFields(params)
+}
+
+// UnreadableRuleFields 返回定义了 canRead 规则且客户端不能读取的字段，参见 Permissions.UnreadableRuleFields
+func (p *PermissionProxy) UnreadableRuleFields(params CanViewParams) []string {
+	return p.permission.UnreadableRuleFields(params)
+}
+
+// RedactedSnapshot 返回去掉客户端不能读取的字段后的文档快照，参见 Permissions.RedactedSnapshot
+func (p *PermissionProxy) RedactedSnapshot(params CanViewParams) ([]byte, bool, error) {
+	return p.permission.RedactedSnapshot(params)
+}
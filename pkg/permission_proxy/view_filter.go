@@ -0,0 +1,654 @@
+package permission_proxy
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/ast"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/token"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js_value"
+	qfe "github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/query_filter_expr"
+)
+
+// ViewFilter 返回客户端 clientId 能查看 collection 中的文档的必要条件，
+// 这个条件可以 AND 到客户端订阅的查询中，让查询执行器只返回客户端可能看到的文档，
+// 这样 Limit 才能按客户端真正能看到的文档数生效。
+// 返回 nil 表示无法推导出任何条件，即所有文档都可能可见。
+//
+// 条件由 canView 的函数体静态分析得到：clientId 和字面量被当作常量求值，
+// doc 的字段与常量的比较被转换为过滤条件，其余无法分析的部分都被视为“可能为 true”。
+// 因此得到的条件只会比 canView 宽松，不会比它严格，查询结果中的每个文档仍然要用 canView 检查
+//
+// 例如对于下面的 canView，clientId 为 "admin" 时返回 nil，否则返回 doc.owner === clientId 对应的条件
+//
+//	canView: ({ doc, clientId }) => {
+//	  if (clientId === "admin") return true;
+//	  return doc.owner === clientId;
+//	}
+func (p *Permissions) ViewFilter(collection string, clientId string) qfe.QueryFilterExpr {
+	rule, ok := p.Rules[collection]
+	if !ok || rule.CanView == nil {
+		// 没有 canView 规则时所有文档都不可见
+		return qfe.NewValueExpr(false)
+	}
+	if rule.canViewExpr == nil {
+		return nil
+	}
+	a := &viewFilterAnalyzer{
+		collection: collection,
+		clientId:   clientId,
+		vars:       make(map[string]viewValue),
+		assigned:   assignedNames(rule.canViewExpr),
+	}
+	cond := a.analyzeFunction(rule.canViewExpr)
+	if cond.filter == nil {
+		if cond.value {
+			return nil
+		}
+		return qfe.NewValueExpr(false)
+	}
+	return cond.filter
+}
+
+// maxViewFilterStatements 限制分析的语句数，
+// 每个依赖 doc 的 if 语句都会让后面的语句被分析两次
+const maxViewFilterStatements = 256
+
+// viewValueKind 是 canView 中表达式的抽象值的种类
+type viewValueKind int
+
+const (
+	// 无法分析的值
+	viewUnknown viewValueKind = iota
+	// 分析时就能确定的值，如字面量、clientId 和集合名
+	viewConst
+	// canView 的参数对象
+	viewParams
+	// 参数中的 doc
+	viewDoc
+	// doc 中指定路径的字段
+	viewField
+	// 依赖 doc 的布尔值
+	viewBool
+)
+
+type viewValue struct {
+	kind  viewValueKind
+	value any      // viewConst
+	path  string   // viewField
+	cond  viewCond // viewBool
+}
+
+// viewCond 是一个布尔值为 true 的必要条件
+//
+// 解释器中 && 和 || 右侧的表达式出错时，错误会被忽略，表达式的值为 false，
+// 所以只有在求值时不会出错的条件才能取反
+type viewCond struct {
+	// 条件依赖 doc 时不为 nil，否则条件为常量 value
+	filter qfe.QueryFilterExpr
+	value  bool
+	// 常量条件只由字面量、clientId 等常量计算得到，求值时不会出错
+	pure bool
+	// 条件为单个字段比较时，negated 是这个比较取反后的条件
+	negated qfe.QueryFilterExpr
+}
+
+var (
+	condTrue  = viewCond{value: true, pure: true}
+	condFalse = viewCond{value: false, pure: true}
+	// 无法分析的条件，只能当作 true，且不能取反
+	condUnknown = viewCond{value: true}
+)
+
+// inexact 返回 c 的一个不能取反的版本
+func inexact(c viewCond) viewCond {
+	c.pure = false
+	c.negated = nil
+	return c
+}
+
+func condAnd(a, b viewCond) viewCond {
+	switch {
+	case a.filter == nil && !a.value:
+		// 不会对 b 求值
+		return a
+	case b.filter == nil && !b.value:
+		return viewCond{value: false, pure: a.pure && b.pure}
+	case a.filter == nil:
+		if a.pure {
+			return b
+		}
+		return inexact(b)
+	case b.filter == nil:
+		if b.pure {
+			return a
+		}
+		return inexact(a)
+	default:
+		return viewCond{filter: qfe.NewAndExpr([]qfe.QueryFilterExpr{a.filter, b.filter})}
+	}
+}
+
+func condOr(a, b viewCond) viewCond {
+	switch {
+	case a.filter == nil && a.value:
+		// 不会对 b 求值
+		return a
+	case b.filter == nil && b.value:
+		return viewCond{value: true, pure: a.pure && b.pure}
+	case a.filter == nil:
+		if a.pure {
+			return b
+		}
+		return inexact(b)
+	case b.filter == nil:
+		if b.pure {
+			return a
+		}
+		return inexact(a)
+	default:
+		return viewCond{filter: qfe.NewOrExpr([]qfe.QueryFilterExpr{a.filter, b.filter})}
+	}
+}
+
+func condNot(a viewCond) viewCond {
+	if a.filter == nil {
+		if a.pure {
+			return viewCond{value: !a.value, pure: true}
+		}
+		return condUnknown
+	}
+	if a.negated != nil {
+		return viewCond{filter: a.negated, negated: a.filter}
+	}
+	return condUnknown
+}
+
+// viewFilterAnalyzer 对 canView 的 AST 做部分求值
+type viewFilterAnalyzer struct {
+	collection string
+	clientId   string
+	vars       map[string]viewValue
+	// 函数中被重新赋值的变量，它们的值无法分析
+	assigned   map[string]struct{}
+	statements int
+}
+
+func (a *viewFilterAnalyzer) analyzeFunction(expr ast.Expr) viewCond {
+	switch fn := expr.(type) {
+	case *ast.ArrowFunctionLiteral:
+		if fn.Async {
+			return condUnknown
+		}
+		a.bindParams(fn.ParameterList)
+		switch body := fn.Body.Body.(type) {
+		case *ast.BlockStatement:
+			return a.analyzeStatements(body.List)
+		case *ast.Expression:
+			return a.returned(a.eval(body.Expr))
+		}
+	case *ast.FunctionLiteral:
+		if fn.Async || fn.Generator {
+			return condUnknown
+		}
+		a.bindParams(fn.ParameterList)
+		return a.analyzeStatements(fn.Body.List)
+	}
+	return condUnknown
+}
+
+func (a *viewFilterAnalyzer) bindParams(params ast.ParameterList) {
+	for i, param := range params.List {
+		if i == 0 && !hasInitializer(param.Initializer) {
+			a.bind(param.Target.Target, viewValue{kind: viewParams})
+		} else {
+			a.bind(param.Target.Target, viewValue{kind: viewUnknown})
+		}
+	}
+	if params.Rest != nil {
+		a.bindUnknown(params.Rest)
+	}
+}
+
+// bind 将 value 绑定到 target 中声明的变量上
+func (a *viewFilterAnalyzer) bind(target ast.Expr, value viewValue) {
+	switch t := target.(type) {
+	case *ast.Identifier:
+		if _, ok := a.assigned[t.Name]; ok {
+			value = viewValue{kind: viewUnknown}
+		}
+		a.vars[t.Name] = value
+	case *ast.ObjectPattern:
+		for _, prop := range t.Properties {
+			switch p := prop.Prop.(type) {
+			case *ast.PropertyShort:
+				v := viewValue{kind: viewUnknown}
+				if !hasInitializer(p.Initializer) {
+					v = a.member(value, p.Name.Name)
+				}
+				a.bind(p.Name, v)
+			case *ast.PropertyKeyed:
+				key, ok := p.Key.Expr.(*ast.StringLiteral)
+				if p.Computed || !ok {
+					a.bindUnknown(p.Value.Expr)
+					continue
+				}
+				a.bind(p.Value.Expr, a.member(value, key.Value))
+			default:
+				a.bindUnknown(p)
+			}
+		}
+		if t.Rest != nil {
+			a.bindUnknown(t.Rest)
+		}
+	default:
+		a.bindUnknown(target)
+	}
+}
+
+// bindUnknown 将 target 中出现的所有标识符都标记为无法分析
+func (a *viewFilterAnalyzer) bindUnknown(target ast.Expr) {
+	if target == nil {
+		return
+	}
+	for name := range identifierNames(target) {
+		a.vars[name] = viewValue{kind: viewUnknown}
+	}
+}
+
+// analyzeStatements 分析依次执行 stmts 时返回 true 的必要条件
+func (a *viewFilterAnalyzer) analyzeStatements(stmts ast.Statements) viewCond {
+	for i, stmt := range stmts {
+		a.statements++
+		if a.statements > maxViewFilterStatements {
+			return condUnknown
+		}
+		switch s := stmt.Stmt.(type) {
+		case *ast.ReturnStatement:
+			if s.Argument == nil || s.Argument.Expr == nil {
+				return condFalse
+			}
+			return a.returned(a.eval(s.Argument.Expr))
+		case *ast.ThrowStatement:
+			// 抛出异常时 canView 返回 false
+			return condFalse
+		case *ast.EmptyStatement:
+		case *ast.ExpressionStatement:
+			// 表达式中的赋值已经由 assignedNames 处理，调用的返回值不影响结果
+		case *ast.VariableDeclaration:
+			for _, decl := range s.List {
+				value := viewValue{kind: viewUnknown}
+				if hasInitializer(decl.Initializer) {
+					value = a.eval(decl.Initializer.Expr)
+				}
+				a.bind(decl.Target.Target, value)
+			}
+		case *ast.BlockStatement:
+			// 块不创建新的作用域，与解释器一致
+			return a.analyzeStatements(concatStatements(s.List, stmts[i+1:]))
+		case *ast.IfStatement:
+			rest := stmts[i+1:]
+			consequent := concatStatements(ast.Statements{*s.Consequent}, rest)
+			alternate := rest
+			if s.Alternate != nil && s.Alternate.Stmt != nil {
+				alternate = concatStatements(ast.Statements{*s.Alternate}, rest)
+			}
+			test := a.truthy(a.eval(s.Test.Expr))
+			if test.filter == nil && !test.value {
+				return a.analyzeStatements(alternate)
+			}
+			if test.filter == nil && test.pure {
+				return a.analyzeStatements(consequent)
+			}
+			// 两个分支中的变量声明互不影响
+			saved := a.snapshotVars()
+			c := a.analyzeStatements(consequent)
+			a.vars = saved
+			alt := a.analyzeStatements(alternate)
+			return condOr(condAnd(test, c), condAnd(condNot(test), alt))
+		default:
+			// 循环、switch、try 等语句不做分析
+			return condUnknown
+		}
+	}
+	// 没有 return 时返回 undefined
+	return condFalse
+}
+
+func (a *viewFilterAnalyzer) snapshotVars() map[string]viewValue {
+	vars := make(map[string]viewValue, len(a.vars))
+	for k, v := range a.vars {
+		vars[k] = v
+	}
+	return vars
+}
+
+func concatStatements(a, b ast.Statements) ast.Statements {
+	ret := make(ast.Statements, 0, len(a)+len(b))
+	ret = append(ret, a...)
+	return append(ret, b...)
+}
+
+// returned 返回 canView 返回 v 时结果为 true 的必要条件，
+// 只有返回布尔值 true 时 canView 才为 true
+func (a *viewFilterAnalyzer) returned(v viewValue) viewCond {
+	switch v.kind {
+	case viewConst:
+		b, _ := v.value.(bool)
+		return viewCond{value: b, pure: true}
+	case viewBool:
+		return v.cond
+	case viewField:
+		return compareField(token.StrictEqual, v.path, true)
+	case viewParams, viewDoc:
+		return condFalse
+	default:
+		return condUnknown
+	}
+}
+
+// truthy 返回 v 为真值的必要条件
+func (a *viewFilterAnalyzer) truthy(v viewValue) viewCond {
+	switch v.kind {
+	case viewConst:
+		return viewCond{value: isTruthy(v.value), pure: true}
+	case viewBool:
+		return v.cond
+	case viewParams, viewDoc:
+		return condTrue
+	default:
+		return condUnknown
+	}
+}
+
+func (a *viewFilterAnalyzer) eval(expr ast.Expr) viewValue {
+	switch e := expr.(type) {
+	case *ast.StringLiteral:
+		return viewValue{kind: viewConst, value: e.Value}
+	case *ast.NumberLiteral:
+		return viewValue{kind: viewConst, value: e.Value}
+	case *ast.BooleanLiteral:
+		return viewValue{kind: viewConst, value: e.Value}
+	case *ast.NullLiteral:
+		return viewValue{kind: viewConst, value: nil}
+	case *ast.Identifier:
+		if v, ok := a.vars[e.Name]; ok {
+			return v
+		}
+		if e.Name == "undefined" {
+			return viewValue{kind: viewConst, value: nil}
+		}
+		return viewValue{kind: viewUnknown}
+	case *ast.MemberExpression:
+		obj := a.eval(e.Object.Expr)
+		switch p := e.Property.Prop.(type) {
+		case *ast.Identifier:
+			return a.member(obj, p.Name)
+		case *ast.ComputedProperty:
+			prop := a.eval(p.Expr.Expr)
+			if name, ok := prop.value.(string); ok && prop.kind == viewConst {
+				return a.member(obj, name)
+			}
+		}
+		return viewValue{kind: viewUnknown}
+	case *ast.UnaryExpression:
+		if e.Operator != token.Not {
+			return viewValue{kind: viewUnknown}
+		}
+		return boolValue(condNot(a.truthy(a.eval(e.Operand.Expr))))
+	case *ast.BinaryExpression:
+		return a.evalBinary(e)
+	case *ast.ConditionalExpression:
+		test := a.truthy(a.eval(e.Test.Expr))
+		if test.filter == nil && test.pure {
+			if test.value {
+				return a.eval(e.Consequent.Expr)
+			}
+			return a.eval(e.Alternate.Expr)
+		}
+		return viewValue{kind: viewUnknown}
+	default:
+		return viewValue{kind: viewUnknown}
+	}
+}
+
+func boolValue(c viewCond) viewValue {
+	return viewValue{kind: viewBool, cond: c}
+}
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// member 返回访问 obj 的属性 prop 得到的值
+func (a *viewFilterAnalyzer) member(obj viewValue, prop string) viewValue {
+	switch obj.kind {
+	case viewParams:
+		// 与 DataFieldAccessHandler 一致，属性名首字母大小写均可
+		switch strings.ToUpper(prop[:1]) + prop[1:] {
+		case "Doc":
+			return viewValue{kind: viewDoc}
+		case "ClientId":
+			return viewValue{kind: viewConst, value: a.clientId}
+		case "Collection":
+			return viewValue{kind: viewConst, value: a.collection}
+		}
+	case viewDoc:
+		if identifierRegex.MatchString(prop) {
+			return viewValue{kind: viewField, path: prop}
+		}
+	case viewField:
+		// length 等属性由字符串、数组的属性处理器处理，不是文档中的字段
+		if identifierRegex.MatchString(prop) && prop != "length" {
+			return viewValue{kind: viewField, path: obj.path + "." + prop}
+		}
+	}
+	return viewValue{kind: viewUnknown}
+}
+
+func (a *viewFilterAnalyzer) evalBinary(e *ast.BinaryExpression) viewValue {
+	switch e.Operator {
+	case token.LogicalAnd:
+		left := a.truthy(a.eval(e.Left.Expr))
+		return boolValue(condAnd(left, a.truthy(a.eval(e.Right.Expr))))
+	case token.LogicalOr:
+		left := a.truthy(a.eval(e.Left.Expr))
+		return boolValue(condOr(left, a.truthy(a.eval(e.Right.Expr))))
+	case token.Equal, token.StrictEqual, token.NotEqual, token.StrictNotEqual,
+		token.Less, token.LessOrEqual, token.Greater, token.GreaterOrEqual:
+	default:
+		return viewValue{kind: viewUnknown}
+	}
+
+	left := a.eval(e.Left.Expr)
+	right := a.eval(e.Right.Expr)
+	switch {
+	case left.kind == viewConst && right.kind == viewConst:
+		cmp, err := js_value.DeepComapreJsValue(left.value, right.value)
+		if err != nil {
+			return viewValue{kind: viewUnknown}
+		}
+		return viewValue{kind: viewConst, value: compareResult(e.Operator, cmp)}
+	case left.kind == viewField && right.kind == viewConst:
+		return boolValue(compareField(e.Operator, left.path, right.value))
+	case left.kind == viewConst && right.kind == viewField:
+		return boolValue(compareField(swapOperator(e.Operator), right.path, left.value))
+	default:
+		return viewValue{kind: viewUnknown}
+	}
+}
+
+func compareResult(op token.Token, cmp int) bool {
+	switch op {
+	case token.Equal, token.StrictEqual:
+		return cmp == 0
+	case token.NotEqual, token.StrictNotEqual:
+		return cmp != 0
+	case token.Less:
+		return cmp < 0
+	case token.LessOrEqual:
+		return cmp <= 0
+	case token.Greater:
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// swapOperator 返回交换左右操作数后等价的比较运算符
+func swapOperator(op token.Token) token.Token {
+	switch op {
+	case token.Less:
+		return token.Greater
+	case token.LessOrEqual:
+		return token.GreaterOrEqual
+	case token.Greater:
+		return token.Less
+	case token.GreaterOrEqual:
+		return token.LessOrEqual
+	default:
+		return op
+	}
+}
+
+func negateOperator(op token.Token) token.Token {
+	switch op {
+	case token.Equal, token.StrictEqual:
+		return token.StrictNotEqual
+	case token.NotEqual, token.StrictNotEqual:
+		return token.StrictEqual
+	case token.Less:
+		return token.GreaterOrEqual
+	case token.LessOrEqual:
+		return token.Greater
+	case token.Greater:
+		return token.LessOrEqual
+	default:
+		return token.Less
+	}
+}
+
+// compareField 返回 doc 中 path 处的字段与常量 value 比较结果为 true 的必要条件
+func compareField(op token.Token, path string, value any) viewCond {
+	filter := compareFieldFilter(op, path, value)
+	if filter == nil {
+		return condUnknown
+	}
+	return viewCond{
+		filter:  filter,
+		negated: compareFieldFilter(negateOperator(op), path, value),
+	}
+}
+
+// compareFieldFilter 生成比较字段与常量的过滤条件
+//
+// 字段不存在或类型与常量不同时，解释器中的比较会出错，canView 返回 false 或者这个比较的值为 false，
+// 而查询过滤条件出错时整个文档都会被排除。
+// 因此先检查字段存在且类型与常量相同（或为 null），保证生成的条件不会出错，且在这些情况下为 false
+func compareFieldFilter(op token.Token, path string, value any) qfe.QueryFilterExpr {
+	var valueType qfe.ValueType
+	switch value.(type) {
+	case nil:
+		valueType = qfe.ValueTypeNull
+	case bool:
+		valueType = qfe.ValueTypeBoolean
+	case float64:
+		valueType = qfe.ValueTypeNumber
+	case string:
+		valueType = qfe.ValueTypeString
+	default:
+		return nil
+	}
+
+	field := qfe.NewFieldValueExpr(qfe.NewValueExpr(path))
+	guards := []qfe.QueryFilterExpr{qfe.NewExistsExpr(qfe.NewValueExpr(path))}
+	if valueType != qfe.ValueTypeNull {
+		guards = append(guards, qfe.NewOrExpr([]qfe.QueryFilterExpr{
+			qfe.NewIsTypeExpr(field, valueType),
+			qfe.NewIsTypeExpr(field, qfe.ValueTypeNull),
+		}))
+	}
+
+	var cmp qfe.QueryFilterExpr
+	v := qfe.NewValueExpr(value)
+	switch op {
+	case token.Equal, token.StrictEqual:
+		cmp = qfe.NewEqExpr(field, v)
+	case token.NotEqual, token.StrictNotEqual:
+		cmp = qfe.NewNeExpr(field, v)
+	case token.Less:
+		cmp = qfe.NewLtExpr(field, v)
+	case token.LessOrEqual:
+		cmp = qfe.NewLteExpr(field, v)
+	case token.Greater:
+		cmp = qfe.NewGtExpr(field, v)
+	case token.GreaterOrEqual:
+		cmp = qfe.NewGteExpr(field, v)
+	default:
+		return nil
+	}
+	return qfe.NewAndExpr(append(guards, cmp))
+}
+
+// isTruthy 与解释器中的真值判断一致
+func isTruthy(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	default:
+		return true
+	}
+}
+
+func hasInitializer(initializer *ast.Expression) bool {
+	return initializer != nil && initializer.Expr != nil
+}
+
+// identifierNames 返回 node 中出现的所有标识符
+func identifierNames(node ast.VisitableNode) map[string]struct{} {
+	v := &identifierCollector{names: make(map[string]struct{})}
+	v.V = v
+	node.VisitWith(v)
+	return v.names
+}
+
+type identifierCollector struct {
+	ast.NoopVisitor
+	names map[string]struct{}
+}
+
+func (v *identifierCollector) VisitIdentifier(n *ast.Identifier) {
+	v.names[n.Name] = struct{}{}
+}
+
+// assignedNames 返回函数中所有被赋值或自增自减的变量，
+// 赋值目标不是标识符时，目标中出现的所有标识符都被视为被赋值
+func assignedNames(fn ast.Expr) map[string]struct{} {
+	v := &assignmentCollector{names: make(map[string]struct{})}
+	v.V = v
+	fn.VisitWith(v)
+	return v.names
+}
+
+type assignmentCollector struct {
+	ast.NoopVisitor
+	names map[string]struct{}
+}
+
+func (v *assignmentCollector) VisitAssignExpression(n *ast.AssignExpression) {
+	for name := range identifierNames(n.Left) {
+		v.names[name] = struct{}{}
+	}
+	n.VisitChildrenWith(v)
+}
+
+func (v *assignmentCollector) VisitUpdateExpression(n *ast.UpdateExpression) {
+	for name := range identifierNames(n.Operand) {
+		v.names[name] = struct{}{}
+	}
+	n.VisitChildrenWith(v)
+}
@@ -0,0 +1,138 @@
+package policy_client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
+	pe "github.com/pkg/errors"
+)
+
+// CheckRequest 是发送给策略服务的请求
+type CheckRequest struct {
+	// 要检查的操作，例如 "post:edit"
+	Action string `json:"action"`
+	// 操作的对象，例如文档 ID
+	Resource any `json:"resource,omitempty"`
+	// 其他输入
+	Input any `json:"input,omitempty"`
+}
+
+// CheckResponse 是策略服务的响应
+type CheckResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// HttpPolicyClient 通过 HTTP 请求外部的策略服务判断是否允许一个操作
+//
+// 每次检查向 Endpoint 发送一个 POST 请求，请求体为 JSON 格式的 CheckRequest，
+// 策略服务返回 2xx 状态码和 JSON 格式的 CheckResponse：
+//
+//	POST /check {"action": "post:edit", "resource": "p1"}
+//	200 OK      {"allow": false, "reason": "not the author"}
+type HttpPolicyClient struct {
+	Endpoint string
+	// 为 nil 时使用 http.DefaultClient
+	Client *http.Client
+	// 每个请求都带上的请求头，例如访问策略服务的凭证
+	Header http.Header
+}
+
+func NewHttpPolicyClient(endpoint string) *HttpPolicyClient {
+	return &HttpPolicyClient{
+		Endpoint: endpoint,
+		Header:   make(http.Header),
+	}
+}
+
+// Check 请求策略服务检查 req
+func (c *HttpPolicyClient) Check(ctx context.Context, req CheckRequest) (*CheckResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, pe.WithStack(err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, pe.WithStack(err)
+	}
+	for key, values := range c.Header {
+		for _, value := range values {
+			httpReq.Header.Add(key, value)
+		}
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, pe.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, pe.Errorf("policy service returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	checkResp := &CheckResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(checkResp); err != nil {
+		return nil, pe.Wrap(err, "invalid policy service response")
+	}
+	return checkResp, nil
+}
+
+// HostObject 返回可以注册到权限规则中的宿主对象，timeout 为单次请求的超时时间：
+//
+//   - check(action, resource?, input?) 返回策略服务是否允许
+//   - decide(action, resource?, input?) 返回 { allow, reason }，可以直接作为规则的返回值
+//
+// 例如注册为 policy 后：
+//
+//	canUpdate: async ({ docId }) => await policy.check("post:edit", docId),
+//	canDelete: ({ docId }) => policy.decide("post:delete", docId),
+func (c *HttpPolicyClient) HostObject(timeout time.Duration) *permission_proxy.HostObject {
+	return &permission_proxy.HostObject{
+		Funcs: map[string]permission_proxy.HostFunc{
+			"check": func(ctx context.Context, args []any) (any, error) {
+				resp, err := c.checkArgs(ctx, args)
+				if err != nil {
+					return nil, err
+				}
+				return resp.Allow, nil
+			},
+			"decide": func(ctx context.Context, args []any) (any, error) {
+				resp, err := c.checkArgs(ctx, args)
+				if err != nil {
+					return nil, err
+				}
+				return map[string]any{"allow": resp.Allow, "reason": resp.Reason}, nil
+			},
+		},
+		Timeout: timeout,
+	}
+}
+
+// checkArgs 将规则中的参数 (action, resource?, input?) 转换为 CheckRequest 并检查
+func (c *HttpPolicyClient) checkArgs(ctx context.Context, args []any) (*CheckResponse, error) {
+	if len(args) == 0 || len(args) > 3 {
+		return nil, pe.Errorf("expect 1 to 3 arguments (action, resource, input), got %d", len(args))
+	}
+	action, ok := args[0].(string)
+	if !ok {
+		return nil, pe.Errorf("action should be a string, got %T", args[0])
+	}
+	req := CheckRequest{Action: action}
+	if len(args) > 1 {
+		req.Resource = args[1]
+	}
+	if len(args) > 2 {
+		req.Input = args[2]
+	}
+	return c.Check(ctx, req)
+}
@@ -0,0 +1,158 @@
+package query
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js_value"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	pe "github.com/pkg/errors"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor 表示结果集中某个文档的位置，用于 keyset 分页
+//
+// Values 是该文档在每个排序字段上的值（与 FindManyQuery.Sort 一一对应），
+// DocId 是该文档的 ID，作为排序值完全相同时的决胜字段。
+// 对客户端来说 Cursor 是不透明的，客户端只需要原样传回 EncodeCursor 的结果即可
+type Cursor struct {
+	Values []js_value.JsValue `json:"v"`
+	DocId  string             `json:"id"`
+}
+
+// EncodeCursor 将 Cursor 编码为不透明的字符串
+func EncodeCursor(c *Cursor) (string, error) {
+	jsonBytes, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(jsonBytes), nil
+}
+
+// DecodeCursor 从 EncodeCursor 得到的字符串中解码出 Cursor
+func DecodeCursor(s string) (*Cursor, error) {
+	jsonBytes, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, pe.Wrapf(ErrInvalidCursor, "%v", err)
+	}
+	var c Cursor
+	if err := json.Unmarshal(jsonBytes, &c); err != nil {
+		return nil, pe.Wrapf(ErrInvalidCursor, "%v", err)
+	}
+	return &c, nil
+}
+
+// CursorOf 计算文档 doc 在查询 q 的排序规则下对应的 Cursor
+func (q *FindManyQuery) CursorOf(doc *DocWithId) (*Cursor, error) {
+	values := make([]js_value.JsValue, len(q.Sort))
+	for i, sort := range q.Sort {
+		v, err := doc_visitor.VisitDocByPath(doc.Doc, sort.Field)
+		if err != nil {
+			return nil, err
+		}
+		jsValue, err := js_value.ToJsValue(v)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = jsValue
+	}
+	return &Cursor{
+		Values: values,
+		DocId:  doc.DocId,
+	}, nil
+}
+
+// CompareWithCursor 比较文档 doc 和游标 c 在排序规则下的先后顺序
+//
+// 返回值：
+//   - 如果 doc 排在 c 之前，返回负数
+//   - 如果 doc 就是 c 指向的文档，返回 0
+//   - 如果 doc 排在 c 之后，返回正数
+func (q *FindManyQuery) CompareWithCursor(doc *DocWithId, c *Cursor) (int, error) {
+	if len(c.Values) != len(q.Sort) {
+		return 0, pe.Wrapf(ErrInvalidCursor, "cursor has %d sort values, query has %d sort fields", len(c.Values), len(q.Sort))
+	}
+
+	for i, sort := range q.Sort {
+		v, err := doc_visitor.VisitDocByPath(doc.Doc, sort.Field)
+		if err != nil {
+			return 0, err
+		}
+		jsValue, err := js_value.ToJsValue(v)
+		if err != nil {
+			return 0, err
+		}
+		cmp, err := js_value.DeepComapreJsValue(jsValue, c.Values[i])
+		if err != nil {
+			return 0, err
+		}
+		if cmp != 0 {
+			if sort.Order == SortOrderAsc {
+				return cmp, nil
+			}
+			return -cmp, nil
+		}
+	}
+
+	return compareDocId(doc.DocId, c.DocId), nil
+}
+
+// DecodeCursors 解码查询的 After 和 Before 游标，未设置的游标返回 nil
+func (q *FindManyQuery) DecodeCursors() (after *Cursor, before *Cursor, err error) {
+	if q.After != "" {
+		after, err = DecodeCursor(q.After)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if q.Before != "" {
+		before, err = DecodeCursor(q.Before)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return after, before, nil
+}
+
+// InCursorRange 检查文档 doc 是否严格位于 after 和 before 两个游标之间
+// 为 nil 的游标表示该方向上没有限制
+func (q *FindManyQuery) InCursorRange(doc *DocWithId, after, before *Cursor) (bool, error) {
+	if after != nil {
+		cmp, err := q.CompareWithCursor(doc, after)
+		if err != nil {
+			return false, err
+		}
+		if cmp <= 0 {
+			return false, nil
+		}
+	}
+
+	if before != nil {
+		cmp, err := q.CompareWithCursor(doc, before)
+		if err != nil {
+			return false, err
+		}
+		if cmp >= 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// HasCursor 返回查询是否设置了 After 或 Before 游标
+func (q *FindManyQuery) HasCursor() bool {
+	return q.After != "" || q.Before != ""
+}
+
+func compareDocId(id1, id2 string) int {
+	if id1 < id2 {
+		return -1
+	}
+	if id1 > id2 {
+		return 1
+	}
+	return 0
+}
@@ -17,12 +17,20 @@ import (
 // Sort: 排序规则
 // Skip: 跳过的文档数量
 // Limit: 返回的最大文档数量
+// After: 只返回排在该游标之后的文档
+// Before: 只返回排在该游标之前的文档。只设置 Before 时向前翻页，
+// Skip 和 Limit 从 Before 游标处往前计数，即跳过离游标最近的 Skip 个文档，
+// 返回再往前的 Limit 个文档，结果仍按排序规则升序排列
+// Lookups: 跨集合关联阶段，被关联的文档会随查询结果一起同步
 type FindManyQuery struct {
-	Collection string              `json:"collection"`       // 集合名称
-	Filter     qfe.QueryFilterExpr `json:"filter,omitempty"` // 过滤条件
-	Sort       []SortField         `json:"sort,omitempty"`   // 排序规则
-	Skip       int64               `json:"skip,omitempty"`   // 跳过的文档数量
-	Limit      int64               `json:"limit,omitempty"`  // 返回的最大文档数量
+	Collection string              `json:"collection"`        // 集合名称
+	Filter     qfe.QueryFilterExpr `json:"filter,omitempty"`  // 过滤条件
+	Sort       []SortField         `json:"sort,omitempty"`    // 排序规则
+	Skip       int64               `json:"skip,omitempty"`    // 跳过的文档数量
+	Limit      int64               `json:"limit,omitempty"`   // 返回的最大文档数量
+	After      string              `json:"after,omitempty"`   // 游标，由 EncodeCursor 生成
+	Before     string              `json:"before,omitempty"`  // 游标，由 EncodeCursor 生成
+	Lookups    []Lookup            `json:"lookups,omitempty"` // 跨集合关联阶段
 }
 
 type FindManyResult = []*DocWithId
@@ -42,7 +50,11 @@ func (q *FindManyQuery) DebugSprint() string {
 	for i, sort := range q.Sort {
 		sortStr[i] = sort.DebugSprint()
 	}
-	return fmt.Sprintf("FindManyQuery{Collection: %s, Filter: %s, Sort: [%s], Skip: %d, Limit: %d}", q.Collection, filterStr, strings.Join(sortStr, ", "), q.Skip, q.Limit)
+	lookupStr := make([]string, len(q.Lookups))
+	for i, lookup := range q.Lookups {
+		lookupStr[i] = lookup.DebugSprint()
+	}
+	return fmt.Sprintf("FindManyQuery{Collection: %s, Filter: %s, Sort: [%s], Skip: %d, Limit: %d, After: %q, Before: %q, Lookups: [%s]}", q.Collection, filterStr, strings.Join(sortStr, ", "), q.Skip, q.Limit, q.After, q.Before, strings.Join(lookupStr, ", "))
 }
 
 // SetFilter 设置查询的过滤条件
@@ -89,6 +101,38 @@ func (q *FindManyQuery) SetLimit(limit int64) error {
 	return nil
 }
 
+// SetAfter 设置 After 游标，查询只返回排在 c 之后的文档
+// 参数:
+//   - c: 游标，为 nil 时清除 After 游标
+func (q *FindManyQuery) SetAfter(c *Cursor) error {
+	if c == nil {
+		q.After = ""
+		return nil
+	}
+	encoded, err := EncodeCursor(c)
+	if err != nil {
+		return err
+	}
+	q.After = encoded
+	return nil
+}
+
+// SetBefore 设置 Before 游标，查询只返回排在 c 之前的文档
+// 参数:
+//   - c: 游标，为 nil 时清除 Before 游标
+func (q *FindManyQuery) SetBefore(c *Cursor) error {
+	if c == nil {
+		q.Before = ""
+		return nil
+	}
+	encoded, err := EncodeCursor(c)
+	if err != nil {
+		return err
+	}
+	q.Before = encoded
+	return nil
+}
+
 // Match 检查给定的文档是否匹配查询条件
 // 参数:
 //   - doc: 要检查的文档
@@ -154,6 +198,21 @@ func (q *FindManyQuery) Compare(doc1, doc2 *loro.LoroDoc) (int, error) {
 	return 0, nil
 }
 
+// CompareDocWithId 在 Compare 的基础上，使用文档 ID 作为决胜字段，
+// 保证结果集中任意两个不同文档的顺序都是确定的
+//
+// 游标分页依赖于这个全序关系：只有顺序确定，"排在游标之后" 才有意义
+func (q *FindManyQuery) CompareDocWithId(doc1, doc2 *DocWithId) (int, error) {
+	cmp, err := q.Compare(doc1.Doc, doc2.Doc)
+	if err != nil {
+		return 0, err
+	}
+	if cmp != 0 {
+		return cmp, nil
+	}
+	return compareDocId(doc1.DocId, doc2.DocId), nil
+}
+
 func (q *FindManyQuery) Encode() ([]byte, error) {
 	var temp struct {
 		Type uint64 `json:"type"`
@@ -176,6 +235,9 @@ func DecodeFindManyQuery(data []byte) (*FindManyQuery, error) {
 		Sort       []SortField     `json:"sort,omitempty"`
 		Skip       int64           `json:"skip,omitempty"`
 		Limit      int64           `json:"limit,omitempty"`
+		After      string          `json:"after,omitempty"`
+		Before     string          `json:"before,omitempty"`
+		Lookups    []Lookup        `json:"lookups,omitempty"`
 	}
 	if err := json.Unmarshal(data, &temp); err != nil {
 		return nil, err
@@ -188,11 +250,27 @@ func DecodeFindManyQuery(data []byte) (*FindManyQuery, error) {
 			return nil, err
 		}
 	}
+	for _, c := range []string{temp.After, temp.Before} {
+		if c == "" {
+			continue
+		}
+		if _, err := DecodeCursor(c); err != nil {
+			return nil, err
+		}
+	}
+	for _, lookup := range temp.Lookups {
+		if err := lookup.Validate(); err != nil {
+			return nil, err
+		}
+	}
 	return &FindManyQuery{
 		Collection: temp.Collection,
 		Filter:     filter,
 		Sort:       temp.Sort,
 		Skip:       temp.Skip,
 		Limit:      temp.Limit,
+		After:      temp.After,
+		Before:     temp.Before,
+		Lookups:    temp.Lookups,
 	}, nil
 }
@@ -18,6 +18,8 @@ type FindManyListeningQuery struct {
 	Query  *FindManyQuery
 	Error  *error
 	Result FindManyResult
+	// LookupResult 是 Query.Lookups 关联到的文档，未经过权限检查
+	LookupResult LookupResult
 }
 
 func (r *FindManyListeningQuery) isListeningQuery() {}
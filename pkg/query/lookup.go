@@ -0,0 +1,119 @@
+package query
+
+import (
+	"fmt"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js_value"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	qfe "github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/query_filter_expr"
+	pe "github.com/pkg/errors"
+)
+
+// Lookup 表示 FindManyQuery 上的一个跨集合关联阶段
+//
+// 例如 postMetas 中的 owner 字段引用了 users 中的 id 字段：
+//
+//	Lookup{From: "users", LocalField: "owner", ForeignField: "id"}
+//
+// 查询结果中每个文档的 LocalField 值（如果是数组，则是数组中的每个元素）
+// 会用来在 From 集合中查找 ForeignField 与之相等的文档，
+// 这些被关联的文档会和查询结果一起同步给客户端
+type Lookup struct {
+	From         string `json:"from"`         // 被关联的集合名称
+	LocalField   string `json:"localField"`   // 当前集合中引用其他文档的字段路径
+	ForeignField string `json:"foreignField"` // 被关联集合中被引用的字段路径
+}
+
+// LookupResult 是每个 Lookup 关联到的文档，与 FindManyQuery.Lookups 一一对应
+type LookupResult = []FindManyResult
+
+func (l *Lookup) DebugSprint() string {
+	return fmt.Sprintf("Lookup{From: %s, LocalField: %s, ForeignField: %s}", l.From, l.LocalField, l.ForeignField)
+}
+
+// Validate 检查 Lookup 的各个字段是否都已设置
+func (l *Lookup) Validate() error {
+	if l.From == "" {
+		return pe.Errorf("invalid lookup: from must not be empty")
+	}
+	if l.LocalField == "" {
+		return pe.Errorf("invalid lookup: localField must not be empty")
+	}
+	if l.ForeignField == "" {
+		return pe.Errorf("invalid lookup: foreignField must not be empty")
+	}
+	return nil
+}
+
+// LocalValues 收集 docs 中所有文档的 LocalField 值（去重），
+// 不存在该字段的文档会被忽略
+func (l *Lookup) LocalValues(docs []*DocWithId) ([]js_value.JsValue, error) {
+	values := make([]js_value.JsValue, 0, len(docs))
+	for _, doc := range docs {
+		v, err := doc_visitor.VisitDocByPath(doc.Doc, l.LocalField)
+		if err != nil {
+			// 字段不存在，不关联任何文档
+			continue
+		}
+		jsValue, err := js_value.ToJsValue(v)
+		if err != nil {
+			return nil, err
+		}
+		// 字段值是数组时，关联数组中的每个元素
+		if arr, ok := jsValue.([]any); ok {
+			for _, item := range arr {
+				values = appendUniqueJsValue(values, item)
+			}
+		} else if jsValue != nil {
+			values = appendUniqueJsValue(values, jsValue)
+		}
+	}
+	return values, nil
+}
+
+// ForeignQuery 返回在 From 集合中查找 ForeignField 属于 values 的文档的查询
+func (l *Lookup) ForeignQuery(values []js_value.JsValue) *FindManyQuery {
+	items := make([]qfe.QueryFilterExpr, len(values))
+	for i, v := range values {
+		items[i] = qfe.NewValueExpr(v)
+	}
+	return &FindManyQuery{
+		Collection: l.From,
+		Filter: qfe.NewInExpr(
+			qfe.NewFieldValueExpr(qfe.NewValueExpr(l.ForeignField)),
+			items,
+		),
+	}
+}
+
+// AddLookup 添加一个关联阶段
+func (q *FindManyQuery) AddLookup(from, localField, foreignField string) {
+	q.Lookups = append(q.Lookups, Lookup{
+		From:         from,
+		LocalField:   localField,
+		ForeignField: foreignField,
+	})
+}
+
+// LookupCollections 返回查询关联到的所有集合（去重）
+func (q *FindManyQuery) LookupCollections() []string {
+	ret := make([]string, 0, len(q.Lookups))
+	seen := make(map[string]struct{}, len(q.Lookups))
+	for _, l := range q.Lookups {
+		if _, ok := seen[l.From]; ok {
+			continue
+		}
+		seen[l.From] = struct{}{}
+		ret = append(ret, l.From)
+	}
+	return ret
+}
+
+func appendUniqueJsValue(values []js_value.JsValue, v js_value.JsValue) []js_value.JsValue {
+	for _, existing := range values {
+		if eq, err := js_value.DeepEqualJsValue(existing, v); err == nil && eq {
+			return values
+		}
+	}
+	return append(values, v)
+}
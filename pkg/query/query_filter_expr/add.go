@@ -0,0 +1,83 @@
+package query_filter_expr
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	pe "github.com/pkg/errors"
+)
+
+// AddExpr 计算两个数字的和
+type AddExpr struct {
+	Type QueryFilterExprType `json:"type"`
+	O1   QueryFilterExpr     `json:"o1"`
+	O2   QueryFilterExpr     `json:"o2"`
+}
+
+func NewAddExpr(o1 QueryFilterExpr, o2 QueryFilterExpr) *AddExpr {
+	return &AddExpr{
+		Type: ExprTypeAdd,
+		O1:   o1,
+		O2:   o2,
+	}
+}
+
+func (e *AddExpr) DebugSprint() string {
+	return fmt.Sprintf("AddExpr{O1: %s, O2: %s}", e.O1.DebugSprint(), e.O2.DebugSprint())
+}
+
+func (e *AddExpr) Eval(doc *loro.LoroDoc) (*ValueExpr, error) {
+	n1, n2, err := evalNumberOperands(doc, e.O1, e.O2, "ADD")
+	if err != nil {
+		return nil, err
+	}
+	return NewValueExpr(n1 + n2), nil
+}
+
+func (e *AddExpr) ToJSON() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func newAddExprFromJson(msg json.RawMessage) (*AddExpr, error) {
+	var temp struct {
+		Type QueryFilterExprType `json:"type"`
+		O1   json.RawMessage     `json:"o1"`
+		O2   json.RawMessage     `json:"o2"`
+	}
+
+	if err := json.Unmarshal(msg, &temp); err != nil {
+		return nil, err
+	}
+
+	o1, err := NewQueryFilterExprFromJson(temp.O1)
+	if err != nil {
+		return nil, err
+	}
+
+	o2, err := NewQueryFilterExprFromJson(temp.O2)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAddExpr(o1, o2), nil
+}
+
+// evalNumberOperands 评估算术表达式的两个操作数，并检查它们是否都是数字
+func evalNumberOperands(doc *loro.LoroDoc, o1 QueryFilterExpr, o2 QueryFilterExpr, op string) (float64, float64, error) {
+	v1, err := o1.Eval(doc)
+	if err != nil {
+		return 0, 0, pe.Wrapf(ErrEvalError, "evaluating left operand of %s: %v", op, err)
+	}
+	v2, err := o2.Eval(doc)
+	if err != nil {
+		return 0, 0, pe.Wrapf(ErrEvalError, "evaluating right operand of %s: %v", op, err)
+	}
+	if !v1.IsNumber() {
+		return 0, 0, pe.Wrapf(ErrTypeError, "expected number for left operand of %s, got %T", op, v1.Value)
+	}
+	if !v2.IsNumber() {
+		return 0, 0, pe.Wrapf(ErrTypeError, "expected number for right operand of %s, got %T", op, v2.Value)
+	}
+	return v1.AsFloat64(), v2.AsFloat64(), nil
+}
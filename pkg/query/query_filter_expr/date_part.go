@@ -0,0 +1,98 @@
+package query_filter_expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	pe "github.com/pkg/errors"
+)
+
+// DatePart 表示日期中的一个部分
+type DatePart string
+
+const (
+	DatePartYear    DatePart = "year"    // 年
+	DatePartMonth   DatePart = "month"   // 月，1 - 12
+	DatePartDay     DatePart = "day"     // 日，1 - 31
+	DatePartHour    DatePart = "hour"    // 时，0 - 23
+	DatePartMinute  DatePart = "minute"  // 分，0 - 59
+	DatePartSecond  DatePart = "second"  // 秒，0 - 59
+	DatePartWeekday DatePart = "weekday" // 星期，0 表示星期日
+)
+
+// DatePartExpr 提取日期（毫秒时间戳）中的指定部分，统一按 UTC 计算
+type DatePartExpr struct {
+	Type   QueryFilterExprType `json:"type"`
+	Target QueryFilterExpr     `json:"target"`
+	Part   DatePart            `json:"part"`
+}
+
+func NewDatePartExpr(target QueryFilterExpr, part DatePart) *DatePartExpr {
+	return &DatePartExpr{
+		Type:   ExprTypeDatePart,
+		Target: target,
+		Part:   part,
+	}
+}
+
+func (e *DatePartExpr) DebugSprint() string {
+	return fmt.Sprintf("DatePartExpr{Target: %s, Part: %s}", e.Target.DebugSprint(), e.Part)
+}
+
+func (e *DatePartExpr) Eval(doc *loro.LoroDoc) (*ValueExpr, error) {
+	// 评估字段表达式
+	target, err := e.Target.Eval(doc)
+	if err != nil {
+		return nil, pe.Wrapf(ErrEvalError, "evaluating target in DATE_PART: %v", err)
+	}
+
+	// 检查字段是否为数字（毫秒时间戳）
+	if !target.IsNumber() {
+		return nil, pe.Wrapf(ErrTypeError, "expected timestamp in DATE_PART expression, got %T", target.Value)
+	}
+
+	t := time.UnixMilli(int64(target.AsFloat64())).UTC()
+	switch e.Part {
+	case DatePartYear:
+		return NewValueExpr(t.Year()), nil
+	case DatePartMonth:
+		return NewValueExpr(int(t.Month())), nil
+	case DatePartDay:
+		return NewValueExpr(t.Day()), nil
+	case DatePartHour:
+		return NewValueExpr(t.Hour()), nil
+	case DatePartMinute:
+		return NewValueExpr(t.Minute()), nil
+	case DatePartSecond:
+		return NewValueExpr(t.Second()), nil
+	case DatePartWeekday:
+		return NewValueExpr(int(t.Weekday())), nil
+	default:
+		return nil, pe.Wrapf(ErrSyntaxError, "unknown date part in DATE_PART expression: %s", e.Part)
+	}
+}
+
+func (e *DatePartExpr) ToJSON() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func newDatePartExprFromJson(msg json.RawMessage) (*DatePartExpr, error) {
+	var temp struct {
+		Type   QueryFilterExprType `json:"type"`
+		Target json.RawMessage     `json:"target"`
+		Part   DatePart            `json:"part"`
+	}
+
+	if err := json.Unmarshal(msg, &temp); err != nil {
+		return nil, err
+	}
+
+	target, err := NewQueryFilterExprFromJson(temp.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDatePartExpr(target, temp.Part), nil
+}
@@ -0,0 +1,232 @@
+package query_filter_expr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js_value"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	pe "github.com/pkg/errors"
+)
+
+// ElemMatchCurrentPath 在 ELEM_MATCH 的条件中表示当前元素本身，
+// 用于元素不是对象（例如数字列表）的情况
+const ElemMatchCurrentPath = "$"
+
+// ElemMatchExpr 检查数组中是否存在至少一个满足条件的元素
+//
+// Cond 中 field_value 和 exists 使用的路径都是相对于当前元素的，例如：
+//
+//	elem_match(path="comments", cond=eq(field("author"), "Alice"))
+//
+// 对第 i 个元素，会检查 comments[i].author 是否等于 "Alice"
+type ElemMatchExpr struct {
+	Type QueryFilterExprType `json:"type"`
+	Path QueryFilterExpr     `json:"path"`
+	Cond QueryFilterExpr     `json:"cond"`
+
+	// Cond 改写后的版本，在构造时生成一次
+	bound *elemMatchCond
+}
+
+// elemMatchCond 是把相对路径绑定到当前元素的条件
+//
+// cond 中 field_value、exists 和嵌套 elem_match 的路径被替换为 elemPathExpr，
+// 求值时读取 prefix 得到当前元素的绝对路径。同一时间只有一次求值可以使用 prefix，
+// 由 mu 保护
+type elemMatchCond struct {
+	mu     sync.Mutex
+	prefix string
+	cond   QueryFilterExpr
+}
+
+func NewElemMatchExpr(path QueryFilterExpr, cond QueryFilterExpr) *ElemMatchExpr {
+	return &ElemMatchExpr{
+		Type:  ExprTypeElemMatch,
+		Path:  path,
+		Cond:  cond,
+		bound: newElemMatchCond(cond),
+	}
+}
+
+func newElemMatchCond(cond QueryFilterExpr) *elemMatchCond {
+	bound := &elemMatchCond{}
+	bound.cond = bindElemPaths(cond, bound)
+	return bound
+}
+
+func (e *ElemMatchExpr) DebugSprint() string {
+	return fmt.Sprintf("ElemMatchExpr{Path: %s, Cond: %s}", e.Path.DebugSprint(), e.Cond.DebugSprint())
+}
+
+func (e *ElemMatchExpr) Eval(doc *loro.LoroDoc) (*ValueExpr, error) {
+	// 获取数组路径
+	pathExpr, err := e.Path.Eval(doc)
+	if err != nil {
+		return nil, pe.Wrapf(ErrEvalError, "evaluating path in ELEM_MATCH: %v", err)
+	}
+
+	if !pathExpr.IsString() {
+		return nil, pe.Wrapf(ErrTypeError, "expected string path in ELEM_MATCH expression, got %T", pathExpr.Value)
+	}
+
+	path := pathExpr.AsString()
+	if !isValidPath(path) {
+		return nil, pe.Wrapf(ErrTypeError, "invalid path in ELEM_MATCH expression: %s", path)
+	}
+
+	// 字段不存在时不匹配
+	val, err := doc_visitor.VisitDocByPath(doc, path)
+	if err != nil {
+		if errors.Is(err, doc_visitor.PathNotFoundError) {
+			return NewValueExpr(false), nil
+		}
+		return nil, pe.Wrapf(ErrFieldError, "path=%s", path)
+	}
+
+	jsValue, err := js_value.ToJsValue(val)
+	if err != nil {
+		return nil, pe.Wrapf(ErrEvalError, "failed to convert value: %v", err)
+	}
+	arr, ok := jsValue.([]any)
+	if !ok {
+		return nil, pe.Wrapf(ErrTypeError, "expected array in ELEM_MATCH expression, got %T", jsValue)
+	}
+
+	bound := e.bound
+	if bound == nil {
+		// 没有通过 NewElemMatchExpr 构造
+		bound = newElemMatchCond(e.Cond)
+	}
+	bound.mu.Lock()
+	defer bound.mu.Unlock()
+	for i := range arr {
+		bound.prefix = fmt.Sprintf("%s[%d]", path, i)
+
+		// 元素上求值出错（例如元素缺少某个字段）视为该元素不满足条件
+		result, err := bound.cond.Eval(doc)
+		if err != nil {
+			continue
+		}
+		if matched, ok := result.Value.(bool); ok && matched {
+			return NewValueExpr(true), nil
+		}
+	}
+
+	return NewValueExpr(false), nil
+}
+
+func (e *ElemMatchExpr) ToJSON() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// bindElemPaths 返回 expr 的副本，其中 field_value、exists 和嵌套 elem_match
+// 的相对路径被替换为相对于 bound 当前元素的 elemPathExpr
+//
+// 嵌套的 elem_match 只改写其 path，其 cond 中的路径相对于内层元素，不做改写
+func bindElemPaths(expr QueryFilterExpr, bound *elemMatchCond) QueryFilterExpr {
+	switch e := expr.(type) {
+	case nil, *ValueExpr:
+		// 字面量不包含路径
+		return expr
+	case *FieldValueExpr:
+		return NewFieldValueExpr(&elemPathExpr{rel: e.Path, bound: bound})
+	case *ExistsExpr:
+		return NewExistsExpr(&elemPathExpr{rel: e.Path, bound: bound})
+	case *ElemMatchExpr:
+		return NewElemMatchExpr(&elemPathExpr{rel: e.Path, bound: bound}, e.Cond)
+	}
+
+	// 其他表达式复制一份，再改写其中的子表达式
+	v := reflect.ValueOf(expr)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return expr
+	}
+	copied := reflect.New(v.Elem().Type())
+	copied.Elem().Set(v.Elem())
+	for i := 0; i < copied.Elem().NumField(); i++ {
+		field := copied.Elem().Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		switch child := field.Interface().(type) {
+		case QueryFilterExpr:
+			if bound := reflect.ValueOf(bindElemPaths(child, bound)); bound.Type().AssignableTo(field.Type()) {
+				field.Set(bound)
+			}
+		case []QueryFilterExpr:
+			children := make([]QueryFilterExpr, len(child))
+			for j, c := range child {
+				children[j] = bindElemPaths(c, bound)
+			}
+			field.Set(reflect.ValueOf(children))
+		}
+	}
+	return copied.Interface().(QueryFilterExpr)
+}
+
+// elemPathExpr 是 elem_match 条件中相对于当前元素的路径，
+// 求值得到当前元素的绝对路径
+type elemPathExpr struct {
+	rel   QueryFilterExpr
+	bound *elemMatchCond
+}
+
+func (e *elemPathExpr) DebugSprint() string {
+	return fmt.Sprintf("ElemPathExpr{Rel: %s}", e.rel.DebugSprint())
+}
+
+func (e *elemPathExpr) Eval(doc *loro.LoroDoc) (*ValueExpr, error) {
+	relExpr, err := e.rel.Eval(doc)
+	if err != nil {
+		return nil, err
+	}
+	if !relExpr.IsString() {
+		return relExpr, nil
+	}
+
+	rel := relExpr.AsString()
+	prefix := e.bound.prefix
+	switch {
+	case rel == ElemMatchCurrentPath:
+		return NewValueExpr(prefix), nil
+	case strings.HasPrefix(rel, "["):
+		return NewValueExpr(prefix + rel), nil
+	default:
+		return NewValueExpr(prefix + "." + rel), nil
+	}
+}
+
+// ToJSON 返回相对路径本身，elemPathExpr 只出现在改写后的条件中，不会被序列化
+func (e *elemPathExpr) ToJSON() ([]byte, error) {
+	return e.rel.ToJSON()
+}
+
+func newElemMatchExprFromJson(msg json.RawMessage) (*ElemMatchExpr, error) {
+	var temp struct {
+		Type QueryFilterExprType `json:"type"`
+		Path json.RawMessage     `json:"path"`
+		Cond json.RawMessage     `json:"cond"`
+	}
+
+	if err := json.Unmarshal(msg, &temp); err != nil {
+		return nil, err
+	}
+
+	path, err := NewQueryFilterExprFromJson(temp.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	cond, err := NewQueryFilterExprFromJson(temp.Cond)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewElemMatchExpr(path, cond), nil
+}
@@ -0,0 +1,77 @@
+package query_filter_expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	pe "github.com/pkg/errors"
+)
+
+// EqIgnoreCaseExpr 忽略大小写的字符串相等比较
+type EqIgnoreCaseExpr struct {
+	Type QueryFilterExprType `json:"type"`
+	O1   QueryFilterExpr     `json:"o1"`
+	O2   QueryFilterExpr     `json:"o2"`
+}
+
+func NewEqIgnoreCaseExpr(o1 QueryFilterExpr, o2 QueryFilterExpr) *EqIgnoreCaseExpr {
+	return &EqIgnoreCaseExpr{
+		Type: ExprTypeEqIgnoreCase,
+		O1:   o1,
+		O2:   o2,
+	}
+}
+
+func (e *EqIgnoreCaseExpr) DebugSprint() string {
+	return fmt.Sprintf("EqIgnoreCaseExpr{O1: %s, O2: %s}", e.O1.DebugSprint(), e.O2.DebugSprint())
+}
+
+func (e *EqIgnoreCaseExpr) Eval(doc *loro.LoroDoc) (*ValueExpr, error) {
+	v1, err := e.O1.Eval(doc)
+	if err != nil {
+		return nil, pe.Wrapf(ErrEvalError, "evaluating left operand of EQ_IGNORE_CASE: %v", err)
+	}
+	v2, err := e.O2.Eval(doc)
+	if err != nil {
+		return nil, pe.Wrapf(ErrEvalError, "evaluating right operand of EQ_IGNORE_CASE: %v", err)
+	}
+
+	if !v1.IsString() {
+		return nil, pe.Wrapf(ErrTypeError, "expected string for left operand of EQ_IGNORE_CASE, got %T", v1.Value)
+	}
+	if !v2.IsString() {
+		return nil, pe.Wrapf(ErrTypeError, "expected string for right operand of EQ_IGNORE_CASE, got %T", v2.Value)
+	}
+
+	return NewValueExpr(strings.EqualFold(v1.AsString(), v2.AsString())), nil
+}
+
+func (e *EqIgnoreCaseExpr) ToJSON() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func newEqIgnoreCaseExprFromJson(msg json.RawMessage) (*EqIgnoreCaseExpr, error) {
+	var temp struct {
+		Type QueryFilterExprType `json:"type"`
+		O1   json.RawMessage     `json:"o1"`
+		O2   json.RawMessage     `json:"o2"`
+	}
+
+	if err := json.Unmarshal(msg, &temp); err != nil {
+		return nil, err
+	}
+
+	o1, err := NewQueryFilterExprFromJson(temp.O1)
+	if err != nil {
+		return nil, err
+	}
+
+	o2, err := NewQueryFilterExprFromJson(temp.O2)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewEqIgnoreCaseExpr(o1, o2), nil
+}
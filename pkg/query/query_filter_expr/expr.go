@@ -14,26 +14,34 @@ import (
 type QueryFilterExprType string
 
 const (
-	ExprTypeAll        QueryFilterExprType = "all"         // 数组包含所有元素
-	ExprTypeAnd        QueryFilterExprType = "and"         // 逻辑与
-	ExprTypeContains   QueryFilterExprType = "contains"    // 字符串包含检查
-	ExprTypeEndsWith   QueryFilterExprType = "ends_with"   // 字符串后缀检查
-	ExprTypeEq         QueryFilterExprType = "eq"          // 相等比较
-	ExprTypeExists     QueryFilterExprType = "exists"      // 字段存在检查
-	ExprTypeFieldValue QueryFilterExprType = "field_value" // 字段值表达式
-	ExprTypeGt         QueryFilterExprType = "gt"          // 大于比较
-	ExprTypeGte        QueryFilterExprType = "gte"         // 大于等于比较
-	ExprTypeIn         QueryFilterExprType = "in"          // 包含比较
-	ExprTypeLt         QueryFilterExprType = "lt"          // 小于比较
-	ExprTypeLte        QueryFilterExprType = "lte"         // 小于等于比较
-	ExprTypeNe         QueryFilterExprType = "ne"          // 不等比较
-	ExprTypeNin        QueryFilterExprType = "nin"         // 不包含比较
-	ExprTypeNot        QueryFilterExprType = "not"         // 逻辑非
-	ExprTypeOr         QueryFilterExprType = "or"          // 逻辑或
-	ExprTypeRegex      QueryFilterExprType = "regex"       // 正则表达式匹配
-	ExprTypeSize       QueryFilterExprType = "size"        // 数组长度检查
-	ExprTypeStartsWith QueryFilterExprType = "starts_with" // 字符串前缀检查
-	ExprTypeValue      QueryFilterExprType = "value"       // 值表达式
+	ExprTypeAdd          QueryFilterExprType = "add"            // 加法
+	ExprTypeAll          QueryFilterExprType = "all"            // 数组包含所有元素
+	ExprTypeAnd          QueryFilterExprType = "and"            // 逻辑与
+	ExprTypeContains     QueryFilterExprType = "contains"       // 字符串包含检查
+	ExprTypeDatePart     QueryFilterExprType = "date_part"      // 提取日期的指定部分
+	ExprTypeElemMatch    QueryFilterExprType = "elem_match"     // 数组中存在满足条件的元素
+	ExprTypeEndsWith     QueryFilterExprType = "ends_with"      // 字符串后缀检查
+	ExprTypeEq           QueryFilterExprType = "eq"             // 相等比较
+	ExprTypeEqIgnoreCase QueryFilterExprType = "eq_ignore_case" // 忽略大小写的字符串相等比较
+	ExprTypeExists       QueryFilterExprType = "exists"         // 字段存在检查
+	ExprTypeFieldValue   QueryFilterExprType = "field_value"    // 字段值表达式
+	ExprTypeGt           QueryFilterExprType = "gt"             // 大于比较
+	ExprTypeGte          QueryFilterExprType = "gte"            // 大于等于比较
+	ExprTypeIn           QueryFilterExprType = "in"             // 包含比较
+	ExprTypeIsType       QueryFilterExprType = "is_type"        // 类型检查
+	ExprTypeLt           QueryFilterExprType = "lt"             // 小于比较
+	ExprTypeLte          QueryFilterExprType = "lte"            // 小于等于比较
+	ExprTypeMod          QueryFilterExprType = "mod"            // 取余
+	ExprTypeNe           QueryFilterExprType = "ne"             // 不等比较
+	ExprTypeNin          QueryFilterExprType = "nin"            // 不包含比较
+	ExprTypeNot          QueryFilterExprType = "not"            // 逻辑非
+	ExprTypeNow          QueryFilterExprType = "now"            // 当前时间
+	ExprTypeOr           QueryFilterExprType = "or"             // 逻辑或
+	ExprTypeRegex        QueryFilterExprType = "regex"          // 正则表达式匹配
+	ExprTypeSize         QueryFilterExprType = "size"           // 数组长度检查
+	ExprTypeStartsWith   QueryFilterExprType = "starts_with"    // 字符串前缀检查
+	ExprTypeSub          QueryFilterExprType = "sub"            // 减法
+	ExprTypeValue        QueryFilterExprType = "value"          // 值表达式
 )
 
 func isValidPath(path string) bool {
@@ -75,16 +83,24 @@ func NewQueryFilterExprFromJson(data []byte) (QueryFilterExpr, error) {
 	}
 
 	switch typeInfo.Type {
+	case ExprTypeAdd:
+		return newAddExprFromJson(data)
 	case ExprTypeAll:
 		return newAllExprFromJson(data)
 	case ExprTypeAnd:
 		return newAndExprFromJson(data)
 	case ExprTypeContains:
 		return newContainsExprFromJson(data)
+	case ExprTypeDatePart:
+		return newDatePartExprFromJson(data)
+	case ExprTypeElemMatch:
+		return newElemMatchExprFromJson(data)
 	case ExprTypeEndsWith:
 		return newEndsWithExprFromJson(data)
 	case ExprTypeEq:
 		return newEqExprFromJson(data)
+	case ExprTypeEqIgnoreCase:
+		return newEqIgnoreCaseExprFromJson(data)
 	case ExprTypeExists:
 		return newExistsExprFromJson(data)
 	case ExprTypeFieldValue:
@@ -95,16 +111,22 @@ func NewQueryFilterExprFromJson(data []byte) (QueryFilterExpr, error) {
 		return newInExprFromJson(data)
 	case ExprTypeGte:
 		return newGteExprFromJson(data)
+	case ExprTypeIsType:
+		return newIsTypeExprFromJson(data)
 	case ExprTypeLt:
 		return newLtExprFromJson(data)
 	case ExprTypeLte:
 		return newLteExprFromJson(data)
+	case ExprTypeMod:
+		return newModExprFromJson(data)
 	case ExprTypeNe:
 		return newNeExprFromJson(data)
 	case ExprTypeNin:
 		return newNinExprFromJson(data)
 	case ExprTypeNot:
 		return newNotExprFromJson(data)
+	case ExprTypeNow:
+		return newNowExprFromJson(data)
 	case ExprTypeOr:
 		return newOrExprFromJson(data)
 	case ExprTypeRegex:
@@ -113,6 +135,8 @@ func NewQueryFilterExprFromJson(data []byte) (QueryFilterExpr, error) {
 		return newSizeExprFromJson(data)
 	case ExprTypeStartsWith:
 		return newStartsWithExprFromJson(data)
+	case ExprTypeSub:
+		return newSubExprFromJson(data)
 	case ExprTypeValue:
 		return newValueExprFromJson(data)
 	default:
@@ -0,0 +1,97 @@
+package query_filter_expr
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	pe "github.com/pkg/errors"
+)
+
+// ValueType 表示值的类型，用于 IS_TYPE 表达式
+type ValueType string
+
+const (
+	ValueTypeNull    ValueType = "null"
+	ValueTypeBoolean ValueType = "boolean"
+	ValueTypeNumber  ValueType = "number"
+	ValueTypeString  ValueType = "string"
+	ValueTypeArray   ValueType = "array"
+	ValueTypeObject  ValueType = "object"
+)
+
+// IsTypeExpr 检查值是否为指定类型
+type IsTypeExpr struct {
+	Type     QueryFilterExprType `json:"type"`
+	Target   QueryFilterExpr     `json:"target"`
+	Expected ValueType           `json:"expected"`
+}
+
+func NewIsTypeExpr(target QueryFilterExpr, expected ValueType) *IsTypeExpr {
+	return &IsTypeExpr{
+		Type:     ExprTypeIsType,
+		Target:   target,
+		Expected: expected,
+	}
+}
+
+func (e *IsTypeExpr) DebugSprint() string {
+	return fmt.Sprintf("IsTypeExpr{Target: %s, Expected: %s}", e.Target.DebugSprint(), e.Expected)
+}
+
+func (e *IsTypeExpr) Eval(doc *loro.LoroDoc) (*ValueExpr, error) {
+	// 评估字段表达式
+	target, err := e.Target.Eval(doc)
+	if err != nil {
+		return nil, pe.Wrapf(ErrEvalError, "evaluating target in IS_TYPE: %v", err)
+	}
+
+	actual, err := valueTypeOf(target)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewValueExpr(actual == e.Expected), nil
+}
+
+func (e *IsTypeExpr) ToJSON() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func valueTypeOf(v *ValueExpr) (ValueType, error) {
+	switch {
+	case v.IsNil():
+		return ValueTypeNull, nil
+	case v.IsBool():
+		return ValueTypeBoolean, nil
+	case v.IsNumber():
+		return ValueTypeNumber, nil
+	case v.IsString():
+		return ValueTypeString, nil
+	case v.IsArray():
+		return ValueTypeArray, nil
+	case v.IsMap():
+		return ValueTypeObject, nil
+	default:
+		return "", pe.Wrapf(ErrTypeError, "unexpected value type %T", v.Value)
+	}
+}
+
+func newIsTypeExprFromJson(msg json.RawMessage) (*IsTypeExpr, error) {
+	var temp struct {
+		Type     QueryFilterExprType `json:"type"`
+		Target   json.RawMessage     `json:"target"`
+		Expected ValueType           `json:"expected"`
+	}
+
+	if err := json.Unmarshal(msg, &temp); err != nil {
+		return nil, err
+	}
+
+	target, err := NewQueryFilterExprFromJson(temp.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewIsTypeExpr(target, temp.Expected), nil
+}
@@ -0,0 +1,68 @@
+package query_filter_expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	pe "github.com/pkg/errors"
+)
+
+// ModExpr 计算两个数字相除的余数，余数的符号与被除数相同（与 Js 的 % 一致）
+type ModExpr struct {
+	Type QueryFilterExprType `json:"type"`
+	O1   QueryFilterExpr     `json:"o1"`
+	O2   QueryFilterExpr     `json:"o2"`
+}
+
+func NewModExpr(o1 QueryFilterExpr, o2 QueryFilterExpr) *ModExpr {
+	return &ModExpr{
+		Type: ExprTypeMod,
+		O1:   o1,
+		O2:   o2,
+	}
+}
+
+func (e *ModExpr) DebugSprint() string {
+	return fmt.Sprintf("ModExpr{O1: %s, O2: %s}", e.O1.DebugSprint(), e.O2.DebugSprint())
+}
+
+func (e *ModExpr) Eval(doc *loro.LoroDoc) (*ValueExpr, error) {
+	n1, n2, err := evalNumberOperands(doc, e.O1, e.O2, "MOD")
+	if err != nil {
+		return nil, err
+	}
+	if n2 == 0 {
+		return nil, pe.Wrapf(ErrEvalError, "division by zero in MOD")
+	}
+	return NewValueExpr(math.Mod(n1, n2)), nil
+}
+
+func (e *ModExpr) ToJSON() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func newModExprFromJson(msg json.RawMessage) (*ModExpr, error) {
+	var temp struct {
+		Type QueryFilterExprType `json:"type"`
+		O1   json.RawMessage     `json:"o1"`
+		O2   json.RawMessage     `json:"o2"`
+	}
+
+	if err := json.Unmarshal(msg, &temp); err != nil {
+		return nil, err
+	}
+
+	o1, err := NewQueryFilterExprFromJson(temp.O1)
+	if err != nil {
+		return nil, err
+	}
+
+	o2, err := NewQueryFilterExprFromJson(temp.O2)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewModExpr(o1, o2), nil
+}
@@ -0,0 +1,46 @@
+package query_filter_expr
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+)
+
+// NowExpr 表示求值时的当前时间，单位为毫秒的 Unix 时间戳
+//
+// 日期字段（DateSchema）同样以毫秒时间戳的形式存储，
+// 因此可以配合 lt / gt 判断日期是否早于或晚于当前时间
+type NowExpr struct {
+	Type QueryFilterExprType `json:"type"`
+}
+
+func NewNowExpr() *NowExpr {
+	return &NowExpr{
+		Type: ExprTypeNow,
+	}
+}
+
+func (e *NowExpr) DebugSprint() string {
+	return "NowExpr{}"
+}
+
+func (e *NowExpr) Eval(doc *loro.LoroDoc) (*ValueExpr, error) {
+	return NewValueExpr(time.Now().UnixMilli()), nil
+}
+
+func (e *NowExpr) ToJSON() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func newNowExprFromJson(msg json.RawMessage) (*NowExpr, error) {
+	var temp struct {
+		Type QueryFilterExprType `json:"type"`
+	}
+
+	if err := json.Unmarshal(msg, &temp); err != nil {
+		return nil, err
+	}
+
+	return NewNowExpr(), nil
+}
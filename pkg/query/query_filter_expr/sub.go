@@ -0,0 +1,63 @@
+package query_filter_expr
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+)
+
+// SubExpr 计算两个数字的差
+type SubExpr struct {
+	Type QueryFilterExprType `json:"type"`
+	O1   QueryFilterExpr     `json:"o1"`
+	O2   QueryFilterExpr     `json:"o2"`
+}
+
+func NewSubExpr(o1 QueryFilterExpr, o2 QueryFilterExpr) *SubExpr {
+	return &SubExpr{
+		Type: ExprTypeSub,
+		O1:   o1,
+		O2:   o2,
+	}
+}
+
+func (e *SubExpr) DebugSprint() string {
+	return fmt.Sprintf("SubExpr{O1: %s, O2: %s}", e.O1.DebugSprint(), e.O2.DebugSprint())
+}
+
+func (e *SubExpr) Eval(doc *loro.LoroDoc) (*ValueExpr, error) {
+	n1, n2, err := evalNumberOperands(doc, e.O1, e.O2, "SUB")
+	if err != nil {
+		return nil, err
+	}
+	return NewValueExpr(n1 - n2), nil
+}
+
+func (e *SubExpr) ToJSON() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func newSubExprFromJson(msg json.RawMessage) (*SubExpr, error) {
+	var temp struct {
+		Type QueryFilterExprType `json:"type"`
+		O1   json.RawMessage     `json:"o1"`
+		O2   json.RawMessage     `json:"o2"`
+	}
+
+	if err := json.Unmarshal(msg, &temp); err != nil {
+		return nil, err
+	}
+
+	o1, err := NewQueryFilterExprFromJson(temp.O1)
+	if err != nil {
+		return nil, err
+	}
+
+	o2, err := NewQueryFilterExprFromJson(temp.O2)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSubExpr(o1, o2), nil
+}
@@ -64,6 +64,11 @@ func (qe *QueryExecutor) FindOne(q *query.FindOneQuery) (query.FindOneResult, er
 }
 
 func (qe *QueryExecutor) FindMany(q *query.FindManyQuery) (query.FindManyResult, error) {
+	after, before, err := q.DecodeCursors()
+	if err != nil {
+		return nil, err
+	}
+
 	// TODO: load all docs into memory is not good
 	docs, err := qe.conn.LoadCollection(q.Collection)
 	if err != nil {
@@ -73,22 +78,46 @@ func (qe *QueryExecutor) FindMany(q *query.FindManyQuery) (query.FindManyResult,
 	// filter out docs that match the query
 	result := make(query.FindManyResult, 0)
 	for docId, doc := range docs {
+		docWithId := &query.DocWithId{
+			DocId: docId,
+			Doc:   doc,
+		}
+
+		// when no sort is specified, the order is the doc id (primary key) order,
+		// so the cursor can be checked against the doc id alone, before evaluating
+		// the (more expensive) filter
+		if len(q.Sort) == 0 && !inDocIdRange(docId, after, before) {
+			continue
+		}
+
 		ok, err := q.Match(doc)
 		if err != nil {
 			fmt.Printf("%+v\n", err)
 		}
-		if ok {
-			result = append(result, &query.DocWithId{
-				DocId: docId,
-				Doc:   doc,
-			})
+		if !ok {
+			continue
 		}
+
+		if len(q.Sort) > 0 && q.HasCursor() {
+			ok, err = q.InCursorRange(docWithId, after, before)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		result = append(result, docWithId)
 	}
 
 	// handle sorting
+	// doc id is always used as the tiebreaker, so the order is total and stable,
+	// this is very important, because EventReduce algorithm and cursor pagination
+	// depend on the order of documents in the result
 	if len(q.Sort) > 0 {
 		sort.Slice(result, func(i, j int) bool {
-			cmp, err := q.Compare(result[i].Doc, result[j].Doc)
+			cmp, err := q.CompareDocWithId(result[i], result[j])
 			if err != nil {
 				// when sorting error occurs, keep the original order
 				return i < j
@@ -97,29 +126,96 @@ func (qe *QueryExecutor) FindMany(q *query.FindManyQuery) (query.FindManyResult,
 		})
 	} else {
 		// if no sorting is specified, sort by doc id (primary key)
-		// this is very important, because EventReduce algorithm depends on the order of documents in the result
 		sort.Slice(result, func(i, j int) bool {
 			return result[i].DocId < result[j].DocId
 		})
 	}
 
+	// paging backwards, skip and limit count from the before cursor, so the
+	// docs closest to the cursor are skipped and the ones before them are kept
+	backwards := before != nil && after == nil
+
 	// handle skip
 	if q.Skip > 0 {
 		if int64(len(result)) <= q.Skip {
 			// if the number of skipped docs is greater than or equal to the result size, return empty result
 			return query.FindManyResult{}, nil
 		}
-		result = result[q.Skip:]
+		if backwards {
+			result = result[:int64(len(result))-q.Skip]
+		} else {
+			result = result[q.Skip:]
+		}
 	}
 
 	// handle limit
 	if q.Limit > 0 && int64(len(result)) > q.Limit {
-		result = result[:q.Limit]
+		if backwards {
+			result = result[int64(len(result))-q.Limit:]
+		} else {
+			result = result[:q.Limit]
+		}
 	}
 
 	return result, nil
 }
 
+// inDocIdRange checks whether docId is strictly between the after and before cursors,
+// it is only valid when the query is ordered by doc id
+func inDocIdRange(docId string, after, before *query.Cursor) bool {
+	if after != nil && docId <= after.DocId {
+		return false
+	}
+	if before != nil && docId >= before.DocId {
+		return false
+	}
+	return true
+}
+
+// Lookup executes all lookup stages of q against the result of q,
+// the returned LookupResult is aligned with q.Lookups
+//
+// deleted docs in the foreign collections are never joined
+func (qe *QueryExecutor) Lookup(q *query.FindManyQuery, result query.FindManyResult) (query.LookupResult, error) {
+	lookupResult := make(query.LookupResult, len(q.Lookups))
+	for i := range q.Lookups {
+		joined, err := qe.LookupAt(q, i, result)
+		if err != nil {
+			return nil, err
+		}
+		lookupResult[i] = joined
+	}
+	return lookupResult, nil
+}
+
+// LookupAt executes the i-th lookup stage of q against the result of q
+func (qe *QueryExecutor) LookupAt(q *query.FindManyQuery, i int, result query.FindManyResult) (query.FindManyResult, error) {
+	lookup := q.Lookups[i]
+	if !qe.IsValidCollection(lookup.From) {
+		return nil, fmt.Errorf("invalid lookup: collection %s does not exist", lookup.From)
+	}
+
+	values, err := lookup.LocalValues(result)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return query.FindManyResult{}, nil
+	}
+
+	docs, err := qe.FindMany(lookup.ForeignQuery(values))
+	if err != nil {
+		return nil, err
+	}
+	joined := make(query.FindManyResult, 0, len(docs))
+	for _, doc := range docs {
+		if !doc_visitor.IsDeleted(doc.Doc) {
+			joined = append(joined, doc)
+		}
+	}
+	return joined, nil
+}
+
 func (qe *QueryExecutor) IsValidCollection(collection string) bool {
 	dbMeta := qe.conn.GetDatabaseMeta()
 	for _, c := range dbMeta.GetCollectionNames() {
@@ -0,0 +1,364 @@
+package query_validator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	qfe "github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/query_filter_expr"
+	pe "github.com/pkg/errors"
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+// QueryValidator 在执行查询之前，根据数据库的 schema 对查询做静态检查
+//
+// 检查的内容包括：
+//   - 查询的集合是否存在
+//   - 过滤条件和排序规则中引用的字段路径是否存在于集合的 DocSchema 中
+//   - 运算符两侧的类型是否匹配，例如不能把 NumberSchema 字段与字符串比较
+//   - 过滤条件的结果是否为布尔值
+//
+// 不合法的查询返回包装了 ErrInvalidQuery 的错误；
+// 合法但可能低效的查询（例如按未建立索引的字段排序）返回警告
+type QueryValidator struct {
+	schema *db_conn.DatabaseSchema
+}
+
+func NewQueryValidator(schema *db_conn.DatabaseSchema) *QueryValidator {
+	return &QueryValidator{
+		schema: schema,
+	}
+}
+
+// Validate 检查查询 q，返回所有警告
+func (v *QueryValidator) Validate(q query.Query) ([]string, error) {
+	switch q := q.(type) {
+	case *query.FindOneQuery:
+		root, err := v.collectionType(q.Collection)
+		if err != nil {
+			return nil, err
+		}
+		if err := v.validateFilter(q.Filter, root); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	case *query.FindManyQuery:
+		return v.validateFindMany(q)
+	default:
+		return nil, pe.Wrapf(ErrInvalidQuery, "unknown query type %T", q)
+	}
+}
+
+func (v *QueryValidator) validateFindMany(q *query.FindManyQuery) ([]string, error) {
+	root, err := v.collectionType(q.Collection)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := v.validateFilter(q.Filter, root); err != nil {
+		return nil, err
+	}
+
+	warnings := make([]string, 0)
+	for _, sort := range q.Sort {
+		t, err := resolvePath(root, sort.Field)
+		if err != nil {
+			return nil, pe.Wrapf(ErrInvalidQuery, "sort field %q of collection %q: %v", sort.Field, q.Collection, err)
+		}
+		if t.kind == kindArray || t.kind == kindObject {
+			return nil, pe.Wrapf(ErrInvalidQuery, "sort field %q of collection %q is %s, only scalar fields can be sorted", sort.Field, q.Collection, t.kind)
+		}
+		if !t.isIndexed() {
+			warnings = append(warnings, fmt.Sprintf("sort field %q of collection %q is not indexed", sort.Field, q.Collection))
+		}
+	}
+
+	for _, lookup := range q.Lookups {
+		if _, err := resolvePath(root, lookup.LocalField); err != nil {
+			return nil, pe.Wrapf(ErrInvalidQuery, "lookup local field %q of collection %q: %v", lookup.LocalField, q.Collection, err)
+		}
+		foreignRoot, err := v.collectionType(lookup.From)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := resolvePath(foreignRoot, lookup.ForeignField); err != nil {
+			return nil, pe.Wrapf(ErrInvalidQuery, "lookup foreign field %q of collection %q: %v", lookup.ForeignField, lookup.From, err)
+		}
+	}
+
+	return warnings, nil
+}
+
+func (v *QueryValidator) collectionType(collection string) (*valueType, error) {
+	collectionSchema, ok := v.schema.Collections[collection]
+	if !ok || collectionSchema.DocSchema == nil {
+		return nil, pe.Wrapf(ErrInvalidQuery, "collection %q does not exist", collection)
+	}
+	return docType(collectionSchema.DocSchema), nil
+}
+
+func (v *QueryValidator) validateFilter(filter qfe.QueryFilterExpr, root *valueType) error {
+	if filter == nil {
+		return nil
+	}
+	t, err := inferType(filter, root)
+	if err != nil {
+		return pe.Wrapf(ErrInvalidQuery, "%v", err)
+	}
+	if !t.isA(kindBoolean) {
+		return pe.Wrapf(ErrInvalidQuery, "filter must evaluate to boolean, got %s", t.kind)
+	}
+	return nil
+}
+
+// resolvePath 解析字段路径，返回路径指向的值的类型
+func resolvePath(root *valueType, path string) (*valueType, error) {
+	segments, err := doc_visitor.ExtractSegments(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid field path %q", path)
+	}
+
+	curr := root
+	for _, segment := range segments {
+		if curr.kind == kindAny {
+			return anyType, nil
+		}
+		switch s := segment.(type) {
+		case int:
+			if curr.kind != kindArray {
+				return nil, fmt.Errorf("field path %q indexes into %s", path, curr.kind)
+			}
+			curr = curr.elem
+		case string:
+			if curr.kind != kindObject {
+				return nil, fmt.Errorf("field path %q accesses key %q of %s", path, s, curr.kind)
+			}
+			if curr.fields == nil {
+				curr = curr.values
+				continue
+			}
+			next, ok := curr.fields[s]
+			if !ok {
+				return nil, fmt.Errorf("field path %q not found in schema", path)
+			}
+			curr = next
+		}
+	}
+	return curr, nil
+}
+
+// constPath 返回常量路径表达式的值，路径不是常量时返回 false
+func constPath(expr qfe.QueryFilterExpr) (string, bool) {
+	valueExpr, ok := expr.(*qfe.ValueExpr)
+	if !ok || !valueExpr.IsString() {
+		return "", false
+	}
+	return valueExpr.AsString(), true
+}
+
+// inferType 推导表达式的类型，同时检查表达式中的字段路径和运算符两侧的类型
+func inferType(expr qfe.QueryFilterExpr, root *valueType) (*valueType, error) {
+	switch e := expr.(type) {
+	case *qfe.ValueExpr:
+		return typeFromValue(e.Value), nil
+
+	case *qfe.FieldValueExpr:
+		path, ok := constPath(e.Path)
+		if !ok {
+			return anyType, nil
+		}
+		if path == qfe.ElemMatchCurrentPath {
+			return root, nil
+		}
+		return resolvePath(root, path)
+
+	case *qfe.ExistsExpr:
+		if path, ok := constPath(e.Path); ok {
+			if _, err := resolvePath(root, path); err != nil {
+				return nil, err
+			}
+		}
+		return booleanType, nil
+
+	case *qfe.NowExpr:
+		return numberType, nil
+
+	case *qfe.EqExpr:
+		return booleanType, checkComparable("eq", e.O1, e.O2, root)
+	case *qfe.NeExpr:
+		return booleanType, checkComparable("ne", e.O1, e.O2, root)
+	case *qfe.GtExpr:
+		return booleanType, checkComparable("gt", e.O1, e.O2, root)
+	case *qfe.GteExpr:
+		return booleanType, checkComparable("gte", e.O1, e.O2, root)
+	case *qfe.LtExpr:
+		return booleanType, checkComparable("lt", e.O1, e.O2, root)
+	case *qfe.LteExpr:
+		return booleanType, checkComparable("lte", e.O1, e.O2, root)
+
+	case *qfe.InExpr:
+		return booleanType, checkMembership("in", e.O1, e.O2, root)
+	case *qfe.NinExpr:
+		return booleanType, checkMembership("nin", e.O1, e.O2, root)
+
+	case *qfe.AndExpr:
+		return booleanType, checkOperands("and", kindBoolean, root, e.Exprs...)
+	case *qfe.OrExpr:
+		return booleanType, checkOperands("or", kindBoolean, root, e.Exprs...)
+	case *qfe.NotExpr:
+		return booleanType, checkOperand("not", e.Expr, kindBoolean, root)
+
+	case *qfe.RegexExpr:
+		return booleanType, checkOperand("regex", e.O1, kindString, root)
+	case *qfe.StartsWithExpr:
+		return booleanType, checkOperands("starts_with", kindString, root, e.Target, e.Prefix)
+	case *qfe.EndsWithExpr:
+		return booleanType, checkOperands("ends_with", kindString, root, e.Target, e.Suffix)
+	case *qfe.ContainsExpr:
+		return booleanType, checkOperands("contains", kindString, root, e.Target, e.Substr)
+	case *qfe.EqIgnoreCaseExpr:
+		return booleanType, checkOperands("eq_ignore_case", kindString, root, e.O1, e.O2)
+
+	case *qfe.SizeExpr:
+		if err := checkOperand("size", e.Target, kindArray, root); err != nil {
+			return nil, err
+		}
+		return booleanType, checkOperand("size", e.Size, kindNumber, root)
+	case *qfe.AllExpr:
+		return booleanType, checkOperand("all", e.Target, kindArray, root)
+
+	case *qfe.AddExpr:
+		return numberType, checkOperands("add", kindNumber, root, e.O1, e.O2)
+	case *qfe.SubExpr:
+		return numberType, checkOperands("sub", kindNumber, root, e.O1, e.O2)
+	case *qfe.ModExpr:
+		return numberType, checkOperands("mod", kindNumber, root, e.O1, e.O2)
+
+	case *qfe.DatePartExpr:
+		switch e.Part {
+		case qfe.DatePartYear, qfe.DatePartMonth, qfe.DatePartDay, qfe.DatePartHour,
+			qfe.DatePartMinute, qfe.DatePartSecond, qfe.DatePartWeekday:
+		default:
+			return nil, fmt.Errorf("date_part: unknown date part %q", e.Part)
+		}
+		return numberType, checkOperand("date_part", e.Target, kindNumber, root)
+
+	case *qfe.IsTypeExpr:
+		switch e.Expected {
+		case qfe.ValueTypeNull, qfe.ValueTypeBoolean, qfe.ValueTypeNumber,
+			qfe.ValueTypeString, qfe.ValueTypeArray, qfe.ValueTypeObject:
+		default:
+			return nil, fmt.Errorf("is_type: unknown type %q", e.Expected)
+		}
+		if _, err := inferType(e.Target, root); err != nil {
+			return nil, err
+		}
+		return booleanType, nil
+
+	case *qfe.ElemMatchExpr:
+		path, ok := constPath(e.Path)
+		if !ok {
+			return booleanType, nil
+		}
+		t, err := resolvePath(root, path)
+		if err != nil {
+			return nil, err
+		}
+		if !t.isA(kindArray) {
+			return nil, fmt.Errorf("elem_match: field %q is %s, not array", path, t.kind)
+		}
+		elem := anyType
+		if t.kind == kindArray {
+			elem = t.elem
+		}
+		// cond 中的路径相对于数组元素
+		condType, err := inferType(e.Cond, elem)
+		if err != nil {
+			return nil, err
+		}
+		if !condType.isA(kindBoolean) {
+			return nil, fmt.Errorf("elem_match: condition must evaluate to boolean, got %s", condType.kind)
+		}
+		return booleanType, nil
+
+	default:
+		// 未知的表达式不做检查
+		return anyType, nil
+	}
+}
+
+func checkComparable(op string, o1, o2 qfe.QueryFilterExpr, root *valueType) error {
+	t1, err := inferType(o1, root)
+	if err != nil {
+		return err
+	}
+	t2, err := inferType(o2, root)
+	if err != nil {
+		return err
+	}
+	if !t1.comparableWith(t2) {
+		return fmt.Errorf("%s: cannot compare %s with %s", op, describe(o1, t1), describe(o2, t2))
+	}
+	return nil
+}
+
+func checkMembership(op string, target qfe.QueryFilterExpr, items []qfe.QueryFilterExpr, root *valueType) error {
+	t, err := inferType(target, root)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		itemType, err := inferType(item, root)
+		if err != nil {
+			return err
+		}
+		// 数组字段与元素逐个比较，这里只检查标量
+		if t.kind == kindArray {
+			continue
+		}
+		if !t.comparableWith(itemType) {
+			return fmt.Errorf("%s: cannot compare %s with %s", op, describe(target, t), describe(item, itemType))
+		}
+	}
+	return nil
+}
+
+func checkOperands(op string, kind valueKind, root *valueType, operands ...qfe.QueryFilterExpr) error {
+	for _, operand := range operands {
+		if err := checkOperand(op, operand, kind, root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkOperand(op string, operand qfe.QueryFilterExpr, kind valueKind, root *valueType) error {
+	t, err := inferType(operand, root)
+	if err != nil {
+		return err
+	}
+	// 可为空的字段在运行时才能确定
+	if t.kind == kindNull {
+		return nil
+	}
+	if !t.isA(kind) {
+		return fmt.Errorf("%s: expected %s, got %s", op, kind, describe(operand, t))
+	}
+	return nil
+}
+
+// describe 用于生成错误信息，字段会带上路径
+func describe(expr qfe.QueryFilterExpr, t *valueType) string {
+	if fieldExpr, ok := expr.(*qfe.FieldValueExpr); ok {
+		if path, ok := constPath(fieldExpr.Path); ok {
+			return fmt.Sprintf("%s field %q", t.kind, path)
+		}
+	}
+	if valueExpr, ok := expr.(*qfe.ValueExpr); ok {
+		return fmt.Sprintf("%s %v", t.kind, valueExpr.Value)
+	}
+	return t.kind.String()
+}
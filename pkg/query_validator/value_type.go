@@ -0,0 +1,156 @@
+package query_validator
+
+import (
+	"fmt"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+)
+
+type valueKind int
+
+const (
+	kindAny valueKind = iota
+	kindNull
+	kindBoolean
+	kindNumber
+	kindString
+	kindArray
+	kindObject
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case kindAny:
+		return "any"
+	case kindNull:
+		return "null"
+	case kindBoolean:
+		return "boolean"
+	case kindNumber:
+		return "number"
+	case kindString:
+		return "string"
+	case kindArray:
+		return "array"
+	case kindObject:
+		return "object"
+	default:
+		return fmt.Sprintf("valueKind(%d)", int(k))
+	}
+}
+
+// valueType 是表达式在静态检查时的类型，由 schema 推导而来
+type valueType struct {
+	kind valueKind
+	// kind == kindArray 时，数组元素的类型
+	elem *valueType
+	// kind == kindObject 时，对象各字段的类型
+	// 为 nil 时表示对象的 key 不固定（RecordSchema），所有值的类型都是 values
+	fields map[string]*valueType
+	values *valueType
+	// 字段上的索引类型，仅对标量字段有意义
+	indexType db_conn.IndexType
+}
+
+var (
+	anyType     = &valueType{kind: kindAny}
+	nullType    = &valueType{kind: kindNull}
+	booleanType = &valueType{kind: kindBoolean}
+	numberType  = &valueType{kind: kindNumber}
+	stringType  = &valueType{kind: kindString}
+)
+
+// isIndexed 返回字段上是否建立了索引
+func (t *valueType) isIndexed() bool {
+	return t.indexType != "" && t.indexType != db_conn.NONE_INDEX
+}
+
+// isA 检查类型是否可能是 kind，any 可能是任何类型
+func (t *valueType) isA(kind valueKind) bool {
+	return t.kind == kindAny || t.kind == kind
+}
+
+// comparableWith 检查两个类型的值能否相互比较
+//
+// null 可以和任何类型比较（表示字段未设置或可为空），any 在静态检查时无法确定
+func (t *valueType) comparableWith(other *valueType) bool {
+	if t.kind == kindAny || other.kind == kindAny {
+		return true
+	}
+	if t.kind == kindNull || other.kind == kindNull {
+		return true
+	}
+	return t.kind == other.kind
+}
+
+// docType 从集合的 DocSchema 推导文档根对象的类型
+func docType(schema *db_conn.DocSchema) *valueType {
+	fields := make(map[string]*valueType, len(schema.Fields)+1)
+	for name, fieldSchema := range schema.Fields {
+		fields[name] = typeFromSchema(fieldSchema)
+	}
+	// 软删除标记，见 doc_visitor.SetDeleted
+	if _, ok := fields["deleted"]; !ok {
+		fields["deleted"] = booleanType
+	}
+	return &valueType{
+		kind:   kindObject,
+		fields: fields,
+	}
+}
+
+// typeFromSchema 从字段的 schema 推导类型
+func typeFromSchema(schema any) *valueType {
+	switch s := schema.(type) {
+	case *db_conn.AnySchema:
+		return anyType
+	case *db_conn.BooleanSchema:
+		return &valueType{kind: kindBoolean, indexType: s.IndexType}
+	case *db_conn.DateSchema:
+		// 日期以毫秒时间戳的形式存储
+		return &valueType{kind: kindNumber, indexType: s.IndexType}
+	case *db_conn.EnumSchema:
+		return &valueType{kind: kindString, indexType: s.IndexType}
+	case *db_conn.NumberSchema:
+		return &valueType{kind: kindNumber, indexType: s.IndexType}
+	case *db_conn.StringSchema:
+		return &valueType{kind: kindString, indexType: s.IndexType}
+	case *db_conn.TextSchema:
+		return &valueType{kind: kindString, indexType: s.IndexType}
+	case *db_conn.ListSchema:
+		return &valueType{kind: kindArray, elem: typeFromSchema(s.ItemSchema)}
+	case *db_conn.MovableListSchema:
+		return &valueType{kind: kindArray, elem: typeFromSchema(s.ItemSchema)}
+	case *db_conn.ObjectSchema:
+		fields := make(map[string]*valueType, len(s.Shape))
+		for name, fieldSchema := range s.Shape {
+			fields[name] = typeFromSchema(fieldSchema)
+		}
+		return &valueType{kind: kindObject, fields: fields}
+	case *db_conn.RecordSchema:
+		return &valueType{kind: kindObject, values: typeFromSchema(s.ValueSchema)}
+	default:
+		// TreeSchema 等结构不固定的类型
+		return anyType
+	}
+}
+
+// typeFromValue 推导字面量的类型
+func typeFromValue(v any) *valueType {
+	switch v.(type) {
+	case nil:
+		return nullType
+	case bool:
+		return booleanType
+	case float64:
+		return numberType
+	case string:
+		return stringType
+	case []any:
+		return &valueType{kind: kindArray, elem: anyType}
+	case map[string]any:
+		return &valueType{kind: kindObject, values: anyType}
+	default:
+		return anyType
+	}
+}
@@ -111,7 +111,9 @@ func ActionInsertFirst(in ActionFunctionInput) {
 	if isFindMany {
 		if isInsertOp {
 			doc := loro.NewLoroDoc()
-			doc.Import(insertOp.Snapshot)
+			if _, err := doc.Import(insertOp.Snapshot); err != nil {
+				panic(fmt.Sprintf("import error: %v", err))
+			}
 			docWithId := &query.DocWithId{
 				DocId: insertOp.DocID,
 				Doc:   doc,
@@ -132,7 +134,9 @@ func ActionInsertLast(in ActionFunctionInput) {
 	if isFindMany {
 		if isInsertOp {
 			doc := loro.NewLoroDoc()
-			doc.Import(insertOp.Snapshot)
+			if _, err := doc.Import(insertOp.Snapshot); err != nil {
+				panic(fmt.Sprintf("import error: %v", err))
+			}
 			docWithId := &query.DocWithId{
 				DocId: insertOp.DocID,
 				Doc:   doc,
@@ -227,7 +231,9 @@ func ActionReplaceExisting(in ActionFunctionInput) {
 			}
 
 			if idx != -1 {
-				lq.Result[idx].Doc.Import(op.Update)
+				if _, err := lq.Result[idx].Doc.Import(op.Update); err != nil {
+					panic(fmt.Sprintf("import error: %v", err))
+				}
 				updateClientUpdates(in)
 			}
 		} else {
@@ -248,7 +254,9 @@ func ActionInsertAtSortPosition(in ActionFunctionInput) {
 	if isFindMany {
 		if isInsertOp {
 			doc := loro.NewLoroDoc()
-			doc.Import(insertOp.Snapshot)
+			if _, err := doc.Import(insertOp.Snapshot); err != nil {
+				panic(fmt.Sprintf("import error: %v", err))
+			}
 			docWithId := &query.DocWithId{
 				DocId: insertOp.DocID,
 				Doc:   doc,
@@ -0,0 +1,863 @@
+package synchronizer2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/log"
+	pe "github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// Commit fan-out
+//
+// Several synchronizers can serve the clients of one database behind a load
+// balancer, each of them holding the subscriptions of its own clients. One of
+// them, the writer, owns the storage: it commits every transaction and
+// publishes the committed and rollbacked transactions to a redis stream. The
+// others, the followers, keep a replica of the database by committing the
+// published transactions in order, so that their query managers see every
+// commit and notify their own clients. Followers forward the transactions of
+// their clients to the writer through a second stream instead of committing
+// them. The writer authorizes them again against its storage, the ack or the
+// failure reaches the client when the follower consumes the result from the
+// commit stream.
+//
+// The writer publishes the commits of the commit journal of its storage, see
+// db_conn.CommitJournal: the entry of commit n has the stream id "n-0" and the
+// rollbacks that follow it "n-1", "n-2"... A goroutine reads the journal after
+// the last published commit and adds the entries, so commits don't wait for
+// redis: while it is unreachable the commits pile up in the journal, and they
+// are published once it is back, also after the writer restarts. Rollbacks are
+// not journaled, they are queued in memory and published after the commit they
+// follow.
+//
+// Every CheckpointEvery commits, the writer stores a checkpoint, the snapshots
+// of all docs and the seq of the last commit they include, and trims the
+// entries up to that commit from the stream and from the journal. A follower starts from the
+// checkpoint and replays the stream after it. When an entry is missing or
+// fails to apply, the follower stops consuming and resyncs: it applies the
+// checkpoint again and replays from there. Entries are applied so that applying
+// them twice is harmless, an insert of a doc the replica already has is merged
+// into it. The replica should be an empty database with the schema of the
+// writer, e.g. a mem:// database.
+//
+// The checkpoint is a single redis value, so the database must stay well
+// below the 512 MB limit of a redis string. Purged tombstones, compacted
+// history and schema updates of the writer are not replicated. A writer whose
+// storage is older than the stream, e.g. restored from a backup, refuses to
+// start with ErrCommitStreamAhead; delete the streams and the checkpoint and
+// restart the followers to start over.
+
+const (
+	// DefaultCommitStream is the default key of the commit stream
+	DefaultCommitStream = "rapierdb:commits"
+	// DefaultCommitFanoutBlock is the default time a read of a stream waits
+	// for new entries
+	DefaultCommitFanoutBlock = 5 * time.Second
+	// DefaultCheckpointEvery is the default number of commits between two
+	// checkpoints
+	DefaultCheckpointEvery = 10000
+
+	// commitFanoutGroup is the consumer group of the writer in the tx stream
+	commitFanoutGroup      = "writer"
+	commitFanoutBatchSize  = 100
+	commitFanoutRetryDelay = time.Second
+	// commitFanoutMaxRollbacks is the number of rollbacks the writer queues
+	// while the commit stream is unreachable, older ones are dropped
+	commitFanoutMaxRollbacks = 10000
+
+	fanoutKindCommit   = "commit"
+	fanoutKindRollback = "rollback"
+)
+
+var (
+	// ErrCommitStreamAhead is returned by the Start of a writer whose storage
+	// misses commits that are in the commit stream
+	ErrCommitStreamAhead = errors.New("commit stream is ahead of the storage")
+	// ErrCommitStreamGap is the failure of a follower that finds a commit
+	// missing from the commit stream, it resyncs from the checkpoint
+	ErrCommitStreamGap = errors.New("commit missing from the commit stream")
+)
+
+type CommitFanoutOptions struct {
+	// Client is the redis client of the streams, required
+	Client redis.UniversalClient
+	// Writer is true for the synchronizer that owns the storage, there must be
+	// exactly one writer per database
+	Writer bool
+	// Stream is the key of the stream of committed and rollbacked transactions
+	Stream string
+	// TxStream is the key of the stream of transactions forwarded to the writer,
+	// defaults to Stream + ":txs"
+	TxStream string
+	// CheckpointKey is the key of the checkpoint of the commit stream, defaults
+	// to Stream + ":checkpoint"
+	CheckpointKey string
+	// CheckpointEvery is the number of commits between two checkpoints of the
+	// writer
+	CheckpointEvery uint64
+	// InstanceId identifies this synchronizer in the streams, defaults to the
+	// host name and the pid
+	InstanceId string
+	// Block is how long a read of a stream waits for new entries
+	Block time.Duration
+}
+
+func (opts *CommitFanoutOptions) EnsureDefaults() {
+	if opts.Stream == "" {
+		opts.Stream = DefaultCommitStream
+	}
+	if opts.TxStream == "" {
+		opts.TxStream = opts.Stream + ":txs"
+	}
+	if opts.CheckpointKey == "" {
+		opts.CheckpointKey = opts.Stream + ":checkpoint"
+	}
+	if opts.CheckpointEvery == 0 {
+		opts.CheckpointEvery = DefaultCheckpointEvery
+	}
+	if opts.InstanceId == "" {
+		host, _ := os.Hostname()
+		opts.InstanceId = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	if opts.Block <= 0 {
+		opts.Block = DefaultCommitFanoutBlock
+	}
+}
+
+type CommitFanoutStats struct {
+	// Published is the number of transactions published to the commit stream
+	Published int64
+	// Forwarded is the number of transactions forwarded to the writer
+	Forwarded int64
+	// Consumed is the number of stream entries handled, forwarded transactions
+	// for the writer and published transactions for a follower
+	Consumed int64
+	// Checkpoints is the number of checkpoints stored by the writer
+	Checkpoints int64
+	// Resyncs is the number of times a follower applied the checkpoint
+	Resyncs int64
+	// LastSeq is the seq of the last commit published by the writer or applied
+	// by a follower
+	LastSeq uint64
+	// Unpublished is the number of commits of the storage of the writer that
+	// are not published yet
+	Unpublished uint64
+	// Failures is the number of failed stream operations and entries
+	Failures int64
+	// LastErr is the last error, nil if nothing failed
+	LastErr error
+}
+
+// CommitFanout shares the commits of a database between synchronizers
+// through redis streams, see the comment at the top of the file
+type CommitFanout struct {
+	conn db_conn.DbConnection
+	opts CommitFanoutOptions
+	// authorize checks the forwarded transactions on the writer, nil allows
+	// every transaction
+	authorize func(tr *db_conn.Transaction) error
+	// wake wakes the publishing goroutine of the writer up
+	wake chan struct{}
+
+	// pubMu guards the fields below on the writer. On a follower they are only
+	// used by the consuming goroutine.
+	pubMu sync.Mutex
+	// lastSeq and lastSub are the seq and the sub of the id of the last entry
+	// of the commit stream added by the writer or applied by a follower, they
+	// are only changed by the publishing goroutine on the writer
+	lastSeq, lastSub uint64
+	// headSeq is the seq of the last commit of the storage of the writer
+	headSeq uint64
+	// rollbacks are the rollbacks of the writer waiting to be published
+	rollbacks []pendingRollback
+	// checkpointSeq is the seq of the last checkpoint, checkpointing is true
+	// while the writer stores a checkpoint
+	checkpointSeq uint64
+	checkpointing bool
+
+	mu    sync.Mutex
+	stats CommitFanoutStats
+}
+
+// pendingRollback is a rollback that follows the commit seq
+type pendingRollback struct {
+	tr     *db_conn.Transaction
+	reason error
+	seq    uint64
+}
+
+var _ db_conn.CommitJournal = &CommitFanout{}
+
+// NewCommitFanout creates a fan-out of the commits of conn, the replica of a
+// follower or the storage of the writer
+func NewCommitFanout(conn db_conn.DbConnection, opts *CommitFanoutOptions) (*CommitFanout, error) {
+	if opts == nil || opts.Client == nil {
+		return nil, pe.New("commit fan-out requires a redis client")
+	}
+	fanout := &CommitFanout{conn: conn, opts: *opts, wake: make(chan struct{}, 1)}
+	fanout.opts.EnsureDefaults()
+	return fanout, nil
+}
+
+// IsWriter reports whether the fan-out belongs to the writer
+func (f *CommitFanout) IsWriter() bool {
+	return f.opts.Writer
+}
+
+// Start starts publishing and consuming until ctx is done
+//
+// block until the commit stream matches the storage for the writer, or until
+// the replica caught up with the commit stream for a follower
+func (f *CommitFanout) Start(ctx context.Context) error {
+	if !f.opts.Writer {
+		if err := f.resync(ctx); err != nil {
+			return err
+		}
+		if err := f.catchUp(ctx); err != nil {
+			return err
+		}
+		go f.consumeCommits(ctx)
+		return nil
+	}
+
+	if err := f.recover(ctx); err != nil {
+		return err
+	}
+	if err := f.conn.SetCommitJournal(f); err != nil {
+		return err
+	}
+	go f.publishCommits(ctx)
+	f.notify()
+	err := f.opts.Client.XGroupCreateMkStream(ctx, f.opts.TxStream, commitFanoutGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return pe.Wrapf(err, "failed to create consumer group of stream %s", f.opts.TxStream)
+	}
+	go f.consumeTxs(ctx)
+	return nil
+}
+
+// Forward sends tr to the writer. Like a commit, a failure is also reported by
+// a rollbacked event of the connection
+func (f *CommitFanout) Forward(ctx context.Context, tr *db_conn.Transaction) error {
+	values, err := f.entryValues("", tr, nil)
+	if err == nil {
+		err = f.opts.Client.XAdd(ctx, &redis.XAddArgs{
+			Stream: f.opts.TxStream,
+			Values: values,
+		}).Err()
+	}
+	if err != nil {
+		err = pe.Wrapf(err, "failed to forward transaction %s", tr.TxID)
+		f.fail("CommitFanout.Forward", err)
+		f.conn.GetRollbackedEb().Publish(&db_conn.TransactionRollbackedEvent{
+			Committer:   tr.Committer,
+			Reason:      err,
+			Transaction: tr,
+		})
+		return err
+	}
+	f.mu.Lock()
+	f.stats.Forwarded++
+	f.mu.Unlock()
+	return nil
+}
+
+// Stats returns the statistics of the fan-out so far
+func (f *CommitFanout) Stats() CommitFanoutStats {
+	f.mu.Lock()
+	stats := f.stats
+	f.mu.Unlock()
+	if f.opts.Writer {
+		f.pubMu.Lock()
+		stats.Unpublished = f.headSeq - f.lastSeq
+		f.pubMu.Unlock()
+	}
+	return stats
+}
+
+// recover brings the commit stream in line with the storage before the writer
+// publishes new commits. The publishing goroutine continues from the last
+// entry of the stream when the journal still has the commits after it, a
+// checkpoint is stored when the stream has none or misses trimmed commits, so
+// the followers resync from it.
+func (f *CommitFanout) recover(ctx context.Context) error {
+	_, seq, err := f.conn.LastJournaled()
+	if err != nil {
+		return err
+	}
+	msgs, err := f.opts.Client.XRevRangeN(ctx, f.opts.Stream, "+", "-", 1).Result()
+	if err != nil {
+		return pe.Wrapf(err, "failed to read stream %s", f.opts.Stream)
+	}
+	var streamSeq, streamSub uint64
+	if len(msgs) > 0 {
+		streamSeq, streamSub, err = parseStreamId(msgs[0].ID)
+		if err != nil {
+			return err
+		}
+	}
+	if streamSeq > seq {
+		return pe.Wrapf(ErrCommitStreamAhead, "stream %s is at commit %d, the storage at commit %d", f.opts.Stream, streamSeq, seq)
+	}
+	f.headSeq = seq
+
+	checkpoint, err := f.opts.Client.HGet(ctx, f.opts.CheckpointKey, "seq").Uint64()
+	if err != nil && err != redis.Nil {
+		return pe.Wrapf(err, "failed to read checkpoint %s", f.opts.CheckpointKey)
+	}
+	if err == nil {
+		entries, err := f.conn.LoadJournal(streamSeq, 1)
+		if err != nil {
+			return err
+		}
+		if streamSeq == seq || (len(entries) > 0 && entries[0].Seq == streamSeq+1) {
+			if streamSeq < seq {
+				log.Infof("CommitFanout.recover: publishing commits %d to %d", streamSeq+1, seq)
+			}
+			f.lastSeq, f.lastSub = streamSeq, streamSub
+			f.checkpointSeq = checkpoint
+			return nil
+		}
+	}
+	f.lastSeq, f.lastSub = seq, 0
+	return f.checkpoint(ctx)
+}
+
+// Committed wakes the publishing goroutine up for a commit of the storage of
+// the writer, it is called by the storage with the commit lock held
+func (f *CommitFanout) Committed(tr *db_conn.Transaction, seq uint64) {
+	f.pubMu.Lock()
+	f.headSeq = seq
+	f.pubMu.Unlock()
+	f.notify()
+}
+
+// Rollbacked queues a rollback of the storage of the writer, it is called by
+// the storage with the commit lock held
+func (f *CommitFanout) Rollbacked(tr *db_conn.Transaction, reason error) {
+	// transactions of the server itself have no client to notify
+	if tr.Committer == db_conn.SystemCommitter {
+		return
+	}
+	f.queueRollback(tr, reason)
+}
+
+// queueRollback queues tr to be published after the last commit of the storage
+func (f *CommitFanout) queueRollback(tr *db_conn.Transaction, reason error) {
+	f.pubMu.Lock()
+	if len(f.rollbacks) == commitFanoutMaxRollbacks {
+		dropped := f.rollbacks[0]
+		f.rollbacks = f.rollbacks[1:]
+		f.fail("CommitFanout.queueRollback", pe.Errorf("dropped rollback of transaction %s, too many rollbacks are waiting to be published", dropped.tr.TxID))
+	}
+	f.rollbacks = append(f.rollbacks, pendingRollback{tr: tr, reason: reason, seq: f.headSeq})
+	f.pubMu.Unlock()
+	f.notify()
+}
+
+func (f *CommitFanout) notify() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// publishCommits publishes the commits of the journal and the queued rollbacks
+// of the writer until ctx is done, retrying after failures so that followers
+// never miss an entry
+func (f *CommitFanout) publishCommits(ctx context.Context) {
+	for {
+		if err := f.publishPending(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			f.fail("CommitFanout.publishCommits", err)
+			if !waitRetry(ctx) {
+				return
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.wake:
+		}
+	}
+}
+
+// publishPending adds the commits of the journal after the last published one
+// to the commit stream in seq order, each rollback after the commit it follows
+func (f *CommitFanout) publishPending(ctx context.Context) error {
+	for {
+		f.pubMu.Lock()
+		lastSeq := f.lastSeq
+		f.pubMu.Unlock()
+		entries, err := f.conn.LoadJournal(lastSeq, commitFanoutBatchSize)
+		if err != nil {
+			return pe.Wrap(err, "failed to load commit journal")
+		}
+		for _, entry := range entries {
+			if entry.Seq != lastSeq+1 {
+				return pe.Errorf("commit journal misses the commits between %d and %d", lastSeq, entry.Seq)
+			}
+			if err := f.publishRollbacks(ctx, entry.Seq); err != nil {
+				return err
+			}
+			if err := f.xadd(ctx, fanoutKindCommit, entry.Transaction, nil, entry.Seq, 0); err != nil && !isStaleStreamId(err) {
+				return pe.Wrapf(err, "failed to publish transaction %s", entry.Transaction.TxID)
+			}
+			// a stale id means a previous try added the entry
+			f.published(entry.Seq)
+			lastSeq = entry.Seq
+
+			f.pubMu.Lock()
+			f.lastSeq, f.lastSub = entry.Seq, 0
+			startCheckpoint := entry.Seq >= f.checkpointSeq+f.opts.CheckpointEvery && !f.checkpointing
+			if startCheckpoint {
+				f.checkpointing = true
+			}
+			f.pubMu.Unlock()
+			if startCheckpoint {
+				go func() {
+					if err := f.checkpoint(ctx); err != nil {
+						f.fail("CommitFanout.checkpoint", err)
+					}
+					f.pubMu.Lock()
+					f.checkpointing = false
+					f.pubMu.Unlock()
+				}()
+			}
+		}
+		if len(entries) < commitFanoutBatchSize {
+			return f.publishRollbacks(ctx, lastSeq+1)
+		}
+	}
+}
+
+// publishRollbacks adds the queued rollbacks that follow commits before seq to
+// the commit stream, after the last published entry
+func (f *CommitFanout) publishRollbacks(ctx context.Context, seq uint64) error {
+	for {
+		f.pubMu.Lock()
+		if len(f.rollbacks) == 0 || f.rollbacks[0].seq >= seq {
+			f.pubMu.Unlock()
+			return nil
+		}
+		rollback := f.rollbacks[0]
+		lastSeq, sub := f.lastSeq, f.lastSub+1
+		f.pubMu.Unlock()
+
+		err := f.xadd(ctx, fanoutKindRollback, rollback.tr, rollback.reason, lastSeq, sub)
+		if err != nil && !isStaleStreamId(err) {
+			return pe.Wrapf(err, "failed to publish transaction %s", rollback.tr.TxID)
+		}
+		f.published(lastSeq)
+		f.pubMu.Lock()
+		f.rollbacks = f.rollbacks[1:]
+		f.lastSub = sub
+		f.pubMu.Unlock()
+	}
+}
+
+func (f *CommitFanout) published(seq uint64) {
+	f.mu.Lock()
+	f.stats.Published++
+	f.stats.LastSeq = seq
+	f.mu.Unlock()
+}
+
+func (f *CommitFanout) xadd(ctx context.Context, kind string, tr *db_conn.Transaction, reason error, seq, sub uint64) error {
+	values, err := f.entryValues(kind, tr, reason)
+	if err != nil {
+		return err
+	}
+	return f.opts.Client.XAdd(ctx, &redis.XAddArgs{
+		Stream: f.opts.Stream,
+		ID:     streamId(seq, sub),
+		Values: values,
+	}).Err()
+}
+
+// checkpoint stores the snapshots of all docs of the storage of the writer and
+// trims the entries they include from the commit stream. The snapshots are
+// loaded after the seq is read, so they include at least the commits up to it.
+func (f *CommitFanout) checkpoint(ctx context.Context) error {
+	f.pubMu.Lock()
+	seq := f.lastSeq
+	f.pubMu.Unlock()
+
+	tr := &db_conn.Transaction{
+		TxID:       fmt.Sprintf("checkpoint-%d", seq),
+		Committer:  db_conn.SystemCommitter,
+		Operations: make([]db_conn.TransactionOp, 0),
+	}
+	for collection := range f.conn.GetDatabaseMeta().GetDatabaseSchema().Collections {
+		docs, err := f.conn.LoadCollection(collection)
+		if err != nil {
+			return pe.Wrapf(err, "failed to load collection %s", collection)
+		}
+		for docId, doc := range docs {
+			tr.Operations = append(tr.Operations, &db_conn.InsertOp{
+				Collection: collection,
+				DocID:      docId,
+				Snapshot:   doc.ExportSnapshot().Bytes(),
+			})
+		}
+	}
+	trBytes, err := db_conn.EncodeTransaction(tr)
+	if err != nil {
+		return pe.Wrapf(err, "failed to encode checkpoint %d", seq)
+	}
+	if err := f.opts.Client.HSet(ctx, f.opts.CheckpointKey, "seq", seq, "tx", trBytes).Err(); err != nil {
+		return pe.Wrapf(err, "failed to store checkpoint %d", seq)
+	}
+	// the rollbacks after the commit seq are kept for the followers that
+	// forwarded them
+	if err := f.opts.Client.XTrimMinID(ctx, f.opts.Stream, streamId(seq, 1)).Err(); err != nil {
+		return pe.Wrapf(err, "failed to trim stream %s", f.opts.Stream)
+	}
+	if err := f.conn.TrimJournal(seq); err != nil {
+		return pe.Wrapf(err, "failed to trim commit journal to %d", seq)
+	}
+
+	f.pubMu.Lock()
+	f.checkpointSeq = max(f.checkpointSeq, seq)
+	f.pubMu.Unlock()
+	f.mu.Lock()
+	f.stats.Checkpoints++
+	f.mu.Unlock()
+	log.Infof("CommitFanout.checkpoint: stored checkpoint %d with %d docs", seq, len(tr.Operations))
+	return nil
+}
+
+// consumeTxs authorizes and commits the transactions forwarded to the writer,
+// the results are published by the commit journal, the denials here
+func (f *CommitFanout) consumeTxs(ctx context.Context) {
+	// entries delivered to a previous run of this instance but not acked first
+	id := "0"
+	for ctx.Err() == nil {
+		streams, err := f.opts.Client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    commitFanoutGroup,
+			Consumer: f.opts.InstanceId,
+			Streams:  []string{f.opts.TxStream, id},
+			Count:    commitFanoutBatchSize,
+			Block:    f.opts.Block,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			f.fail("CommitFanout.consumeTxs", pe.Wrapf(err, "failed to read stream %s", f.opts.TxStream))
+			waitRetry(ctx)
+			continue
+		}
+		msgs := streams[0].Messages
+		if id == "0" && len(msgs) == 0 {
+			id = ">"
+			continue
+		}
+		for _, msg := range msgs {
+			_, tr, _, err := decodeFanoutEntry(msg)
+			if err != nil {
+				f.fail("CommitFanout.consumeTxs", pe.Wrapf(err, "invalid entry %s", msg.ID))
+			} else {
+				// the replica of the follower may be behind the storage, so the
+				// transaction is authorized again
+				if f.authorize == nil {
+					f.conn.Commit(tr)
+				} else if err := f.authorize(tr); err != nil {
+					log.Warnf("CommitFanout.consumeTxs: forwarded transaction %s of client %s denied: %v", tr.TxID, tr.Committer, err)
+					f.queueRollback(tr, err)
+				} else {
+					f.conn.Commit(tr)
+				}
+				f.mu.Lock()
+				f.stats.Consumed++
+				f.mu.Unlock()
+			}
+			if err := f.opts.Client.XAck(ctx, f.opts.TxStream, commitFanoutGroup, msg.ID).Err(); err != nil {
+				f.fail("CommitFanout.consumeTxs", pe.Wrapf(err, "failed to ack entry %s", msg.ID))
+			}
+		}
+	}
+}
+
+// resync applies the checkpoint to the replica of the follower, the follower
+// continues with the entries after it
+func (f *CommitFanout) resync(ctx context.Context) error {
+	values, err := f.opts.Client.HGetAll(ctx, f.opts.CheckpointKey).Result()
+	if err != nil {
+		return pe.Wrapf(err, "failed to read checkpoint %s", f.opts.CheckpointKey)
+	}
+	if len(values) == 0 {
+		// no commit was trimmed yet, replay the whole stream
+		f.lastSeq, f.lastSub = 0, 0
+		return nil
+	}
+	seq, err := strconv.ParseUint(values["seq"], 10, 64)
+	if err != nil {
+		return pe.Wrapf(err, "invalid checkpoint %s", f.opts.CheckpointKey)
+	}
+	tr, err := db_conn.DecodeTransaction([]byte(values["tx"]))
+	if err != nil {
+		return pe.Wrapf(err, "invalid checkpoint %s", f.opts.CheckpointKey)
+	}
+	// one doc at a time, so the committed events stay small
+	for _, op := range tr.Operations {
+		err := f.applyCommit(&db_conn.Transaction{
+			TxID:       tr.TxID,
+			Committer:  db_conn.SystemCommitter,
+			Operations: []db_conn.TransactionOp{op},
+		})
+		if err != nil {
+			return pe.Wrapf(err, "failed to apply checkpoint %d", seq)
+		}
+	}
+	f.lastSeq, f.lastSub = seq, 0
+	f.mu.Lock()
+	f.stats.Resyncs++
+	f.stats.LastSeq = seq
+	f.mu.Unlock()
+	log.Infof("CommitFanout.resync: applied checkpoint %d with %d docs", seq, len(tr.Operations))
+	return nil
+}
+
+// catchUp applies the entries of the commit stream until the replica of the
+// follower reaches the end of the stream
+func (f *CommitFanout) catchUp(ctx context.Context) error {
+	for {
+		msgs, err := f.readCommits(ctx, -1)
+		if err != nil {
+			return pe.Wrapf(err, "failed to read stream %s", f.opts.Stream)
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+		if err := f.applyCommits(msgs); err != nil {
+			f.fail("CommitFanout.catchUp", err)
+			if err := f.resync(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (f *CommitFanout) consumeCommits(ctx context.Context) {
+	for ctx.Err() == nil {
+		msgs, err := f.readCommits(ctx, f.opts.Block)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			f.fail("CommitFanout.consumeCommits", pe.Wrapf(err, "failed to read stream %s", f.opts.Stream))
+			waitRetry(ctx)
+			continue
+		}
+		err = f.applyCommits(msgs)
+		for err != nil {
+			// the replica no longer matches the storage of the writer, stop
+			// consuming until it is resynced
+			f.fail("CommitFanout.consumeCommits", err)
+			if !waitRetry(ctx) {
+				return
+			}
+			err = f.resync(ctx)
+		}
+	}
+}
+
+// readCommits reads the entries of the commit stream after the last applied
+// one, a negative block doesn't wait for new entries
+func (f *CommitFanout) readCommits(ctx context.Context, block time.Duration) ([]redis.XMessage, error) {
+	streams, err := f.opts.Client.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{f.opts.Stream, streamId(f.lastSeq, f.lastSub)},
+		Count:   commitFanoutBatchSize,
+		Block:   block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return streams[0].Messages, nil
+}
+
+// applyCommits commits the published transactions to the replica of the
+// follower in order, and stops at the first entry that is missing or fails.
+// The synchronizer handles the committed events of the replica like the ones
+// of a storage, and the rollbacked events published for the rollbacks of the
+// writer
+func (f *CommitFanout) applyCommits(msgs []redis.XMessage) error {
+	for _, msg := range msgs {
+		seq, sub, err := parseStreamId(msg.ID)
+		if err != nil {
+			return err
+		}
+		kind, tr, reason, err := decodeFanoutEntry(msg)
+		if err != nil {
+			return pe.Wrapf(err, "invalid entry %s", msg.ID)
+		}
+		switch kind {
+		case fanoutKindCommit:
+			if sub != 0 || seq != f.lastSeq+1 {
+				return pe.Wrapf(ErrCommitStreamGap, "entry %s after commit %d", msg.ID, f.lastSeq)
+			}
+			if err := f.applyCommit(tr); err != nil {
+				return pe.Wrapf(err, "replica failed to commit transaction %s", tr.TxID)
+			}
+			f.mu.Lock()
+			f.stats.LastSeq = seq
+			f.mu.Unlock()
+		case fanoutKindRollback:
+			f.conn.GetRollbackedEb().Publish(&db_conn.TransactionRollbackedEvent{
+				Committer:   tr.Committer,
+				Reason:      errors.New(reason),
+				Transaction: tr,
+			})
+		default:
+			return pe.Errorf("entry %s has unknown kind %q", msg.ID, kind)
+		}
+		f.lastSeq, f.lastSub = seq, sub
+		f.mu.Lock()
+		f.stats.Consumed++
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+// applyCommit commits tr to the replica. Inserts of docs the replica already
+// has, applied again after a resync, are merged into them as updates.
+func (f *CommitFanout) applyCommit(tr *db_conn.Transaction) error {
+	ops := make([]db_conn.TransactionOp, 0, len(tr.Operations))
+	for _, op := range tr.Operations {
+		if insert, ok := op.(*db_conn.InsertOp); ok {
+			if _, err := f.conn.LoadDoc(insert.Collection, insert.DocID); err == nil {
+				op = &db_conn.UpdateOp{Collection: insert.Collection, DocID: insert.DocID, Update: insert.Snapshot}
+			}
+		}
+		ops = append(ops, op)
+	}
+	return f.conn.Commit(&db_conn.Transaction{
+		TxID:       tr.TxID,
+		Committer:  tr.Committer,
+		Operations: ops,
+	})
+}
+
+func (f *CommitFanout) fail(where string, err error) {
+	log.Errorf("%s: %v", where, err)
+	f.mu.Lock()
+	f.stats.Failures++
+	f.stats.LastErr = err
+	f.mu.Unlock()
+}
+
+// entryValues returns the fields of the stream entry of tr, kind is empty for
+// the entries of the tx stream
+func (f *CommitFanout) entryValues(kind string, tr *db_conn.Transaction, reason error) (map[string]any, error) {
+	trBytes, err := db_conn.EncodeTransaction(tr)
+	if err != nil {
+		return nil, pe.Wrapf(err, "failed to encode transaction %s", tr.TxID)
+	}
+	values := map[string]any{
+		"origin": f.opts.InstanceId,
+		"tx":     trBytes,
+	}
+	if kind != "" {
+		values["kind"] = kind
+	}
+	if reason != nil {
+		values["reason"] = reason.Error()
+	}
+	return values, nil
+}
+
+func decodeFanoutEntry(msg redis.XMessage) (kind string, tr *db_conn.Transaction, reason string, err error) {
+	trString, ok := msg.Values["tx"].(string)
+	if !ok {
+		return "", nil, "", pe.New("missing transaction")
+	}
+	tr, err = db_conn.DecodeTransaction([]byte(trString))
+	if err != nil {
+		return "", nil, "", err
+	}
+	kind, _ = msg.Values["kind"].(string)
+	reason, _ = msg.Values["reason"].(string)
+	return kind, tr, reason, nil
+}
+
+// streamId returns the id of the entry sub of commit seq in the commit stream
+func streamId(seq, sub uint64) string {
+	return fmt.Sprintf("%d-%d", seq, sub)
+}
+
+func parseStreamId(id string) (seq, sub uint64, err error) {
+	seqString, subString, ok := strings.Cut(id, "-")
+	if ok {
+		seq, err = strconv.ParseUint(seqString, 10, 64)
+	}
+	if ok && err == nil {
+		sub, err = strconv.ParseUint(subString, 10, 64)
+	}
+	if !ok || err != nil {
+		return 0, 0, pe.Errorf("invalid id %q in commit stream", id)
+	}
+	return seq, sub, nil
+}
+
+// isStaleStreamId reports whether XADD failed because the stream already has
+// an entry with the id or a greater one
+func isStaleStreamId(err error) bool {
+	return strings.Contains(err.Error(), "equal or smaller than the target stream top item")
+}
+
+// waitRetry waits before retrying a failed stream operation, returns false if
+// ctx is done first
+func waitRetry(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(commitFanoutRetryDelay):
+		return true
+	}
+}
+
+// CommitFanoutStats returns the statistics of the commit fan-out, ok is false if
+// the fan-out is disabled or the database is not connected
+func (s *Synchronizer) CommitFanoutStats() (stats CommitFanoutStats, ok bool) {
+	if s.managedDb == nil || s.managedDb.commitFanout == nil {
+		return stats, false
+	}
+	return s.managedDb.commitFanout.Stats(), true
+}
+
+// authorizeForwarded checks a transaction forwarded to the writer against the
+// permission rules, with the storage of the writer
+func (s *Synchronizer) authorizeForwarded(tr *db_conn.Transaction) error {
+	if denied := s.authorizeTransaction(tr.Committer, tr); denied != nil {
+		return &PermissionDeniedError{Decision: *denied}
+	}
+	return nil
+}
+
+// commit commits tr to the storage, or forwards it to the writer when the
+// synchronizer is a follower of a commit fan-out
+func (s *Synchronizer) commit(tr *db_conn.Transaction) error {
+	if fanout := s.managedDb.commitFanout; fanout != nil && !fanout.IsWriter() {
+		return fanout.Forward(s.ctx, tr)
+	}
+	return s.managedDb.conn.Commit(tr)
+}
@@ -0,0 +1,278 @@
+package synchronizer2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	pe "github.com/pkg/errors"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/doc_history"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/log"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/message/v1"
+	network_server "github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/network/server"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
+)
+
+var ErrDocVersionNotFound = errors.New("doc version not found")
+
+// PermissionDeniedError is returned when a permission rule rejects a request
+type PermissionDeniedError struct {
+	Decision permission_proxy.Decision
+}
+
+func (e *PermissionDeniedError) Error() string {
+	return fmt.Sprintf("permission denied: %s", e.Decision)
+}
+
+// viewDoc loads the current doc and checks that the client can view it.
+// The history of a doc is visible to the clients that can view the doc now,
+// a deleted doc has no viewable history.
+func (s *Synchronizer) viewDoc(clientId, collection, docId string) (*loro.LoroDoc, permission_proxy.CanViewParams, error) {
+	params := permission_proxy.CanViewParams{
+		Collection: collection,
+		DocId:      docId,
+		ClientId:   clientId,
+		Db: &permission_proxy.DbWrapper{
+			QueryExecutor: s.managedDb.queryExecutor,
+		},
+	}
+	doc, err := s.managedDb.conn.LoadDoc(collection, docId)
+	if err != nil {
+		return nil, params, err
+	}
+	params.Doc = doc
+	decision := s.managedDb.permissionProxy.DecideView(params)
+	if !decision.Allowed {
+		return nil, params, &PermissionDeniedError{Decision: decision}
+	}
+	return doc, params, nil
+}
+
+// docAtSeq returns doc as of the version seq in its history, seq 0 is the empty doc
+func (s *Synchronizer) docAtSeq(doc *loro.LoroDoc, collection, docId string, seq uint64) (*loro.LoroDoc, error) {
+	if seq == 0 {
+		if doc.IsShallow() {
+			return nil, pe.Wrapf(ErrDocVersionNotFound, "history of doc %s/%s was compacted", collection, docId)
+		}
+		return doc_history.DocAt(doc, nil), nil
+	}
+	versions, err := s.managedDb.conn.LoadDocHistory(collection, docId)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		if v.Seq == seq {
+			return doc_history.DocAt(doc, v.Frontiers), nil
+		}
+	}
+	return nil, pe.Wrapf(ErrDocVersionNotFound, "version %d of doc %s/%s", seq, collection, docId)
+}
+
+// readableValue returns the data of doc without the fields the client can't read.
+// The readable fields are decided on the current doc, as when syncing it, but
+// every field with a read rule is checked, since a past version may hold a
+// field that was deleted since. redacted is true when any such field is
+// unreadable, even if doc doesn't hold it, so the caller never hands out
+// the history of doc.
+func (s *Synchronizer) readableValue(doc *loro.LoroDoc, params permission_proxy.CanViewParams) (map[string]any, bool, error) {
+	value, err := doc_history.Value(doc)
+	if err != nil {
+		return nil, false, err
+	}
+	if !s.managedDb.permissionProxy.HasFieldReadRules(params.Collection) {
+		return value, false, nil
+	}
+	fields := s.managedDb.permissionProxy.UnreadableRuleFields(params)
+	permission_proxy.RedactValue(value, fields)
+	return value, len(fields) > 0, nil
+}
+
+// DocHistory returns the versions of a doc the client can view, oldest first
+func (s *Synchronizer) DocHistory(clientId, collection, docId string) ([]*db_conn.DocVersion, error) {
+	if _, _, err := s.viewDoc(clientId, collection, docId); err != nil {
+		return nil, err
+	}
+	return s.managedDb.conn.LoadDocHistory(collection, docId)
+}
+
+// DocAtVersion returns the snapshot of a doc as of the version seq.
+//
+// If the client can't read some fields, the snapshot is built from the
+// readable fields and shares no history with the doc, see
+// permission_proxy.Permissions.RedactedSnapshot
+func (s *Synchronizer) DocAtVersion(clientId, collection, docId string, seq uint64) ([]byte, error) {
+	doc, params, err := s.viewDoc(clientId, collection, docId)
+	if err != nil {
+		return nil, err
+	}
+	past, err := s.docAtSeq(doc, collection, docId, seq)
+	if err != nil {
+		return nil, err
+	}
+	value, redacted, err := s.readableValue(past, params)
+	if err != nil {
+		return nil, err
+	}
+	if !redacted {
+		return past.ExportSnapshot().Bytes(), nil
+	}
+	redactedDoc, err := doc_history.FromValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return redactedDoc.ExportSnapshot().Bytes(), nil
+}
+
+// DiffDocVersions returns the JSON patch from the version fromSeq of a doc to
+// the version toSeq, fields the client can't read are left out
+func (s *Synchronizer) DiffDocVersions(clientId, collection, docId string, fromSeq, toSeq uint64) ([]doc_history.PatchOp, error) {
+	doc, params, err := s.viewDoc(clientId, collection, docId)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]map[string]any, 0, 2)
+	for _, seq := range []uint64{fromSeq, toSeq} {
+		past, err := s.docAtSeq(doc, collection, docId, seq)
+		if err != nil {
+			return nil, err
+		}
+		value, _, err := s.readableValue(past, params)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return doc_history.Diff(values[0], values[1]), nil
+}
+
+// RestoreDocVersion restores the data of a doc to the version seq by committing
+// an update in the transaction txId. The client must be allowed to view the doc
+// and to update it to the restored value.
+//
+// The result of the commit is reported to the client like any other transaction
+func (s *Synchronizer) RestoreDocVersion(clientId, txId, collection, docId string, seq uint64) error {
+	tr, err := s.restoreTransaction(clientId, txId, collection, docId, seq)
+	if err != nil {
+		return err
+	}
+	return s.commit(tr)
+}
+
+// restoreTransaction returns the authorized transaction of RestoreDocVersion
+func (s *Synchronizer) restoreTransaction(clientId, txId, collection, docId string, seq uint64) (*db_conn.Transaction, error) {
+	doc, _, err := s.viewDoc(clientId, collection, docId)
+	if err != nil {
+		return nil, err
+	}
+	past, err := s.docAtSeq(doc, collection, docId, seq)
+	if err != nil {
+		return nil, err
+	}
+	update, restored, err := doc_history.RestoreUpdate(doc, past)
+	if err != nil {
+		return nil, err
+	}
+	decision := s.managedDb.permissionProxy.DecideUpdate(permission_proxy.CanUpdateParams{
+		Collection: collection,
+		DocId:      docId,
+		NewDoc:     restored,
+		OldDoc:     doc,
+		ClientId:   clientId,
+		Db: &permission_proxy.DbWrapper{
+			QueryExecutor: s.managedDb.queryExecutor,
+			HostCalls:     permission_proxy.NewHostCallCache(),
+		},
+	})
+	if !decision.Allowed {
+		return nil, &PermissionDeniedError{Decision: decision}
+	}
+	return &db_conn.Transaction{
+		TxID:      txId,
+		Committer: clientId,
+		Operations: []db_conn.TransactionOp{
+			&db_conn.UpdateOp{
+				Collection: collection,
+				DocID:      docId,
+				Update:     update,
+			},
+		},
+	}, nil
+}
+
+// handleDocHistoryMessage answers a DocHistoryMessageV1. Restores are answered
+// by the ack or failure of the restore transaction instead of a response.
+func (s *Synchronizer) handleDocHistoryMessage(clientId string, msg *message.DocHistoryMessageV1) {
+	if msg.Action == message.DOC_HISTORY_RESTORE {
+		tr, err := s.restoreTransaction(clientId, msg.RequestId, msg.Collection, msg.DocId, msg.Seq)
+		var denied *PermissionDeniedError
+		switch {
+		case err == nil:
+			// the ack or the failure is sent when the committed / rollbacked event is handled
+			s.commit(tr)
+			return
+		case errors.As(err, &denied):
+			log.Warnf("Synchronizer.handleDocHistoryMessage: Restore %s of client %s failed to pass authorization: %s", msg.RequestId, clientId, denied.Decision)
+			err = sendTransactionDeniedMessage(s.network, clientId, msg.RequestId, denied.Decision)
+		default:
+			log.Infof("Synchronizer.handleDocHistoryMessage: Restore %s of client %s failed: %v", msg.RequestId, clientId, err)
+			err = sendTransactionFailedMessage(s.network, clientId, msg.RequestId, err)
+		}
+		if err != nil {
+			log.Errorf("Synchronizer.handleDocHistoryMessage: Failed to send transaction failed message to client %s: %v", clientId, err)
+		}
+		return
+	}
+
+	resp := &message.DocHistoryRespMessageV1{RequestId: msg.RequestId}
+	var err error
+	switch msg.Action {
+	case message.DOC_HISTORY_LIST:
+		var versions []*db_conn.DocVersion
+		versions, err = s.DocHistory(clientId, msg.Collection, msg.DocId)
+		for _, v := range versions {
+			resp.Versions = append(resp.Versions, message.DocVersionV1{
+				Seq:       v.Seq,
+				Frontiers: v.Frontiers,
+				TxID:      v.TxID,
+				Committer: v.Committer,
+				Timestamp: v.Timestamp,
+			})
+		}
+	case message.DOC_HISTORY_READ:
+		resp.Snapshot, err = s.DocAtVersion(clientId, msg.Collection, msg.DocId, msg.Seq)
+	case message.DOC_HISTORY_DIFF:
+		var ops []doc_history.PatchOp
+		ops, err = s.DiffDocVersions(clientId, msg.Collection, msg.DocId, msg.FromSeq, msg.Seq)
+		if err == nil {
+			resp.Patch, err = json.Marshal(ops)
+		}
+	default:
+		err = pe.Errorf("unknown doc history action %d", msg.Action)
+	}
+	if err != nil {
+		log.Infof("Synchronizer.handleDocHistoryMessage: Request %s of client %s failed: %v", msg.RequestId, clientId, err)
+		resp = &message.DocHistoryRespMessageV1{
+			RequestId: msg.RequestId,
+			Error:     err.Error(),
+		}
+		var denied *PermissionDeniedError
+		if errors.As(err, &denied) {
+			resp.Denial = newPermissionDenial(denied.Decision)
+		}
+	}
+	if err := sendDocHistoryRespMessage(s.network, clientId, resp); err != nil {
+		log.Errorf("Synchronizer.handleDocHistoryMessage: Failed to send doc history response to client %s: %v", clientId, err)
+	}
+}
+
+func sendDocHistoryRespMessage(network network_server.NetworkProvider, clientId string, resp *message.DocHistoryRespMessageV1) error {
+	respBytes, err := resp.Encode()
+	if err != nil {
+		return pe.Errorf("failed to encode doc history response message: %v", err)
+	}
+	network.Send(clientId, respBytes)
+	return nil
+}
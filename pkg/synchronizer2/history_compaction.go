@@ -0,0 +1,30 @@
+package synchronizer2
+
+import (
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+)
+
+// HistoryCompactionStats returns the statistics of the history compaction, ok
+// is false if the compaction is disabled or the database is not connected
+func (s *Synchronizer) HistoryCompactionStats() (stats db_conn.JobStats, ok bool) {
+	if s.managedDb == nil || s.managedDb.historyCompactor == nil {
+		return stats, false
+	}
+	return s.managedDb.historyCompactor.Stats(), true
+}
+
+// predatesShallowRoot reports whether the version vv of a client misses some
+// history that was dropped by a compaction of doc, so the updates from vv
+// can't be exported
+func predatesShallowRoot(doc *loro.LoroDoc, vv *loro.VersionVector) bool {
+	if !doc.IsShallow() {
+		return false
+	}
+	switch vv.PartialCompare(doc.ShallowSinceVv()) {
+	case loro.PartialOrderGt, loro.PartialOrderEq:
+		return false
+	default:
+		return true
+	}
+}
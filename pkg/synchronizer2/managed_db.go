@@ -6,6 +6,7 @@ import (
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query_executor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query_validator"
 )
 
 type ManagedDb struct {
@@ -17,4 +18,13 @@ type ManagedDb struct {
 	queryExecutor   *query_executor.QueryExecutor
 	permissionProxy *permission_proxy.PermissionProxy
 	queryManager    *QueryManager
+	queryValidator  *query_validator.QueryValidator
+	// nil if the tombstone GC is disabled or the connection is read-only
+	tombstoneGc *db_conn.TombstoneGc
+	// nil on read-only connections
+	ttlSweeper *db_conn.TtlSweeper
+	// nil if the history compaction is disabled or the connection is read-only
+	historyCompactor *db_conn.HistoryCompactor
+	// nil if the commit fan-out is disabled
+	commitFanout *CommitFanout
 }
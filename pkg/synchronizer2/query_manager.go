@@ -5,9 +5,15 @@ import (
 
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/eventreduce"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/log"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query"
+	qfe "github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/query_filter_expr"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query_executor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	pe "github.com/pkg/errors"
 )
 
 // QueryManager is responsible for managing all the queries subscribed by clients
@@ -16,23 +22,55 @@ import (
 // listening to the incoming transactions, using the EventReduce algorithm to
 // calculate the Action to take for updating the result set, and then executing
 // the ActionFunction to update the result set.
+//
+// Queries are deduplicated by their StableStringify hash: all clients subscribing
+// the same query share one ListeningQuery, so the query is executed and maintained
+// only once. Permissions are applied per client when the updates of a shared query
+// are fanned out to its subscribers.
+//
+// Before a query is shared, the view filter derived from the canView rule of the
+// client (see Permissions.ViewFilter) is AND-ed into its filter, so the query
+// executor only returns docs the client may view, and Limit counts these docs
+// only. Clients with the same view filter still share the rewritten query.
 type QueryManager struct {
+	// Listening queries shared by all subscribers
+	// queryHash -> query
+	queries map[string]*sharedListeningQuery
 	// Queries subscribed by each client
-	// clientId -> queryHash -> query
-	subscriptions   map[string]map[string]query.ListeningQuery
+	// clientId -> hash of the subscribed query -> hash of the shared query,
+	// they differ when the view filter of the client is AND-ed into the query
+	subscriptions map[string]map[string]string
+	// Listening queries that may be affected by ops on each collection,
+	// including the collections joined by lookups
+	// collection -> queryHash -> query
+	byCollection    map[string]map[string]*sharedListeningQuery
 	queryExecutor   *query_executor.QueryExecutor
 	permissionProxy *permission_proxy.PermissionProxy
 	eventReducer    eventreduce.EventReducer
-	mu              sync.RWMutex // Protect concurrent access to subscriptions
+	// Redacted snapshots last sent to each client, see redactedCopies
+	redactedCopies *redactedCopies
+	mu             sync.RWMutex // Protect concurrent access to queries and subscriptions
+}
+
+// sharedListeningQuery is a ListeningQuery shared by all clients subscribing the same query
+type sharedListeningQuery struct {
+	hash string
+	lq   query.ListeningQuery
+	// Clients subscribing this query, the size of the set is the reference count
+	// of the query, the query is dropped when it reaches zero
+	subscribers map[string]struct{}
 }
 
 // NewQueryManager creates and returns a new QueryManager instance
 func NewQueryManager(queryExecutor *query_executor.QueryExecutor, permissionProxy *permission_proxy.PermissionProxy) *QueryManager {
 	return &QueryManager{
-		subscriptions:   make(map[string]map[string]query.ListeningQuery),
+		queries:         make(map[string]*sharedListeningQuery),
+		subscriptions:   make(map[string]map[string]string),
+		byCollection:    make(map[string]map[string]*sharedListeningQuery),
 		queryExecutor:   queryExecutor,
 		permissionProxy: permissionProxy,
 		eventReducer:    eventreduce.GetEventReducer(),
+		redactedCopies:  newRedactedCopies(),
 		mu:              sync.RWMutex{},
 	}
 }
@@ -55,10 +93,15 @@ func (m *QueryManager) createListeningQuery(q query.Query) (query.ListeningQuery
 		if err != nil {
 			return nil, err
 		}
+		lookupRes, err := m.queryExecutor.Lookup(q, res)
+		if err != nil {
+			return nil, err
+		}
 		return &query.FindManyListeningQuery{
-			Query:  q,
-			Error:  nil,
-			Result: res,
+			Query:        q,
+			Error:        nil,
+			Result:       res,
+			LookupResult: lookupRes,
 		}, nil
 	default:
 		panic("unknown query type")
@@ -66,35 +109,100 @@ func (m *QueryManager) createListeningQuery(q query.Query) (query.ListeningQuery
 }
 
 // SubscribeNewQuery subscribes to a new query
+//
+// If another client has already subscribed the same query, the existing
+// ListeningQuery is reused instead of executing the query again
 func (s *QueryManager) SubscribeNewQuery(clientId string, newQuery query.Query) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	queryHash, err := query.StableStringify(newQuery)
+	if err != nil {
+		return err
+	}
+
 	ss, ok := s.subscriptions[clientId]
 	if !ok {
-		ss = make(map[string]query.ListeningQuery)
+		ss = make(map[string]string)
 		s.subscriptions[clientId] = ss
 	}
+	if _, subscribed := ss[queryHash]; subscribed {
+		return nil
+	}
 
-	queryHash, err := query.StableStringify(newQuery)
+	sharedQuery := s.withViewFilter(clientId, newQuery)
+	sharedHash, err := query.StableStringify(sharedQuery)
 	if err != nil {
 		return err
 	}
 
-	lq, err := s.createListeningQuery(newQuery)
-	if err != nil {
-		return err
+	sq, ok := s.queries[sharedHash]
+	if !ok {
+		lq, err := s.createListeningQuery(sharedQuery)
+		if err != nil {
+			return err
+		}
+		sq = &sharedListeningQuery{
+			hash:        sharedHash,
+			lq:          lq,
+			subscribers: make(map[string]struct{}),
+		}
+		s.queries[sharedHash] = sq
+		for _, collection := range getQueryCollections(lq) {
+			qs, ok := s.byCollection[collection]
+			if !ok {
+				qs = make(map[string]*sharedListeningQuery)
+				s.byCollection[collection] = qs
+			}
+			qs[sharedHash] = sq
+		}
 	}
-	ss[queryHash] = lq
 
+	sq.subscribers[clientId] = struct{}{}
+	ss[queryHash] = sharedHash
 	return nil
 }
 
+// withViewFilter returns q with the view filter of the client on the collection
+// of q AND-ed into its filter, or q itself if no view filter can be derived
+func (s *QueryManager) withViewFilter(clientId string, q query.Query) query.Query {
+	switch q := q.(type) {
+	case *query.FindOneQuery:
+		viewFilter := s.permissionProxy.ViewFilter(q.Collection, clientId)
+		if viewFilter == nil {
+			return q
+		}
+		filtered := *q
+		filtered.Filter = andFilter(viewFilter, q.Filter)
+		return &filtered
+	case *query.FindManyQuery:
+		viewFilter := s.permissionProxy.ViewFilter(q.Collection, clientId)
+		if viewFilter == nil {
+			return q
+		}
+		filtered := *q
+		filtered.Filter = andFilter(viewFilter, q.Filter)
+		return &filtered
+	default:
+		return q
+	}
+}
+
+func andFilter(viewFilter qfe.QueryFilterExpr, filter qfe.QueryFilterExpr) qfe.QueryFilterExpr {
+	if filter == nil {
+		return viewFilter
+	}
+	return qfe.NewAndExpr([]qfe.QueryFilterExpr{viewFilter, filter})
+}
+
 // RemoveAllSubscriptedQueries removes all the query subscriptions for the specified client
 func (s *QueryManager) RemoveAllSubscriptedQueries(clientId string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	for _, sharedHash := range s.subscriptions[clientId] {
+		s.unsubscribe(clientId, sharedHash)
+	}
 	delete(s.subscriptions, clientId)
 }
 
@@ -109,11 +217,38 @@ func (s *QueryManager) RemoveSubscriptedQuery(clientId string, q query.Query) er
 	}
 
 	if clientMap, ok := s.subscriptions[clientId]; ok {
-		delete(clientMap, queryHash)
+		if sharedHash, subscribed := clientMap[queryHash]; subscribed {
+			s.unsubscribe(clientId, sharedHash)
+			delete(clientMap, queryHash)
+		}
 	}
 	return nil
 }
 
+// unsubscribe removes clientId from the subscribers of the shared query,
+// and drops the query when no client subscribes it anymore.
+// The caller must hold s.mu and remove the query from s.subscriptions[clientId]
+func (s *QueryManager) unsubscribe(clientId string, queryHash string) {
+	sq, ok := s.queries[queryHash]
+	if !ok {
+		return
+	}
+	delete(sq.subscribers, clientId)
+	if len(sq.subscribers) > 0 {
+		return
+	}
+
+	delete(s.queries, queryHash)
+	for _, collection := range getQueryCollections(sq.lq) {
+		if qs, ok := s.byCollection[collection]; ok {
+			delete(qs, queryHash)
+			if len(qs) == 0 {
+				delete(s.byCollection, collection)
+			}
+		}
+	}
+}
+
 // CheckSubscriptedQuery checks if the specified client has subscribed to the given query
 func (a *QueryManager) CheckSubscriptedQuery(clientId string, q query.Query) (bool, error) {
 	a.mu.RLock()
@@ -128,7 +263,57 @@ func (a *QueryManager) CheckSubscriptedQuery(clientId string, q query.Query) (bo
 	if !ok {
 		return false, nil
 	}
-	return clientMap[queryHash] != nil, nil
+	_, subscribed := clientMap[queryHash]
+	return subscribed, nil
+}
+
+// ViewableDocKeys returns the keys of the docs in the cached result of q
+// (including the joined docs) that the client is allowed to view
+//
+// q must be subscribed by the client
+func (a *QueryManager) ViewableDocKeys(clientId string, q query.Query) (map[string]struct{}, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	queryHash, err := query.StableStringify(q)
+	if err != nil {
+		return nil, err
+	}
+	sharedHash, ok := a.subscriptions[clientId][queryHash]
+	if !ok {
+		return nil, pe.Errorf("query %s is not subscribed", q.DebugSprint())
+	}
+	sq := a.queries[sharedHash]
+
+	collection := getQueryCollection(sq.lq)
+	var docs []*query.DocWithId
+	switch lq := sq.lq.(type) {
+	case *query.FindOneListeningQuery:
+		if lq.Result != nil {
+			docs = append(docs, lq.Result)
+		}
+	case *query.FindManyListeningQuery:
+		docs = lq.Result
+	}
+
+	ret := make(map[string]struct{}, len(docs))
+	for _, doc := range docs {
+		if !a.canView(clientId, collection, doc) {
+			continue
+		}
+		docKey, err := key_utils.CalcDocKey(collection, doc.DocId)
+		if err != nil {
+			return nil, err
+		}
+		ret[string(docKey)] = struct{}{}
+	}
+
+	if lq, ok := sq.lq.(*query.FindManyListeningQuery); ok {
+		for docKey := range a.ViewableLookupDocs(clientId, lq.Query, lq.LookupResult) {
+			ret[docKey] = struct{}{}
+		}
+	}
+	return ret, nil
 }
 
 type ClientUpdates struct {
@@ -136,42 +321,429 @@ type ClientUpdates struct {
 	Deletes map[string]struct{}
 }
 
+func newClientUpdates() *ClientUpdates {
+	return &ClientUpdates{
+		Updates: make(map[string][]byte),
+		Deletes: make(map[string]struct{}),
+	}
+}
+
 func (cu *ClientUpdates) IsEmpty() bool {
 	return len(cu.Updates) == 0 && len(cu.Deletes) == 0
 }
 
+// HandleTransaction updates the results of all listening queries affected by txn,
+// and returns the updates each client should see
+//
+// Each op only visits the queries on its collection (or joining its collection),
+// and each shared query is updated once no matter how many clients subscribe it
 func (a *QueryManager) HandleTransaction(txn *db_conn.Transaction) map[string]*ClientUpdates {
-	a.mu.RLock()
-	defer a.mu.RUnlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
 	cu := make(map[string]*ClientUpdates)
 	for _, op := range txn.Operations {
-		for clientId, queries := range a.subscriptions {
-			clientUpdates, ok := cu[clientId]
-			if !ok {
-				clientUpdates = &ClientUpdates{
-					Updates: make(map[string][]byte),
-					Deletes: make(map[string]struct{}),
-				}
-				cu[clientId] = clientUpdates
+		opCollection := getCollection(op)
+		cache := newCanViewCache(op)
+		for _, sq := range a.byCollection[opCollection] {
+			a.handleOp(sq, op, opCollection, cache, cu)
+		}
+	}
+	for clientId, clientUpdates := range cu {
+		a.redactUpdates(clientId, clientUpdates)
+	}
+	return cu
+}
+
+// redactUpdates replaces the updates of docs with fields the client can't read
+// by redacted snapshots, see PermissionProxy.RedactedSnapshot
+//
+// A redacted snapshot shares no history with the stored doc, so an incremental
+// update can't be applied on top of it, the doc is always sent as a whole instead.
+// The snapshot is recorded as the base of the client's next edits on the doc,
+// see Synchronizer.mergeRedactedUpdates
+func (a *QueryManager) redactUpdates(clientId string, clientUpdates *ClientUpdates) {
+	for docKey := range clientUpdates.Updates {
+		docKeyBytes := util.String2Bytes(docKey)
+		collection, err := key_utils.GetCollectionNameFromKey(docKeyBytes)
+		if err != nil || !a.permissionProxy.HasFieldReadRules(collection) {
+			continue
+		}
+		docId, err := key_utils.GetDocIdFromKey(docKeyBytes)
+		if err != nil {
+			delete(clientUpdates.Updates, docKey)
+			continue
+		}
+		doc, err := a.queryExecutor.FindOneById(collection, docId)
+		if err != nil || doc == nil {
+			log.Warnf("QueryManager.redactUpdates: failed to load doc %s/%s: %v", collection, docId, err)
+			delete(clientUpdates.Updates, docKey)
+			continue
+		}
+		snapshot, redacted, err := a.permissionProxy.RedactedSnapshot(a.canViewParams(clientId, collection, doc))
+		if err != nil {
+			log.Warnf("QueryManager.redactUpdates: failed to redact doc %s/%s: %v", collection, docId, err)
+			delete(clientUpdates.Updates, docKey)
+			continue
+		}
+		if redacted {
+			clientUpdates.Updates[docKey] = snapshot
+			a.redactedCopies.set(clientId, docKey, snapshot)
+		} else {
+			a.redactedCopies.delete(clientId, docKey)
+		}
+	}
+}
+
+// handleOp applies op to the shared query sq, and writes the changes visible
+// to each subscriber of sq into cu. cache is shared by all queries op is applied to
+func (a *QueryManager) handleOp(sq *sharedListeningQuery, op db_conn.TransactionOp, opCollection string, cache *canViewCache, cu map[string]*ClientUpdates) {
+	getClientUpdates := func(clientId string) *ClientUpdates {
+		clientUpdates, ok := cu[clientId]
+		if !ok {
+			clientUpdates = newClientUpdates()
+			cu[clientId] = clientUpdates
+		}
+		return clientUpdates
+	}
+
+	// the joined docs may change when either side of the lookup changes,
+	// so remember what each subscriber could see before op is applied
+	fmlq, isFindMany := sq.lq.(*query.FindManyListeningQuery)
+	lookupAffected := isFindMany && isLookupAffected(fmlq, opCollection)
+	var prevLookupDocs map[string]map[string]*query.DocWithId
+	if lookupAffected {
+		prevLookupDocs = make(map[string]map[string]*query.DocWithId, len(sq.subscribers))
+		for clientId := range sq.subscribers {
+			prevLookupDocs[clientId] = a.viewableLookupDocs(clientId, fmlq.Query, fmlq.LookupResult, cache)
+		}
+	}
+
+	if getQueryCollection(sq.lq) == opCollection {
+		// a delete is only sent to clients that have received the doc,
+		// i.e. the doc was in the result and viewable before op is applied
+		prevViewers := a.resultDocViewers(sq, getDocId(op))
+
+		queryUpdates := newClientUpdates()
+		in := ActionFunctionInput{
+			permissions:    a.permissionProxy,
+			listeningQuery: sq.lq,
+			op:             op,
+			clientUpdates:  queryUpdates,
+			queryExecutor:  a.queryExecutor,
+		}
+		// Use the EventReduce algorithm to calculate the Action to take for updating the result set
+		action := a.eventReducer.Reduce(sq.lq, op)
+		// Get the corresponding ActionFunction based on the Action
+		actionFunc := GetActionFunction(action)
+		// Execute the ActionFunction
+		actionFunc(in)
+
+		if !queryUpdates.IsEmpty() {
+			for clientId := range sq.subscribers {
+				_, received := prevViewers[clientId]
+				a.mergeViewableUpdates(clientId, sq.lq, op, received, queryUpdates, getClientUpdates(clientId))
 			}
+		}
+	}
+
+	if lookupAffected {
+		lookupRes, err := a.updateLookups(fmlq, opCollection)
+		if err != nil {
+			log.Warnf("QueryManager.handleOp: failed to execute lookups of %s: %v", fmlq.Query.DebugSprint(), err)
+			return
+		}
+		fmlq.LookupResult = lookupRes
+		for clientId := range sq.subscribers {
+			currDocs := a.viewableLookupDocs(clientId, fmlq.Query, lookupRes, cache)
+			diffLookupDocs(op, prevLookupDocs[clientId], currDocs, getClientUpdates(clientId))
+		}
+	}
+}
+
+// updateLookups returns the lookup result of fmlq after an op on opCollection
+// is applied. The op may change the local values of all lookups if it's on the
+// collection of the query, otherwise only the lookups joining opCollection
+// are executed again
+func (a *QueryManager) updateLookups(fmlq *query.FindManyListeningQuery, opCollection string) (query.LookupResult, error) {
+	lookupRes := make(query.LookupResult, len(fmlq.Query.Lookups))
+	for i, lookup := range fmlq.Query.Lookups {
+		if fmlq.Query.Collection != opCollection && lookup.From != opCollection && i < len(fmlq.LookupResult) {
+			lookupRes[i] = fmlq.LookupResult[i]
+			continue
+		}
+		joined, err := a.queryExecutor.LookupAt(fmlq.Query, i, fmlq.Result)
+		if err != nil {
+			return nil, err
+		}
+		lookupRes[i] = joined
+	}
+	return lookupRes, nil
+}
+
+// canViewCache caches the canView decisions made while one op is handled, so
+// a doc joined by many queries is checked once for each client. The doc
+// changed by the op is never cached, whether it can be viewed differs before
+// and after the op is applied
+type canViewCache struct {
+	opKey   string
+	allowed map[canViewCacheKey]bool
+}
 
-			for _, lq := range queries {
-				// Use the EventReduce algorithm to calculate the Action to take for updating the result set
-				action := a.eventReducer.Reduce(lq, op)
-				// Get the corresponding ActionFunction based on the Action
-				actionFunc := GetActionFunction(action)
-				// Execute the ActionFunction
-				actionFunc(ActionFunctionInput{
-					clientId:       clientId,
-					permissions:    a.permissionProxy,
-					listeningQuery: lq,
-					op:             op,
-					clientUpdates:  clientUpdates,
-					queryExecutor:  a.queryExecutor,
-				})
+type canViewCacheKey struct {
+	clientId string
+	docKey   string
+}
+
+func newCanViewCache(op db_conn.TransactionOp) *canViewCache {
+	opKey, err := key_utils.CalcDocKey(getCollection(op), getDocId(op))
+	if err != nil {
+		// nothing is cached without knowing which doc op changes
+		return nil
+	}
+	return &canViewCache{
+		opKey:   string(opKey),
+		allowed: make(map[canViewCacheKey]bool),
+	}
+}
+
+// canViewCached is canView with the decision cached in cache, cache may be nil
+func (a *QueryManager) canViewCached(cache *canViewCache, clientId string, collection string, docKey string, doc *query.DocWithId) bool {
+	if cache == nil || docKey == cache.opKey {
+		return a.canView(clientId, collection, doc)
+	}
+	key := canViewCacheKey{clientId: clientId, docKey: docKey}
+	if allowed, ok := cache.allowed[key]; ok {
+		return allowed
+	}
+	allowed := a.canView(clientId, collection, doc)
+	cache.allowed[key] = allowed
+	return allowed
+}
+
+// resultDocViewers returns the subscribers of sq that can view the doc docId
+// in the current result of sq, it's empty if the doc is not in the result
+func (a *QueryManager) resultDocViewers(sq *sharedListeningQuery, docId string) map[string]struct{} {
+	doc := findResultDoc(sq.lq, docId)
+	if doc == nil {
+		return nil
+	}
+	collection := getQueryCollection(sq.lq)
+	viewers := make(map[string]struct{}, len(sq.subscribers))
+	for clientId := range sq.subscribers {
+		if a.canView(clientId, collection, doc) {
+			viewers[clientId] = struct{}{}
+		}
+	}
+	return viewers
+}
+
+// mergeViewableUpdates merges the updates of a shared query into the updates of
+// a subscriber, the doc changed by op is skipped if the client can't view it.
+// received tells whether the client has received the doc before op, deletes
+// are dropped otherwise, so they never reveal docs the client can't view
+func (a *QueryManager) mergeViewableUpdates(clientId string, lq query.ListeningQuery, op db_conn.TransactionOp, received bool, src *ClientUpdates, dst *ClientUpdates) {
+	// 删除操作具有最高优先级
+	if received {
+		for docKey := range src.Deletes {
+			delete(dst.Updates, docKey)
+			dst.Deletes[docKey] = struct{}{}
+		}
+	}
+
+	if len(src.Updates) == 0 || !a.canViewOpDoc(clientId, lq, op) {
+		return
+	}
+	_, isUpdateOp := op.(*db_conn.UpdateOp)
+	for docKey, update := range src.Updates {
+		if isUpdateOp {
+			// 如果该键已在删除集合中，则不应再更新它
+			if _, deleted := dst.Deletes[docKey]; deleted {
+				continue
 			}
+		} else {
+			delete(dst.Deletes, docKey)
 		}
+		dst.Updates[docKey] = update
+	}
+}
+
+// canViewOpDoc checks if the client can view the doc changed by op,
+// the doc is taken from the result of lq if it's still in the result
+func (a *QueryManager) canViewOpDoc(clientId string, lq query.ListeningQuery, op db_conn.TransactionOp) bool {
+	collection := getQueryCollection(lq)
+	docId := getDocId(op)
+
+	doc := findResultDoc(lq, docId)
+	if doc == nil {
+		if insertOp, ok := op.(*db_conn.InsertOp); ok {
+			loroDoc := loro.NewLoroDoc()
+			if _, err := loroDoc.Import(insertOp.Snapshot); err != nil {
+				return false
+			}
+			doc = &query.DocWithId{DocId: docId, Doc: loroDoc}
+		} else {
+			// the doc has been removed from the result by op
+			res, err := a.queryExecutor.FindOneById(collection, docId)
+			if err != nil || res == nil {
+				return false
+			}
+			doc = res
+		}
+	}
+	return a.canView(clientId, collection, doc)
+}
+
+func (a *QueryManager) canView(clientId string, collection string, doc *query.DocWithId) bool {
+	return a.permissionProxy.CanView(a.canViewParams(clientId, collection, doc))
+}
+
+func (a *QueryManager) canViewParams(clientId string, collection string, doc *query.DocWithId) permission_proxy.CanViewParams {
+	return permission_proxy.CanViewParams{
+		Collection: collection,
+		DocId:      doc.DocId,
+		Doc:        doc.Doc,
+		ClientId:   clientId,
+		Db: &permission_proxy.DbWrapper{
+			QueryExecutor: a.queryExecutor,
+		},
+	}
+}
+
+// ViewableLookupDocs returns the joined docs in lookupResult that the client is allowed to view,
+// keyed by doc key
+func (a *QueryManager) ViewableLookupDocs(clientId string, q *query.FindManyQuery, lookupResult query.LookupResult) map[string]*query.DocWithId {
+	return a.viewableLookupDocs(clientId, q, lookupResult, nil)
+}
+
+func (a *QueryManager) viewableLookupDocs(clientId string, q *query.FindManyQuery, lookupResult query.LookupResult, cache *canViewCache) map[string]*query.DocWithId {
+	ret := make(map[string]*query.DocWithId)
+	for i, docs := range lookupResult {
+		collection := q.Lookups[i].From
+		for _, doc := range docs {
+			docKey, err := key_utils.CalcDocKey(collection, doc.DocId)
+			if err != nil {
+				log.Warnf("QueryManager.ViewableLookupDocs: failed to calc doc key for %s.%s: %v", collection, doc.DocId, err)
+				continue
+			}
+			if _, ok := ret[string(docKey)]; ok {
+				continue
+			}
+			if a.canViewCached(cache, clientId, collection, string(docKey), doc) {
+				ret[string(docKey)] = doc
+			}
+		}
+	}
+	return ret
+}
+
+// diffLookupDocs writes the changes between the joined docs visible to a client
+// before (prevDocs) and after (currDocs) op is applied into clientUpdates
+//
+//   - docs newly joined are sent as full snapshots, because the client may not have them
+//   - docs still joined and modified by op are sent as op itself
+//   - docs deleted by op are sent as deletes
+func diffLookupDocs(op db_conn.TransactionOp, prevDocs, currDocs map[string]*query.DocWithId, clientUpdates *ClientUpdates) {
+	opKey, err := key_utils.CalcDocKey(getCollection(op), getDocId(op))
+	if err != nil {
+		log.Warnf("QueryManager.diffLookupDocs: failed to calc doc key: %v", err)
+		return
+	}
+
+	for docKey, doc := range currDocs {
+		if _, existed := prevDocs[docKey]; !existed {
+			delete(clientUpdates.Deletes, docKey)
+			clientUpdates.Updates[docKey] = doc.Doc.ExportSnapshot().Bytes()
+			continue
+		}
+		if docKey != string(opKey) {
+			continue
+		}
+		switch op := op.(type) {
+		case *db_conn.InsertOp:
+			clientUpdates.Updates[docKey] = op.Snapshot
+		case *db_conn.UpdateOp:
+			if _, deleted := clientUpdates.Deletes[docKey]; !deleted {
+				clientUpdates.Updates[docKey] = op.Update
+			}
+		}
+	}
+
+	if _, isDelete := op.(*db_conn.DeleteOp); isDelete {
+		if _, existed := prevDocs[string(opKey)]; existed {
+			delete(clientUpdates.Updates, string(opKey))
+			clientUpdates.Deletes[string(opKey)] = struct{}{}
+		}
+	}
+}
+
+// isLookupAffected checks if an op on collection may change the joined docs of lq
+func isLookupAffected(lq *query.FindManyListeningQuery, collection string) bool {
+	if len(lq.Query.Lookups) == 0 {
+		return false
+	}
+	if lq.Query.Collection == collection {
+		return true
+	}
+	for _, c := range lq.Query.LookupCollections() {
+		if c == collection {
+			return true
+		}
+	}
+	return false
+}
+
+func getQueryCollection(lq query.ListeningQuery) string {
+	switch lq := lq.(type) {
+	case *query.FindManyListeningQuery:
+		return lq.Query.Collection
+	case *query.FindOneListeningQuery:
+		return lq.Query.Collection
+	default:
+		panic("unexpected listening query")
+	}
+}
+
+// getQueryCollections returns the collections whose ops may affect lq,
+// i.e. the collection of the query and the collections joined by its lookups
+func getQueryCollections(lq query.ListeningQuery) []string {
+	collections := []string{getQueryCollection(lq)}
+	if fmlq, ok := lq.(*query.FindManyListeningQuery); ok {
+		for _, c := range fmlq.Query.LookupCollections() {
+			if c != collections[0] {
+				collections = append(collections, c)
+			}
+		}
+	}
+	return collections
+}
+
+// findResultDoc returns the doc with docId in the result of lq, or nil if not found
+func findResultDoc(lq query.ListeningQuery, docId string) *query.DocWithId {
+	switch lq := lq.(type) {
+	case *query.FindOneListeningQuery:
+		if lq.Result != nil && lq.Result.DocId == docId {
+			return lq.Result
+		}
+	case *query.FindManyListeningQuery:
+		for _, doc := range lq.Result {
+			if doc.DocId == docId {
+				return doc
+			}
+		}
+	}
+	return nil
+}
+
+func getCollection(op db_conn.TransactionOp) string {
+	switch op := op.(type) {
+	case *db_conn.InsertOp:
+		return op.Collection
+	case *db_conn.UpdateOp:
+		return op.Collection
+	case *db_conn.DeleteOp:
+		return op.Collection
+	default:
+		panic("unexpected operation")
 	}
-	return cu
 }
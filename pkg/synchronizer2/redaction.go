@@ -0,0 +1,213 @@
+package synchronizer2
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+)
+
+// redactedCopies keeps the last redacted snapshot sent to each client for each
+// doc, which is the base the client's edits on the doc are made on
+//
+// A redacted copy shares no history with the stored doc (see
+// PermissionProxy.RedactedSnapshot), so an update made on it can only be read
+// against the copy itself, see Synchronizer.mergeRedactedUpdates
+type redactedCopies struct {
+	// clientId -> doc key -> snapshot
+	copies map[string]map[string][]byte
+	mu     sync.Mutex
+}
+
+func newRedactedCopies() *redactedCopies {
+	return &redactedCopies{
+		copies: make(map[string]map[string][]byte),
+	}
+}
+
+// set records that snapshot, a redacted copy of the doc, was sent to the client
+func (r *redactedCopies) set(clientId, docKey string, snapshot []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clientCopies, ok := r.copies[clientId]
+	if !ok {
+		clientCopies = make(map[string][]byte)
+		r.copies[clientId] = clientCopies
+	}
+	clientCopies[docKey] = snapshot
+}
+
+func (r *redactedCopies) get(clientId, docKey string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snapshot, ok := r.copies[clientId][docKey]
+	return snapshot, ok
+}
+
+// delete forgets the redacted copy of the doc, called when the client is sent
+// the doc itself
+func (r *redactedCopies) delete(clientId, docKey string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.copies[clientId], docKey)
+}
+
+func (r *redactedCopies) removeClient(clientId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.copies, clientId)
+}
+
+// mergeRedactedUpdates rewrites the updates in tr that a client made on
+// redacted copies of docs into updates on the stored docs, and returns the
+// current redacted snapshots of the docs whose updates can't be merged,
+// keyed by doc key. tr must not be committed when any snapshot is returned
+//
+// The update is applied to the redacted copy the client was sent, and each
+// field changed by it is written into a fork of the stored doc, leaving the
+// fields the client can't read untouched. An update is not merged when:
+//   - it doesn't apply to the last redacted copy sent to the client, e.g. the
+//     client hasn't received the copy with the latest changes yet
+//   - it changes a field the client can't read, or a parent of such a field
+//
+// Updates of docs the client has no redacted copy of are left unchanged if
+// they import into the stored doc as they are, e.g. made by a client that was
+// sent the doc itself before it lost access to some fields
+func (s *Synchronizer) mergeRedactedUpdates(clientId string, tr *db_conn.Transaction) (map[string][]byte, error) {
+	snapshots := make(map[string][]byte)
+	for _, op := range tr.Operations {
+		updateOp, ok := op.(*db_conn.UpdateOp)
+		if !ok || !s.managedDb.permissionProxy.HasFieldReadRules(updateOp.Collection) {
+			continue
+		}
+		stored, err := s.managedDb.conn.LoadDoc(updateOp.Collection, updateOp.DocID)
+		if err != nil {
+			// missing docs are rejected by the authorization
+			continue
+		}
+		params := permission_proxy.CanViewParams{
+			Collection: updateOp.Collection,
+			DocId:      updateOp.DocID,
+			Doc:        stored,
+			ClientId:   clientId,
+			Db: &permission_proxy.DbWrapper{
+				QueryExecutor: s.managedDb.queryExecutor,
+			},
+		}
+		unreadable := s.managedDb.permissionProxy.UnreadableFields(params)
+		if len(unreadable) == 0 {
+			continue
+		}
+		key, err := key_utils.CalcDocKey(updateOp.Collection, updateOp.DocID)
+		if err != nil {
+			return nil, err
+		}
+		docKey := string(key)
+
+		if base, found := s.managedDb.queryManager.redactedCopies.get(clientId, docKey); found {
+			merged, ok, err := mergeRedactedUpdate(base, stored, updateOp.Update, unreadable)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				updateOp.Update = merged
+				continue
+			}
+		} else {
+			// an update that can't be imported at all is rejected as well
+			status, err := stored.Fork().Import(updateOp.Update)
+			if err == nil && (status.GetPending() == nil || status.GetPending().IsEmpty()) {
+				continue
+			}
+		}
+
+		snapshot, redacted, err := s.managedDb.permissionProxy.RedactedSnapshot(params)
+		if err != nil {
+			return nil, err
+		}
+		if !redacted {
+			snapshot = stored.ExportSnapshot().Bytes()
+		}
+		s.managedDb.queryManager.redactedCopies.set(clientId, docKey, snapshot)
+		snapshots[docKey] = snapshot
+	}
+	return snapshots, nil
+}
+
+// mergeRedactedUpdate applies update to base, the redacted copy of the doc
+// last sent to the client, and returns the changed fields written into stored
+// as an update on stored. ok is false if the update can't be merged
+func mergeRedactedUpdate(base []byte, stored *loro.LoroDoc, update []byte, unreadable []string) (merged []byte, ok bool, err error) {
+	baseDoc := loro.NewLoroDoc()
+	if _, err := baseDoc.Import(base); err != nil {
+		return nil, false, err
+	}
+	clientDoc := baseDoc.Fork()
+	status, err := clientDoc.Import(update)
+	if err != nil || (status.GetPending() != nil && !status.GetPending().IsEmpty()) {
+		return nil, false, nil
+	}
+	changed, err := permission_proxy.ChangedFields(baseDoc, clientDoc)
+	if err != nil {
+		return nil, false, err
+	}
+	value, err := clientDoc.GetMap(doc_visitor.DATA_MAP_NAME).ToGoObject()
+	if err != nil {
+		return nil, false, err
+	}
+
+	doc := stored.Fork()
+	data := doc.GetMap(doc_visitor.DATA_MAP_NAME)
+	for _, field := range changed {
+		parent, path := mapContainingField(data, field)
+		// writing a field replaces all its subfields, which must all be readable
+		if permission_proxy.OverlapsAny(path, unreadable) {
+			return nil, false, nil
+		}
+		segments := strings.Split(path, ".")
+		last := segments[len(segments)-1]
+		if v, exists := fieldValue(value, segments); exists {
+			err = parent.InsertValueCoerce(last, v)
+		} else {
+			err = parent.Delete(last)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return doc.ExportUpdatesFrom(stored.GetOplogVv()).Bytes(), true, nil
+}
+
+// mapContainingField returns the map container in data that the field at
+// path is written into, and the path of the field written. The path is cut at
+// the first parent that isn't a map container, the whole parent is written then
+func mapContainingField(data *loro.LoroMap, path string) (*loro.LoroMap, string) {
+	segments := strings.Split(path, ".")
+	m := data
+	for i, segment := range segments[:len(segments)-1] {
+		child, err := m.Get(segment)
+		next, ok := child.(*loro.LoroMap)
+		if err != nil || !ok {
+			return m, strings.Join(segments[:i+1], ".")
+		}
+		m = next
+	}
+	return m, path
+}
+
+// fieldValue returns the value at the path given by segments in value
+func fieldValue(value map[string]any, segments []string) (any, bool) {
+	for _, segment := range segments[:len(segments)-1] {
+		next, ok := value[segment].(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		value = next
+	}
+	v, ok := value[segments[len(segments)-1]]
+	return v, ok
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query_executor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query_validator"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
 )
 
@@ -33,9 +34,14 @@ const (
 
 type Synchronizer struct {
 	// Dependencies should be injected
-	dbConnector db_connector.DbConnector
-	network     network_server.NetworkProvider
-	dbUrl       string
+	dbConnector       db_connector.DbConnector
+	network           network_server.NetworkProvider
+	dbUrl             string
+	permissionOptions *permission_proxy.PermissionProxyOptions
+	tombstoneGc       *db_conn.TombstoneGcOptions
+	ttlSweeper        *db_conn.TtlSweeperOptions
+	historyCompaction *db_conn.HistoryCompactionOptions
+	commitFanout      *CommitFanoutOptions
 
 	// Managed databases
 	// db url -> managed db (db connection, query executor, permission proxy)
@@ -54,18 +60,38 @@ type SynchronizerParams struct {
 	DbConnector db_connector.DbConnector
 	Network     network_server.NetworkProvider
 	DbUrl       string
+	// Optional, host objects and limits for permission rules
+	PermissionOptions *permission_proxy.PermissionProxyOptions
+	// Optional, purges deleted docs in the background when set
+	TombstoneGc *db_conn.TombstoneGcOptions
+	// Optional, options of the sweeper that deletes expired docs of the
+	// collections with a TTL, the sweeper runs unless
+	// the database is read-only
+	TtlSweeper *db_conn.TtlSweeperOptions
+	// Optional, compacts the history of the docs of some collections in the
+	// background when set
+	HistoryCompaction *db_conn.HistoryCompactionOptions
+	// Optional, shares the commits of the database with other synchronizers
+	// through redis streams when set, see CommitFanout. The background jobs
+	// above only run on the writer
+	CommitFanout *CommitFanoutOptions
 }
 
 func NewSynchronizerWithContext(ctx context.Context, params *SynchronizerParams) *Synchronizer {
 	ctx, cancel := context.WithCancel(ctx)
 
 	synchronizer := &Synchronizer{
-		dbConnector: params.DbConnector,
-		network:     params.Network,
-		dbUrl:       params.DbUrl,
-		managedDb:   nil,
-		ctx:         ctx,
-		cancel:      cancel,
+		dbConnector:       params.DbConnector,
+		network:           params.Network,
+		dbUrl:             params.DbUrl,
+		permissionOptions: params.PermissionOptions,
+		tombstoneGc:       params.TombstoneGc,
+		ttlSweeper:        params.TtlSweeper,
+		historyCompaction: params.HistoryCompaction,
+		commitFanout:      params.CommitFanout,
+		managedDb:         nil,
+		ctx:               ctx,
+		cancel:            cancel,
 		// status init to SynchronizerStatusNotStarted by default
 		statusEventBus: util.NewEventBus[SynchronizerStatus](),
 	}
@@ -216,82 +242,50 @@ func (s *Synchronizer) handleMessage(clientId string, msgBytes []byte) {
 		// set committer to client id
 		msg.Transaction.Committer = clientId
 
-		// authorization
-		pass := true
-		dbWrapper := &permission_proxy.DbWrapper{
-			QueryExecutor: s.managedDb.queryExecutor,
+		// a client that was offline longer than the tombstone retention may
+		// still change purged docs, tell it to delete them instead
+		purgedKeys, err := s.purgedDocKeys(msg.Transaction)
+		if err != nil {
+			log.Errorf("Synchronizer.handleMessage: Failed to check purged docs of transaction %s: %v", msg.Transaction.TxID, err)
 		}
-		for _, op := range msg.Transaction.Operations {
-			switch op := op.(type) {
-			case *db_conn.InsertOp:
-				{
-					newDoc := loro.NewLoroDoc()
-					newDoc.Import(op.Snapshot)
-					pass = s.managedDb.permissionProxy.CanCreate(permission_proxy.CanCreateParams{
-						Collection: op.Collection,
-						DocId:      op.DocID,
-						NewDoc:     newDoc,
-						ClientId:   clientId,
-						Db:         dbWrapper,
-					})
-					if !pass {
-						pass = false
-						break
-					}
-				}
-			case *db_conn.UpdateOp:
-				{
-					oldDoc, err := s.managedDb.conn.LoadDoc(op.Collection, op.DocID)
-					if err != nil {
-						pass = false
-						log.Debugf("Synchronizer.handleMessage: trying to update doc %s.%s, but failed to load doc: %v", op.Collection, op.DocID, err)
-						break
-					}
-					newDoc := oldDoc.Fork()
-					newDoc.Import(op.Update)
-					pass = s.managedDb.permissionProxy.CanUpdate(permission_proxy.CanUpdateParams{
-						Collection: op.Collection,
-						DocId:      op.DocID,
-						NewDoc:     newDoc,
-						OldDoc:     oldDoc,
-						ClientId:   clientId,
-						Db:         dbWrapper,
-					})
-					if !pass {
-						pass = false
-						break
-					}
-				}
-			case *db_conn.DeleteOp:
-				{
-					oldDoc, err := s.managedDb.conn.LoadDoc(op.Collection, op.DocID)
-					if err != nil {
-						pass = false
-						log.Debugf("Synchronizer.handleMessage: trying to delete doc %s.%s, but failed to load doc: %v", op.Collection, op.DocID, err)
-						break
-					}
-					pass = s.managedDb.permissionProxy.CanDelete(permission_proxy.CanDeleteParams{
-						Collection: op.Collection,
-						DocId:      op.DocID,
-						Doc:        oldDoc,
-						ClientId:   clientId,
-						Db:         dbWrapper,
-					})
-					if !pass {
-						pass = false
-						break
-					}
-				}
+		if len(purgedKeys) > 0 {
+			log.Infof("Synchronizer.handleMessage: Transaction %s of client %s changes %d purged docs", msg.Transaction.TxID, clientId, len(purgedKeys))
+			err := sendTransactionFailedMessage(s.network, clientId, msg.Transaction.TxID, db_conn.ErrDocPurged)
+			if err != nil {
+				log.Errorf("Synchronizer.handleMessage: Failed to send transaction failed message to client %s: %v", clientId, err)
+			}
+			err = sendPostDocMessage(s.network, clientId, map[string][]byte{}, purgedKeys)
+			if err != nil {
+				log.Errorf("Synchronizer.handleMessage: Failed to send post doc message to client %s: %v", clientId, err)
 			}
+			return
+		}
+
+		// changes made on the redacted copy of a doc are merged into the stored doc,
+		// if they can't be, reject the transaction and send the current redacted
+		// copy to replace the local changes
+		redacted, err := s.mergeRedactedUpdates(clientId, msg.Transaction)
+		if err != nil {
+			log.Errorf("Synchronizer.handleMessage: Failed to merge redacted docs of transaction %s: %v", msg.Transaction.TxID, err)
 		}
-		if !pass {
-			log.Errorf("Synchronizer.handleMessage: Transaction failed to pass authorization, ignore it")
-			err := sendTransactionFailedMessage(
-				s.network,
-				clientId,
-				msg.Transaction.TxID,
-				fmt.Errorf("transaction failed to pass authorization"),
-			)
+		if len(redacted) > 0 {
+			log.Infof("Synchronizer.handleMessage: Transaction %s of client %s can't be merged into %d redacted docs", msg.Transaction.TxID, clientId, len(redacted))
+			err := sendTransactionFailedMessage(s.network, clientId, msg.Transaction.TxID, permission_proxy.ErrRedactedDocUpdate)
+			if err != nil {
+				log.Errorf("Synchronizer.handleMessage: Failed to send transaction failed message to client %s: %v", clientId, err)
+			}
+			err = sendPostDocMessage(s.network, clientId, redacted, []string{})
+			if err != nil {
+				log.Errorf("Synchronizer.handleMessage: Failed to send post doc message to client %s: %v", clientId, err)
+			}
+			return
+		}
+
+		// authorization, the transaction is rejected by the first denied op
+		denied := s.authorizeTransaction(clientId, msg.Transaction)
+		if denied != nil {
+			log.Warnf("Synchronizer.handleMessage: Transaction %s of client %s failed to pass authorization: %s", msg.Transaction.TxID, clientId, denied)
+			err := sendTransactionDeniedMessage(s.network, clientId, msg.Transaction.TxID, *denied)
 			if err != nil {
 				log.Errorf("Synchronizer.handleMessage: Failed to send transaction failed message to client %s: %v", clientId, err)
 			}
@@ -302,7 +296,7 @@ func (s *Synchronizer) handleMessage(clientId string, msgBytes []byte) {
 		// because we listen to transaction committed / rollbacked events
 		// so we don't need to send TransactionAckMessage or
 		// TransactionFailedMessage to client here
-		s.managedDb.conn.Commit(msg.Transaction)
+		s.commit(msg.Transaction)
 		log.Debugf("Synchronizer.handleMessage: Committed transaction %s", msg.Transaction.TxID)
 		return
 
@@ -320,43 +314,36 @@ func (s *Synchronizer) handleMessage(clientId string, msgBytes []byte) {
 		docKeys := map[string]struct{}{}
 		for _, q := range msg.Added {
 			log.Debugf("Synchronizer.handleMessage: Client %s subscribed %s", clientId, q.DebugSprint())
-			err := s.managedDb.queryManager.SubscribeNewQuery(clientId, q)
+
+			// reject queries that don't match the collection schema before executing them
+			warnings, err := s.managedDb.queryValidator.Validate(q)
+			if err != nil {
+				log.Infof("Synchronizer.handleMessage: Rejected query %s from client %s: %v", q.DebugSprint(), clientId, err)
+				err = sendSubscriptionFailedMessage(s.network, clientId, q, err)
+				if err != nil {
+					log.Errorf("Synchronizer.handleMessage: Failed to send subscription failed message to client %s: %v", clientId, err)
+				}
+				continue
+			}
+			for _, warning := range warnings {
+				log.Warnf("Synchronizer.handleMessage: Query %s from client %s: %s", q.DebugSprint(), clientId, warning)
+			}
+
+			err = s.managedDb.queryManager.SubscribeNewQuery(clientId, q)
 			if err != nil {
 				log.Errorf("Synchronizer.handleMessage: Failed to subscribe new query %s: %v", q.DebugSprint(), err)
 				continue
 			}
 
 			// generate VersionQueryMessageV1
-			// first exec the query, then collect all doc keys in query result
-			switch q := q.(type) {
-			case *query.FindOneQuery:
-				res, err := s.managedDb.queryExecutor.FindOne(q)
-				if err != nil {
-					log.Errorf("Synchronizer.handleMessage: Failed to exec find one query %s: %v", q.DebugSprint(), err)
-					continue
-				}
-				if res != nil {
-					docKey, err := key_utils.CalcDocKey(q.Collection, res.DocId)
-					if err != nil {
-						log.Errorf("Synchronizer.handleMessage: Failed to calc doc key for find one query %s: %v", q.DebugSprint(), err)
-						continue
-					}
-					docKeys[string(docKey)] = struct{}{}
-				}
-			case *query.FindManyQuery:
-				res, err := s.managedDb.queryExecutor.FindMany(q)
-				if err != nil {
-					log.Errorf("Synchronizer.handleMessage: Failed to exec find many query %s: %v", q.DebugSprint(), err)
-					continue
-				}
-				for _, docWithId := range res {
-					docKey, err := key_utils.CalcDocKey(q.Collection, docWithId.DocId)
-					if err != nil {
-						log.Errorf("Synchronizer.handleMessage: Failed to calc doc key for find many query %s: %v", q.DebugSprint(), err)
-						continue
-					}
-					docKeys[string(docKey)] = struct{}{}
-				}
+			// collect the keys of all docs in the (shared) query result the client can view
+			viewableKeys, err := s.managedDb.queryManager.ViewableDocKeys(clientId, q)
+			if err != nil {
+				log.Errorf("Synchronizer.handleMessage: Failed to collect doc keys of query %s: %v", q.DebugSprint(), err)
+				continue
+			}
+			for docKey := range viewableKeys {
+				docKeys[docKey] = struct{}{}
 			}
 		}
 
@@ -385,27 +372,53 @@ func (s *Synchronizer) handleMessage(clientId string, msgBytes []byte) {
 				log.Errorf("Synchronizer.handleMessage: Failed to get doc id from doc key %s: %v", docKey, err)
 				continue
 			}
-			if vvBytes == nil || len(vvBytes) == 0 {
-				doc, err := s.managedDb.conn.LoadDoc(collection, docId)
+			doc, err := s.managedDb.conn.LoadDoc(collection, docId)
+			if err != nil {
+				if purged, _ := s.managedDb.conn.IsPurged(collection, docId); purged {
+					toDelete = append(toDelete, docKey)
+					continue
+				}
+				log.Errorf("msgHandler: Failed to load doc %s/%s: %v", collection, docId, err)
+				continue
+			}
+			// docs with fields the client can't read are always sent as redacted snapshots
+			if s.managedDb.permissionProxy.HasFieldReadRules(collection) {
+				snapshot, redacted, err := s.managedDb.permissionProxy.RedactedSnapshot(permission_proxy.CanViewParams{
+					Collection: collection,
+					DocId:      docId,
+					Doc:        doc,
+					ClientId:   clientId,
+					Db: &permission_proxy.DbWrapper{
+						QueryExecutor: s.managedDb.queryExecutor,
+					},
+				})
 				if err != nil {
-					log.Errorf("msgHandler: Failed to load doc %s/%s: %v", collection, docId, err)
+					log.Errorf("msgHandler: Failed to redact doc %s/%s: %v", collection, docId, err)
+					continue
+				}
+				if redacted {
+					toUpsert[docKey] = snapshot
+					s.managedDb.queryManager.redactedCopies.set(clientId, docKey, snapshot)
 					continue
 				}
+				s.managedDb.queryManager.redactedCopies.delete(clientId, docKey)
+			}
+			if vvBytes == nil || len(vvBytes) == 0 {
 				docBytes := doc.ExportSnapshot().Bytes()
 				toUpsert[docKey] = docBytes
 			} else {
-				doc, err := s.managedDb.conn.LoadDoc(collection, docId)
-				if err != nil {
-					log.Errorf("msgHandler: Failed to load doc %s/%s: %v", collection, docId, err)
+				vv := loro.NewVvFromBytes(loro.NewRustBytesVec(vvBytes))
+				if predatesShallowRoot(doc, vv) {
+					// the history the client is missing was compacted
+					toUpsert[docKey] = doc.ExportSnapshot().Bytes()
 					continue
 				}
-				vv := loro.NewVvFromBytes(loro.NewRustBytesVec(vvBytes))
 				updateBytesVec := doc.ExportUpdatesFrom(vv)
 				updateBytes := updateBytesVec.Bytes()
 				toUpsert[docKey] = updateBytes
 			}
 		}
-		if len(toUpsert) > 0 {
+		if len(toUpsert) > 0 || len(toDelete) > 0 {
 			err := sendPostDocMessage(s.network, clientId, toUpsert, toDelete)
 			if err != nil {
 				log.Errorf("Synchronizer.handleMessage: Failed to send post doc message to client %s: %v", clientId, err)
@@ -414,23 +427,99 @@ func (s *Synchronizer) handleMessage(clientId string, msgBytes []byte) {
 			}
 		}
 
+	case *message.DocHistoryMessageV1:
+		s.handleDocHistoryMessage(clientId, msg)
+
 	default:
 		log.Warnf("Synchronizer.handleMessage: Received unknown message type: %T, ignore it", msg)
 	}
 }
 
-func (s *Synchronizer) handleTransactionCommitted(ev *db_conn.TransactionCommittedEvent) {
-	// send ack message to transaction committer
-	resp := &message.AckTransactionMessageV1{
-		TxID: ev.Transaction.TxID,
+// authorizeTransaction checks the transaction of a client against the
+// permission rules, returns the decision of the first denied op or nil if every
+// op is allowed. Host function calls are cached across the rules of the
+// transaction.
+func (s *Synchronizer) authorizeTransaction(clientId string, tr *db_conn.Transaction) *permission_proxy.Decision {
+	dbWrapper := &permission_proxy.DbWrapper{
+		QueryExecutor: s.managedDb.queryExecutor,
+		HostCalls:     permission_proxy.NewHostCallCache(),
 	}
-	respBytes, err := resp.Encode()
-	if err != nil {
-		log.Errorf("failed to encode transaction ack message: %v", err)
-		return
+	for i, op := range tr.Operations {
+		var decision permission_proxy.Decision
+		switch op := op.(type) {
+		case *db_conn.InsertOp:
+			newDoc := loro.NewLoroDoc()
+			if _, err := newDoc.Import(op.Snapshot); err != nil {
+				log.Debugf("Synchronizer.authorizeTransaction: trying to insert doc %s.%s, but failed to import snapshot: %v", op.Collection, op.DocID, err)
+				decision = permission_proxy.Decision{Rule: "canCreate", Collection: op.Collection, DocId: op.DocID, Err: err}
+				break
+			}
+			decision = s.managedDb.permissionProxy.DecideCreate(permission_proxy.CanCreateParams{
+				Collection: op.Collection,
+				DocId:      op.DocID,
+				NewDoc:     newDoc,
+				ClientId:   clientId,
+				Db:         dbWrapper,
+			})
+		case *db_conn.UpdateOp:
+			oldDoc, err := s.managedDb.conn.LoadDoc(op.Collection, op.DocID)
+			if err != nil {
+				log.Debugf("Synchronizer.authorizeTransaction: trying to update doc %s.%s, but failed to load doc: %v", op.Collection, op.DocID, err)
+				decision = permission_proxy.Decision{Rule: "canUpdate", Collection: op.Collection, DocId: op.DocID, Err: err}
+				break
+			}
+			newDoc := oldDoc.Fork()
+			if _, err := newDoc.Import(op.Update); err != nil {
+				log.Debugf("Synchronizer.authorizeTransaction: trying to update doc %s.%s, but failed to import update: %v", op.Collection, op.DocID, err)
+				decision = permission_proxy.Decision{Rule: "canUpdate", Collection: op.Collection, DocId: op.DocID, Err: err}
+				break
+			}
+			decision = s.managedDb.permissionProxy.DecideUpdate(permission_proxy.CanUpdateParams{
+				Collection: op.Collection,
+				DocId:      op.DocID,
+				NewDoc:     newDoc,
+				OldDoc:     oldDoc,
+				ClientId:   clientId,
+				Db:         dbWrapper,
+			})
+		case *db_conn.DeleteOp:
+			oldDoc, err := s.managedDb.conn.LoadDoc(op.Collection, op.DocID)
+			if err != nil {
+				log.Debugf("Synchronizer.authorizeTransaction: trying to delete doc %s.%s, but failed to load doc: %v", op.Collection, op.DocID, err)
+				decision = permission_proxy.Decision{Rule: "canDelete", Collection: op.Collection, DocId: op.DocID, Err: err}
+				break
+			}
+			decision = s.managedDb.permissionProxy.DecideDelete(permission_proxy.CanDeleteParams{
+				Collection: op.Collection,
+				DocId:      op.DocID,
+				Doc:        oldDoc,
+				ClientId:   clientId,
+				Db:         dbWrapper,
+			})
+		}
+		if !decision.Allowed {
+			decision.OpIndex = i
+			return &decision
+		}
+	}
+	return nil
+}
+
+func (s *Synchronizer) handleTransactionCommitted(ev *db_conn.TransactionCommittedEvent) {
+	// send ack message to transaction committer, transactions of the server
+	// itself have no client to ack
+	if ev.Committer != db_conn.SystemCommitter {
+		resp := &message.AckTransactionMessageV1{
+			TxID: ev.Transaction.TxID,
+		}
+		respBytes, err := resp.Encode()
+		if err != nil {
+			log.Errorf("failed to encode transaction ack message: %v", err)
+			return
+		}
+		s.network.Send(ev.Committer, respBytes)
+		log.Debugf("Synchronizer.handleTransactionCommitted: Sent transaction ack message to %s", ev.Committer)
 	}
-	s.network.Send(ev.Committer, respBytes)
-	log.Debugf("Synchronizer.handleTransactionCommitted: Sent transaction ack message to %s", ev.Committer)
 
 	// notify queryManager of the transaction
 	// queryManager updates all query results based on the transaction
@@ -471,6 +560,9 @@ func (s *Synchronizer) handleTransactionCommitted(ev *db_conn.TransactionCommitt
 }
 
 func (s *Synchronizer) handleTransactionRollbacked(ev *db_conn.TransactionRollbackedEvent) {
+	if ev.Committer == db_conn.SystemCommitter {
+		return
+	}
 	// send TransactionFailedMessage to transaction committer
 	err := sendTransactionFailedMessage(
 		s.network,
@@ -489,6 +581,7 @@ func (s *Synchronizer) handleConnectionClosed(ev network_server.ConnectionClosed
 	// remove all subscriptions of a client when it disconnects
 	log.Debugf("Synchronizer.handleConnectionClosed: Client %s disconnected", ev.ClientId)
 	s.managedDb.queryManager.RemoveAllSubscriptedQueries(ev.ClientId)
+	s.managedDb.queryManager.redactedCopies.removeClient(ev.ClientId)
 }
 
 func sendTransactionFailedMessage(network network_server.NetworkProvider, clientId string, txId string, reason error) error {
@@ -504,6 +597,52 @@ func sendTransactionFailedMessage(network network_server.NetworkProvider, client
 	return nil
 }
 
+// sendTransactionDeniedMessage tells the committer that its transaction
+// was rejected by the permission check described by decision
+func sendTransactionDeniedMessage(network network_server.NetworkProvider, clientId string, txId string, decision permission_proxy.Decision) error {
+	resp := &message.TransactionFailedMessageV1{
+		TxID:   txId,
+		Reason: fmt.Errorf("transaction failed to pass authorization: %s", decision),
+		Denial: newPermissionDenial(decision),
+	}
+	respBytes, err := resp.Encode()
+	if err != nil {
+		return pe.Errorf("failed to encode transaction failed message: %v", err)
+	}
+	network.Send(clientId, respBytes)
+	return nil
+}
+
+// newPermissionDenial converts a denied decision to its wire format
+func newPermissionDenial(decision permission_proxy.Decision) *message.PermissionDenialV1 {
+	denial := &message.PermissionDenialV1{
+		Rule:       decision.Rule,
+		Collection: decision.Collection,
+		DocId:      decision.DocId,
+		OpIndex:    decision.OpIndex,
+		Reason:     decision.Reason,
+		Line:       decision.Line,
+		Column:     decision.Column,
+	}
+	if decision.Err != nil {
+		denial.Error = decision.Err.Error()
+	}
+	return denial
+}
+
+func sendSubscriptionFailedMessage(network network_server.NetworkProvider, clientId string, q query.Query, reason error) error {
+	resp := &message.SubscriptionFailedMessageV1{
+		Query:  q,
+		Reason: reason,
+	}
+	respBytes, err := resp.Encode()
+	if err != nil {
+		return pe.Errorf("failed to encode subscription failed message: %v", err)
+	}
+	network.Send(clientId, respBytes)
+	return nil
+}
+
 func sendVersionQueryMessage(network network_server.NetworkProvider, clientId string, docKeys map[string]struct{}) error {
 	vqm := &message.VersionQueryMessageV1{
 		Queries: docKeys,
@@ -548,11 +687,12 @@ func (s *Synchronizer) connectDatabase() error {
 	<-conn.WaitForStatus(db_conn.DbConnStatusRunning)
 
 	queryExecutor := query_executor.NewQueryExecutor(conn)
-	permissionProxy, err := permission_proxy.NewPermissionProxy(conn)
+	permissionProxy, err := permission_proxy.NewPermissionProxy(conn, s.permissionOptions)
 	if err != nil {
 		return err
 	}
 	queryManager := NewQueryManager(queryExecutor, permissionProxy)
+	queryValidator := query_validator.NewQueryValidator(conn.GetDatabaseMeta().GetDatabaseSchema())
 
 	// start a goroutine to listen and handle transaction committed / rollbacked events
 	go func() {
@@ -577,6 +717,35 @@ func (s *Synchronizer) connectDatabase() error {
 		queryExecutor:   queryExecutor,
 		permissionProxy: permissionProxy,
 		queryManager:    queryManager,
+		queryValidator:  queryValidator,
+	}
+	if s.commitFanout != nil {
+		s.managedDb.commitFanout, err = NewCommitFanout(conn, s.commitFanout)
+		if err != nil {
+			return err
+		}
+		s.managedDb.commitFanout.authorize = s.authorizeForwarded
+		if err := s.managedDb.commitFanout.Start(subCtx); err != nil {
+			return err
+		}
+		if !s.managedDb.commitFanout.IsWriter() {
+			// the replica of a follower only changes with the commits of the writer
+			return nil
+		}
+	}
+	if conn.IsReadOnly() {
+		// the background jobs below all write to the database
+		return nil
+	}
+	if s.tombstoneGc != nil {
+		s.managedDb.tombstoneGc = db_conn.NewTombstoneGc(conn, s.tombstoneGc)
+		s.managedDb.tombstoneGc.Start(subCtx)
+	}
+	s.managedDb.ttlSweeper = db_conn.NewTtlSweeper(conn, s.ttlSweeper)
+	s.managedDb.ttlSweeper.Start(subCtx)
+	if s.historyCompaction != nil {
+		s.managedDb.historyCompactor = db_conn.NewHistoryCompactor(conn, s.historyCompaction)
+		s.managedDb.historyCompactor.Start(subCtx)
 	}
 
 	return nil
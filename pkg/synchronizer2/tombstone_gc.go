@@ -0,0 +1,43 @@
+package synchronizer2
+
+import (
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+)
+
+// TombstoneGcStats returns the statistics of the tombstone GC, ok is false if
+// the GC is disabled or the database is not connected
+func (s *Synchronizer) TombstoneGcStats() (stats db_conn.JobStats, ok bool) {
+	if s.managedDb == nil || s.managedDb.tombstoneGc == nil {
+		return stats, false
+	}
+	return s.managedDb.tombstoneGc.Stats(), true
+}
+
+// purgedDocKeys returns the keys of the purged docs updated or deleted by tr
+func (s *Synchronizer) purgedDocKeys(tr *db_conn.Transaction) ([]string, error) {
+	keys := make([]string, 0)
+	for _, op := range tr.Operations {
+		var collection, docId string
+		switch op := op.(type) {
+		case *db_conn.UpdateOp:
+			collection, docId = op.Collection, op.DocID
+		case *db_conn.DeleteOp:
+			collection, docId = op.Collection, op.DocID
+		default:
+			continue
+		}
+		purged, err := s.managedDb.conn.IsPurged(collection, docId)
+		if err != nil {
+			return nil, err
+		}
+		if purged {
+			key, err := key_utils.CalcDocKey(collection, docId)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, string(key))
+		}
+	}
+	return keys, nil
+}
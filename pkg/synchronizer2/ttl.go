@@ -0,0 +1,12 @@
+package synchronizer2
+
+import "github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+
+// TtlSweeperStats returns the statistics of the sweeper of expired docs, ok is
+// false if the database is not connected or is read-only
+func (s *Synchronizer) TtlSweeperStats() (stats db_conn.JobStats, ok bool) {
+	if s.managedDb == nil || s.managedDb.ttlSweeper == nil {
+		return stats, false
+	}
+	return s.managedDb.ttlSweeper.Stats(), true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	conn := setupConn(t).(*db_conn.PebbleDbConn)
+	defer cleanupEngine(t, conn)
+
+	ops := []db_conn.TransactionOp{}
+	for _, docId := range []string{"user1", "user2", "3f2504e0-4f89-11d3-9a0c-0305e82c3301"} {
+		doc := loro.NewLoroDoc()
+		doc.GetText("name").InsertText(docId, 0)
+		ops = append(ops, &db_conn.InsertOp{Collection: "users", DocID: docId, Snapshot: doc.ExportSnapshot().Bytes()})
+	}
+	assert.NoError(t, conn.Commit(&db_conn.Transaction{TxID: "11111111-1111-1111-1111-111111111111", Committer: "test-client", Operations: ops}))
+
+	var archive bytes.Buffer
+	docs, err := conn.Backup(&archive, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, docs)
+
+	docs, err = db_conn.VerifyBackup(bytes.NewReader(archive.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, docs)
+
+	restorePath := filepath.Join(t.TempDir(), "restored")
+	docs, err = db_conn.RestoreBackup(bytes.NewReader(archive.Bytes()), restorePath)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, docs)
+	_, err = db_conn.RestoreBackup(bytes.NewReader(archive.Bytes()), restorePath)
+	assert.Error(t, err)
+
+	restored, err := db_conn.NewPebbleDbConnWithContext(context.Background(), &db_conn.PebbleDbConnParams{Path: restorePath})
+	assert.NoError(t, err)
+	assert.NoError(t, restored.Open())
+	defer restored.Close()
+	assert.Equal(t, conn.GetDatabaseMeta().GetPermissionJs(), restored.GetDatabaseMeta().GetPermissionJs())
+	doc, err := restored.LoadDoc("users", "3f2504e0-4f89-11d3-9a0c-0305e82c3301")
+	assert.NoError(t, err)
+	assert.Equal(t, "3f2504e0-4f89-11d3-9a0c-0305e82c3301", util.Must(doc.GetText("name").ToString()))
+
+	// 损坏或截断的备份不能通过校验，也不会留下恢复了一半的数据库
+	corrupted := bytes.Clone(archive.Bytes())
+	corrupted[len(corrupted)/2] ^= 0xFF
+	_, err = db_conn.VerifyBackup(bytes.NewReader(corrupted))
+	assert.ErrorIs(t, err, db_conn.ErrBackupCorrupted)
+	_, err = db_conn.VerifyBackup(bytes.NewReader(archive.Bytes()[:archive.Len()-1]))
+	assert.ErrorIs(t, err, db_conn.ErrBackupCorrupted)
+	corruptedPath := filepath.Join(t.TempDir(), "corrupted")
+	_, err = db_conn.RestoreBackup(bytes.NewReader(corrupted), corruptedPath)
+	assert.ErrorIs(t, err, db_conn.ErrBackupCorrupted)
+	assert.NoDirExists(t, corruptedPath)
+
+	// checkpoint 是可以直接打开的数据库
+	checkpointPath := filepath.Join(t.TempDir(), "checkpoint")
+	assert.NoError(t, conn.Checkpoint(checkpointPath))
+	checkpoint, err := db_conn.NewPebbleDbConnWithContext(context.Background(), &db_conn.PebbleDbConnParams{Path: checkpointPath, ReadOnly: true})
+	assert.NoError(t, err)
+	assert.NoError(t, checkpoint.Open())
+	defer checkpoint.Close()
+	docsInCheckpoint, err := checkpoint.LoadCollection("users")
+	assert.NoError(t, err)
+	assert.Len(t, docsInCheckpoint, 3)
+}
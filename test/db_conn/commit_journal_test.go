@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/stretchr/testify/assert"
+)
+
+// seqJournal 记录通知的提交序号
+type seqJournal struct {
+	seqs []uint64
+}
+
+func (j *seqJournal) Committed(tr *db_conn.Transaction, seq uint64) { j.seqs = append(j.seqs, seq) }
+
+func (j *seqJournal) Rollbacked(tr *db_conn.Transaction, reason error) {}
+
+// 提交按序号写入日志，可以按序号读回，删除时保留最后一个提交
+func TestCommitJournal(t *testing.T) {
+	t.Parallel()
+	conn := newTestMemConn(t, nil)
+	journal := &seqJournal{}
+	assert.NoError(t, conn.SetCommitJournal(journal))
+
+	for _, docId := range []string{"p1", "p2", "p3"} {
+		doc := loro.NewLoroDoc()
+		assert.NoError(t, doc.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("title", docId))
+		assert.NoError(t, conn.Commit(&db_conn.Transaction{
+			TxID:       "tx-" + docId,
+			Committer:  "client1",
+			Operations: []db_conn.TransactionOp{&db_conn.InsertOp{Collection: "posts", DocID: docId, Snapshot: doc.ExportSnapshot().Bytes()}},
+		}))
+	}
+	assert.Equal(t, []uint64{1, 2, 3}, journal.seqs)
+
+	entries, err := conn.LoadJournal(1, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, uint64(2), entries[0].Seq)
+	assert.Equal(t, "tx-p2", entries[0].Transaction.TxID)
+	entries, err = conn.LoadJournal(0, 1)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, uint64(1), entries[0].Seq)
+
+	assert.NoError(t, conn.TrimJournal(3))
+	entries, err = conn.LoadJournal(0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, uint64(3), entries[0].Seq)
+	assert.NoError(t, conn.TrimJournal(10))
+	tr, seq, err := conn.LastJournaled()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), seq)
+	assert.Equal(t, "tx-p3", tr.TxID)
+}
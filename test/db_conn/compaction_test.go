@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactHistory(t *testing.T) {
+	t.Parallel()
+	doc := loro.NewLoroDoc()
+	dataMap := doc.GetMap(doc_visitor.DATA_MAP_NAME)
+	assert.NoError(t, dataMap.InsertValueCoerce("title", "v1"))
+	conn := newTestMemConn(t, nil, &db_conn.InsertOp{Collection: "notes", DocID: "n1", Snapshot: doc.ExportSnapshot().Bytes()})
+
+	for i, title := range []string{"v2", "v3"} {
+		vv := doc.GetOplogVv()
+		assert.NoError(t, dataMap.InsertValueCoerce("title", title))
+		assert.NoError(t, conn.Commit(&db_conn.Transaction{
+			TxID:       fmt.Sprintf("tx%d", i+2),
+			Committer:  "client1",
+			Operations: []db_conn.TransactionOp{&db_conn.UpdateOp{Collection: "notes", DocID: "n1", Update: doc.ExportUpdatesFrom(vv).Bytes()}},
+		}))
+	}
+
+	// 保留期内的历史不会被压缩
+	compacted, err := conn.CompactHistory("notes", time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, compacted)
+	assert.Len(t, util.Must(conn.LoadDocHistory("notes", "n1")), 3)
+
+	compacted, err = conn.CompactHistory("notes", time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, compacted)
+	history := util.Must(conn.LoadDocHistory("notes", "n1"))
+	assert.Len(t, history, 1)
+	assert.Equal(t, "tx3", history[0].TxID)
+	compactedDoc := util.Must(conn.LoadDoc("notes", "n1"))
+	assert.True(t, compactedDoc.IsShallow())
+	value, err := compactedDoc.GetMap(doc_visitor.DATA_MAP_NAME).ToGoObject()
+	assert.NoError(t, err)
+	assert.Equal(t, "v3", value["title"])
+
+	// 压缩后仍然可以提交更新
+	vv := doc.GetOplogVv()
+	assert.NoError(t, dataMap.InsertValueCoerce("title", "v4"))
+	assert.NoError(t, conn.Commit(&db_conn.Transaction{
+		TxID:       "tx4",
+		Committer:  "client1",
+		Operations: []db_conn.TransactionOp{&db_conn.UpdateOp{Collection: "notes", DocID: "n1", Update: doc.ExportUpdatesFrom(vv).Bytes()}},
+	}))
+	value, err = util.Must(conn.LoadDoc("notes", "n1")).GetMap(doc_visitor.DATA_MAP_NAME).ToGoObject()
+	assert.NoError(t, err)
+	assert.Equal(t, "v4", value["title"])
+}
+
+// 基于压缩前的版本做出的更新不能被合入，提交被回滚，而不是丢掉更新中的修改后成功
+func TestCommitPreHorizonUpdate(t *testing.T) {
+	t.Parallel()
+	dbSchema := db_conn.DatabaseSchema{
+		Name:        "testdb",
+		Version:     "1.0.0",
+		Collections: map[string]*db_conn.CollectionSchema{},
+	}
+	connect := map[string]func(t *testing.T) db_conn.DbConnection{
+		"mem": func(t *testing.T) db_conn.DbConnection {
+			return newTestMemConn(t, &dbSchema)
+		},
+		"pebble": func(t *testing.T) db_conn.DbConnection {
+			path := filepath.Join(t.TempDir(), "db")
+			assert.NoError(t, db_conn.CreateNewPebbleDb(path, &dbSchema, emptyPermissionJs))
+			conn := util.Must(db_conn.NewPebbleDbConnWithContext(context.Background(), &db_conn.PebbleDbConnParams{Path: path}))
+			assert.NoError(t, conn.Open())
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		},
+	}
+	for name, newConn := range connect {
+		t.Run(name, func(t *testing.T) {
+			conn := newConn(t)
+
+			doc := loro.NewLoroDoc()
+			dataMap := doc.GetMap(doc_visitor.DATA_MAP_NAME)
+			assert.NoError(t, dataMap.InsertValueCoerce("title", "v1"))
+			assert.NoError(t, conn.Commit(&db_conn.Transaction{
+				TxID:       "tx1",
+				Committer:  "client1",
+				Operations: []db_conn.TransactionOp{&db_conn.InsertOp{Collection: "notes", DocID: "n1", Snapshot: doc.ExportSnapshot().Bytes()}},
+			}))
+			// client2 持有第一个版本，之后离线修改
+			stale := doc.Fork()
+			for i, title := range []string{"v2", "v3"} {
+				vv := doc.GetOplogVv()
+				assert.NoError(t, dataMap.InsertValueCoerce("title", title))
+				assert.NoError(t, conn.Commit(&db_conn.Transaction{
+					TxID:       fmt.Sprintf("tx%d", i+2),
+					Committer:  "client1",
+					Operations: []db_conn.TransactionOp{&db_conn.UpdateOp{Collection: "notes", DocID: "n1", Update: doc.ExportUpdatesFrom(vv).Bytes()}},
+				}))
+			}
+			compacted, err := conn.CompactHistory("notes", time.Now().Add(time.Minute))
+			assert.NoError(t, err)
+			assert.Equal(t, 1, compacted)
+
+			// client2 的更新依赖被压缩掉的历史
+			vv := stale.GetOplogVv()
+			assert.NoError(t, stale.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("body", "offline"))
+			err = conn.Commit(&db_conn.Transaction{
+				TxID:       "tx4",
+				Committer:  "client2",
+				Operations: []db_conn.TransactionOp{&db_conn.UpdateOp{Collection: "notes", DocID: "n1", Update: stale.ExportUpdatesFrom(vv).Bytes()}},
+			})
+			assert.ErrorIs(t, err, db_conn.ErrUpdateNotImported)
+
+			// 文档和历史都没有变化
+			value, err := util.Must(conn.LoadDoc("notes", "n1")).GetMap(doc_visitor.DATA_MAP_NAME).ToGoObject()
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]any{"title": "v3"}, value)
+			history := util.Must(conn.LoadDocHistory("notes", "n1"))
+			assert.Len(t, history, 1)
+			assert.Equal(t, "tx3", history[0].TxID)
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_connector"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/stretchr/testify/assert"
+)
+
+func newKeyringEntry(t *testing.T, id string) string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.NoError(t, err)
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	dir := t.TempDir()
+	schemaPath := filepath.Join(dir, "schema.js")
+	permissionPath := filepath.Join(dir, "permission.js")
+	assert.NoError(t, os.WriteFile(schemaPath, []byte(`Schema.database({
+  name: "testdb",
+  version: "1.0.0",
+  collections: {
+    notes: Schema.collection({
+      name: "notes",
+      docSchema: Schema.doc({
+        id: Schema.string().unique(),
+        title: Schema.string(),
+      }),
+    }),
+  },
+});`), 0o644))
+	assert.NoError(t, os.WriteFile(permissionPath, []byte(`Permission.create({ version: "1.0.0", rules: {} });`), 0o644))
+	dbPath := filepath.Join(dir, "db")
+	k1, k2 := newKeyringEntry(t, "k1"), newKeyringEntry(t, "k2")
+	keyFile := filepath.Join(dir, "keys")
+	assert.NoError(t, os.WriteFile(keyFile, []byte(k1+"\n"), 0o600))
+	connector := db_connector.NewPebbleConnector()
+
+	open := func(query string) (db_conn.DbConnection, error) {
+		conn, err := connector.ConnectWithContext(context.Background(), "rapierdb://"+dbPath+"?"+query)
+		if err != nil {
+			return nil, err
+		}
+		return conn, conn.Open()
+	}
+
+	t.Run("无效的密钥", func(t *testing.T) {
+		_, err := db_conn.ParseKeyring("")
+		assert.ErrorIs(t, err, db_conn.ErrEncryptionKeyMissing)
+		_, err = db_conn.ParseKeyring("k1:" + base64.StdEncoding.EncodeToString([]byte("short")))
+		assert.Error(t, err)
+		_, err = db_conn.ParseKeyring(k1 + "," + k1)
+		assert.Error(t, err)
+		keyring, err := db_conn.ParseKeyring("# keys\n" + k1 + "\n" + k2 + "\n")
+		assert.NoError(t, err)
+		assert.Equal(t, "k2", keyring.ActiveKeyId())
+
+		_, err = connector.ConnectWithContext(context.Background(), "rapierdb://"+dbPath+"?encryptionKeyFile="+keyFile+"&encryptionKeyEnv=KEYS")
+		assert.Error(t, err)
+	})
+
+	t.Run("加密已有数据", func(t *testing.T) {
+		conn, err := open("createIfMissing=true&schema=" + schemaPath + "&permission=" + permissionPath + "&encryptionKeyFile=" + keyFile)
+		assert.NoError(t, err)
+		_, err = conn.(*db_conn.PebbleDbConn).Reencrypt()
+		assert.NoError(t, err)
+		assert.NoError(t, conn.Close())
+	})
+
+	t.Run("缺少密钥时无法打开", func(t *testing.T) {
+		_, err := open("")
+		assert.ErrorIs(t, err, db_conn.ErrEncryptionKeyMissing)
+		_, err = open("encryptionKeyFile=" + filepath.Join(dir, "missing"))
+		assert.ErrorIs(t, err, db_conn.ErrEncryptionKeyMissing)
+		t.Setenv("TEST_ENCRYPTION_KEYS", k2)
+		_, err = open("encryptionKeyEnv=TEST_ENCRYPTION_KEYS")
+		assert.ErrorIs(t, err, db_conn.ErrEncryptionKeyMissing)
+	})
+
+	t.Run("轮换密钥", func(t *testing.T) {
+		t.Setenv("TEST_ENCRYPTION_KEYS", k1+","+k2)
+		conn, err := open("encryptionKeyEnv=TEST_ENCRYPTION_KEYS")
+		assert.NoError(t, err)
+		_, err = conn.(*db_conn.PebbleDbConn).Reencrypt()
+		assert.NoError(t, err)
+		assert.NoError(t, conn.Close())
+
+		t.Setenv("TEST_ENCRYPTION_KEYS", k2)
+		conn, err = open("encryptionKeyEnv=TEST_ENCRYPTION_KEYS")
+		assert.NoError(t, err)
+		assert.Equal(t, "testdb", conn.GetDatabaseMeta().GetDatabaseSchema().Name)
+		assert.NoError(t, conn.Close())
+	})
+	t.Run("历史版本和备份", func(t *testing.T) {
+		t.Setenv("TEST_ENCRYPTION_KEYS", k2)
+		conn, err := open("encryptionKeyEnv=TEST_ENCRYPTION_KEYS")
+		assert.NoError(t, err)
+		doc := loro.NewLoroDoc()
+		assert.NoError(t, doc.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("title", "secret title"))
+		assert.NoError(t, conn.Commit(&db_conn.Transaction{
+			TxID:       "tx1",
+			Committer:  "secret-committer",
+			Operations: []db_conn.TransactionOp{&db_conn.InsertOp{Collection: "notes", DocID: "n1", Snapshot: doc.ExportSnapshot().Bytes()}},
+		}))
+		history, err := conn.LoadDocHistory("notes", "n1")
+		assert.NoError(t, err)
+		assert.Len(t, history, 1)
+		assert.Equal(t, "secret-committer", history[0].Committer)
+
+		// 加密数据库的备份默认被拒绝
+		var archive bytes.Buffer
+		_, err = conn.(*db_conn.PebbleDbConn).Backup(&archive, false)
+		assert.ErrorIs(t, err, db_conn.ErrPlaintextBackup)
+		docs, err := conn.(*db_conn.PebbleDbConn).Backup(&archive, true)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, docs)
+		assert.True(t, bytes.Contains(archive.Bytes(), []byte("secret-committer")))
+		assert.NoError(t, conn.Close())
+
+		// 磁盘上的文档和历史版本都没有明文
+		pebbleDb, err := pebble.Open(dbPath, &pebble.Options{ReadOnly: true})
+		assert.NoError(t, err)
+		defer pebbleDb.Close()
+		iter, err := pebbleDb.NewIter(nil)
+		assert.NoError(t, err)
+		defer iter.Close()
+		for iter.First(); iter.Valid(); iter.Next() {
+			assert.False(t, bytes.Contains(iter.Value(), []byte("secret")), "plaintext value of %q", iter.Key())
+		}
+	})
+}
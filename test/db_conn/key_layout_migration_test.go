@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigratePebbleDbKeyLayout(t *testing.T) {
+	dbPath := t.TempDir()
+	dbSchema := db_conn.DatabaseSchema{
+		Name:        "testdb",
+		Version:     "1.0.0",
+		Collections: map[string]*db_conn.CollectionSchema{},
+	}
+	err := db_conn.CreateNewPebbleDb(dbPath, &dbSchema, `Permission.create({ version: "1.0.0", rules: {} });`)
+	assert.NoError(t, err)
+
+	// 构造一个定长格式的旧数据库：旧的元数据末尾没有键格式
+	docs := map[[2]string]string{
+		{"users", "u1"}:                   "alice",
+		{"postMetas", "0123456789abcdef"}: "post",
+		{"very_long_name16", "id"}:        "long",
+	}
+	pebbleDb, err := pebble.Open(dbPath, &pebble.Options{})
+	assert.NoError(t, err)
+	metaBytes, closer, err := pebbleDb.Get([]byte(key_utils.STORAGE_META_KEY))
+	assert.NoError(t, err)
+	oldMetaBytes := append([]byte(nil), metaBytes[:len(metaBytes)-1]...)
+	closer.Close()
+	assert.NoError(t, pebbleDb.Set([]byte(key_utils.STORAGE_META_KEY), oldMetaBytes, pebble.Sync))
+	for doc, value := range docs {
+		key, err := key_utils.CalcFixedWidthDocKey(doc[0], doc[1])
+		assert.NoError(t, err)
+		assert.NoError(t, pebbleDb.Set(key, []byte(value), pebble.Sync))
+	}
+	assert.NoError(t, pebbleDb.Close())
+
+	// 没有迁移的数据库不能打开
+	conn, err := db_conn.NewPebbleDbConnWithContext(context.Background(), &db_conn.PebbleDbConnParams{Path: dbPath})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, conn.Open(), db_conn.ErrKeyLayoutOutdated)
+
+	migrated, err := db_conn.MigratePebbleDbKeyLayout(dbPath)
+	assert.NoError(t, err)
+	assert.Equal(t, len(docs), migrated)
+	migrated, err = db_conn.MigratePebbleDbKeyLayout(dbPath)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, migrated)
+
+	pebbleDb, err = pebble.Open(dbPath, &pebble.Options{})
+	assert.NoError(t, err)
+	for doc, value := range docs {
+		key, err := key_utils.CalcDocKey(doc[0], doc[1])
+		assert.NoError(t, err)
+		got, closer, err := pebbleDb.Get(key)
+		if assert.NoError(t, err, "%q", doc) {
+			assert.Equal(t, value, string(got))
+			closer.Close()
+		}
+		oldKey, err := key_utils.CalcFixedWidthDocKey(doc[0], doc[1])
+		assert.NoError(t, err)
+		_, _, err = pebbleDb.Get(oldKey)
+		assert.ErrorIs(t, err, pebble.ErrNotFound)
+	}
+	assert.NoError(t, pebbleDb.Close())
+
+	conn, err = db_conn.NewPebbleDbConnWithContext(context.Background(), &db_conn.PebbleDbConnParams{Path: dbPath})
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Open())
+	assert.Equal(t, key_utils.CURRENT_KEY_LAYOUT, conn.GetDatabaseMeta().GetKeyLayout())
+	assert.NoError(t, conn.Close())
+}
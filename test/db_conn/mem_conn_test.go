@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_connector"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+const emptyPermissionJs = `Permission.create({ version: "1.0.0", rules: {} });`
+
+// newTestMemConn 创建名为 t.Name() 的内存数据库并打开一个连接，docs 在一个事务中插入，
+// schema 为 nil 时数据库中没有定义任何集合。测试结束时关闭连接并删除数据库
+func newTestMemConn(t *testing.T, schema *db_conn.DatabaseSchema, docs ...*db_conn.InsertOp) db_conn.DbConnection {
+	if schema == nil {
+		schema = &db_conn.DatabaseSchema{
+			Name:        "testdb",
+			Version:     "1.0.0",
+			Collections: map[string]*db_conn.CollectionSchema{},
+		}
+	}
+	assert.NoError(t, db_conn.CreateNewMemDb(t.Name(), schema, emptyPermissionJs))
+	t.Cleanup(func() { db_conn.DropMemDb(t.Name()) })
+	conn, err := db_conn.NewMemDbConnWithContext(context.Background(), &db_conn.MemDbConnParams{Name: t.Name()})
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Open())
+	t.Cleanup(func() { conn.Close() })
+
+	if len(docs) > 0 {
+		tr := &db_conn.Transaction{TxID: "setup", Committer: "setup"}
+		for _, doc := range docs {
+			tr.Operations = append(tr.Operations, doc)
+		}
+		assert.NoError(t, conn.Commit(tr))
+	}
+	return conn
+}
+
+func TestMemDbConn(t *testing.T) {
+	t.Parallel()
+	conn := newTestMemConn(t, nil)
+	assert.Error(t, db_conn.CreateNewMemDb(t.Name(), &db_conn.DatabaseSchema{Name: "testdb"}, ""))
+	assert.Equal(t, db_conn.DbConnStatusRunning, conn.GetStatus())
+	assert.Equal(t, "testdb", conn.GetDatabaseMeta().GetDatabaseSchema().Name)
+
+	committed := conn.GetCommittedEb().Subscribe()
+	rollbacked := conn.GetRollbackedEb().Subscribe()
+
+	doc := loro.NewLoroDoc()
+	doc.GetText("name").InsertText("Alice", 0)
+	assert.NoError(t, conn.Commit(&db_conn.Transaction{
+		TxID:      "11111111-1111-1111-1111-111111111111",
+		Committer: "test-client",
+		Operations: []db_conn.TransactionOp{
+			&db_conn.InsertOp{Collection: "users", DocID: "user1", Snapshot: doc.ExportSnapshot().Bytes()},
+			&db_conn.InsertOp{Collection: "users2", DocID: "user2", Snapshot: doc.ExportSnapshot().Bytes()},
+		},
+	}))
+	assert.Equal(t, "test-client", (<-committed).Committer)
+
+	loadedDoc, err := conn.LoadDoc("users", "user1")
+	assert.NoError(t, err)
+	assert.Equal(t, "Alice", util.Must(loadedDoc.GetText("name").ToString()))
+
+	// 更新不存在的文档时整个事务回滚
+	forked := loadedDoc.Fork()
+	vv := forked.GetOplogVv()
+	forked.GetText("name").InsertText(" and Bob", 5)
+	err = conn.Commit(&db_conn.Transaction{
+		TxID:      "22222222-2222-2222-2222-222222222222",
+		Committer: "test-client",
+		Operations: []db_conn.TransactionOp{
+			&db_conn.UpdateOp{Collection: "users", DocID: "user1", Update: forked.ExportUpdatesFrom(vv).Bytes()},
+			&db_conn.UpdateOp{Collection: "users", DocID: "xxxxxxx", Update: forked.ExportUpdatesFrom(vv).Bytes()},
+		},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, err, (<-rollbacked).Reason)
+	assert.Equal(t, "Alice", util.Must(loadedDoc.GetText("name").ToString()))
+
+	// 另一个连接可以看到提交的数据，只读连接不能写入
+	connector := db_connector.NewMemConnector()
+	readConn, err := connector.ConnectWithContext(context.Background(), "mem://"+t.Name()+"?readonly=true")
+	assert.NoError(t, err)
+	assert.NoError(t, readConn.Open())
+	defer readConn.Close()
+	docs, err := readConn.LoadCollection("users")
+	assert.NoError(t, err)
+	assert.Len(t, docs, 1)
+	assert.Contains(t, docs, "user1")
+	assert.ErrorIs(t, readConn.Commit(&db_conn.Transaction{TxID: "33333333-3333-3333-3333-333333333333"}), db_conn.ErrReadOnly)
+
+	assert.NoError(t, conn.Commit(&db_conn.Transaction{
+		TxID:      "44444444-4444-4444-4444-444444444444",
+		Committer: "test-client",
+		Operations: []db_conn.TransactionOp{
+			&db_conn.UpdateOp{Collection: "users", DocID: "user1", Update: forked.ExportUpdatesFrom(vv).Bytes()},
+		},
+	}))
+	assert.Equal(t, "Alice and Bob", util.Must(loadedDoc.GetText("name").ToString()))
+	readConn.InvalidateCache()
+	loadedDoc, err = readConn.LoadDoc("users", "user1")
+	assert.NoError(t, err)
+	assert.Equal(t, "Alice and Bob", util.Must(loadedDoc.GetText("name").ToString()))
+
+	// 不存在的数据库不能打开
+	missingConn, err := connector.ConnectWithContext(context.Background(), "mem://missing")
+	assert.NoError(t, err)
+	assert.ErrorIs(t, missingConn.Open(), db_conn.ErrMemDbNotFound)
+	_, err = connector.ConnectWithContext(context.Background(), "mem://"+t.Name()+"?enableWal=false")
+	assert.Error(t, err)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_connector"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPebbleConnectorOptions(t *testing.T) {
+	dir := t.TempDir()
+	schemaPath := filepath.Join(dir, "schema.js")
+	permissionPath := filepath.Join(dir, "permission.js")
+	assert.NoError(t, os.WriteFile(schemaPath, []byte(`Schema.database({
+  name: "testdb",
+  version: "1.0.0",
+  collections: {},
+});`), 0o644))
+	assert.NoError(t, os.WriteFile(permissionPath, []byte(`Permission.create({ version: "1.0.0", rules: {} });`), 0o644))
+	dbPath := filepath.Join(dir, "db")
+	connector := db_connector.NewPebbleConnector()
+
+	t.Run("拒绝无效的参数", func(t *testing.T) {
+		for _, query := range []string{
+			"unknown=1",
+			"readonly=maybe",
+			"docsCacheSize=0",
+			"cacheSize=-1",
+			"readonly=true&readonly=false",
+			"createIfMissing=true&schema=" + schemaPath,
+			"createIfMissing=true&readonly=true&schema=" + schemaPath + "&permission=" + permissionPath,
+		} {
+			_, err := connector.ConnectWithContext(context.Background(), "rapierdb://"+dbPath+"?"+query)
+			assert.Error(t, err, query)
+		}
+	})
+
+	t.Run("数据库不存在时创建", func(t *testing.T) {
+		conn, err := connector.ConnectWithContext(context.Background(), "rapierdb://"+dbPath+"?createIfMissing=true&sync=false&cacheSize=1048576&memTableSize=4194304&docsCacheSize=10&schema="+schemaPath+"&permission="+permissionPath)
+		assert.NoError(t, err)
+		assert.NoError(t, conn.Open())
+		assert.Equal(t, "testdb", conn.GetDatabaseMeta().GetDatabaseSchema().Name)
+		assert.NoError(t, conn.Commit(&db_conn.Transaction{TxID: "tx1", Committer: "admin"}))
+		assert.NoError(t, conn.Close())
+	})
+
+	t.Run("只读连接拒绝写入", func(t *testing.T) {
+		conn, err := connector.ConnectWithContext(context.Background(), "rapierdb://"+dbPath+"?readonly=true&enableWal=false")
+		assert.NoError(t, err)
+		assert.NoError(t, conn.Open())
+		err = conn.Commit(&db_conn.Transaction{TxID: "tx2", Committer: "admin"})
+		assert.ErrorIs(t, err, db_conn.ErrReadOnly)
+		assert.ErrorIs(t, conn.UpdatePermissionJs(`Permission.create({ version: "1.0.1", rules: {} });`), db_conn.ErrReadOnly)
+		assert.NoError(t, conn.Close())
+	})
+}
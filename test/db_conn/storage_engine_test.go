@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"testing"
@@ -25,44 +26,116 @@ func TestKeyUtils(t *testing.T) {
 		assert.Equal(t, "doc1", docId)
 	})
 
-	t.Run("calcDocKey 应该检查字段长度限制", func(t *testing.T) {
-		// 集合名称太长
-		_, err := key_utils.CalcDocKey("very_very_very_long_collection_name", "doc1")
-		assert.Error(t, err)
+	t.Run("calcDocKey 应该支持任意长度和包含 0 字节的集合名和文档ID", func(t *testing.T) {
+		tests := [][2]string{
+			{"very_very_very_long_collection_name", "3f2504e0-4f89-11d3-9a0c-0305e82c3301"},
+			{"a\x00b", "doc\x00"},
+			{"users", ""},
+		}
+		for _, tt := range tests {
+			key, err := key_utils.CalcDocKey(tt[0], tt[1])
+			assert.NoError(t, err)
+			collection, docId, err := key_utils.ParseDocKey(key)
+			assert.NoError(t, err)
+			assert.Equal(t, tt[0], collection)
+			assert.Equal(t, tt[1], docId)
+		}
 
-		// 文档ID太长
-		_, err = key_utils.CalcDocKey("users", "very_very_very_long_document_id")
+		_, err := key_utils.CalcDocKey("", "doc1")
 		assert.Error(t, err)
 	})
 
+	t.Run("文档键值应该先按集合名再按文档ID排序", func(t *testing.T) {
+		ordered := [][2]string{
+			{"a", "x"},
+			{"a\x00", ""},
+			{"ab", ""},
+			{"user", "zzz"},
+			{"users", ""},
+			{"users", "a"},
+			{"users", "a\x00"},
+			{"users", "b"},
+			{"users\x00", "a"},
+			{"users2", "a"},
+		}
+		for i := 1; i < len(ordered); i++ {
+			prev, err := key_utils.CalcDocKey(ordered[i-1][0], ordered[i-1][1])
+			assert.NoError(t, err)
+			key, err := key_utils.CalcDocKey(ordered[i][0], ordered[i][1])
+			assert.NoError(t, err)
+			assert.Negative(t, bytes.Compare(prev, key), "%q should be before %q", ordered[i-1], ordered[i])
+		}
+	})
+
 	t.Run("calcCollectionLowerBound 和 calcCollectionUpperBound 应该正确计算范围", func(t *testing.T) {
 		lower, err := key_utils.CalcCollectionLowerBound("users")
 		assert.NoError(t, err)
-
 		upper, err := key_utils.CalcCollectionUpperBound("users")
 		assert.NoError(t, err)
 
-		// 验证下界和上界包含相同的数据库和集合名称
 		collection, err := key_utils.GetCollectionNameFromKey(lower)
 		assert.NoError(t, err)
 		assert.Equal(t, "users", collection)
-		collection, err = key_utils.GetCollectionNameFromKey(upper)
+
+		inRange := func(collection, docId string) bool {
+			key, err := key_utils.CalcDocKey(collection, docId)
+			assert.NoError(t, err)
+			return bytes.Compare(lower, key) <= 0 && bytes.Compare(key, upper) < 0
+		}
+		assert.True(t, inRange("users", ""))
+		assert.True(t, inRange("users", "doc1"))
+		assert.True(t, inRange("users", "\xff\xff\xff"))
+		assert.False(t, inRange("user", "s"))
+		assert.False(t, inRange("users2", "doc1"))
+		assert.False(t, inRange("users\x00", "doc1"))
+	})
+
+	t.Run("墓碑和已清除文档的键", func(t *testing.T) {
+		key, err := key_utils.CalcTombstoneKey("users\x00", "doc1")
 		assert.NoError(t, err)
-		assert.Equal(t, "users", collection)
+		collection, docId, err := key_utils.ParseTombstoneKey(key)
+		assert.NoError(t, err)
+		assert.Equal(t, "users\x00", collection)
+		assert.Equal(t, "doc1", docId)
 
-		// 验证下界的文档ID部分全为0
-		docIdLower, err := key_utils.GetDocIdFromKey(lower)
+		key, err = key_utils.CalcPurgedKey("users", "doc1")
 		assert.NoError(t, err)
-		for _, b := range []byte(docIdLower) {
-			assert.Equal(t, byte(0), b)
-		}
+		_, _, err = key_utils.ParseTombstoneKey(key)
+		assert.Error(t, err)
+		_, docId, err = key_utils.ParsePurgedKey(key)
+		assert.NoError(t, err)
+		assert.Equal(t, "doc1", docId)
+	})
 
-		// 验证上界的文档ID部分全为0xFF
-		docIdUpper, err := key_utils.GetDocIdFromKey(upper)
+	t.Run("TTL 索引的键应该按过期时间排序", func(t *testing.T) {
+		early, err := key_utils.CalcTtlKey(1000, "users", "b")
 		assert.NoError(t, err)
-		for _, b := range []byte(docIdUpper) {
-			assert.Equal(t, byte(0xFF), b)
-		}
+		late, err := key_utils.CalcTtlKey(256000, "users", "a")
+		assert.NoError(t, err)
+		assert.Less(t, string(early), string(late))
+		assert.Less(t, string(early), string(key_utils.CalcTtlUpperBound(1001)))
+		assert.GreaterOrEqual(t, string(late), string(key_utils.CalcTtlUpperBound(1001)))
+
+		expiresAt, collection, docId, err := key_utils.ParseTtlKey(late)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(256000), expiresAt)
+		assert.Equal(t, "users", collection)
+		assert.Equal(t, "a", docId)
+		_, _, _, err = key_utils.ParseTtlKey([]byte("x123"))
+		assert.Error(t, err)
+	})
+
+	t.Run("旧的定长格式", func(t *testing.T) {
+		key, err := key_utils.CalcFixedWidthDocKey("users", "doc1")
+		assert.NoError(t, err)
+		assert.Len(t, key, key_utils.KEY_SIZE_IN_BYTES)
+		collection, docId, err := key_utils.ParseFixedWidthDocKey(key)
+		assert.NoError(t, err)
+		assert.Equal(t, "users", collection)
+		assert.Equal(t, "doc1", docId)
+
+		_, err = key_utils.CalcFixedWidthDocKey("users", "very_very_very_long_document_id")
+		assert.Error(t, err)
 	})
 }
 
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTombstoneGc(t *testing.T) {
+	t.Parallel()
+	doc := loro.NewLoroDoc()
+	assert.NoError(t, doc.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("title", "hello"))
+	snapshot := doc.ExportSnapshot().Bytes()
+	conn := newTestMemConn(t, nil,
+		&db_conn.InsertOp{Collection: "posts", DocID: "p1", Snapshot: snapshot},
+		&db_conn.InsertOp{Collection: "posts", DocID: "p2", Snapshot: snapshot},
+	)
+	assert.NoError(t, conn.Commit(&db_conn.Transaction{
+		TxID:       "tx2",
+		Committer:  "client1",
+		Operations: []db_conn.TransactionOp{&db_conn.DeleteOp{Collection: "posts", DocID: "p1"}},
+	}))
+
+	// 保留期内的墓碑不会被清除
+	gc := db_conn.NewTombstoneGc(conn, &db_conn.TombstoneGcOptions{Retention: time.Hour})
+	purged, err := gc.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, purged)
+	assert.True(t, doc_visitor.IsDeleted(util.Must(conn.LoadDoc("posts", "p1"))))
+
+	purged, err = conn.PurgeTombstones(time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	_, err = conn.LoadDoc("posts", "p1")
+	assert.Error(t, err)
+	assert.True(t, util.Must(conn.IsPurged("posts", "p1")))
+	assert.False(t, util.Must(conn.IsPurged("posts", "p2")))
+	assert.Empty(t, util.Must(conn.LoadDocHistory("posts", "p1")))
+	assert.Len(t, util.Must(conn.LoadCollection("posts")), 1)
+
+	stats := gc.Stats()
+	assert.Equal(t, int64(1), stats.Runs)
+	assert.Equal(t, int64(0), stats.Processed)
+	assert.NoError(t, stats.LastErr)
+
+	// 被清除的文档 id 可以重新使用
+	assert.NoError(t, conn.Commit(&db_conn.Transaction{
+		TxID:       "tx3",
+		Committer:  "client1",
+		Operations: []db_conn.TransactionOp{&db_conn.InsertOp{Collection: "posts", DocID: "p1", Snapshot: snapshot}},
+	}))
+	assert.False(t, util.Must(conn.IsPurged("posts", "p1")))
+}
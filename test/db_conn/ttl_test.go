@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTtlSweeper(t *testing.T) {
+	t.Parallel()
+	dbSchema := db_conn.DatabaseSchema{
+		Name:    "testdb",
+		Version: "1.0.0",
+		Collections: map[string]*db_conn.CollectionSchema{
+			"sessions": {
+				Name: "sessions",
+				DocSchema: &db_conn.DocSchema{Fields: map[string]any{
+					"createdAt": &db_conn.DateSchema{},
+				}},
+				Ttl: &db_conn.TtlSchema{Field: "createdAt", Seconds: 60},
+			},
+		},
+	}
+	newSession := func(createdAt time.Time) []byte {
+		doc := loro.NewLoroDoc()
+		assert.NoError(t, doc.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("createdAt", createdAt.UnixMilli()))
+		return doc.ExportSnapshot().Bytes()
+	}
+	now := time.Now()
+	conn := newTestMemConn(t, &dbSchema,
+		&db_conn.InsertOp{Collection: "sessions", DocID: "old", Snapshot: newSession(now.Add(-time.Hour))},
+		&db_conn.InsertOp{Collection: "sessions", DocID: "new", Snapshot: newSession(now)},
+	)
+
+	expired, err := conn.ExpiredDocs(now, 10)
+	assert.NoError(t, err)
+	assert.Len(t, expired, 1)
+	assert.Equal(t, "old", expired[0].DocID)
+
+	committers := make(chan string, 1)
+	unsubscribe := conn.GetCommittedEb().SubscribeCallback(func(ev *db_conn.TransactionCommittedEvent) {
+		committers <- ev.Committer
+	})
+	defer unsubscribe()
+
+	sweeper := db_conn.NewTtlSweeper(conn, nil)
+	deleted, err := sweeper.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.Equal(t, db_conn.SystemCommitter, <-committers)
+	assert.True(t, doc_visitor.IsDeleted(util.Must(conn.LoadDoc("sessions", "old"))))
+	assert.False(t, doc_visitor.IsDeleted(util.Must(conn.LoadDoc("sessions", "new"))))
+
+	// 删除的文档不再出现在 TTL 索引中
+	expired, err = conn.ExpiredDocs(now.Add(2*time.Minute), 10)
+	assert.NoError(t, err)
+	assert.Len(t, expired, 1)
+	assert.Equal(t, "new", expired[0].DocID)
+	assert.Equal(t, int64(1), sweeper.Stats().Processed)
+}
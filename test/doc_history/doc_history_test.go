@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/doc_history"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	from := map[string]any{
+		"title": "a",
+		"tags":  []any{"x"},
+		"meta":  map[string]any{"views": 1.0, "a/b": true},
+		"old":   "gone",
+	}
+	to := map[string]any{
+		"title": "b",
+		"tags":  []any{"x"},
+		"meta":  map[string]any{"views": 2.0},
+		"new":   nil,
+	}
+	ops := doc_history.Diff(from, to)
+	patch, err := json.Marshal(ops)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"op": "remove", "path": "/meta/a~1b"},
+		{"op": "replace", "path": "/meta/views", "value": 2},
+		{"op": "add", "path": "/new", "value": null},
+		{"op": "remove", "path": "/old"},
+		{"op": "replace", "path": "/title", "value": "b"}
+	]`, string(patch))
+
+	assert.Empty(t, doc_history.Diff(to, to))
+}
+
+func TestDocHistory(t *testing.T) {
+	conn := newTestMemConn(t)
+
+	doc := loro.NewLoroDoc()
+	assert.NoError(t, doc.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("title", "v1"))
+	assert.NoError(t, conn.Commit(&db_conn.Transaction{
+		TxID:       "tx1",
+		Committer:  "client1",
+		Operations: []db_conn.TransactionOp{&db_conn.InsertOp{Collection: "posts", DocID: "p1", Snapshot: doc.ExportSnapshot().Bytes()}},
+	}))
+
+	// 第二次提交修改标题并增加一个字段
+	vv := doc.GetOplogVv()
+	assert.NoError(t, doc.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("title", "v2"))
+	assert.NoError(t, doc.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("body", "hello"))
+	assert.NoError(t, conn.Commit(&db_conn.Transaction{
+		TxID:       "tx2",
+		Committer:  "client2",
+		Operations: []db_conn.TransactionOp{&db_conn.UpdateOp{Collection: "posts", DocID: "p1", Update: doc.ExportUpdatesFrom(vv).Bytes()}},
+	}))
+
+	versions, err := conn.LoadDocHistory("posts", "p1")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, "tx1", versions[0].TxID)
+	assert.Equal(t, "client2", versions[1].Committer)
+	assert.Less(t, versions[0].Seq, versions[1].Seq)
+
+	current := util.Must(conn.LoadDoc("posts", "p1"))
+	past := doc_history.DocAt(current, versions[0].Frontiers)
+	assert.Equal(t, map[string]any{"title": "v1"}, util.Must(doc_history.Value(past)))
+	assert.Empty(t, util.Must(doc_history.Value(doc_history.DocAt(current, nil))))
+
+	// 恢复到第一个版本，第一个版本中没有的字段被设为 null
+	update, restored, err := doc_history.RestoreUpdate(current, past)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"title": "v1", "body": nil}, util.Must(doc_history.Value(restored)))
+	assert.NoError(t, conn.Commit(&db_conn.Transaction{
+		TxID:       "tx3",
+		Committer:  "client1",
+		Operations: []db_conn.TransactionOp{&db_conn.UpdateOp{Collection: "posts", DocID: "p1", Update: update}},
+	}))
+	versions, err = conn.LoadDocHistory("posts", "p1")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 3)
+}
+
+// newTestMemConn 创建名为 t.Name() 的空内存数据库并打开一个连接，测试结束时关闭连接并删除数据库
+func newTestMemConn(t *testing.T) db_conn.DbConnection {
+	dbSchema := db_conn.DatabaseSchema{
+		Name:        "testdb",
+		Version:     "1.0.0",
+		Collections: map[string]*db_conn.CollectionSchema{},
+	}
+	assert.NoError(t, db_conn.CreateNewMemDb(t.Name(), &dbSchema, `Permission.create({ version: "1.0.0", rules: {} });`))
+	t.Cleanup(func() { db_conn.DropMemDb(t.Name()) })
+	conn, err := db_conn.NewMemDbConnWithContext(context.Background(), &db_conn.MemDbConnParams{Name: t.Name()})
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Open())
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
@@ -5,6 +5,7 @@ import (
 	_ "embed"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"strings"
 	"testing"
 
@@ -55,3 +56,85 @@ func TestMiscEncodingDecoding(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, query1, decoded)
 }
+
+func TestTransactionFailedMessageEncodingDecoding(t *testing.T) {
+	msg := &message.TransactionFailedMessageV1{
+		TxID:   "tx1",
+		Reason: errors.New("transaction failed to pass authorization"),
+		Denial: &message.PermissionDenialV1{
+			Rule:       "canUpdate",
+			Collection: "postMetas",
+			DocId:      "p1",
+			OpIndex:    2,
+			Reason:     "not owner",
+			Line:       12,
+			Column:     7,
+		},
+	}
+	encoded, err := msg.Encode()
+	assert.NoError(t, err)
+	decoded, err := message.DecodeMessage(bytes.NewBuffer(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, msg, decoded)
+
+	// 没有 Denial 的旧编码仍然可以解码
+	msg.Denial = nil
+	encoded, err = msg.Encode()
+	assert.NoError(t, err)
+	decoded, err = message.DecodeMessage(bytes.NewBuffer(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, msg, decoded)
+}
+
+func TestDocHistoryMessageEncodingDecoding(t *testing.T) {
+	req := &message.DocHistoryMessageV1{
+		RequestId:  "req1",
+		Action:     message.DOC_HISTORY_DIFF,
+		Collection: "postMetas",
+		DocId:      "p1",
+		FromSeq:    1,
+		Seq:        1700000000000000000,
+	}
+	encoded, err := req.Encode()
+	assert.NoError(t, err)
+	decoded, err := message.DecodeMessage(bytes.NewBuffer(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, req, decoded)
+
+	resp := &message.DocHistoryRespMessageV1{
+		RequestId: "req1",
+		Versions: []message.DocVersionV1{
+			{Seq: 1, Frontiers: []byte{1, 2, 3}, TxID: "tx1", Committer: "client1", Timestamp: 1700000000000},
+			{Seq: 2, Frontiers: []byte{4, 5}, TxID: "tx2", Committer: "client2", Timestamp: 1700000000001},
+		},
+		Snapshot: []byte{},
+		Patch:    []byte(`[{"op":"replace","path":"/title","value":"b"}]`),
+		Error:    "",
+	}
+	encoded, err = resp.Encode()
+	assert.NoError(t, err)
+	decoded, err = message.DecodeMessage(bytes.NewBuffer(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, resp, decoded)
+
+	// 被拒绝的请求带有权限检查结果
+	resp = &message.DocHistoryRespMessageV1{
+		RequestId: "req2",
+		Versions:  []message.DocVersionV1{},
+		Snapshot:  []byte{},
+		Patch:     []byte{},
+		Error:     "permission denied",
+		Denial: &message.PermissionDenialV1{
+			Rule:       "canView",
+			Collection: "postMetas",
+			DocId:      "p1",
+			OpIndex:    -1,
+			Reason:     "private post",
+		},
+	}
+	encoded, err = resp.Encode()
+	assert.NoError(t, err)
+	decoded, err = message.DecodeMessage(bytes.NewBuffer(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, resp, decoded)
+}
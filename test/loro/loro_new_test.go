@@ -104,11 +104,38 @@ func TestVersionGap(t *testing.T) {
 	updateFromVv1 := doc2.ExportUpdatesFrom(vv1).Bytes()
 
 	doc3 := doc1.Fork()
-	status := doc3.Import(updateFromVv21)
+	status, err := doc3.Import(updateFromVv21)
+	assert.NoError(t, err)
 	assert.True(t, status.GetSuccess().IsEmpty())
 	assert.NotNil(t, status.GetPending())
 
-	status2 := doc3.Import(updateFromVv1)
+	status2, err := doc3.Import(updateFromVv1)
+	assert.NoError(t, err)
 	assert.False(t, status2.GetSuccess().IsEmpty())
 	assert.Nil(t, status2.GetPending())
 }
+
+func TestImportFailed(t *testing.T) {
+	doc := loro.NewLoroDoc()
+	assert.NoError(t, doc.GetMap("data").InsertValueCoerce("age", 30))
+	vv := doc.GetOplogVv()
+
+	// 损坏的数据无法导入，文档不变
+	status, err := doc.Import([]byte("not a loro blob"))
+	assert.ErrorIs(t, err, loro.ErrLoroImportFailed)
+	assert.Nil(t, status)
+	assert.Equal(t, loro.PartialOrderEq, doc.GetOplogVv().PartialCompare(vv))
+	assert.Equal(t, int64(30), doc.GetMap("data").MustGet("age"))
+
+	// 依赖浅快照之前历史的更新也无法导入
+	fork := doc.Fork()
+	assert.NoError(t, doc.GetMap("data").InsertValueCoerce("age", 31))
+	shallowBytes, err := doc.ExportShallowSnapshot(doc.GetOplogFrontiers())
+	assert.NoError(t, err)
+	shallow := loro.NewLoroDoc()
+	_, err = shallow.Import(shallowBytes.Bytes())
+	assert.NoError(t, err)
+	assert.NoError(t, fork.GetMap("data").InsertValueCoerce("name", "John"))
+	_, err = shallow.Import(fork.ExportUpdatesFrom(vv).Bytes())
+	assert.ErrorIs(t, err, loro.ErrLoroImportFailed)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyze(t *testing.T) {
+	schema, err := db_conn.NewDatabaseSchemaFromJs(testSchema1)
+	assert.NoError(t, err)
+
+	permission, err := permission_proxy.NewPermissionFromJs(testPermissionConditional)
+	assert.NoError(t, err)
+	assert.Empty(t, permission.Analyze(schema))
+
+	// rules 在 version 之前，并且有额外的 description
+	permission, err = permission_proxy.NewPermissionFromJs(`Permission.create({
+  rules: {
+    postMetas: {
+      canView: ({ doc, clientId, db }) => {
+        const users = db.userz.find({ filter: eq(field("id"), clientId) });
+        return doc.ownr === clientId || isAdmin(clientId);
+      },
+      canCreate: (params) => params.newDoc.title !== "" && !params.newDoc.deleted,
+      canDelete: ({ doc: d }) => new Date() > d.createdAt,
+      fields: {
+        secret: { canRead: () => false },
+      },
+    },
+    comments: {
+      canView: () => true,
+    },
+  },
+  version: "1.0.0",
+  description: "extra keys are ignored",
+});`)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0.0", permission.Version)
+
+	messages := make(map[string]string)
+	for _, d := range permission.Analyze(schema) {
+		messages[d.Message] = d.Severity
+		assert.Greater(t, d.Line, 0, d.String())
+	}
+	assert.Equal(t, map[string]string{
+		"collection userz is not defined in schema":                        permission_proxy.SeverityError,
+		"field ownr is not defined in schema of collection postMetas":      permission_proxy.SeverityError,
+		"undefined identifier isAdmin":                                     permission_proxy.SeverityError,
+		"new expression is not supported":                                  permission_proxy.SeverityWarning,
+		"undefined identifier Date":                                        permission_proxy.SeverityError,
+		"field createdAt is not defined in schema of collection postMetas": permission_proxy.SeverityError,
+		"field secret is not defined in schema":                            permission_proxy.SeverityError,
+		"collection comments is not defined in schema":                     permission_proxy.SeverityError,
+	}, messages)
+}
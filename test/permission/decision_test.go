@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecision(t *testing.T) {
+	permission, err := permission_proxy.NewPermissionFromJs(`Permission.create({
+  version: "1.0.0",
+  rules: {
+    posts: {
+      canView: ({ clientId }) => clientId === "admin" ? true : { allow: false, reason: "not admin" },
+      canDelete: ({ clientId }) => {
+        return clientId.length > missing;
+      },
+    },
+  },
+});`)
+	assert.NoError(t, err)
+
+	decision := permission.DecideView(permission_proxy.CanViewParams{Collection: "posts", DocId: "p1", ClientId: "admin"})
+	assert.True(t, decision.Allowed)
+
+	decision = permission.DecideView(permission_proxy.CanViewParams{Collection: "posts", DocId: "p1", ClientId: "u1"})
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "canView", decision.Rule)
+	assert.Equal(t, "not admin", decision.Reason)
+	assert.NoError(t, decision.Err)
+
+	// 规则出错时记录出错位置
+	decision = permission.DecideDelete(permission_proxy.CanDeleteParams{Collection: "posts", DocId: "p1", ClientId: "u1"})
+	assert.False(t, decision.Allowed)
+	assert.Error(t, decision.Err)
+	assert.Equal(t, 7, decision.Line)
+	assert.Equal(t, 34, decision.Column)
+
+	decision = permission.DecideUpdate(permission_proxy.CanUpdateParams{Collection: "posts", DocId: "p1", ClientId: "u1"})
+	assert.False(t, decision.Allowed)
+	assert.ErrorIs(t, decision.Err, permission_proxy.ErrRuleNotDefined)
+
+	decision = permission.DecideView(permission_proxy.CanViewParams{Collection: "users", ClientId: "u1"})
+	assert.ErrorIs(t, decision.Err, permission_proxy.ErrNoCollectionRule)
+}
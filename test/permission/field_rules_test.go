@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldRules(t *testing.T) {
+	permission, err := permission_proxy.NewPermissionFromJs(`Permission.create({
+  version: "1.0.0",
+  rules: {
+    users: {
+      canView: () => true,
+      fields: {
+        email: {
+          canRead: ({ clientId }) => clientId === "admin",
+        },
+      },
+    },
+    postMetas: {
+      canView: () => true,
+      canUpdate: () => true,
+      fields: {
+        owner: {
+          canWrite: ({ oldDoc }) => oldDoc === null,
+        },
+        "meta.createdAt": {
+          canWrite: () => false,
+        },
+      },
+    },
+  },
+});`)
+	assert.NoError(t, err)
+
+	users := permission.Rules["users"]
+	assert.NotNil(t, users.CanView)
+	assert.NotNil(t, users.Fields["email"].CanRead)
+	assert.Nil(t, users.Fields["email"].CanWrite)
+	assert.True(t, permission.HasFieldReadRules("users"))
+
+	postMetas := permission.Rules["postMetas"]
+	assert.Len(t, postMetas.Fields, 2)
+	assert.NotNil(t, postMetas.Fields["owner"].CanWrite)
+	assert.NotNil(t, postMetas.Fields["meta.createdAt"].CanWrite)
+	assert.False(t, permission.HasFieldReadRules("postMetas"))
+
+	_, err = permission_proxy.NewPermissionFromJs(`Permission.create({
+  version: "1.0.0",
+  rules: {
+    users: {
+      fields: {
+        email: {
+          canView: () => true,
+        },
+      },
+    },
+  },
+});`)
+	assert.ErrorIs(t, err, permission_proxy.ErrInvalidPermissionDefinition)
+}
+
+// ChangedFields 只返回被设置或删除的字段，嵌套对象中的字段以 . 分隔
+func TestChangedFields(t *testing.T) {
+	oldDoc := loro.NewLoroDoc()
+	data := oldDoc.GetMap(doc_visitor.DATA_MAP_NAME)
+	assert.NoError(t, data.InsertValueCoerce("title", "hello"))
+	assert.NoError(t, data.InsertValueCoerce("owner", "alice"))
+	meta, err := data.InsertContainer("meta", loro.NewEmptyLoroMap())
+	assert.NoError(t, err)
+	assert.NoError(t, meta.(*loro.LoroMap).InsertValueCoerce("createdAt", int64(1)))
+	assert.NoError(t, meta.(*loro.LoroMap).InsertValueCoerce("tag", "a"))
+
+	changed, err := permission_proxy.ChangedFields(nil, oldDoc)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"title", "owner", "meta", "meta.createdAt", "meta.tag"}, changed)
+
+	newDoc := oldDoc.Fork()
+	data = newDoc.GetMap(doc_visitor.DATA_MAP_NAME)
+	assert.NoError(t, data.InsertValueCoerce("title", "world"))
+	assert.NoError(t, data.Delete("owner"))
+	assert.NoError(t, data.MustGet("meta").(*loro.LoroMap).InsertValueCoerce("tag", "b"))
+
+	changed, err = permission_proxy.ChangedFields(oldDoc, newDoc)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"title", "owner", "meta.tag"}, changed)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_harness"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPermissionHarness(t *testing.T) {
+	fixture, err := permission_harness.LoadFixture("fixtures/post_metas.json")
+	assert.NoError(t, err)
+	harness, err := permission_harness.New(fixture)
+	assert.NoError(t, err)
+
+	for _, result := range harness.RunAll(fixture) {
+		assert.True(t, result.Passed, result.String())
+	}
+
+	// 期望与实际不符时报告失败和原因
+	result := harness.Run(permission_harness.Case{
+		Name:       "错误的期望",
+		ClientId:   "user3",
+		Op:         permission_harness.OpView,
+		Collection: "postMetas",
+		DocId:      "post1",
+		Expect:     permission_harness.ExpectAllow,
+	})
+	assert.False(t, result.Passed)
+	assert.Equal(t, "canView", result.Decision.Rule)
+	assert.Contains(t, result.String(), "FAIL 错误的期望: expected allow, got denied by canView of postMetas/post1")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/policy_client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostFunctions(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		req := policy_client.CheckRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch req.Action {
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+		case "broken":
+			http.Error(w, "policy not loaded", http.StatusInternalServerError)
+			return
+		}
+		resp := policy_client.CheckResponse{Allow: req.Action == "post:edit" && req.Resource == "p1"}
+		if !resp.Allow {
+			resp.Reason = "denied by policy"
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	permission, err := permission_proxy.NewPermissionFromJs(`Permission.create({
+  version: "1.0.0",
+  rules: {
+    posts: {
+      canCreate: async ({ docId }) => {
+        try {
+          return await policy.check("broken", docId);
+        } catch (e) {
+          return { allow: false, reason: "policy service unavailable" };
+        }
+      },
+      canUpdate: async ({ docId }) => {
+        const edit = policy.check("post:edit", docId);
+        const again = policy.check("post:edit", docId);
+        return (await edit) && (await again);
+      },
+      canDelete: ({ docId }) => docId === "slow" ? policy.check("slow") : policy.decide("post:delete", docId),
+    },
+  },
+});`)
+	assert.NoError(t, err)
+	permission.RegisterHostObject("policy", policy_client.NewHttpPolicyClient(server.URL).HostObject(50*time.Millisecond))
+	permission.Limits.Timeout = time.Second
+
+	db := &permission_proxy.DbWrapper{HostCalls: permission_proxy.NewHostCallCache()}
+	decision := permission.DecideUpdate(permission_proxy.CanUpdateParams{Collection: "posts", DocId: "p1", Db: db})
+	assert.True(t, decision.Allowed, decision.String())
+	decision = permission.DecideUpdate(permission_proxy.CanUpdateParams{Collection: "posts", DocId: "p2", Db: db})
+	assert.False(t, decision.Allowed, decision.String())
+	// 同一个事务中参数相同的调用只请求一次
+	decision = permission.DecideUpdate(permission_proxy.CanUpdateParams{Collection: "posts", DocId: "p1", Db: db})
+	assert.True(t, decision.Allowed, decision.String())
+	assert.Equal(t, int32(2), requests.Load())
+
+	// 规则直接返回 Promise 时等待它的结果
+	decision = permission.DecideDelete(permission_proxy.CanDeleteParams{Collection: "posts", DocId: "p1", Db: db})
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "denied by policy", decision.Reason)
+
+	// 宿主函数出错时可以在规则中捕获
+	decision = permission.DecideCreate(permission_proxy.CanCreateParams{Collection: "posts", DocId: "p1", Db: db})
+	assert.False(t, decision.Allowed)
+	assert.NoError(t, decision.Err)
+	assert.Equal(t, "policy service unavailable", decision.Reason)
+
+	// 超时
+	decision = permission.DecideDelete(permission_proxy.CanDeleteParams{Collection: "posts", DocId: "slow", Db: db})
+	assert.False(t, decision.Allowed)
+	assert.ErrorIs(t, decision.Err, permission_proxy.ErrHostCallTimeout)
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	_ "embed"
-	"fmt"
 	"testing"
 
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
@@ -76,12 +75,14 @@ func TestPermission(t *testing.T) {
 	post1, err := engine.LoadDoc("postMetas", "post1")
 	assert.NoError(t, err)
 	post1new := loro.NewLoroDoc()
-	post1new.Import(post1.ExportSnapshot().Bytes())
+	_, err = post1new.Import(post1.ExportSnapshot().Bytes())
+	assert.NoError(t, err)
 	datamap := post1new.GetMap(doc_visitor.DATA_MAP_NAME)
 	datamap.InsertValueCoerce("owner", "user2")
 
 	post1new2 := loro.NewLoroDoc()
-	post1new2.Import(post1.ExportSnapshot().Bytes())
+	_, err = post1new2.Import(post1.ExportSnapshot().Bytes())
+	assert.NoError(t, err)
 	datamap2 := post1new2.GetMap(doc_visitor.DATA_MAP_NAME)
 	datamap2.InsertValueCoerce("title", "Another Post")
 
@@ -171,20 +172,15 @@ func TestPermission(t *testing.T) {
 }
 
 func setupConn(t *testing.T) db_conn.DbConnection {
-	dbPath := t.TempDir()
-	fmt.Println("dbPath", dbPath)
 	dbSchema, err := db_conn.NewDatabaseSchemaFromJs(testSchema1)
 	assert.NoError(t, err)
 	dbPermissionsJs := testPermissionConditional
-	err = db_conn.CreateNewPebbleDb(dbPath, dbSchema, dbPermissionsJs)
+	err = db_conn.CreateNewMemDb(t.Name(), dbSchema, dbPermissionsJs)
 	assert.NoError(t, err)
+	t.Cleanup(func() { db_conn.DropMemDb(t.Name()) })
 
-	opts := db_conn.PebbleDbConnParams{
-		Path: dbPath,
-	}
-	opts.EnsureDefaults()
 	ctx := context.Background()
-	conn, err := db_conn.NewPebbleDbConnWithContext(ctx, &opts)
+	conn, err := db_conn.NewMemDbConnWithContext(ctx, &db_conn.MemDbConnParams{Name: t.Name()})
 	assert.NoError(t, err)
 	err = conn.Open()
 	assert.NoError(t, err)
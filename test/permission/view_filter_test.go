@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
+	qfe "github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/query_filter_expr"
+	"github.com/stretchr/testify/assert"
+)
+
+const viewFilterPermission = `Permission.create({
+  version: "1.0.0",
+  rules: {
+    users: {
+      canView: ({ doc, clientId }) => {
+        if (clientId === "admin") return true;
+        return doc.id === clientId;
+      },
+    },
+    posts: {
+      canView: function (params) {
+        const me = params.clientId;
+        if (params.doc.status === "draft") return params.doc.owner === me;
+        return !(params.doc.hidden === true);
+      },
+    },
+    postMetas: {
+      canView: ({ doc, clientId, db }) => {
+        const client = db.users.findOne({ filter: eq(field("id"), clientId) });
+        if (!client) return false;
+        return doc.owner === clientId || client.role === "admin";
+      },
+    },
+    banned: {
+      canView: ({ clientId }) => clientId === "nobody",
+    },
+  },
+});`
+
+func TestViewFilter(t *testing.T) {
+	permission, err := permission_proxy.NewPermissionFromJs(viewFilterPermission)
+	assert.NoError(t, err)
+
+	// 字段与常量比较时先检查字段存在且类型匹配
+	compare := func(cmp qfe.QueryFilterExpr, path string, valueType qfe.ValueType) qfe.QueryFilterExpr {
+		field := qfe.NewFieldValueExpr(qfe.NewValueExpr(path))
+		return qfe.NewAndExpr([]qfe.QueryFilterExpr{
+			qfe.NewExistsExpr(qfe.NewValueExpr(path)),
+			qfe.NewOrExpr([]qfe.QueryFilterExpr{
+				qfe.NewIsTypeExpr(field, valueType),
+				qfe.NewIsTypeExpr(field, qfe.ValueTypeNull),
+			}),
+			cmp,
+		})
+	}
+	field := func(path string) qfe.QueryFilterExpr {
+		return qfe.NewFieldValueExpr(qfe.NewValueExpr(path))
+	}
+
+	tests := []struct {
+		name       string
+		collection string
+		clientId   string
+		want       qfe.QueryFilterExpr
+	}{
+		{
+			name:       "常量条件为 true 时不需要过滤",
+			collection: "users",
+			clientId:   "admin",
+			want:       nil,
+		},
+		{
+			name:       "字段与 clientId 比较",
+			collection: "users",
+			clientId:   "u1",
+			want:       compare(qfe.NewEqExpr(field("id"), qfe.NewValueExpr("u1")), "id", qfe.ValueTypeString),
+		},
+		{
+			name:       "if 语句和单个比较取反",
+			collection: "posts",
+			clientId:   "u1",
+			want: qfe.NewOrExpr([]qfe.QueryFilterExpr{
+				qfe.NewAndExpr([]qfe.QueryFilterExpr{
+					compare(qfe.NewEqExpr(field("status"), qfe.NewValueExpr("draft")), "status", qfe.ValueTypeString),
+					compare(qfe.NewEqExpr(field("owner"), qfe.NewValueExpr("u1")), "owner", qfe.ValueTypeString),
+				}),
+				qfe.NewAndExpr([]qfe.QueryFilterExpr{
+					compare(qfe.NewNeExpr(field("status"), qfe.NewValueExpr("draft")), "status", qfe.ValueTypeString),
+					compare(qfe.NewNeExpr(field("hidden"), qfe.NewValueExpr(true)), "hidden", qfe.ValueTypeBoolean),
+				}),
+			}),
+		},
+		{
+			name:       "依赖数据库查询的条件无法下推",
+			collection: "postMetas",
+			clientId:   "u1",
+			want:       nil,
+		},
+		{
+			name:       "常量条件为 false 时不返回任何文档",
+			collection: "banned",
+			clientId:   "u1",
+			want:       qfe.NewValueExpr(false),
+		},
+		{
+			name:       "没有规则的集合不返回任何文档",
+			collection: "unknown",
+			clientId:   "u1",
+			want:       qfe.NewValueExpr(false),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := permission.ViewFilter(tt.collection, tt.clientId)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query_executor"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupMemConn 创建一个内存数据库，并用一个事务插入 docs
+// docs: 集合名 -> 文档 ID -> 字段
+func setupMemConn(t *testing.T, dbSchema *db_conn.DatabaseSchema, permissionJs string, docs map[string]map[string]map[string]any) db_conn.DbConnection {
+	assert.NoError(t, db_conn.CreateNewMemDb(t.Name(), dbSchema, permissionJs))
+	t.Cleanup(func() { db_conn.DropMemDb(t.Name()) })
+	conn, err := db_conn.NewMemDbConnWithContext(context.Background(), &db_conn.MemDbConnParams{Name: t.Name()})
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Open())
+	t.Cleanup(func() { conn.Close() })
+
+	tr := &db_conn.Transaction{TxID: "setup", Committer: "setup"}
+	for collection, collectionDocs := range docs {
+		for docId, fields := range collectionDocs {
+			tr.Operations = append(tr.Operations, &db_conn.InsertOp{
+				Collection: collection,
+				DocID:      docId,
+				Snapshot:   newDocSnapshot(t, fields),
+			})
+		}
+	}
+	assert.NoError(t, conn.Commit(tr))
+	return conn
+}
+
+func newDocSnapshot(t *testing.T, fields map[string]any) []byte {
+	doc := loro.NewLoroDoc()
+	dataMap := doc.GetMap(doc_visitor.DATA_MAP_NAME)
+	for k, v := range fields {
+		assert.NoError(t, dataMap.InsertValueCoerce(k, v))
+	}
+	return doc.ExportSnapshot().Bytes()
+}
+
+func docIds(result query.FindManyResult) []string {
+	ids := make([]string, len(result))
+	for i, doc := range result {
+		ids[i] = doc.DocId
+	}
+	return ids
+}
+
+func TestFindManyCursor(t *testing.T) {
+	dbSchema := &db_conn.DatabaseSchema{
+		Name:    "testdb",
+		Version: "1.0.0",
+		Collections: map[string]*db_conn.CollectionSchema{
+			"users": {
+				Name: "users",
+				DocSchema: &db_conn.DocSchema{Fields: map[string]any{
+					"age": &db_conn.NumberSchema{},
+				}},
+			},
+		},
+	}
+	// b 和 c 的 age 相同，按文档 ID 决胜
+	conn := setupMemConn(t, dbSchema, `Permission.create({ version: "1.0.0", rules: {} });`, map[string]map[string]map[string]any{
+		"users": {
+			"a": {"age": 20},
+			"b": {"age": 30},
+			"c": {"age": 30},
+			"d": {"age": 40},
+			"e": {"age": 50},
+		},
+	})
+	qe := query_executor.NewQueryExecutor(conn)
+
+	newQuery := func() *query.FindManyQuery {
+		return &query.FindManyQuery{
+			Collection: "users",
+			Sort:       []query.SortField{{Field: "age", Order: query.SortOrderAsc}},
+		}
+	}
+	cursorOf := func(docId string) *query.Cursor {
+		doc, err := conn.LoadDoc("users", docId)
+		assert.NoError(t, err)
+		c, err := newQuery().CursorOf(&query.DocWithId{DocId: docId, Doc: doc})
+		assert.NoError(t, err)
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		after  string
+		before string
+		skip   int64
+		limit  int64
+		want   []string
+	}{
+		{name: "after，排序值相同的文档按 ID 排在游标之后", after: "b", want: []string{"c", "d", "e"}},
+		{name: "after + limit", after: "b", limit: 2, want: []string{"c", "d"}},
+		{name: "after 指向排序值相同的后一个文档", after: "c", want: []string{"d", "e"}},
+		{name: "before", before: "d", want: []string{"a", "b", "c"}},
+		{name: "before + limit 保留离游标最近的文档", before: "d", limit: 2, want: []string{"b", "c"}},
+		{name: "before + skip 从游标处往前跳过", before: "d", skip: 1, limit: 1, want: []string{"b"}},
+		{name: "before 指向排序值相同的后一个文档", before: "c", want: []string{"a", "b"}},
+		{name: "after + before", after: "a", before: "e", want: []string{"b", "c", "d"}},
+		{name: "after + before + skip + limit", after: "a", before: "e", skip: 1, limit: 1, want: []string{"c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQuery()
+			q.Skip = tt.skip
+			q.Limit = tt.limit
+			if tt.after != "" {
+				assert.NoError(t, q.SetAfter(cursorOf(tt.after)))
+			}
+			if tt.before != "" {
+				assert.NoError(t, q.SetBefore(cursorOf(tt.before)))
+			}
+			result, err := qe.FindMany(q)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, docIds(result))
+		})
+	}
+
+	// 不排序时按文档 ID 分页
+	q := &query.FindManyQuery{Collection: "users", Limit: 2}
+	assert.NoError(t, q.SetAfter(&query.Cursor{DocId: "b"}))
+	result, err := qe.FindMany(q)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c", "d"}, docIds(result))
+}
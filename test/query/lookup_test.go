@@ -0,0 +1,208 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	qfe "github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/query_filter_expr"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query_executor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/synchronizer2"
+	"github.com/stretchr/testify/assert"
+)
+
+// 只有公开的用户和用户本人能看到 users 中的文档
+const lookupPermissionJs = `Permission.create({
+  version: "1.0.0",
+  rules: {
+    postMetas: {
+      canView: ({ doc, clientId }) => true,
+    },
+    users: {
+      canView: ({ doc, clientId }) => doc.public === true || doc.id === clientId,
+    },
+  },
+});`
+
+func setupLookupConn(t *testing.T) db_conn.DbConnection {
+	dbSchema := &db_conn.DatabaseSchema{
+		Name:    "testdb",
+		Version: "1.0.0",
+		Collections: map[string]*db_conn.CollectionSchema{
+			"postMetas": {
+				Name: "postMetas",
+				DocSchema: &db_conn.DocSchema{Fields: map[string]any{
+					"owner": &db_conn.StringSchema{},
+				}},
+			},
+			"users": {
+				Name: "users",
+				DocSchema: &db_conn.DocSchema{Fields: map[string]any{
+					"id":     &db_conn.StringSchema{},
+					"public": &db_conn.BooleanSchema{},
+				}},
+			},
+		},
+	}
+	return setupMemConn(t, dbSchema, lookupPermissionJs, map[string]map[string]map[string]any{
+		"postMetas": {
+			"p1": {"owner": "u1"},
+			"p2": {"owner": "u2"},
+			"p3": {"owner": "u3"},
+		},
+		"users": {
+			"u1": {"id": "u1", "public": true},
+			"u2": {"id": "u2", "public": true},
+			"u3": {"id": "u3", "public": false},
+		},
+	})
+}
+
+func newLookupQuery() *query.FindManyQuery {
+	q := &query.FindManyQuery{Collection: "postMetas"}
+	q.AddLookup("users", "owner", "id")
+	return q
+}
+
+func docKey(t *testing.T, collection, docId string) string {
+	key, err := key_utils.CalcDocKey(collection, docId)
+	assert.NoError(t, err)
+	return string(key)
+}
+
+// commitAndHandle 提交事务，再交给 QueryManager 处理，和 Synchronizer 的顺序一致
+func commitAndHandle(t *testing.T, conn db_conn.DbConnection, qm *synchronizer2.QueryManager, ops ...db_conn.TransactionOp) map[string]*synchronizer2.ClientUpdates {
+	tr := &db_conn.Transaction{TxID: t.Name(), Committer: "writer", Operations: ops}
+	assert.NoError(t, conn.Commit(tr))
+	return qm.HandleTransaction(tr)
+}
+
+func updateFieldOp(t *testing.T, conn db_conn.DbConnection, collection, docId, field string, value any) *db_conn.UpdateOp {
+	doc, err := conn.LoadDoc(collection, docId)
+	assert.NoError(t, err)
+	doc = doc.Fork()
+	vv := doc.GetOplogVv()
+	assert.NoError(t, doc.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce(field, value))
+	return &db_conn.UpdateOp{Collection: collection, DocID: docId, Update: doc.ExportUpdatesFrom(vv).Bytes()}
+}
+
+func TestLookupExecution(t *testing.T) {
+	conn := setupLookupConn(t)
+	qe := query_executor.NewQueryExecutor(conn)
+
+	q := newLookupQuery()
+	result, err := qe.FindMany(q)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"p1", "p2", "p3"}, docIds(result))
+
+	lookupResult, err := qe.Lookup(q, result)
+	assert.NoError(t, err)
+	assert.Len(t, lookupResult, 1)
+	assert.ElementsMatch(t, []string{"u1", "u2", "u3"}, docIds(lookupResult[0]))
+
+	// 只关联结果集中文档引用的用户
+	q.Limit = 1
+	result, err = qe.FindMany(q)
+	assert.NoError(t, err)
+	lookupResult, err = qe.Lookup(q, result)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"u1"}, docIds(lookupResult[0]))
+
+	// 关联不存在的集合会报错
+	q.Lookups[0].From = "comments"
+	_, err = qe.Lookup(q, result)
+	assert.Error(t, err)
+
+	// 已删除的文档不会被关联
+	assert.NoError(t, conn.Commit(&db_conn.Transaction{
+		TxID:       "delete-u1",
+		Committer:  "writer",
+		Operations: []db_conn.TransactionOp{&db_conn.DeleteOp{Collection: "users", DocID: "u1"}},
+	}))
+	q = newLookupQuery()
+	result, err = qe.FindMany(q)
+	assert.NoError(t, err)
+	lookupResult, err = qe.Lookup(q, result)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"u2", "u3"}, docIds(lookupResult[0]))
+}
+
+func TestLookupLiveUpdates(t *testing.T) {
+	conn := setupLookupConn(t)
+	qe := query_executor.NewQueryExecutor(conn)
+	permissionProxy, err := permission_proxy.NewPermissionProxy(conn, nil)
+	assert.NoError(t, err)
+	qm := synchronizer2.NewQueryManager(qe, permissionProxy)
+
+	assert.NoError(t, qm.SubscribeNewQuery("c1", newLookupQuery()))
+	assert.NoError(t, qm.SubscribeNewQuery("u3", newLookupQuery()))
+
+	// canView 过滤被关联的文档
+	keys, err := qm.ViewableDocKeys("c1", newLookupQuery())
+	assert.NoError(t, err)
+	assert.Contains(t, keys, docKey(t, "users", "u1"))
+	assert.Contains(t, keys, docKey(t, "users", "u2"))
+	assert.NotContains(t, keys, docKey(t, "users", "u3"))
+	keys, err = qm.ViewableDocKeys("u3", newLookupQuery())
+	assert.NoError(t, err)
+	assert.Contains(t, keys, docKey(t, "users", "u3"))
+
+	t.Run("被关联一侧插入文档", func(t *testing.T) {
+		commitAndHandle(t, conn, qm, &db_conn.InsertOp{Collection: "postMetas", DocID: "p4", Snapshot: newDocSnapshot(t, map[string]any{"owner": "u4"})})
+		cus := commitAndHandle(t, conn, qm, &db_conn.InsertOp{Collection: "users", DocID: "u4", Snapshot: newDocSnapshot(t, map[string]any{"id": "u4", "public": true})})
+		assert.Contains(t, cus["c1"].Updates, docKey(t, "users", "u4"))
+	})
+
+	t.Run("结果一侧修改引用", func(t *testing.T) {
+		cus := commitAndHandle(t, conn, qm, &db_conn.InsertOp{Collection: "users", DocID: "u5", Snapshot: newDocSnapshot(t, map[string]any{"id": "u5", "public": true})})
+		// u5 没有被任何文档引用
+		if cu, ok := cus["c1"]; ok {
+			assert.NotContains(t, cu.Updates, docKey(t, "users", "u5"))
+		}
+		cus = commitAndHandle(t, conn, qm, updateFieldOp(t, conn, "postMetas", "p1", "owner", "u5"))
+		assert.Contains(t, cus["c1"].Updates, docKey(t, "postMetas", "p1"))
+		assert.Contains(t, cus["c1"].Updates, docKey(t, "users", "u5"))
+	})
+
+	t.Run("不能查看的文档不会被同步", func(t *testing.T) {
+		cus := commitAndHandle(t, conn, qm, updateFieldOp(t, conn, "users", "u3", "public", false))
+		if cu, ok := cus["c1"]; ok {
+			assert.NotContains(t, cu.Updates, docKey(t, "users", "u3"))
+		}
+		assert.Contains(t, cus["u3"].Updates, docKey(t, "users", "u3"))
+	})
+
+	t.Run("被关联一侧删除文档", func(t *testing.T) {
+		cus := commitAndHandle(t, conn, qm, &db_conn.DeleteOp{Collection: "users", DocID: "u2"})
+		assert.Contains(t, cus["c1"].Deletes, docKey(t, "users", "u2"))
+		keys, err := qm.ViewableDocKeys("c1", newLookupQuery())
+		assert.NoError(t, err)
+		assert.NotContains(t, keys, docKey(t, "users", "u2"))
+	})
+}
+
+func TestDeleteOnlySentToReceivers(t *testing.T) {
+	conn := setupLookupConn(t)
+	qe := query_executor.NewQueryExecutor(conn)
+	permissionProxy, err := permission_proxy.NewPermissionProxy(conn, nil)
+	assert.NoError(t, err)
+	qm := synchronizer2.NewQueryManager(qe, permissionProxy)
+
+	q := &query.FindManyQuery{
+		Collection: "postMetas",
+		Filter:     qfe.NewEqExpr(qfe.NewFieldValueExpr(qfe.NewValueExpr("owner")), qfe.NewValueExpr("u1")),
+	}
+	assert.NoError(t, qm.SubscribeNewQuery("c1", q))
+
+	// p2 不在结果中，客户端从未收到过它
+	cus := commitAndHandle(t, conn, qm, &db_conn.DeleteOp{Collection: "postMetas", DocID: "p2"})
+	if cu, ok := cus["c1"]; ok {
+		assert.NotContains(t, cu.Deletes, docKey(t, "postMetas", "p2"))
+	}
+
+	cus = commitAndHandle(t, conn, qm, &db_conn.DeleteOp{Collection: "postMetas", DocID: "p1"})
+	assert.Contains(t, cus["c1"].Deletes, docKey(t, "postMetas", "p1"))
+}
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js_value"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/log"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query"
@@ -51,7 +52,9 @@ func prepareTestCases() []QfeTestCase {
 		}
 
 		doc := loro.NewLoroDoc()
-		doc.Import(docSnapshot)
+		if _, err := doc.Import(docSnapshot); err != nil {
+			log.Errorf("failed to import doc: %s", err)
+		}
 
 		expr, err := qfe.NewQueryFilterExprFromJson([]byte(temp.Expr))
 		if err != nil {
@@ -115,3 +118,59 @@ func TestFindManyQuery(t *testing.T) {
 	assert.Equal(t, q, decoded)
 	fmt.Printf("decoded: %+v\n", decoded)
 }
+
+func TestFindManyQueryCursor(t *testing.T) {
+	q := &query.FindManyQuery{
+		Collection: "test",
+		Sort: []query.SortField{
+			{
+				Field: "age",
+				Order: query.SortOrderDesc,
+			},
+		},
+		Limit: 10,
+	}
+
+	cursor := &query.Cursor{
+		Values: []js_value.JsValue{float64(18)},
+		DocId:  "doc1",
+	}
+	assert.NoError(t, q.SetAfter(cursor))
+
+	encoded, err := q.Encode()
+	assert.NoError(t, err)
+	decoded, err := query.DecodeFindManyQuery(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, q, decoded)
+
+	after, before, err := decoded.DecodeCursors()
+	assert.NoError(t, err)
+	assert.Nil(t, before)
+	assert.Equal(t, cursor, after)
+
+	q.After = "not a cursor"
+	encoded, err = q.Encode()
+	assert.NoError(t, err)
+	_, err = query.DecodeFindManyQuery(encoded)
+	assert.ErrorIs(t, err, query.ErrInvalidCursor)
+}
+
+func TestFindManyQueryLookup(t *testing.T) {
+	q := &query.FindManyQuery{
+		Collection: "postMetas",
+	}
+	q.AddLookup("users", "owner", "id")
+
+	encoded, err := q.Encode()
+	assert.NoError(t, err)
+	decoded, err := query.DecodeFindManyQuery(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, q, decoded)
+	assert.Equal(t, []string{"users"}, decoded.LookupCollections())
+
+	q.Lookups[0].ForeignField = ""
+	encoded, err = q.Encode()
+	assert.NoError(t, err)
+	_, err = query.DecodeFindManyQuery(encoded)
+	assert.Error(t, err)
+}
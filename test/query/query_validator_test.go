@@ -0,0 +1,96 @@
+package main
+
+import (
+	_ "embed"
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query"
+	qfe "github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/query_filter_expr"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query_validator"
+	"github.com/stretchr/testify/assert"
+)
+
+//go:embed test_schema1.js
+var testSchema1 string
+
+func field(path string) qfe.QueryFilterExpr {
+	return qfe.NewFieldValueExpr(qfe.NewValueExpr(path))
+}
+
+func TestQueryValidator(t *testing.T) {
+	schema, err := db_conn.NewDatabaseSchemaFromJs(testSchema1)
+	assert.NoError(t, err)
+	validator := query_validator.NewQueryValidator(schema)
+
+	// 合法的查询
+	q := &query.FindManyQuery{
+		Collection: "users",
+		Filter: qfe.NewAndExpr([]qfe.QueryFilterExpr{
+			qfe.NewGtExpr(field("age"), qfe.NewValueExpr(18)),
+			qfe.NewEqExpr(field("orders[0].sku"), qfe.NewValueExpr("A-1")),
+			qfe.NewEqExpr(field("settings.darkMode"), qfe.NewValueExpr(true)),
+			qfe.NewElemMatchExpr(
+				qfe.NewValueExpr("orders"),
+				qfe.NewGteExpr(field("amount"), qfe.NewValueExpr(100)),
+			),
+		}),
+		Sort: []query.SortField{{Field: "age", Order: query.SortOrderAsc}},
+	}
+	q.AddLookup("posts", "id", "owner")
+	warnings, err := validator.Validate(q)
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+
+	// 集合不存在
+	_, err = validator.Validate(&query.FindManyQuery{Collection: "comments"})
+	assert.ErrorIs(t, err, query_validator.ErrInvalidQuery)
+
+	// 字段路径拼写错误
+	_, err = validator.Validate(&query.FindManyQuery{
+		Collection: "users",
+		Filter:     qfe.NewEqExpr(field("nmae"), qfe.NewValueExpr("John")),
+	})
+	assert.ErrorIs(t, err, query_validator.ErrInvalidQuery)
+	assert.Contains(t, err.Error(), "nmae")
+
+	// number 字段与字符串比较
+	_, err = validator.Validate(&query.FindOneQuery{
+		Collection: "users",
+		Filter:     qfe.NewEqExpr(field("age"), qfe.NewValueExpr("18")),
+	})
+	assert.ErrorIs(t, err, query_validator.ErrInvalidQuery)
+	assert.Contains(t, err.Error(), "age")
+
+	// elem_match 的条件中引用了数组元素不存在的字段
+	_, err = validator.Validate(&query.FindManyQuery{
+		Collection: "users",
+		Filter: qfe.NewElemMatchExpr(
+			qfe.NewValueExpr("orders"),
+			qfe.NewEqExpr(field("price"), qfe.NewValueExpr(1)),
+		),
+	})
+	assert.ErrorIs(t, err, query_validator.ErrInvalidQuery)
+
+	// 过滤条件不是布尔值
+	_, err = validator.Validate(&query.FindManyQuery{
+		Collection: "users",
+		Filter:     field("age"),
+	})
+	assert.ErrorIs(t, err, query_validator.ErrInvalidQuery)
+
+	// lookup 的 foreignField 不存在
+	q2 := &query.FindManyQuery{Collection: "users"}
+	q2.AddLookup("posts", "id", "author")
+	_, err = validator.Validate(q2)
+	assert.ErrorIs(t, err, query_validator.ErrInvalidQuery)
+
+	// 按未建立索引的字段排序
+	warnings, err = validator.Validate(&query.FindManyQuery{
+		Collection: "users",
+		Sort:       []query.SortField{{Field: "loginCount", Order: query.SortOrderDesc}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "loginCount")
+}
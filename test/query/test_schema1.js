@@ -0,0 +1,32 @@
+Schema.database({
+  name: "testDB",
+  version: "1.0.0",
+  collections: {
+    users: Schema.collection({
+      name: "users",
+      docSchema: Schema.doc({
+        id: Schema.string().unique().index("hash"),
+        name: Schema.string().nullable(),
+        age: Schema.number().index("range"),
+        loginCount: Schema.number(),
+        createdAt: Schema.date().index("range"),
+        tags: Schema.list(Schema.string()),
+        orders: Schema.list(
+          Schema.object({
+            sku: Schema.string(),
+            amount: Schema.number(),
+          })
+        ),
+        settings: Schema.record(Schema.boolean()),
+      }),
+    }),
+    posts: Schema.collection({
+      name: "posts",
+      docSchema: Schema.doc({
+        id: Schema.string().unique().index("hash"),
+        owner: Schema.string().index("hash"),
+        title: Schema.string(),
+      }),
+    }),
+  },
+});
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/synchronizer2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// connectRedis 连接本地的 redis，不可用时跳过测试。返回本测试使用的流，测试结束时删除
+func connectRedis(t *testing.T) (*redis.Client, string) {
+	rdb := newRedisClient()
+	t.Cleanup(func() { rdb.Close() })
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		t.Skipf("redis 不可用: %v", err)
+	}
+	stream := fmt.Sprintf("test-commits-%d", time.Now().UnixNano())
+	t.Cleanup(func() { rdb.Del(context.Background(), stream, stream+":txs", stream+":checkpoint") })
+	return rdb, stream
+}
+
+func newRedisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+}
+
+// openMemDb 创建有 users 集合的内存数据库并打开一个连接，测试结束时关闭连接并删除数据库
+func openMemDb(t *testing.T, name string) db_conn.DbConnection {
+	dbSchema := db_conn.DatabaseSchema{
+		Name:    "testdb",
+		Version: "1.0.0",
+		Collections: map[string]*db_conn.CollectionSchema{
+			"users": {
+				Name:      "users",
+				DocSchema: &db_conn.DocSchema{Fields: map[string]any{}},
+			},
+		},
+	}
+	assert.NoError(t, db_conn.CreateNewMemDb(name, &dbSchema, `Permission.create({ version: "1.0.0", rules: {} });`))
+	t.Cleanup(func() { db_conn.DropMemDb(name) })
+	conn, err := db_conn.NewMemDbConnWithContext(context.Background(), &db_conn.MemDbConnParams{Name: name})
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Open())
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func insertOp(t *testing.T, docId string) *db_conn.InsertOp {
+	doc := loro.NewLoroDoc()
+	assert.NoError(t, doc.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("name", docId))
+	return &db_conn.InsertOp{Collection: "users", DocID: docId, Snapshot: doc.ExportSnapshot().Bytes()}
+}
+
+func insertTx(t *testing.T, docId string) *db_conn.Transaction {
+	return &db_conn.Transaction{
+		TxID:       "insert-" + docId,
+		Committer:  "client1",
+		Operations: []db_conn.TransactionOp{insertOp(t, docId)},
+	}
+}
+
+// startFanout 启动 conn 的提交分发
+func startFanout(t *testing.T, ctx context.Context, conn db_conn.DbConnection, opts synchronizer2.CommitFanoutOptions) *synchronizer2.CommitFanout {
+	opts.Block = 100 * time.Millisecond
+	fanout, err := synchronizer2.NewCommitFanout(conn, &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, fanout.Start(ctx))
+	return fanout
+}
+
+// hasDocs 检查 conn 中是否有 docIds 中的所有文档
+func hasDocs(conn db_conn.DbConnection, docIds ...string) bool {
+	for _, docId := range docIds {
+		if _, err := conn.LoadDoc("users", docId); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCommitFanout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rdb, stream := connectRedis(t)
+
+	// 启用分发前写入的文档由写者的检查点带给跟随者
+	storage := openMemDb(t, t.Name()+"-writer")
+	assert.NoError(t, storage.Commit(insertTx(t, "alice")))
+	writer := startFanout(t, ctx, storage, synchronizer2.CommitFanoutOptions{
+		Client:     rdb,
+		Writer:     true,
+		Stream:     stream,
+		InstanceId: "writer",
+	})
+
+	replica := openMemDb(t, t.Name()+"-follower")
+	follower := startFanout(t, ctx, replica, synchronizer2.CommitFanoutOptions{
+		Client:     rdb,
+		Stream:     stream,
+		InstanceId: "follower",
+	})
+	assert.True(t, hasDocs(replica, "alice"))
+
+	// 跟随者转发的事务由写者提交，再回放到副本
+	committed := make(chan *db_conn.TransactionCommittedEvent, 1)
+	unsubscribe := replica.GetCommittedEb().SubscribeCallback(func(ev *db_conn.TransactionCommittedEvent) {
+		committed <- ev
+	})
+	defer unsubscribe()
+	assert.NoError(t, follower.Forward(ctx, &db_conn.Transaction{
+		TxID:       "tx2",
+		Committer:  "client2",
+		Operations: []db_conn.TransactionOp{insertOp(t, "bob")},
+	}))
+	select {
+	case ev := <-committed:
+		assert.Equal(t, "tx2", ev.Transaction.TxID)
+		assert.Equal(t, "client2", ev.Committer)
+	case <-time.After(5 * time.Second):
+		t.Fatal("副本没有收到提交的事务")
+	}
+	assert.True(t, hasDocs(storage, "bob"))
+	assert.True(t, hasDocs(replica, "bob"))
+
+	// 写者回滚的事务以回滚事件通知跟随者
+	rollbacked := make(chan *db_conn.TransactionRollbackedEvent, 1)
+	unsubscribe2 := replica.GetRollbackedEb().SubscribeCallback(func(ev *db_conn.TransactionRollbackedEvent) {
+		rollbacked <- ev
+	})
+	defer unsubscribe2()
+	assert.NoError(t, follower.Forward(ctx, &db_conn.Transaction{
+		TxID:       "tx3",
+		Committer:  "client2",
+		Operations: []db_conn.TransactionOp{insertOp(t, "bob")},
+	}))
+	select {
+	case ev := <-rollbacked:
+		assert.Equal(t, "tx3", ev.Transaction.TxID)
+		assert.Error(t, ev.Reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("副本没有收到回滚的事务")
+	}
+
+	assert.Eventually(t, func() bool {
+		return writer.Stats().Consumed == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(2), follower.Stats().Forwarded)
+}
+
+// 写者存储检查点后，流和提交日志中检查点包含的提交被删除，新的跟随者从检查点开始
+func TestCommitFanoutCheckpoint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rdb, stream := connectRedis(t)
+
+	storage := openMemDb(t, t.Name()+"-writer")
+	writer := startFanout(t, ctx, storage, synchronizer2.CommitFanoutOptions{
+		Client:          rdb,
+		Writer:          true,
+		Stream:          stream,
+		InstanceId:      "writer",
+		CheckpointEvery: 2,
+	})
+	for _, docId := range []string{"alice", "bob", "carol"} {
+		assert.NoError(t, storage.Commit(insertTx(t, docId)))
+	}
+	// 启动时存储一次，第二个提交之后再存储一次
+	assert.Eventually(t, func() bool {
+		return writer.Stats().Checkpoints == 2 && writer.Stats().Unpublished == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	checkpoint, err := rdb.HGet(ctx, stream+":checkpoint", "seq").Uint64()
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, checkpoint, uint64(2))
+	msgs, err := rdb.XRange(ctx, stream, "-", "+").Result()
+	assert.NoError(t, err)
+	for _, msg := range msgs {
+		var seq, sub uint64
+		_, err := fmt.Sscanf(msg.ID, "%d-%d", &seq, &sub)
+		assert.NoError(t, err)
+		assert.Greater(t, seq, checkpoint)
+	}
+	entries, err := storage.LoadJournal(0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, checkpoint, entries[0].Seq)
+
+	replica := openMemDb(t, t.Name()+"-follower")
+	follower := startFanout(t, ctx, replica, synchronizer2.CommitFanoutOptions{
+		Client:     rdb,
+		Stream:     stream,
+		InstanceId: "follower",
+	})
+	assert.True(t, hasDocs(replica, "alice", "bob", "carol"))
+	assert.Equal(t, int64(1), follower.Stats().Resyncs)
+	assert.Equal(t, uint64(3), follower.Stats().LastSeq)
+}
+
+// redis 不可用时写者的提交不会等待发布，写者重启后从提交日志发布没有发布的提交
+func TestCommitFanoutWriterRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rdb, stream := connectRedis(t)
+
+	storage := openMemDb(t, t.Name()+"-writer")
+	writerCtx, stopWriter := context.WithCancel(ctx)
+	writerRdb := newRedisClient()
+	writer := startFanout(t, writerCtx, storage, synchronizer2.CommitFanoutOptions{
+		Client:     writerRdb,
+		Writer:     true,
+		Stream:     stream,
+		InstanceId: "writer",
+	})
+	replica := openMemDb(t, t.Name()+"-follower")
+	startFanout(t, ctx, replica, synchronizer2.CommitFanoutOptions{
+		Client:     rdb,
+		Stream:     stream,
+		InstanceId: "follower",
+	})
+	assert.NoError(t, storage.Commit(insertTx(t, "alice")))
+	assert.Eventually(t, func() bool { return hasDocs(replica, "alice") }, 5*time.Second, 10*time.Millisecond)
+
+	// 写者连不上 redis 时提交照常完成，提交留在日志中
+	writerRdb.Close()
+	for _, docId := range []string{"bob", "carol"} {
+		done := make(chan error, 1)
+		go func() { done <- storage.Commit(insertTx(t, docId)) }()
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("提交在等待发布")
+		}
+	}
+	assert.Equal(t, uint64(2), writer.Stats().Unpublished)
+	stopWriter()
+
+	restarted := startFanout(t, ctx, storage, synchronizer2.CommitFanoutOptions{
+		Client:     rdb,
+		Writer:     true,
+		Stream:     stream,
+		InstanceId: "writer",
+	})
+	assert.Eventually(t, func() bool { return hasDocs(replica, "bob", "carol") }, 5*time.Second, 10*time.Millisecond)
+	// 日志中有流之后的所有提交，不需要存储检查点
+	assert.Equal(t, uint64(0), restarted.Stats().Unpublished)
+	assert.Equal(t, int64(0), restarted.Stats().Checkpoints)
+}
+
+// 流中缺少跟随者下一个要应用的提交时，跟随者从检查点重新同步
+func TestCommitFanoutFollowerGap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rdb, stream := connectRedis(t)
+
+	storage := openMemDb(t, t.Name()+"-writer")
+	writerCtx, stopWriter := context.WithCancel(ctx)
+	writerRdb := newRedisClient()
+	startFanout(t, writerCtx, storage, synchronizer2.CommitFanoutOptions{
+		Client:     writerRdb,
+		Writer:     true,
+		Stream:     stream,
+		InstanceId: "writer",
+	})
+	replica := openMemDb(t, t.Name()+"-follower")
+	follower := startFanout(t, ctx, replica, synchronizer2.CommitFanoutOptions{
+		Client:     rdb,
+		Stream:     stream,
+		InstanceId: "follower",
+	})
+	assert.NoError(t, storage.Commit(insertTx(t, "alice")))
+	assert.Eventually(t, func() bool { return hasDocs(replica, "alice") }, 5*time.Second, 10*time.Millisecond)
+
+	// 日志中已经没有写者停止期间的提交时，重启的写者只能存储检查点，流中缺少这些提交
+	writerRdb.Close()
+	stopWriter()
+	assert.NoError(t, storage.Commit(insertTx(t, "bob")))
+	assert.NoError(t, storage.Commit(insertTx(t, "carol")))
+	assert.NoError(t, storage.TrimJournal(3))
+	restarted := startFanout(t, ctx, storage, synchronizer2.CommitFanoutOptions{
+		Client:     rdb,
+		Writer:     true,
+		Stream:     stream,
+		InstanceId: "writer",
+	})
+	assert.Equal(t, int64(1), restarted.Stats().Checkpoints)
+
+	// 跟随者在提交 1 之后读到提交 4，重新同步后得到所有文档
+	assert.NoError(t, storage.Commit(insertTx(t, "dave")))
+	assert.Eventually(t, func() bool {
+		return hasDocs(replica, "bob", "carol", "dave")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(2), follower.Stats().Resyncs)
+	assert.Equal(t, uint64(4), follower.Stats().LastSeq)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	_ "embed"
+	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
@@ -97,3 +99,28 @@ func TestNewDatabaseSchemaFromJSON(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, db_conn.MOVABLE_LIST_SCHEMA, db_conn.GetType(sortedItemsField))
 }
+
+//go:embed test_schema_ttl.js
+var testSchemaTtl string
+
+func TestCollectionTtl(t *testing.T) {
+	dbSchema, err := db_conn.NewDatabaseSchemaFromJs(testSchemaTtl)
+	assert.NoError(t, err)
+	ttl := dbSchema.Collections["sessions"].Ttl
+	assert.Equal(t, &db_conn.TtlSchema{Field: "createdAt", Seconds: 3600}, ttl)
+
+	// 序列化后应该保留 TTL
+	jsonBytes, err := json.Marshal(dbSchema.ToJSON())
+	assert.NoError(t, err)
+	var data map[string]any
+	assert.NoError(t, json.Unmarshal(jsonBytes, &data))
+	parsed, err := db_conn.NewDatabaseSchemaFromJSON(data)
+	assert.NoError(t, err)
+	assert.Equal(t, ttl, parsed.Collections["sessions"].Ttl)
+
+	// TTL 字段必须是日期字段
+	_, err = db_conn.NewDatabaseSchemaFromJs(strings.Replace(testSchemaTtl, `field: "createdAt"`, `field: "id"`, 1))
+	assert.ErrorIs(t, err, db_conn.ErrInvalidDatabaseSchema)
+	_, err = db_conn.NewDatabaseSchemaFromJs(strings.Replace(testSchemaTtl, "seconds: 3600", "seconds: 0", 1))
+	assert.Error(t, err)
+}
@@ -0,0 +1,14 @@
+Schema.database({
+  name: "testDB",
+  version: "1.0.0",
+  collections: {
+    sessions: Schema.collection({
+      name: "sessions",
+      docSchema: Schema.doc({
+        id: Schema.string(),
+        createdAt: Schema.date(),
+      }),
+      ttl: { field: "createdAt", seconds: 3600 },
+    }),
+  },
+});
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_connector"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/synchronizer2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// 跟随者的副本可能落后于写者的存储，转发的事务由写者按自己的存储重新检查权限
+func TestForwardedTransactionAuthorizedByWriter(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+	defer rdb.Close()
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		t.Skipf("redis 不可用: %v", err)
+	}
+	stream := fmt.Sprintf("test-commits-%d", time.Now().UnixNano())
+	defer rdb.Del(context.Background(), stream, stream+":txs", stream+":checkpoint")
+
+	dbSchema := &db_conn.DatabaseSchema{
+		Name:    "testdb",
+		Version: "1.0.0",
+		Collections: map[string]*db_conn.CollectionSchema{
+			"users": {
+				Name:      "users",
+				DocSchema: &db_conn.DocSchema{Fields: map[string]any{"name": &db_conn.StringSchema{}}},
+			},
+		},
+	}
+	dbName := setupMemDb(t, dbSchema, `Permission.create({
+  version: "1.0.0",
+  rules: {
+    users: {
+      canView: () => true,
+      canCreate: ({ clientId }) => clientId === "admin",
+    },
+  },
+});`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	synchronizer := synchronizer2.NewSynchronizerWithContext(ctx, &synchronizer2.SynchronizerParams{
+		DbConnector: db_connector.NewMemConnector(),
+		Network:     newFakeNetwork(),
+		DbUrl:       "mem://" + dbName,
+		CommitFanout: &synchronizer2.CommitFanoutOptions{
+			Client:     rdb,
+			Writer:     true,
+			Stream:     stream,
+			InstanceId: "writer",
+			Block:      100 * time.Millisecond,
+		},
+	})
+	assert.NoError(t, synchronizer.Start())
+
+	// 跟随者的副本，直接转发事务，不经过跟随者自己的权限检查
+	replicaName := dbName + "-replica"
+	assert.NoError(t, db_conn.CreateNewMemDb(replicaName, dbSchema, `Permission.create({ version: "1.0.0", rules: {} });`))
+	defer db_conn.DropMemDb(replicaName)
+	replica, err := db_connector.NewMemConnector().ConnectWithContext(ctx, "mem://"+replicaName)
+	assert.NoError(t, err)
+	assert.NoError(t, replica.Open())
+	defer replica.Close()
+	follower, err := synchronizer2.NewCommitFanout(replica, &synchronizer2.CommitFanoutOptions{
+		Client:     rdb,
+		Stream:     stream,
+		InstanceId: "follower",
+		Block:      100 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, follower.Start(ctx))
+
+	committed := make(chan *db_conn.TransactionCommittedEvent, 1)
+	unsubscribe := replica.GetCommittedEb().SubscribeCallback(func(ev *db_conn.TransactionCommittedEvent) {
+		committed <- ev
+	})
+	defer unsubscribe()
+	rollbacked := make(chan *db_conn.TransactionRollbackedEvent, 1)
+	unsubscribe2 := replica.GetRollbackedEb().SubscribeCallback(func(ev *db_conn.TransactionRollbackedEvent) {
+		rollbacked <- ev
+	})
+	defer unsubscribe2()
+
+	insert := func(txId, clientId, docId string) *db_conn.Transaction {
+		doc := loro.NewLoroDoc()
+		assert.NoError(t, doc.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("name", docId))
+		return &db_conn.Transaction{
+			TxID:       txId,
+			Committer:  clientId,
+			Operations: []db_conn.TransactionOp{&db_conn.InsertOp{Collection: "users", DocID: docId, Snapshot: doc.ExportSnapshot().Bytes()}},
+		}
+	}
+
+	// 没有权限的事务被写者拒绝，跟随者收到回滚
+	assert.NoError(t, follower.Forward(ctx, insert("tx1", "mallory", "mallory")))
+	select {
+	case ev := <-rollbacked:
+		assert.Equal(t, "tx1", ev.Transaction.TxID)
+		assert.Contains(t, ev.Reason.Error(), "permission denied")
+	case <-time.After(5 * time.Second):
+		t.Fatal("副本没有收到回滚的事务")
+	}
+
+	// 有权限的事务被提交，回放到副本
+	assert.NoError(t, follower.Forward(ctx, insert("tx2", "admin", "alice")))
+	select {
+	case ev := <-committed:
+		assert.Equal(t, "tx2", ev.Transaction.TxID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("副本没有收到提交的事务")
+	}
+	_, err = replica.LoadDoc("users", "mallory")
+	assert.Error(t, err)
+	_, err = replica.LoadDoc("users", "alice")
+	assert.NoError(t, err)
+
+	cancel()
+	<-synchronizer.WaitForStatus(synchronizer2.SynchronizerStatusStopped)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_connector"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/doc_history"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/synchronizer2"
+	"github.com/stretchr/testify/assert"
+)
+
+// 历史版本中有当前已经删除的字段时，不能读取该字段的客户端看不到它
+func TestDocHistoryFieldRemovedSince(t *testing.T) {
+	dbSchema := &db_conn.DatabaseSchema{
+		Name:    "testdb",
+		Version: "1.0.0",
+		Collections: map[string]*db_conn.CollectionSchema{
+			"users": {
+				Name: "users",
+				DocSchema: &db_conn.DocSchema{Fields: map[string]any{
+					"name":  &db_conn.StringSchema{},
+					"email": &db_conn.StringSchema{},
+				}},
+			},
+		},
+	}
+	permissionJs := `Permission.create({
+  version: "1.0.0",
+  rules: {
+    users: {
+      canView: () => true,
+      fields: {
+        email: {
+          canRead: ({ clientId }) => clientId === "admin",
+        },
+      },
+    },
+  },
+});`
+
+	// 第一个版本有 email，第二个版本把 email 设为 null，当前文档中不再有这个字段
+	doc := loro.NewLoroDoc()
+	assert.NoError(t, doc.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("name", "alice"))
+	assert.NoError(t, doc.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("email", "alice@example.com"))
+	tx1 := &db_conn.Transaction{
+		TxID:       "tx1",
+		Committer:  "admin",
+		Operations: []db_conn.TransactionOp{&db_conn.InsertOp{Collection: "users", DocID: "alice", Snapshot: doc.ExportSnapshot().Bytes()}},
+	}
+	vv := doc.GetOplogVv()
+	assert.NoError(t, doc.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("email", nil))
+	tx2 := &db_conn.Transaction{
+		TxID:       "tx2",
+		Committer:  "admin",
+		Operations: []db_conn.TransactionOp{&db_conn.UpdateOp{Collection: "users", DocID: "alice", Update: doc.ExportUpdatesFrom(vv).Bytes()}},
+	}
+	dbName := setupMemDb(t, dbSchema, permissionJs, tx1, tx2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	synchronizer := synchronizer2.NewSynchronizerWithContext(ctx, &synchronizer2.SynchronizerParams{
+		DbConnector: db_connector.NewMemConnector(),
+		Network:     newFakeNetwork(),
+		DbUrl:       "mem://" + dbName,
+	})
+	assert.NoError(t, synchronizer.Start())
+
+	versions, err := synchronizer.DocHistory("admin", "users", "alice")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	// 第一个版本的快照中没有 email，也不带文档的历史
+	snapshot, err := synchronizer.DocAtVersion("c1", "users", "alice", versions[0].Seq)
+	assert.NoError(t, err)
+	past := loro.NewLoroDoc()
+	_, err = past.Import(snapshot)
+	assert.NoError(t, err)
+	value, err := doc_history.Value(past)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{"name": "alice"}, value)
+
+	// 两个版本之间的差异中也没有 email
+	ops, err := synchronizer.DiffDocVersions("c1", "users", "alice", versions[0].Seq, versions[1].Seq)
+	assert.NoError(t, err)
+	assert.Empty(t, ops)
+
+	// 能读取 email 的客户端仍然能看到它被删除
+	ops, err = synchronizer.DiffDocVersions("admin", "users", "alice", versions[0].Seq, versions[1].Seq)
+	assert.NoError(t, err)
+	assert.Equal(t, []doc_history.PatchOp{{Op: "replace", Path: "/email", Value: nil}}, ops)
+
+	cancel()
+	<-synchronizer.WaitForStatus(synchronizer2.SynchronizerStatusStopped)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_connector"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/synchronizer2"
+	"github.com/stretchr/testify/assert"
+)
+
+// 只读连接上不启动会写数据库的后台任务
+func TestReadOnlySkipsBackgroundJobs(t *testing.T) {
+	dbName := setupMemDb(t, &db_conn.DatabaseSchema{
+		Name:        "testdb",
+		Version:     "1.0.0",
+		Collections: map[string]*db_conn.CollectionSchema{},
+	}, `Permission.create({ version: "1.0.0", rules: {} });`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	synchronizer := synchronizer2.NewSynchronizerWithContext(ctx, &synchronizer2.SynchronizerParams{
+		DbConnector: db_connector.NewMemConnector(),
+		Network:     newFakeNetwork(),
+		DbUrl:       "mem://" + dbName + "?readonly=true",
+		TombstoneGc: &db_conn.TombstoneGcOptions{},
+	})
+	assert.NoError(t, synchronizer.Start())
+
+	_, ok := synchronizer.TtlSweeperStats()
+	assert.False(t, ok)
+	_, ok = synchronizer.TombstoneGcStats()
+	assert.False(t, ok)
+
+	cancel()
+	<-synchronizer.WaitForStatus(synchronizer2.SynchronizerStatusStopped)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_conn"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/db_connector"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/key_utils"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/loro"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/message/v1"
+	network_server "github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/network/server"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/permission_proxy"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/query/doc_visitor"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/synchronizer2"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNetwork 把服务端发给每个客户端的消息放进 channel，客户端的消息通过 receive 直接交给 Synchronizer
+type fakeNetwork struct {
+	mu       sync.Mutex
+	handler  func(clientId string, msg []byte)
+	sent     map[string]chan message.Message
+	closedCh chan network_server.ConnectionClosedEvent
+}
+
+var _ network_server.NetworkProvider = &fakeNetwork{}
+
+func newFakeNetwork() *fakeNetwork {
+	return &fakeNetwork{
+		sent:     make(map[string]chan message.Message),
+		closedCh: make(chan network_server.ConnectionClosedEvent),
+	}
+}
+
+func (n *fakeNetwork) outbox(clientId string) chan message.Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ch, ok := n.sent[clientId]
+	if !ok {
+		ch = make(chan message.Message, 16)
+		n.sent[clientId] = ch
+	}
+	return ch
+}
+
+func (n *fakeNetwork) receive(t *testing.T, clientId string, msg interface{ Encode() ([]byte, error) }) {
+	msgBytes, err := msg.Encode()
+	assert.NoError(t, err)
+	n.mu.Lock()
+	handler := n.handler
+	n.mu.Unlock()
+	handler(clientId, msgBytes)
+}
+
+// next 返回服务端发给客户端的下一条消息
+func (n *fakeNetwork) next(t *testing.T, clientId string) message.Message {
+	select {
+	case msg := <-n.outbox(clientId):
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("客户端 %s 没有收到消息", clientId)
+		return nil
+	}
+}
+
+func (n *fakeNetwork) Start() error                          { return nil }
+func (n *fakeNetwork) Stop() error                           { return nil }
+func (n *fakeNetwork) CloseConnection(clientId string) error { return nil }
+func (n *fakeNetwork) CloseAllConnections() error            { return nil }
+func (n *fakeNetwork) Broadcast(msg []byte) error            { return nil }
+func (n *fakeNetwork) GetAllClientIds() []string             { return nil }
+
+func (n *fakeNetwork) Send(clientId string, msgBytes []byte) error {
+	msg, err := message.DecodeMessage(bytes.NewBuffer(msgBytes))
+	if err != nil {
+		return err
+	}
+	n.outbox(clientId) <- msg
+	return nil
+}
+
+func (n *fakeNetwork) SetMsgHandler(handler func(clientId string, msg []byte)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.handler = handler
+}
+
+func (n *fakeNetwork) GetStatus() network_server.NetworkStatus {
+	return network_server.NetworkRunning
+}
+
+func (n *fakeNetwork) SubscribeStatusChange() <-chan network_server.NetworkStatus {
+	return make(chan network_server.NetworkStatus)
+}
+
+func (n *fakeNetwork) UnsubscribeStatusChange(ch <-chan network_server.NetworkStatus) {}
+
+func (n *fakeNetwork) WaitForStatus(targetStatus network_server.NetworkStatus) <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+func (n *fakeNetwork) SubscribeConnectionClosed() <-chan network_server.ConnectionClosedEvent {
+	return n.closedCh
+}
+
+func (n *fakeNetwork) UnsubscribeConnectionClosed(ch <-chan network_server.ConnectionClosedEvent) {}
+
+// 客户端修改去掉了字段的文档副本时，修改的字段被合入原文档，不能读取的字段保持不变；
+// 修改了不能读取的字段时，事务被明确拒绝，而不是被静默丢弃后确认
+func TestUpdateRedactedDoc(t *testing.T) {
+	dbSchema := &db_conn.DatabaseSchema{
+		Name:    "testdb",
+		Version: "1.0.0",
+		Collections: map[string]*db_conn.CollectionSchema{
+			"users": {
+				Name: "users",
+				DocSchema: &db_conn.DocSchema{Fields: map[string]any{
+					"name":  &db_conn.StringSchema{},
+					"email": &db_conn.StringSchema{},
+				}},
+			},
+		},
+	}
+	permissionJs := `Permission.create({
+  version: "1.0.0",
+  rules: {
+    users: {
+      canView: () => true,
+      canUpdate: () => true,
+      fields: {
+        email: {
+          canRead: ({ clientId }) => clientId === "admin",
+        },
+      },
+    },
+  },
+});`
+
+	// 写入初始文档
+	stored := loro.NewLoroDoc()
+	assert.NoError(t, stored.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("name", "alice"))
+	assert.NoError(t, stored.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("email", "alice@example.com"))
+	dbName := setupMemDb(t, dbSchema, permissionJs, &db_conn.Transaction{
+		TxID:       "setup",
+		Committer:  "admin",
+		Operations: []db_conn.TransactionOp{&db_conn.InsertOp{Collection: "users", DocID: "alice", Snapshot: stored.ExportSnapshot().Bytes()}},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := newFakeNetwork()
+	synchronizer := synchronizer2.NewSynchronizerWithContext(ctx, &synchronizer2.SynchronizerParams{
+		DbConnector: db_connector.NewMemConnector(),
+		Network:     network,
+		DbUrl:       "mem://" + dbName,
+	})
+	assert.NoError(t, synchronizer.Start())
+
+	docKey, err := key_utils.CalcDocKey("users", "alice")
+	assert.NoError(t, err)
+
+	// 客户端拉取文档，得到去掉 email 的副本
+	network.receive(t, "c1", &message.VersionQueryRespMessageV1{Responses: map[string][]byte{string(docKey): nil}})
+	postDoc, ok := network.next(t, "c1").(*message.PostDocMessageV1)
+	assert.True(t, ok)
+	local := loro.NewLoroDoc()
+	_, err = local.Import(postDoc.Upsert[string(docKey)])
+	assert.NoError(t, err)
+	_, err = doc_visitor.VisitDocByPath(local, "email")
+	assert.Error(t, err)
+
+	// 在副本上修改 name
+	vv := local.GetOplogVv()
+	assert.NoError(t, local.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("name", "bob"))
+	network.receive(t, "c1", &message.PostTransactionMessageV1{Transaction: &db_conn.Transaction{
+		TxID:       "tx1",
+		Operations: []db_conn.TransactionOp{&db_conn.UpdateOp{Collection: "users", DocID: "alice", Update: local.ExportUpdatesFrom(vv).Bytes()}},
+	}})
+
+	ack, ok := network.next(t, "c1").(*message.AckTransactionMessageV1)
+	assert.True(t, ok)
+	assert.Equal(t, "tx1", ack.TxID)
+
+	// 能读取所有字段的客户端看到 name 被修改，email 保持不变
+	network.receive(t, "admin", &message.VersionQueryRespMessageV1{Responses: map[string][]byte{string(docKey): nil}})
+	postDoc, ok = network.next(t, "admin").(*message.PostDocMessageV1)
+	assert.True(t, ok)
+	full := loro.NewLoroDoc()
+	_, err = full.Import(postDoc.Upsert[string(docKey)])
+	assert.NoError(t, err)
+	name, err := doc_visitor.VisitDocByPath(full, "name")
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", name)
+	email, err := doc_visitor.VisitDocByPath(full, "email")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@example.com", email)
+
+	// 重新拉取副本后写入看不到的 email，事务被拒绝
+	network.receive(t, "c1", &message.VersionQueryRespMessageV1{Responses: map[string][]byte{string(docKey): nil}})
+	postDoc, ok = network.next(t, "c1").(*message.PostDocMessageV1)
+	assert.True(t, ok)
+	local = loro.NewLoroDoc()
+	_, err = local.Import(postDoc.Upsert[string(docKey)])
+	assert.NoError(t, err)
+	vv = local.GetOplogVv()
+	assert.NoError(t, local.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("email", "mallory@example.com"))
+	network.receive(t, "c1", &message.PostTransactionMessageV1{Transaction: &db_conn.Transaction{
+		TxID:       "tx2",
+		Operations: []db_conn.TransactionOp{&db_conn.UpdateOp{Collection: "users", DocID: "alice", Update: local.ExportUpdatesFrom(vv).Bytes()}},
+	}})
+	failed, ok := network.next(t, "c1").(*message.TransactionFailedMessageV1)
+	assert.True(t, ok)
+	assert.Equal(t, "tx2", failed.TxID)
+	assert.Equal(t, permission_proxy.ErrRedactedDocUpdate.Error(), failed.Reason.Error())
+	// 随后收到当前的副本，用来替换本地的修改
+	postDoc, ok = network.next(t, "c1").(*message.PostDocMessageV1)
+	assert.True(t, ok)
+	assert.Contains(t, postDoc.Upsert, string(docKey))
+
+	// 能读取所有字段的客户端基于完整的文档修改，事务被提交
+	vv = full.GetOplogVv()
+	assert.NoError(t, full.GetMap(doc_visitor.DATA_MAP_NAME).InsertValueCoerce("name", "carol"))
+	network.receive(t, "admin", &message.PostTransactionMessageV1{Transaction: &db_conn.Transaction{
+		TxID:       "tx3",
+		Operations: []db_conn.TransactionOp{&db_conn.UpdateOp{Collection: "users", DocID: "alice", Update: full.ExportUpdatesFrom(vv).Bytes()}},
+	}})
+	ack, ok = network.next(t, "admin").(*message.AckTransactionMessageV1)
+	assert.True(t, ok)
+	assert.Equal(t, "tx3", ack.TxID)
+
+	cancel()
+	<-synchronizer.WaitForStatus(synchronizer2.SynchronizerStatusStopped)
+}
@@ -125,3 +125,19 @@ func setupDb(t *testing.T) string {
 
 	return dbPath
 }
+
+// setupMemDb 创建内存数据库并提交 txs 中的事务，返回数据库名，测试结束时删除数据库
+func setupMemDb(t *testing.T, dbSchema *db_conn.DatabaseSchema, permissionJs string, txs ...*db_conn.Transaction) string {
+	dbName := t.Name()
+	assert.NoError(t, db_conn.CreateNewMemDb(dbName, dbSchema, permissionJs))
+	t.Cleanup(func() { db_conn.DropMemDb(dbName) })
+
+	conn, err := db_connector.NewMemConnector().ConnectWithContext(context.Background(), "mem://"+dbName)
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Open())
+	defer conn.Close()
+	for _, tx := range txs {
+		assert.NoError(t, conn.Commit(tx))
+	}
+	return dbName
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/ast"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/parser"
+	"github.com/jlwxz-capstone-project/rapierdb-server-go/pkg/js2go_transpiler/transpiler"
+	"github.com/stretchr/testify/assert"
+)
+
+// compileScript 编译单个函数表达式
+func compileScript(t testing.TB, js string) *transpiler.CompiledFunc {
+	program, err := parser.ParseFile("var _ = " + js + ";")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	decl := program.Body[0].Stmt.(*ast.VariableDeclaration)
+	compiled, err := transpiler.Compile(decl.List[0].Initializer.Expr)
+	if err != nil {
+		t.Fatalf("compile error: %v", err)
+	}
+	return compiled
+}
+
+// 编译执行与解释执行的结果应该相同
+func TestCompiledMatchesInterpreted(t *testing.T) {
+	doc := map[string]any{
+		"owner": "u1",
+		"tags":  []any{"a", "b"},
+		"meta":  map[string]any{"score": float64(7), "reviewer": nil},
+	}
+	user := map[string]any{"id": "u1", "role": "member"}
+
+	tests := []struct {
+		name     string
+		js       string
+		args     []any
+		compiled bool
+	}{
+		{
+			name:     "属性访问和逻辑运算",
+			js:       `(doc, user) => user.role === "admin" || (doc.owner === user.id && doc.tags.join(",") === "a,b")`,
+			args:     []any{doc, user},
+			compiled: true,
+		},
+		{
+			name: "局部变量、if 和 return",
+			js: `function (doc, user) {
+				const score = doc.meta.score;
+				let level = "low";
+				if (score > 5) {
+					level = "high";
+				} else {
+					return "rejected";
+				}
+				return level + ":" + user.id;
+			}`,
+			args:     []any{doc, user},
+			compiled: true,
+		},
+		{
+			name: "闭包访问外层变量",
+			js: `(doc) => {
+				let count = 0;
+				const inc = (n) => { count += n; return count; };
+				inc(2);
+				inc(3);
+				return count;
+			}`,
+			args:     []any{doc},
+			compiled: true,
+		},
+		{
+			name:     "解构参数",
+			js:       `({ owner, missing = "default" }, [first, , third]) => owner + missing + first + third`,
+			args:     []any{doc, []any{"x", "y", "z"}},
+			compiled: true,
+		},
+		{
+			name:     "可选链、空值合并和模板字符串",
+			js:       "(doc) => `${doc.meta?.reviewer?.name ?? \"nobody\"}:${typeof doc.meta.score}`",
+			args:     []any{doc},
+			compiled: true,
+		},
+		{
+			name:     "方法调用和内置对象",
+			js:       `(doc) => Array.isArray(doc.tags) && doc.tags.join("-") === "a-b" && doc.owner.toUpperCase() === "U1"`,
+			args:     []any{doc},
+			compiled: true,
+		},
+		{
+			name:     "对象字面量和计算属性",
+			js:       `(doc) => { const key = "owner"; const o = { [key]: doc[key], n: 1 }; o.n++; return o; }`,
+			args:     []any{doc},
+			compiled: true,
+		},
+		{
+			name:     "for...of 和循环中的 return",
+			js:       `(doc) => { for (const tag of doc.tags) { if (tag === "b") return true; } return false; }`,
+			args:     []any{doc},
+			compiled: true,
+		},
+		{
+			name: "循环中嵌套的 return null 结束函数",
+			js: `(doc) => {
+				for (const tag of doc.tags) {
+					if (tag === "a") { return null; }
+				}
+				return "not reached";
+			}`,
+			args:     []any{doc},
+			compiled: true,
+		},
+		{
+			name: "for、while、for...in、break 和 continue",
+			js: `(doc) => {
+				let out = "";
+				for (let i = 0; i < 5; i++) {
+					if (i === 1) continue;
+					if (i === 3) break;
+					out += i;
+				}
+				let n = 0;
+				while (true) { n++; if (n > 2) break; }
+				do { n++; } while (n < 5);
+				for (const key in doc.meta) { out += key; }
+				return out + n;
+			}`,
+			args:     []any{doc},
+			compiled: true,
+		},
+		{
+			name: "带标签的循环",
+			js: `(doc) => {
+				let count = 0;
+				outer: for (const a of doc.tags) {
+					for (const b of doc.tags) {
+						if (b === "b") continue outer;
+						if (a === "b") break outer;
+						count++;
+					}
+				}
+				return count;
+			}`,
+			args:     []any{doc},
+			compiled: true,
+		},
+		{
+			name: "switch 的 fall through 和 default",
+			js: `(doc) => {
+				let out = "";
+				switch (doc.owner) {
+				case "u0": out += "0";
+				case "u1": out += "1";
+				case "u2": out += "2"; break;
+				default: out += "d";
+				}
+				switch (doc.meta.score) { case 1: return "one"; default: out += "!"; }
+				return out;
+			}`,
+			args:     []any{doc},
+			compiled: true,
+		},
+		{
+			name: "try、catch 和 finally",
+			js: `(doc) => {
+				let out = "";
+				try { doc.owner - 1; } catch (e) { out += "caught:"; }
+				try { throw { code: 1 }; } catch ({ code }) { out += code; } finally { out += ":finally"; }
+				const f = () => { try { return "try"; } finally { out += ":returned"; } };
+				return f() + out;
+			}`,
+			args:     []any{doc},
+			compiled: true,
+		},
+		{
+			name: "循环变量只在循环内可见",
+			js: `(doc) => {
+				const tag = "outer";
+				for (const tag of doc.tags) { const x = tag; }
+				return tag + typeof x;
+			}`,
+			args:     []any{doc},
+			compiled: true,
+		},
+		{
+			name:     "循环体中的闭包回退到解释执行",
+			js:       `(doc) => { const fns = []; for (const tag of doc.tags) { fns.push(() => tag); } return fns.map(f => f()).join(","); }`,
+			args:     []any{doc},
+			compiled: false,
+		},
+		{
+			name:     "运行时错误",
+			js:       `(doc) => doc.owner - 1`,
+			args:     []any{doc},
+			compiled: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			interpreted, err := transpiler.TranspileJsScriptToGoFunc(tt.js, transpiler.NewScope(nil, nil, nil))
+			assert.NoError(t, err)
+			compiled := compileScript(t, tt.js)
+			assert.Equal(t, tt.compiled, compiled.IsCompiled())
+			compiledFn, err := compiled.Bind(transpiler.NewScope(nil, nil, nil))
+			assert.NoError(t, err)
+
+			want, wantErr := interpreted(tt.args...)
+			got, gotErr := compiledFn(tt.args...)
+			assert.Equal(t, wantErr != nil, gotErr != nil, "want error %v, got error %v", wantErr, gotErr)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+// 每个规则在同一组输入上分别解释执行、Bind 后执行和用 Call 执行，三者的结果和是否出错都应该相同，
+// 输入包括缺少字段、null 和类型不对的文档
+func TestCompiledAgreesWithInterpreterOnInputs(t *testing.T) {
+	rules := []string{
+		`(doc, user) => doc.owner === user.id`,
+		`(doc, user) => user.role === "admin" || doc.status !== "archived" && doc.owner === user.id`,
+		`(doc) => (doc.meta?.score ?? 0) > 5`,
+		`(doc) => doc.tags.includes("public")`,
+		`(doc) => doc.tags?.length > 1 ? doc.tags[1] : null`,
+		`(doc, user) => { if (!user) return false; const { id, role = "guest" } = user; return role + ":" + id + ":" + doc.owner; }`,
+		`(doc) => { let n = 0; for (const key in doc) { n++; } return n; }`,
+		`(doc) => { let out = []; for (const tag of doc.tags ?? []) { if (tag === "skip") continue; out.push(tag.toUpperCase()); } return out.join(","); }`,
+		`(doc) => { switch (typeof doc.meta) { case "object": return doc.meta === null ? "null" : "object"; default: return typeof doc.meta; } }`,
+		`(doc) => { try { return doc.meta.score * 2; } catch (e) { return "caught"; } finally { doc = null; } }`,
+		`(doc, user) => ` + "`${doc.owner}/${user?.id ?? \"anonymous\"}`",
+		`(doc) => doc.count - 1`,
+		`async (doc) => (await doc.owner) === "u1"`,
+	}
+	docs := []any{
+		map[string]any{"owner": "u1", "status": "published", "tags": []any{"public", "skip", "x"}, "meta": map[string]any{"score": float64(7)}, "count": float64(3)},
+		map[string]any{"owner": "u2", "status": "archived", "tags": []any{}, "meta": nil},
+		map[string]any{"owner": nil, "meta": map[string]any{}},
+		map[string]any{},
+		nil,
+	}
+	users := []any{
+		map[string]any{"id": "u1", "role": "member"},
+		map[string]any{"id": "u2", "role": "admin"},
+		map[string]any{"id": "u3"},
+		nil,
+	}
+
+	budget, cancel := transpiler.NewBudget(context.Background(), transpiler.Limits{MaxSteps: 100000})
+	defer cancel()
+	for _, rule := range rules {
+		interpreted, err := transpiler.TranspileJsScriptToGoFunc(rule, transpiler.NewScope(nil, nil, nil))
+		assert.NoError(t, err, rule)
+		compiled := compileScript(t, rule)
+		assert.True(t, compiled.IsCompiled(), rule)
+		bound, err := compiled.Bind(transpiler.NewScope(nil, nil, nil))
+		assert.NoError(t, err, rule)
+		// Call 只绑定一次作用域，每次调用使用自己的执行预算
+		scope := transpiler.NewScope(nil, nil, nil)
+
+		for i, doc := range docs {
+			for j, user := range users {
+				want, wantErr := interpreted(doc, user)
+				got, gotErr := bound(doc, user)
+				assert.Equal(t, wantErr != nil, gotErr != nil, "%s 第 %d 个文档第 %d 个用户：解释执行出错 %v，编译执行出错 %v", rule, i, j, wantErr, gotErr)
+				assert.Equal(t, want, got, "%s 第 %d 个文档第 %d 个用户", rule, i, j)
+
+				called, callErr := compiled.Call(scope, nil, budget, doc, user)
+				assert.Equal(t, wantErr != nil, callErr != nil, "%s 第 %d 个文档第 %d 个用户：解释执行出错 %v，Call 出错 %v", rule, i, j, wantErr, callErr)
+				assert.Equal(t, want, called, "%s 第 %d 个文档第 %d 个用户", rule, i, j)
+			}
+		}
+	}
+}
+
+// Call 的 vars 只在这次调用中可见，并且在作用域之前查找
+func TestCompiledCallVars(t *testing.T) {
+	for i, js := range []string{
+		`(id) => prefix + id`,
+		// 循环体中的闭包不能编译，Call 回退到解释执行
+		`(id) => { let r = null; for (const p of [prefix]) { const f = () => p + id; r = f(); } return r; }`,
+	} {
+		compiled := compileScript(t, js)
+		assert.Equal(t, i == 0, compiled.IsCompiled())
+		scope := transpiler.NewScope(nil, nil, nil)
+		scope.Vars["prefix"] = "scope:"
+
+		got, err := compiled.Call(scope, map[string]any{"prefix": "call:"}, nil, "u1")
+		assert.NoError(t, err)
+		assert.Equal(t, "call:u1", got)
+		got, err = compiled.Call(scope, nil, nil, "u1")
+		assert.NoError(t, err)
+		assert.Equal(t, "scope:u1", got)
+	}
+}
+
+func TestCompiledExecutionBudget(t *testing.T) {
+	compiled := compileScript(t, `(n) => { const loop = (i) => i <= 0 ? 0 : loop(i - 1); return loop(n); }`)
+	assert.True(t, compiled.IsCompiled())
+
+	budget, cancel := transpiler.NewBudget(context.Background(), transpiler.Limits{MaxSteps: 1000})
+	defer cancel()
+	ctx := transpiler.NewScope(nil, nil, nil)
+	ctx.Budget = budget
+	fn, err := compiled.Bind(ctx)
+	assert.NoError(t, err)
+
+	_, err = fn(float64(10000))
+	assert.True(t, errors.Is(err, transpiler.ErrBudgetExceeded))
+}
+
+func TestAwait(t *testing.T) {
+	js := `async (id) => {
+		const role = lookup(id);
+		const other = lookup("u2");
+		return (await role) + "," + (await other) + "," + (await 1);
+	}`
+	newScope := func() *transpiler.Scope {
+		scope := transpiler.NewScope(nil, nil, nil)
+		scope.Vars["lookup"] = func(id string) *transpiler.Promise {
+			return transpiler.NewPromise(func() (any, error) {
+				if id == "missing" {
+					return nil, errors.New("not found")
+				}
+				return "role of " + id, nil
+			})
+		}
+		scope.Vars["never"] = func() *transpiler.Promise {
+			return transpiler.NewPromise(func() (any, error) {
+				select {}
+			})
+		}
+		return scope
+	}
+
+	interpreted, err := transpiler.TranspileJsScriptToGoFunc(js, newScope())
+	assert.NoError(t, err)
+	compiled := compileScript(t, js)
+	assert.True(t, compiled.IsCompiled())
+	compiledFn, err := compiled.Bind(newScope())
+	assert.NoError(t, err)
+	for _, fn := range []func(...any) (any, error){interpreted, compiledFn} {
+		ret, err := fn("u1")
+		assert.NoError(t, err)
+		assert.Equal(t, "role of u1,role of u2,1", ret)
+		// 被拒绝的 Promise 在 await 处抛出错误
+		_, err = fn("missing")
+		assert.ErrorContains(t, err, "not found")
+	}
+
+	// await 不能超出执行预算的时间限制
+	compiled = compileScript(t, `async () => { try { return await never(); } catch (e) { return "caught"; } }`)
+	budget, cancel := transpiler.NewBudget(context.Background(), transpiler.Limits{Timeout: 20 * time.Millisecond})
+	defer cancel()
+	scope := newScope()
+	scope.Budget = budget
+	fn, err := compiled.Bind(scope)
+	assert.NoError(t, err)
+	_, err = fn()
+	assert.True(t, errors.Is(err, transpiler.ErrBudgetExceeded))
+}
+
+const benchmarkRule = `(doc, ctx) => {
+	const user = ctx.user;
+	if (user.role === "admin") {
+		return true;
+	}
+	const score = doc.meta.score ?? 0;
+	return doc.owner === user.id && doc.status !== "archived" && score > 5;
+}`
+
+func benchmarkRuleArgs() []any {
+	doc := map[string]any{
+		"owner":  "u1",
+		"status": "published",
+		"meta":   map[string]any{"score": float64(7)},
+	}
+	ctx := map[string]any{
+		"user": map[string]any{"id": "u1", "role": "member"},
+	}
+	return []any{doc, ctx}
+}
+
+func BenchmarkInterpretedRule(b *testing.B) {
+	fn, err := transpiler.TranspileJsScriptToGoFunc(benchmarkRule, transpiler.NewScope(nil, nil, nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+	args := benchmarkRuleArgs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if ret, err := fn(args...); err != nil || ret != true {
+			b.Fatal(ret, err)
+		}
+	}
+}
+
+func BenchmarkCompiledRule(b *testing.B) {
+	fn, err := transpiler.CompileJsScriptToGoFunc(benchmarkRule, transpiler.NewScope(nil, nil, nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+	args := benchmarkRuleArgs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if ret, err := fn(args...); err != nil || ret != true {
+			b.Fatal(ret, err)
+		}
+	}
+}
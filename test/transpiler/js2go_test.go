@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"runtime"
@@ -1930,3 +1932,441 @@ func TestEarlyReturn(t *testing.T) {
 		})
 	}
 }
+
+func TestLoopStatements(t *testing.T) {
+	ctx := transpiler.NewScope(nil, nil, nil)
+
+	tests := []struct {
+		name    string
+		js      string
+		want    any
+		wantErr bool
+	}{
+		{
+			name: "for 循环",
+			js:   "var result = 0; for (let i = 0; i < 5; i = i + 1) { result = result + i; }",
+			want: float64(10),
+		},
+		{
+			name: "for...of 数组",
+			js:   "var result = ''; for (const tag of ['a', 'b', 'c']) { result = result + tag; }",
+			want: "abc",
+		},
+		{
+			name: "for...of 字符串",
+			js:   "var result = 0; for (const ch of 'hello') { result = result + 1; }",
+			want: float64(5),
+		},
+		{
+			name: "for...of 解构",
+			js:   "var result = 0; for (const { n } of [{ n: 1 }, { n: 2 }]) { result = result + n; }",
+			want: float64(3),
+		},
+		{
+			name: "for...in 对象",
+			js:   "var result = ''; for (const key in { b: 1, a: 2 }) { result = result + key; }",
+			want: "ab",
+		},
+		{
+			name: "for...in 数组",
+			js:   "var result = ''; for (const i in ['x', 'y']) { result = result + i; }",
+			want: "01",
+		},
+		{
+			name: "while 循环",
+			js:   "var result = 1; while (result < 100) { result = result * 2; }",
+			want: float64(128),
+		},
+		{
+			name: "do...while 至少执行一次",
+			js:   "var result = 0; do { result = result + 1; } while (false);",
+			want: float64(1),
+		},
+		{
+			name: "break",
+			js:   "var result = 0; for (const x of [1, 2, 3, 4]) { if (x === 3) break; result = result + x; }",
+			want: float64(3),
+		},
+		{
+			name: "continue",
+			js:   "var result = 0; for (const x of [1, 2, 3, 4]) { if (x === 2) continue; result = result + x; }",
+			want: float64(8),
+		},
+		{
+			name: "for 循环中 continue 仍执行 update",
+			js:   "var result = 0; for (let i = 0; i < 4; i = i + 1) { if (i === 1) continue; result = result + i; }",
+			want: float64(5),
+		},
+		{
+			name: "带标签的 break",
+			js: `var result = 0;
+			outer: for (const x of [1, 2, 3]) {
+				for (const y of [1, 2, 3]) {
+					if (y === 2) continue outer;
+					if (x === 3) break outer;
+					result = result + x * 10 + y;
+				}
+			}`,
+			want: float64(11 + 21),
+		},
+		{
+			name: "带标签的块语句",
+			js:   "var result = 1; block: { result = 2; break block; result = 3; }",
+			want: float64(2),
+		},
+		{
+			name: "循环变量不泄漏到外部作用域",
+			js:   "var result = 'outer'; for (const result of [1, 2]) {}",
+			want: "outer",
+		},
+		{
+			name:    "迭代 null",
+			js:      "var result; for (const x of null) {}",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx.Vars = make(map[string]any)
+
+			_, err := transpiler.Execute(tt.js, ctx)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Execute() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr {
+				assert.Equal(t, tt.want, ctx.Vars["result"])
+			}
+		})
+	}
+}
+
+func TestSwitchStatement(t *testing.T) {
+	ctx := transpiler.NewScope(nil, nil, nil)
+
+	fn, err := transpiler.TranspileJsScriptToGoFunc(`function (role) {
+		let level = 0;
+		switch (role) {
+			case "admin":
+				level = level + 100;
+			case "editor":
+				level = level + 10;
+				break;
+			case "viewer":
+				return 1;
+			default:
+				level = -1;
+		}
+		return level;
+	}`, ctx)
+	assert.NoError(t, err)
+
+	cases := map[string]any{
+		"admin":  float64(110), // fall through
+		"editor": float64(10),
+		"viewer": float64(1),
+		"guest":  float64(-1),
+	}
+	for role, want := range cases {
+		got, err := fn(role)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, role)
+	}
+}
+
+func TestTryThrowStatement(t *testing.T) {
+	ctx := transpiler.NewScope(nil, nil, nil)
+
+	tests := []struct {
+		name string
+		js   string
+		want any
+	}{
+		{
+			name: "catch 捕获 throw 的值",
+			js: `() => {
+				try {
+					throw { code: 403 };
+				} catch (e) {
+					return e.code;
+				}
+			}`,
+			want: float64(403),
+		},
+		{
+			name: "catch 捕获运行时错误",
+			js: `() => {
+				try {
+					notExist;
+				} catch (e) {
+					return e.name;
+				}
+			}`,
+			want: "Error",
+		},
+		{
+			name: "finally 总会执行",
+			js: `() => {
+				let result = "";
+				try {
+					result = result + "try;";
+				} finally {
+					result = result + "finally";
+				}
+				return result;
+			}`,
+			want: "try;finally",
+		},
+		{
+			name: "finally 中的 return 覆盖 catch",
+			js: `() => {
+				try {
+					throw "boom";
+				} catch (e) {
+					return "catch";
+				} finally {
+					return "finally";
+				}
+			}`,
+			want: "finally",
+		},
+		{
+			name: "循环中 break 经过 finally",
+			js: `() => {
+				let count = 0;
+				for (const x of [1, 2, 3]) {
+					try {
+						if (x === 2) break;
+					} finally {
+						count = count + 1;
+					}
+				}
+				return count;
+			}`,
+			want: float64(2),
+		},
+		{
+			name: "循环中的 early return",
+			js: `(roles) => {
+				for (const role of roles) {
+					if (role === "admin") {
+						return true;
+					}
+				}
+				return false;
+			}`,
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn, err := transpiler.TranspileJsScriptToGoFunc(tt.js, ctx)
+			assert.NoError(t, err)
+			got, err := fn([]any{"user"})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	// 未捕获的异常返回给调用方
+	fn, err := transpiler.TranspileJsScriptToGoFunc(`(x) => {
+		if (x < 0) {
+			throw "negative";
+		}
+		return x;
+	}`, ctx)
+	assert.NoError(t, err)
+	_, err = fn(float64(-1))
+	var throwErr *transpiler.ThrowError
+	assert.True(t, errors.As(err, &throwErr))
+	assert.Equal(t, "negative", throwErr.Value)
+}
+
+func TestModernExpressions(t *testing.T) {
+	ctx := transpiler.NewScope(nil, nil, nil)
+
+	tests := []struct {
+		name    string
+		js      string
+		want    any
+		wantErr bool
+	}{
+		{
+			name: "模板字符串",
+			js:   "var a = 'user'; var b = 42; var result = `${a}:${b}`;",
+			want: "user:42",
+		},
+		{
+			name: "模板字符串中的表达式",
+			js:   "var result = `sum=${1 + 2}, ok=${1 < 2}, arr=${[1, 2]}`;",
+			want: "sum=3, ok=true, arr=1,2",
+		},
+		{
+			name: "可选链 - 存在",
+			js:   "var doc = { profile: { owner: 'alice' } }; var result = doc.profile?.owner;",
+			want: "alice",
+		},
+		{
+			name: "可选链 - 短路",
+			js:   "var doc = { profile: null }; var result = doc.profile?.owner.name;",
+			want: nil,
+		},
+		{
+			name: "可选调用",
+			js:   "var f = null; var result = f?.();",
+			want: nil,
+		},
+		{
+			name: "空值合并",
+			js:   "var doc = { profile: null }; var result = doc.profile?.owner ?? '';",
+			want: "",
+		},
+		{
+			name: "空值合并保留 falsy 值",
+			js:   "var result = 0 ?? 1;",
+			want: float64(0),
+		},
+		{
+			name: "空值合并短路",
+			js:   "var result = 'x' ?? notExist;",
+			want: "x",
+		},
+		{
+			name: "typeof",
+			js:   "var result = [typeof 1, typeof 'a', typeof true, typeof {}, typeof [], typeof null, typeof notExist, typeof (() => 1)].join(',');",
+			want: "number,string,boolean,object,object,object,undefined,function",
+		},
+		{
+			name: "in 对象",
+			js:   "var obj = { a: 1 }; var result = ('a' in obj) + ',' + ('b' in obj);",
+			want: "true,false",
+		},
+		{
+			name: "in 数组",
+			js:   "var arr = ['x']; var result = (0 in arr) + ',' + (1 in arr) + ',' + ('length' in arr);",
+			want: "true,false,true",
+		},
+		{
+			name:    "in 非对象",
+			js:      "var result = 'a' in 'abc';",
+			wantErr: true,
+		},
+		{
+			name: "Array.isArray",
+			js:   "var result = Array.isArray([1]) + ',' + Array.isArray('a') + ',' + Array.isArray(null);",
+			want: "true,false,false",
+		},
+		{
+			name: "复合赋值",
+			js:   "var result = 1; result += 2; result *= 3; result -= 1;",
+			want: float64(8),
+		},
+		{
+			name: "复合赋值 - 字符串拼接",
+			js:   "var result = 'a'; result += 'b';",
+			want: "ab",
+		},
+		{
+			name: "复合赋值 - 对象属性",
+			js:   "var obj = { n: 1 }; obj.n += 10; var result = obj.n;",
+			want: float64(11),
+		},
+		{
+			name: "前缀和后缀自增",
+			js:   "var i = 1; var a = i++; var b = ++i; var result = [a, b, i].join(',');",
+			want: "1,3,3",
+		},
+		{
+			name: "自减",
+			js:   "var result = 3; result--; --result;",
+			want: float64(1),
+		},
+		{
+			name: "逗号表达式",
+			js:   "var a = 0; var result = (a = 5, a + 1);",
+			want: float64(6),
+		},
+		{
+			name: "for 循环中的自增和逗号表达式",
+			js:   "var result = 0; for (let i = 0, j = 10; i < j; i++, j--) { result++; }",
+			want: float64(5),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx.Vars = make(map[string]any)
+
+			_, err := transpiler.Execute(tt.js, ctx)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Execute() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr {
+				assert.Equal(t, tt.want, ctx.Vars["result"])
+			}
+		})
+	}
+
+	// 嵌套函数调用中抛出的异常传播给调用方
+	fn, err := transpiler.TranspileJsScriptToGoFunc(`(x) => {
+		const check = (v) => {
+			if (v === undefined) throw "missing";
+			return v;
+		};
+		return check(x);
+	}`, ctx)
+	assert.NoError(t, err)
+	_, err = fn(nil)
+	var throwErr *transpiler.ThrowError
+	assert.True(t, errors.As(err, &throwErr))
+}
+
+func TestExecutionBudget(t *testing.T) {
+	run := func(js string, limits transpiler.Limits) error {
+		budget, cancel := transpiler.NewBudget(context.Background(), limits)
+		defer cancel()
+		ctx := transpiler.NewScope(nil, nil, nil)
+		ctx.Budget = budget
+		_, err := transpiler.Execute(js, ctx)
+		return err
+	}
+
+	t.Run("步数限制", func(t *testing.T) {
+		err := run("var i = 0; while (true) { i++; }", transpiler.Limits{MaxSteps: 1000})
+		var budgetErr *transpiler.BudgetExceededError
+		assert.True(t, errors.As(err, &budgetErr))
+		assert.Equal(t, transpiler.LimitSteps, budgetErr.Limit)
+	})
+
+	t.Run("超时", func(t *testing.T) {
+		err := run("while (true) {}", transpiler.Limits{Timeout: 10 * time.Millisecond})
+		var budgetErr *transpiler.BudgetExceededError
+		assert.True(t, errors.As(err, &budgetErr))
+		assert.Equal(t, transpiler.LimitDeadline, budgetErr.Limit)
+	})
+
+	t.Run("try/catch 不能捕获超出预算", func(t *testing.T) {
+		err := run(`
+			var caught = false;
+			try { while (true) {} } catch (e) { caught = true; } finally { caught = true; }
+		`, transpiler.Limits{MaxSteps: 1000})
+		assert.True(t, errors.Is(err, transpiler.ErrBudgetExceeded))
+	})
+
+	t.Run("嵌套函数调用共享预算", func(t *testing.T) {
+		err := run(`
+			const spin = () => { while (true) {} };
+			const obj = { spin: spin };
+			obj.spin();
+		`, transpiler.Limits{MaxSteps: 1000})
+		assert.True(t, errors.Is(err, transpiler.ErrBudgetExceeded))
+	})
+
+	t.Run("未超出预算", func(t *testing.T) {
+		err := run("var sum = 0; for (let i = 0; i < 10; i++) { sum += i; }", transpiler.Limits{MaxSteps: 1000})
+		assert.NoError(t, err)
+	})
+}